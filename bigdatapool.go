@@ -0,0 +1,290 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/containers/storage/pkg/lockfile"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// bigDataPoolMigratedFile is created in an image or container store's
+// directory once the big data items which were stored before the pool was
+// used have been moved into it.
+const bigDataPoolMigratedFile = "bigdata-pooled"
+
+// bigDataPool holds a single copy of each distinct big data item which is
+// stored for images and containers, named after the item's digest.  Each image
+// or container which has an item with those contents refers to the copy using
+// a hard link in its own directory, so readers find it where they always did,
+// and the copy's link count, less the pool's own link, is the number of
+// references to it.  A copy which is no longer referenced is removed.
+//
+// Items are only ever replaced, never modified in place, so sharing them is
+// invisible to callers.  If a link can't be created, for example because the
+// pool is on a different file system, the item is written as a separate copy,
+// just as it would have been without the pool.
+type bigDataPool struct {
+	// lockfile serializes adding and removing references against
+	// removing copies which are no longer referenced.  It is always
+	// acquired after an image or container store's lock, if one is held.
+	lockfile *lockfile.LockFile
+	dir      string
+}
+
+func newBigDataPool(dir string) (*bigDataPool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	lockfile, err := lockfile.GetLockFile(filepath.Join(dir, "bigdata.lock"))
+	if err != nil {
+		return nil, err
+	}
+	return &bigDataPool{lockfile: lockfile, dir: dir}, nil
+}
+
+// path returns the location of the pool's copy of items with digest d.
+func (p *bigDataPool) path(d digest.Digest) string {
+	return filepath.Join(p.dir, d.Algorithm().String(), d.Encoded())
+}
+
+// reference checks if the file at path refers to a copy in the pool, and if
+// it does, returns the digest which identifies that copy.
+// Requires p.lockfile.
+func (p *bigDataPool) reference(path string) (digest.Digest, bool, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	if !fi.Mode().IsRegular() || linkCount(fi) < 2 {
+		return "", false, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, err
+	}
+	d := digest.Canonical.FromBytes(data)
+	poolInfo, err := os.Stat(p.path(d))
+	if err != nil || !os.SameFile(fi, poolInfo) {
+		return "", false, nil
+	}
+	return d, true, nil
+}
+
+// release removes the pool's copy of items with digest d if nothing refers
+// to it any more.
+// Requires p.lockfile.
+func (p *bigDataPool) release(d digest.Digest) {
+	poolPath := p.path(d)
+	fi, err := os.Stat(poolPath)
+	if err != nil || linkCount(fi) > 1 {
+		return
+	}
+	if err := os.Remove(poolPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logrus.Debugf("Removing unreferenced big data item %q: %v", poolPath, err)
+	}
+}
+
+// link replaces the file at path with a reference to the copy at poolPath.
+func (p *bigDataPool) link(poolPath, path string) error {
+	tmpPath := path + ".pooled"
+	if err := os.Remove(tmpPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Link(poolPath, tmpPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// write stores data at path, as a reference to the pool's copy of it if
+// possible.  The data which was previously stored there, if any, is released.
+// A nil pool just writes the data.
+func (p *bigDataPool) write(path string, data []byte) error {
+	if p == nil {
+		return ioutils.AtomicWriteFile(path, data, 0o600)
+	}
+	p.lockfile.Lock()
+	defer p.lockfile.Unlock()
+
+	old, oldPooled, err := p.reference(path)
+	if err != nil {
+		return err
+	}
+	d := digest.Canonical.FromBytes(data)
+	if oldPooled && old == d {
+		return nil
+	}
+	if err := p.add(d, path, data); err != nil {
+		logrus.Debugf("Not sharing big data item %q: %v", path, err)
+		if err := ioutils.AtomicWriteFile(path, data, 0o600); err != nil {
+			return err
+		}
+	}
+	if oldPooled {
+		p.release(old)
+	}
+	return nil
+}
+
+// add makes sure that the pool has a copy of data, whose digest is d, and
+// replaces the file at path with a reference to it.
+// Requires p.lockfile.
+func (p *bigDataPool) add(d digest.Digest, path string, data []byte) error {
+	poolPath := p.path(d)
+	if _, err := os.Lstat(poolPath); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(poolPath), 0o700); err != nil {
+			return err
+		}
+		if err := ioutils.AtomicWriteFile(poolPath, data, 0o600); err != nil {
+			return err
+		}
+	}
+	if err := p.link(poolPath, path); err != nil {
+		p.release(d)
+		return err
+	}
+	return nil
+}
+
+// remove removes the item at path, and releases its data.
+func (p *bigDataPool) remove(path string) error {
+	if p == nil {
+		return os.Remove(path)
+	}
+	p.lockfile.Lock()
+	defer p.lockfile.Unlock()
+
+	d, pooled, err := p.reference(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	if pooled {
+		p.release(d)
+	}
+	return nil
+}
+
+// removeAll removes dir, which contains the items at paths, and releases
+// the items' data.
+func (p *bigDataPool) removeAll(dir string, paths []string) error {
+	if p == nil {
+		return os.RemoveAll(dir)
+	}
+	p.lockfile.Lock()
+	defer p.lockfile.Unlock()
+
+	var released []digest.Digest
+	for _, path := range paths {
+		d, pooled, err := p.reference(path)
+		if err != nil {
+			logrus.Debugf("Checking if big data item %q is shared: %v", path, err)
+			continue
+		}
+		if pooled {
+			released = append(released, d)
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	for _, d := range released {
+		p.release(d)
+	}
+	return nil
+}
+
+// migrate replaces the items at paths, which were written without using the
+// pool, with references to the pool's copies of their contents, unless that
+// has already been done for the store at storeDir.
+func (p *bigDataPool) migrate(storeDir string, paths []string) error {
+	marker := filepath.Join(storeDir, bigDataPoolMigratedFile)
+	if _, err := os.Lstat(marker); err == nil {
+		return nil
+	}
+
+	p.lockfile.Lock()
+	defer p.lockfile.Unlock()
+
+	var saved int64
+	for _, path := range paths {
+		fi, err := os.Lstat(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		if !fi.Mode().IsRegular() || linkCount(fi) > 1 {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		d := digest.Canonical.FromBytes(data)
+		poolPath := p.path(d)
+		if _, err := os.Lstat(poolPath); err == nil {
+			// Another item already has these contents.
+			if err := p.link(poolPath, path); err != nil {
+				return fmt.Errorf("sharing big data item %q: %w", path, err)
+			}
+			saved += fi.Size()
+			continue
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		// This is the first item with these contents, so it becomes
+		// the pool's copy.
+		if err := os.MkdirAll(filepath.Dir(poolPath), 0o700); err != nil {
+			return err
+		}
+		if err := os.Link(path, poolPath); err != nil {
+			return fmt.Errorf("sharing big data item %q: %w", path, err)
+		}
+	}
+	if saved > 0 {
+		logrus.Debugf("Deduplicating big data items in %q saved %d bytes", storeDir, saved)
+	}
+	return os.WriteFile(marker, nil, 0o600)
+}
+
+// prune removes copies which nothing refers to, which can be left behind if
+// items are removed by versions of this library which don't use the pool.
+func (p *bigDataPool) prune() error {
+	p.lockfile.Lock()
+	defer p.lockfile.Unlock()
+
+	return filepath.WalkDir(p.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == p.dir || entry.IsDir() || !entry.Type().IsRegular() {
+			return nil
+		}
+		d := digest.NewDigestFromEncoded(digest.Algorithm(filepath.Base(filepath.Dir(path))), entry.Name())
+		if d.Validate() != nil {
+			return nil
+		}
+		p.release(d)
+		return nil
+	})
+}
@@ -0,0 +1,124 @@
+//go:build !windows
+
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/storage/pkg/reexec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sameFile(t *testing.T, a, b string) bool {
+	t.Helper()
+	aInfo, err := os.Stat(a)
+	require.NoError(t, err)
+	bInfo, err := os.Stat(b)
+	require.NoError(t, err)
+	return os.SameFile(aInfo, bInfo)
+}
+
+func poolEntries(t *testing.T, dir string) []string {
+	t.Helper()
+	var entries []string
+	require.NoError(t, filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err == nil && entry.Type().IsRegular() && entry.Name() != "bigdata.lock" {
+			entries = append(entries, path)
+		}
+		return err
+	}))
+	return entries
+}
+
+func TestStoreBigDataPool(t *testing.T) {
+	reexec.Init()
+
+	s := newTestStore(t, StoreOptions{}).(*store)
+	defer s.Free()
+	images := s.imageStore.(*imageStore)
+	containers := s.containerStore.(*containerStore)
+	poolDir := filepath.Join(s.graphRoot, "vfs-bigdata")
+
+	layer, err := s.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+	one, err := s.CreateImage("", nil, layer.ID, "", nil)
+	require.NoError(t, err)
+	two, err := s.CreateImage("", nil, layer.ID, "", nil)
+	require.NoError(t, err)
+	container, err := s.CreateContainer("", nil, one.ID, "", "", nil)
+	require.NoError(t, err)
+
+	// Identical items are stored once, no matter who they belong to.
+	config := []byte(`{"config":{}}`)
+	require.NoError(t, s.SetImageBigData(one.ID, "config", config, nil))
+	require.NoError(t, s.SetImageBigData(two.ID, "other-name", config, nil))
+	require.NoError(t, s.SetContainerBigData(container.ID, "config", config))
+	assert.Len(t, poolEntries(t, poolDir), 1)
+	assert.True(t, sameFile(t, images.datapath(one.ID, "config"), images.datapath(two.ID, "other-name")))
+	assert.True(t, sameFile(t, images.datapath(one.ID, "config"), containers.datapath(container.ID, "config")))
+
+	// Replacing an item doesn't affect the others.
+	require.NoError(t, s.SetImageBigData(two.ID, "other-name", []byte("changed"), nil))
+	assert.Len(t, poolEntries(t, poolDir), 2)
+	data, err := s.ImageBigData(one.ID, "config")
+	require.NoError(t, err)
+	assert.Equal(t, config, data)
+	data, err = s.ContainerBigData(container.ID, "config")
+	require.NoError(t, err)
+	assert.Equal(t, config, data)
+	data, err = s.ImageBigData(two.ID, "other-name")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("changed"), data)
+
+	// Copies are removed once nothing refers to them.
+	_, err = s.DeleteImage(two.ID, true)
+	require.NoError(t, err)
+	assert.Len(t, poolEntries(t, poolDir), 1)
+	require.NoError(t, s.DeleteContainer(container.ID))
+	assert.Len(t, poolEntries(t, poolDir), 1)
+	_, err = s.DeleteImage(one.ID, true)
+	require.NoError(t, err)
+	assert.Empty(t, poolEntries(t, poolDir))
+}
+
+func TestImageStoreBigDataPoolMigration(t *testing.T) {
+	dir := t.TempDir()
+	pool, err := newBigDataPool(filepath.Join(dir, "pool"))
+	require.NoError(t, err)
+	imagesDir := filepath.Join(dir, "images")
+
+	// Items written without the pool are separate copies.
+	unpooled, err := newImageStore(imagesDir, false, nil)
+	require.NoError(t, err)
+	for _, id := range []string{"one", "two"} {
+		addTestImage(t, unpooled, id, nil)
+		require.NoError(t, unpooled.startWriting())
+		require.NoError(t, unpooled.SetBigData(id, "item", []byte("data"), nil))
+		unpooled.stopWriting()
+	}
+	r := unpooled.(*imageStore)
+	assert.False(t, sameFile(t, r.datapath("one", "item"), r.datapath("two", "item")))
+
+	// They're shared once a store which uses the pool first writes.
+	pooled, err := newImageStore(imagesDir, false, pool)
+	require.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(imagesDir, bigDataPoolMigratedFile))
+	require.NoError(t, pooled.startWriting())
+	pooled.stopWriting()
+	assert.FileExists(t, filepath.Join(imagesDir, bigDataPoolMigratedFile))
+	assert.True(t, sameFile(t, r.datapath("one", "item"), r.datapath("two", "item")))
+	assert.Len(t, poolEntries(t, pool.dir), 1)
+
+	// Copies which were left behind by writers which didn't use the pool
+	// are pruned.
+	require.NoError(t, unpooled.startWriting())
+	require.NoError(t, unpooled.Delete("one"))
+	require.NoError(t, unpooled.Delete("two"))
+	unpooled.stopWriting()
+	assert.Len(t, poolEntries(t, pool.dir), 1)
+	require.NoError(t, pool.prune())
+	assert.Empty(t, poolEntries(t, pool.dir))
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+const bigDataPoolSupported = true
+
+// linkCount returns the number of hard links to a file.
+func linkCount(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink) //nolint:unconvert // Need the conversion for e.g. linux/arm64.
+	}
+	return 1
+}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package storage
+
+import "os"
+
+const bigDataPoolSupported = false
+
+func linkCount(_ os.FileInfo) uint64 {
+	return 1
+}
@@ -39,6 +39,9 @@ var (
 	// ErrLayerContentModified describes a layer which contains contents which should not be
 	// there, or for which ownership/permissions/dates have been changed.
 	ErrLayerContentModified = types.ErrLayerContentModified
+	// ErrLayerVerityMismatch describes a layer whose files no longer match the fs-verity
+	// digests which were recorded for them when the layer was populated.
+	ErrLayerVerityMismatch = types.ErrLayerVerityMismatch
 	// ErrLayerDataMissing describes a layer which is missing a big data item.
 	ErrLayerDataMissing = types.ErrLayerDataMissing
 	// ErrLayerMissing describes a layer which is the missing parent of a layer.
@@ -72,6 +75,7 @@ type CheckOptions struct {
 	LayerMountable              bool           // check that layers are mountable
 	LayerContents               bool           // check that contents of image layers match their diffs, with no unexpected changes, requires LayerMountable
 	LayerData                   bool           // check that associated "big" data items are present and can be read
+	LayerVerity                 bool           // check that files in layers sealed with fs-verity still match their recorded digests
 	ImageData                   bool           // check that associated "big" data items are present, can be read, and match the recorded size
 	ContainerData               bool           // check that associated "big" data items are present and can be read
 }
@@ -90,6 +94,7 @@ func CheckMost() *CheckOptions {
 		LayerMountable: true,
 		LayerContents:  false,
 		LayerData:      true,
+		LayerVerity:    true,
 		ImageData:      true,
 		ContainerData:  true,
 	}
@@ -102,6 +107,7 @@ func CheckEverything() *CheckOptions {
 		LayerMountable: true,
 		LayerContents:  true,
 		LayerData:      true,
+		LayerVerity:    true,
 		ImageData:      true,
 		ContainerData:  true,
 	}
@@ -120,11 +126,13 @@ type CheckReport struct {
 
 // RepairOptions is the set of options for Repair().
 type RepairOptions struct {
-	RemoveContainers bool // Remove damaged containers
+	RemoveContainers   bool // Remove damaged containers
+	RemovePinnedImages bool // Remove damaged images even if they're pinned
 }
 
 // RepairEverything returns a RepairOptions with every optional remediation
-// enabled.
+// enabled, except for removing pinned images, which must be requested
+// explicitly.
 func RepairEverything() *RepairOptions {
 	return &RepairOptions{
 		RemoveContainers: true,
@@ -251,6 +259,18 @@ func (s *store) Check(options *CheckOptions) (CheckReport, error) {
 					}()
 				}
 			}
+			// Check that the files in the layer, if it was sealed when it was populated,
+			// still have the fs-verity digests that we recorded for them then.
+			if options.LayerVerity {
+				if err := store.verifyVerity(id); err != nil {
+					err := fmt.Errorf("%slayer %s: %w", readWriteDesc, id, err)
+					if isReadWrite {
+						report.Layers[id] = append(report.Layers[id], err)
+					} else {
+						report.ROLayers[id] = append(report.ROLayers[id], err)
+					}
+				}
+			}
 			// Check that the content we get back when extracting the layer's contents
 			// match the recorded digest and size.  A layer for which they're not given
 			// isn't a part of an image, and is likely the read-write layer for a
@@ -742,7 +762,7 @@ func (s *store) Repair(report CheckReport, options *RepairOptions) []error {
 	// Now delete damaged images.  Note which layers were removed as part of removing those images.
 	deletedLayers := make(map[string]struct{})
 	for id := range report.Images {
-		layers, err := s.DeleteImage(id, true)
+		layers, err := s.DeleteImageWithOptions(id, &DeleteImageOptions{Commit: true, RemovePinned: options.RemovePinnedImages})
 		if err != nil {
 			if !errors.Is(err, ErrImageUnknown) && !errors.Is(err, ErrLayerUnknown) {
 				err := fmt.Errorf("deleting image %s: %w", id, err)
@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	drivers "github.com/containers/storage/drivers"
+	"github.com/containers/storage/drivers/copy"
+	"github.com/containers/storage/pkg/idtools"
+	"github.com/containers/storage/pkg/system"
+	"github.com/containers/storage/types"
+	"github.com/sirupsen/logrus"
+)
+
+func (s *store) CloneContainer(source, id string, names []string, cOptions *CloneContainerOptions) (*Container, error) {
+	var options CloneContainerOptions
+	if cOptions != nil {
+		options = *cOptions
+		options.IDMappingOptions.UIDMap = copySlicePreferringNil(cOptions.IDMappingOptions.UIDMap)
+		options.IDMappingOptions.GIDMap = copySlicePreferringNil(cOptions.IDMappingOptions.GIDMap)
+		options.Labels = copyMapPreferringNil(cOptions.Labels)
+	}
+
+	rlstore, lstores, err := s.bothLayerStoreKinds()
+	if err != nil {
+		return nil, err
+	}
+	if err := rlstore.startWriting(); err != nil {
+		return nil, err
+	}
+	defer rlstore.stopWriting()
+	for _, store := range lstores {
+		if err := store.startReading(); err != nil {
+			return nil, err
+		}
+		defer store.stopReading()
+	}
+	if err := s.containerStore.startWriting(); err != nil {
+		return nil, err
+	}
+	defer s.containerStore.stopWriting()
+
+	src, err := s.containerStore.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	srcLayer, err := rlstore.Get(src.LayerID)
+	if err != nil {
+		return nil, fmt.Errorf("locating layer %q of container %q: %w", src.LayerID, src.ID, err)
+	}
+	var parentLayer *Layer
+	if srcLayer.Parent != "" {
+		for _, store := range append([]roLayerStore{rlstore}, lstores...) {
+			if parentLayer, err = store.Get(srcLayer.Parent); err == nil {
+				break
+			}
+		}
+		if parentLayer == nil {
+			return nil, fmt.Errorf("locating parent %q of layer %q: %w", srcLayer.Parent, srcLayer.ID, ErrLayerUnknown)
+		}
+	}
+
+	uidMap, gidMap := src.UIDMap, src.GIDMap
+	if options.HostUIDMapping || len(options.UIDMap) > 0 {
+		uidMap = options.UIDMap
+	}
+	if options.HostGIDMapping || len(options.GIDMap) > 0 {
+		gidMap = options.GIDMap
+	}
+	if options.HostUIDMapping {
+		uidMap = nil
+	}
+	if options.HostGIDMapping {
+		gidMap = nil
+	}
+	volatile, _ := src.Flags[volatileFlag].(bool)
+	layerOptions := &LayerOptions{
+		IDMappingOptions: types.IDMappingOptions{
+			UIDMap: copySlicePreferringNil(srcLayer.UIDMap),
+			GIDMap: copySlicePreferringNil(srcLayer.GIDMap),
+		},
+		TemplateLayer: srcLayer.ID,
+		Volatile:      volatile || s.transientStore,
+	}
+	slo := &stagedLayerOptions{Clone: true}
+	if !slices.Equal(uidMap, src.UIDMap) || !slices.Equal(gidMap, src.GIDMap) {
+		// The files which the source container added to its layer are
+		// owned by IDs in its own mappings, even if the rest of the
+		// layer's contents are shifted to match them at mount time.
+		_, cloneable := drivers.AsCloneDriver(s.graphDriver)
+		layerShifted := len(srcLayer.UIDMap) == 0 && len(srcLayer.GIDMap) == 0
+		switch {
+		case cloneable && layerShifted && s.canUseShifting(uidMap, gidMap):
+			// Only the copies of the files which the source
+			// container added need to be changed.
+			slo.CloneFromIDMappings = idtools.NewIDMappingsFromMaps(src.UIDMap, src.GIDMap)
+			slo.CloneToIDMappings = idtools.NewIDMappingsFromMaps(uidMap, gidMap)
+		case slices.Equal(srcLayer.UIDMap, src.UIDMap) && slices.Equal(srcLayer.GIDMap, src.GIDMap):
+			// Everything in the copy is changed to match the new
+			// mappings.
+			layerOptions.UIDMap = copySlicePreferringNil(uidMap)
+			layerOptions.GIDMap = copySlicePreferringNil(gidMap)
+		default:
+			return nil, fmt.Errorf("changing the ID mappings of a copy of container %q, whose layer is ID-shifted when it is mounted, is not supported by the %q driver", src.ID, s.graphDriverName)
+		}
+	}
+	clayer, _, err := rlstore.create("", parentLayer, nil, srcLayer.MountLabel, nil, layerOptions, true, nil, slo)
+	if err != nil {
+		return nil, fmt.Errorf("copying layer %q of container %q: %w", srcLayer.ID, src.ID, err)
+	}
+
+	containerOptions := &ContainerOptions{
+		IDMappingOptions: types.IDMappingOptions{
+			HostUIDMapping: len(uidMap) == 0,
+			HostGIDMapping: len(gidMap) == 0,
+			UIDMap:         copySlicePreferringNil(uidMap),
+			GIDMap:         copySlicePreferringNil(gidMap),
+		},
+		Flags:    copyMapPreferringNil(src.Flags),
+		Volatile: volatile || s.transientStore,
+		Metadata: src.Metadata,
+		Labels:   src.Labels,
+	}
+	if options.Metadata != "" {
+		containerOptions.Metadata = options.Metadata
+	}
+	if options.Labels != nil {
+		containerOptions.Labels = options.Labels
+	}
+	for _, key := range src.BigDataNames {
+		data, err := s.containerStore.BigData(src.ID, key)
+		if err != nil {
+			err = fmt.Errorf("reading big data item %q of container %q: %w", key, src.ID, err)
+			if err2 := rlstore.deleteWhileHoldingLock(clayer.ID); err2 != nil {
+				logrus.Errorf("While recovering from a failure to clone a container, error deleting layer %#v: %v", clayer.ID, err2)
+			}
+			return nil, err
+		}
+		containerOptions.BigData = append(containerOptions.BigData, ContainerBigDataOption{Key: key, Data: data})
+	}
+	container, err := s.containerStore.create(id, names, src.ImageID, clayer.ID, containerOptions)
+	if err != nil {
+		if err2 := rlstore.deleteWhileHoldingLock(clayer.ID); err2 != nil {
+			logrus.Errorf("While recovering from a failure to clone a container, error deleting layer %#v: %v", clayer.ID, err2)
+		}
+		return nil, err
+	}
+
+	if err := s.copyContainerDirectories(src.ID, container.ID); err != nil {
+		err = fmt.Errorf("copying directories of container %q: %w", src.ID, err)
+		if err2 := s.containerStore.Delete(container.ID); err2 != nil {
+			logrus.Errorf("While recovering from a failure to clone a container, error deleting container %#v: %v", container.ID, err2)
+		}
+		if err2 := s.removeContainerDirectories(container.ID); err2 != nil {
+			logrus.Errorf("While recovering from a failure to clone a container, error removing directories of container %#v: %v", container.ID, err2)
+		}
+		if err2 := rlstore.deleteWhileHoldingLock(clayer.ID); err2 != nil {
+			logrus.Errorf("While recovering from a failure to clone a container, error deleting layer %#v: %v", clayer.ID, err2)
+		}
+		return nil, err
+	}
+	return container, nil
+}
+
+// containerDirectories returns the locations of the directories which
+// ContainerDirectory and ContainerRunDirectory return for a container.
+func (s *store) containerDirectories(id string) []string {
+	middleDir := s.graphDriverName + "-containers"
+	return []string{
+		filepath.Join(s.GraphRoot(), middleDir, id, "userdata"),
+		filepath.Join(s.RunRoot(), middleDir, id, "userdata"),
+	}
+}
+
+// copyContainerDirectories copies the contents of the source container's
+// directories, if it has any, to the corresponding ones for another container.
+func (s *store) copyContainerDirectories(source, id string) error {
+	destinations := s.containerDirectories(id)
+	for i, srcDir := range s.containerDirectories(source) {
+		if _, err := os.Lstat(srcDir); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		if err := os.MkdirAll(destinations[i], 0o700); err != nil {
+			return err
+		}
+		if err := copy.DirCopy(srcDir, destinations[i], copy.Content, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeContainerDirectories removes what's left of a container's directories
+// after its record has been deleted.
+func (s *store) removeContainerDirectories(id string) error {
+	var errs []error
+	for _, dir := range s.containerDirectories(id) {
+		if err := system.EnsureRemoveAll(filepath.Dir(dir)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
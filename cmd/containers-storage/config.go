@@ -8,7 +8,18 @@ import (
 	"github.com/containers/storage/types"
 )
 
+var (
+	configExplain  = false
+	configValidate = false
+)
+
 func config(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	if configExplain {
+		return explainConfig(args)
+	}
+	if configValidate {
+		return validateConfig(args)
+	}
 	options, err := types.DefaultStoreOptions()
 	if err != nil {
 		return 1, fmt.Errorf("default: %+v", err)
@@ -21,13 +32,80 @@ func config(flags *mflag.FlagSet, action string, m storage.Store, args []string)
 	return outputJSON(options)
 }
 
+// configFileArg returns the configuration file named on the command line, or
+// the default configuration file.
+func configFileArg(args []string) (string, error) {
+	if len(args) > 0 {
+		return args[0], nil
+	}
+	return types.DefaultConfigFile()
+}
+
+func explainConfig(args []string) (int, error) {
+	configFile, err := configFileArg(args)
+	if err != nil {
+		return 1, err
+	}
+	explanation, err := types.ExplainConfigurationFile(configFile)
+	if err != nil {
+		return 1, err
+	}
+	if jsonOutput {
+		return outputJSON(explanation)
+	}
+	fmt.Printf("# Files, in the order in which they were read:\n")
+	for _, file := range explanation.Files {
+		fmt.Printf("#   %s\n", file)
+	}
+	for _, setting := range explanation.Settings {
+		value := fmt.Sprintf("%v", setting.Value)
+		if s, ok := setting.Value.(string); ok {
+			value = fmt.Sprintf("%q", s)
+		}
+		fmt.Printf("%s = %s  # %s\n", setting.Key, value, setting.Source)
+	}
+	return 0, nil
+}
+
+func validateConfig(args []string) (int, error) {
+	configFile, err := configFileArg(args)
+	if err != nil {
+		return 1, err
+	}
+	diagnostics, err := types.ValidateConfigurationFile(configFile)
+	if err != nil {
+		return 1, err
+	}
+	if jsonOutput {
+		if diagnostics == nil {
+			diagnostics = []types.ConfigDiagnostic{}
+		}
+		if _, err := outputJSON(diagnostics); err != nil {
+			return 1, err
+		}
+	} else {
+		for _, d := range diagnostics {
+			fmt.Printf("%s (%s)\n", d, d.Code)
+		}
+	}
+	if len(diagnostics) > 0 {
+		return 1, nil
+	}
+	return 0, nil
+}
+
 func init() {
 	commands = append(commands, command{
 		names:       []string{"config"},
 		usage:       "Print storage library configuration as JSON",
 		minArgs:     0,
 		maxArgs:     1,
-		optionsHelp: "[configurationFile]",
+		optionsHelp: "[options [...]] [configurationFile]",
 		action:      config,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&configExplain, []string{"-explain"}, configExplain, "Show the values which the configuration files set, and which file set each one")
+			flags.BoolVar(&configValidate, []string{"-validate"}, configValidate, "Check the configuration files for problems, and exit with status 1 if any are found")
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
 	})
 }
@@ -235,6 +235,33 @@ func createContainer(flags *mflag.FlagSet, action string, m storage.Store, args
 	return 0, nil
 }
 
+func cloneContainer(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	if paramMetadataFile != "" {
+		b, err := os.ReadFile(paramMetadataFile)
+		if err != nil {
+			return 1, err
+		}
+		paramMetadata = string(b)
+	}
+	mappings, err := paramIDMapping()
+	if err != nil {
+		return 1, err
+	}
+	options := &storage.CloneContainerOptions{IDMappingOptions: *mappings, Metadata: paramMetadata}
+	container, err := m.CloneContainer(args[0], paramID, paramNames, options)
+	if err != nil {
+		return 1, err
+	}
+	if jsonOutput {
+		return outputJSON(container)
+	}
+	fmt.Printf("%s\n", container.ID)
+	for _, name := range container.Names {
+		fmt.Printf("\t%s\n", name)
+	}
+	return 0, nil
+}
+
 func init() {
 	commands = append(commands, command{
 		names:       []string{"create-storage-layer"},
@@ -337,4 +364,25 @@ func init() {
 			flags.StringVar(&paramSubGIDMap, []string{"-subgidmap"}, "", "subgid GID map for a group")
 		},
 	})
+	commands = append(commands, command{
+		names:       []string{"clone-container", "clonecontainer"},
+		optionsHelp: "[options [...]] containerNameOrID",
+		usage:       "Create a new container from the current state of another container",
+		minArgs:     1,
+		maxArgs:     1,
+		action:      cloneContainer,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.Var(opts.NewListOptsRef(&paramNames, nil), []string{"-name", "n"}, "Container name")
+			flags.StringVar(&paramID, []string{"-id", "i"}, "", "Container ID")
+			flags.StringVar(&paramMetadata, []string{"-metadata", "m"}, "", "Metadata")
+			flags.StringVar(&paramMetadataFile, []string{"-metadata-file", "f"}, "", "Metadata File")
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			flags.BoolVar(&paramHostUIDMap, []string{"-hostuidmap"}, paramHostUIDMap, "Force host UID map")
+			flags.BoolVar(&paramHostGIDMap, []string{"-hostgidmap"}, paramHostGIDMap, "Force host GID map")
+			flags.StringVar(&paramUIDMap, []string{"-uidmap"}, "", "UID map")
+			flags.StringVar(&paramGIDMap, []string{"-gidmap"}, "", "GID map")
+			flags.StringVar(&paramSubUIDMap, []string{"-subuidmap"}, "", "subuid UID map for a user")
+			flags.StringVar(&paramSubGIDMap, []string{"-subgidmap"}, "", "subgid GID map for a group")
+		},
+	})
 }
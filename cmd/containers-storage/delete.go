@@ -8,7 +8,10 @@ import (
 	"github.com/containers/storage/pkg/mflag"
 )
 
-var testDeleteImage = false
+var (
+	testDeleteImage  = false
+	forceDeleteImage = false
+)
 
 func deleteThing(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
 	if len(args) < 1 {
@@ -85,7 +88,10 @@ func deleteImage(flags *mflag.FlagSet, action string, m storage.Store, args []st
 	}
 	deleted := make(map[string]deletedImage)
 	for _, what := range args {
-		layers, err := m.DeleteImage(what, !testDeleteImage)
+		layers, err := m.DeleteImageWithOptions(what, &storage.DeleteImageOptions{
+			Commit:       !testDeleteImage,
+			RemovePinned: forceDeleteImage,
+		})
 		errText := ""
 		if err != nil {
 			errText = err.Error()
@@ -182,6 +188,7 @@ func init() {
 		action:      deleteImage,
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
 			flags.BoolVar(&testDeleteImage, []string{"-test", "t"}, jsonOutput, "Only test removal")
+			flags.BoolVar(&forceDeleteImage, []string{"-force", "f"}, forceDeleteImage, "Delete pinned images, too")
 			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
 		},
 	})
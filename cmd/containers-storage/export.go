@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/internal/opts"
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/mflag"
+)
+
+var (
+	exportFile     = ""
+	exportGzip     = false
+	exportZstd     = false
+	exportIncludes = []string{}
+	exportExcludes = []string{}
+)
+
+func export(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	options := storage.ExportOptions{
+		IncludeFiles:    exportIncludes,
+		ExcludePatterns: exportExcludes,
+	}
+	if exportGzip {
+		options.Compression = archive.Gzip
+	}
+	if exportZstd {
+		options.Compression = archive.Zstd
+	}
+	output := io.Writer(os.Stdout)
+	if exportFile != "" {
+		f, err := os.Create(exportFile)
+		if err != nil {
+			return 1, err
+		}
+		defer f.Close()
+		output = f
+	}
+	reader, err := m.ExportContainer(args[0], &options)
+	if err != nil {
+		return 1, err
+	}
+	_, err = io.Copy(output, reader)
+	if closeErr := reader.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 1, err
+	}
+	return 0, nil
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"export"},
+		optionsHelp: "[options [...]] containerNameOrID",
+		usage:       "Export a container's filesystem as a tar archive",
+		minArgs:     1,
+		maxArgs:     1,
+		action:      export,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.StringVar(&exportFile, []string{"-file", "f"}, "", "Write to file instead of stdout")
+			flags.BoolVar(&exportGzip, []string{"-gzip", "c"}, exportGzip, "Compress using gzip")
+			flags.BoolVar(&exportZstd, []string{"-zstd"}, exportZstd, "Compress using zstd")
+			flags.Var(opts.NewListOptsRef(&exportIncludes, nil), []string{"-include"}, "Only include PATH and its contents")
+			flags.Var(opts.NewListOptsRef(&exportExcludes, nil), []string{"-exclude"}, "Leave out paths which match PATTERN")
+		},
+	})
+}
@@ -48,6 +48,9 @@ func image(flags *mflag.FlagSet, action string, m storage.Store, args []string)
 			if image.ReadOnly {
 				fmt.Printf("Read Only: true\n")
 			}
+			if image.Pinned() {
+				fmt.Printf("Pinned: true\n")
+			}
 		}
 	}
 	if len(matched) != len(args) {
@@ -32,6 +32,9 @@ func images(flags *mflag.FlagSet, action string, m storage.Store, args []string)
 		for _, name := range image.BigDataNames {
 			fmt.Printf("\tdata: %s\n", name)
 		}
+		if image.Pinned() {
+			fmt.Printf("\tpinned: true\n")
+		}
 	}
 	return 0, nil
 }
@@ -66,6 +69,9 @@ func imagesByDigest(flags *mflag.FlagSet, action string, m storage.Store, args [
 		for _, name := range image.BigDataNames {
 			fmt.Printf("\tdata: %s\n", name)
 		}
+		if image.Pinned() {
+			fmt.Printf("\tpinned: true\n")
+		}
 	}
 	return 0, nil
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/internal/opts"
+	"github.com/containers/storage/pkg/mflag"
+)
+
+var (
+	listLayers     = false
+	listImages     = false
+	listContainers = false
+	listQuiet      = false
+	listFilters    = []string{}
+	listFields     = []string{}
+)
+
+func list(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	filter, err := storage.ParseMultiListFilter(listFilters)
+	if err != nil {
+		return 1, err
+	}
+	options := storage.MultiListOptions{
+		Layers:     listLayers,
+		Images:     listImages,
+		Containers: listContainers,
+		Filter:     filter,
+		Fields:     listFields,
+	}
+	if !options.Layers && !options.Images && !options.Containers {
+		options.Layers, options.Images, options.Containers = true, true, true
+	}
+	result, err := m.MultiList(options)
+	if err != nil {
+		return 1, err
+	}
+	if jsonOutput {
+		return outputJSON(result)
+	}
+	for _, layer := range result.Layers {
+		fmt.Printf("layer %s\n", layer.ID)
+		if listQuiet {
+			continue
+		}
+		for _, name := range layer.Names {
+			fmt.Printf("\tname: %s\n", name)
+		}
+	}
+	for _, image := range result.Images {
+		fmt.Printf("image %s\n", image.ID)
+		if listQuiet {
+			continue
+		}
+		for _, name := range image.Names {
+			fmt.Printf("\tname: %s\n", name)
+		}
+	}
+	for _, container := range result.Containers {
+		fmt.Printf("container %s\n", container.ID)
+		if listQuiet {
+			continue
+		}
+		for _, name := range container.Names {
+			fmt.Printf("\tname: %s\n", name)
+		}
+	}
+	return 0, nil
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"list"},
+		optionsHelp: "[options [...]]",
+		usage:       "List layers, images, and containers which match filters",
+		action:      list,
+		minArgs:     0,
+		maxArgs:     0,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&listLayers, []string{"-layers"}, listLayers, "List layers")
+			flags.BoolVar(&listImages, []string{"-images"}, listImages, "List images")
+			flags.BoolVar(&listContainers, []string{"-containers"}, listContainers, "List containers")
+			flags.Var(opts.NewListOptsRef(&listFilters, nil), []string{"-filter", "f"}, "Only list items which match KEY=VALUE")
+			flags.Var(opts.NewListOptsRef(&listFields, nil), []string{"-field"}, "Only include FIELD in JSON output")
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			flags.BoolVar(&listQuiet, []string{"-quiet", "q"}, listQuiet, "Only print IDs")
+		},
+	})
+}
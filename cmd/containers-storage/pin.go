@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/mflag"
+)
+
+func pinImage(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	pin := m.PinImage
+	if action == "unpin-image" {
+		pin = m.UnpinImage
+	}
+	failed := false
+	for _, what := range args {
+		if err := pin(what); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", what, err)
+			failed = true
+		}
+	}
+	if failed {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"pin-image"},
+		optionsHelp: "ImageNameOrID [...]",
+		usage:       "Protect images from being deleted",
+		minArgs:     1,
+		maxArgs:     -1,
+		action:      pinImage,
+	})
+	commands = append(commands, command{
+		names:       []string{"unpin-image"},
+		optionsHelp: "ImageNameOrID [...]",
+		usage:       "Allow pinned images to be deleted",
+		minArgs:     1,
+		maxArgs:     -1,
+		action:      pinImage,
+	})
+}
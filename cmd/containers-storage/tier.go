@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/mflag"
+	"github.com/docker/go-units"
+)
+
+var (
+	demoteUnusedFor = ""
+	demoteMinSize   = ""
+)
+
+func moveLayers(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	move := m.DemoteLayer
+	if action == "promote-layer" {
+		move = m.PromoteLayer
+	}
+	failed := false
+	for _, what := range args {
+		if err := move(what); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", what, err)
+			failed = true
+		}
+	}
+	if failed {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func demoteLayers(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	var policy *storage.TierPolicy
+	if demoteUnusedFor != "" || demoteMinSize != "" {
+		policy = &storage.TierPolicy{}
+		if demoteUnusedFor != "" {
+			unusedFor, err := time.ParseDuration(demoteUnusedFor)
+			if err != nil {
+				return 1, fmt.Errorf("parsing --unused-for: %w", err)
+			}
+			policy.UnusedFor = unusedFor
+		}
+		if demoteMinSize != "" {
+			minSize, err := units.RAMInBytes(demoteMinSize)
+			if err != nil {
+				return 1, fmt.Errorf("parsing --min-size: %w", err)
+			}
+			policy.MinSize = minSize
+		}
+	}
+	demoted, err := m.DemoteLayers(policy)
+	if jsonOutput {
+		if demoted == nil {
+			demoted = []string{}
+		}
+		if _, outputErr := outputJSON(demoted); outputErr != nil {
+			return 1, outputErr
+		}
+	} else {
+		for _, id := range demoted {
+			fmt.Printf("%s\n", id)
+		}
+	}
+	if err != nil {
+		return 1, err
+	}
+	return 0, nil
+}
+
+func init() {
+	commands = append(commands, command{
+		names:       []string{"demote-layer"},
+		optionsHelp: "LayerNameOrID [...]",
+		usage:       "Move layers to the cold store",
+		minArgs:     1,
+		maxArgs:     -1,
+		action:      moveLayers,
+	})
+	commands = append(commands, command{
+		names:       []string{"promote-layer"},
+		optionsHelp: "LayerNameOrID [...]",
+		usage:       "Move layers back from the cold store",
+		minArgs:     1,
+		maxArgs:     -1,
+		action:      moveLayers,
+	})
+	commands = append(commands, command{
+		names:       []string{"demote-layers"},
+		optionsHelp: "[options [...]]",
+		usage:       "Move layers which haven't been used recently to the cold store",
+		minArgs:     0,
+		maxArgs:     0,
+		action:      demoteLayers,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.StringVar(&demoteUnusedFor, []string{"-unused-for"}, demoteUnusedFor, "Only move layers which haven't been used for this long (e.g. 720h)")
+			flags.StringVar(&demoteMinSize, []string{"-min-size"}, demoteMinSize, "Only move layers which are at least this large (e.g. 100M)")
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+}
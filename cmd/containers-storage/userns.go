@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/mflag"
+)
+
+func formatAutoUserNSRanges(ranges []storage.AutoUserNSRange) string {
+	if len(ranges) == 0 {
+		return "-"
+	}
+	s := ""
+	for i, r := range ranges {
+		if i > 0 {
+			s += ","
+		}
+		s += fmt.Sprintf("%d-%d", r.Start, r.Start+r.Size-1)
+	}
+	return s
+}
+
+func autoUserNSUsage(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	usage, err := m.AutoUserNSUsage()
+	if err != nil {
+		return 1, err
+	}
+	if jsonOutput {
+		return outputJSON(usage)
+	}
+	fmt.Printf("Available UIDs: %s\n", formatAutoUserNSRanges(usage.AvailableUIDs))
+	fmt.Printf("Available GIDs: %s\n", formatAutoUserNSRanges(usage.AvailableGIDs))
+	fmt.Printf("Free UIDs: %s\n", formatAutoUserNSRanges(usage.FreeUIDs))
+	fmt.Printf("Free GIDs: %s\n", formatAutoUserNSRanges(usage.FreeGIDs))
+	fmt.Printf("Used UIDs: %s\n", formatAutoUserNSRanges(usage.UsedUIDs))
+	fmt.Printf("Used GIDs: %s\n", formatAutoUserNSRanges(usage.UsedGIDs))
+	for _, a := range usage.Allocations {
+		switch {
+		case a.Reservation != "":
+			fmt.Printf("Reservation %s: UIDs %s, GIDs %s\n", a.Reservation, formatAutoUserNSRanges(a.UIDs), formatAutoUserNSRanges(a.GIDs))
+		case a.Group != "":
+			fmt.Printf("Group %s (%s): UIDs %s, GIDs %s\n", a.Group, strings.Join(a.Containers, ", "), formatAutoUserNSRanges(a.UIDs), formatAutoUserNSRanges(a.GIDs))
+		case a.Image != "":
+			fmt.Printf("Image %s (%s): UIDs %s, GIDs %s\n", a.Image, strings.Join(a.Containers, ", "), formatAutoUserNSRanges(a.UIDs), formatAutoUserNSRanges(a.GIDs))
+		default:
+			fmt.Printf("Container %s: UIDs %s, GIDs %s\n", a.Container, formatAutoUserNSRanges(a.UIDs), formatAutoUserNSRanges(a.GIDs))
+		}
+	}
+	return 0, nil
+}
+
+func reserveAutoUserNS(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	size, err := strconv.ParseUint(args[1], 10, 32)
+	if err != nil {
+		return 1, fmt.Errorf("parsing size %q: %w", args[1], err)
+	}
+	allocation, err := m.ReserveAutoUserNS(args[0], uint32(size))
+	if err != nil {
+		return 1, err
+	}
+	if jsonOutput {
+		return outputJSON(allocation)
+	}
+	fmt.Printf("UIDs: %s\n", formatAutoUserNSRanges(allocation.UIDs))
+	fmt.Printf("GIDs: %s\n", formatAutoUserNSRanges(allocation.GIDs))
+	return 0, nil
+}
+
+func releaseAutoUserNS(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
+	failed := false
+	for _, name := range args {
+		if err := m.ReleaseAutoUserNS(name); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			failed = true
+		}
+	}
+	if failed {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func init() {
+	commands = append(commands, command{
+		names:   []string{"auto-userns-usage"},
+		usage:   "Show which IDs automatic user namespaces are using",
+		minArgs: 0,
+		maxArgs: 0,
+		action:  autoUserNSUsage,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+	commands = append(commands, command{
+		names:       []string{"reserve-auto-userns"},
+		optionsHelp: "[options [...]] name size",
+		usage:       "Set aside IDs so that automatic user namespaces don't use them",
+		minArgs:     2,
+		maxArgs:     2,
+		action:      reserveAutoUserNS,
+		addFlags: func(flags *mflag.FlagSet, cmd *command) {
+			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+		},
+	})
+	commands = append(commands, command{
+		names:       []string{"release-auto-userns"},
+		optionsHelp: "name [...]",
+		usage:       "Release IDs which were set aside with reserve-auto-userns",
+		minArgs:     1,
+		maxArgs:     -1,
+		action:      releaseAutoUserNS,
+	})
+}
@@ -7,8 +7,10 @@ import (
 	"github.com/containers/storage/pkg/mflag"
 )
 
+var wipeProtectPinned = false
+
 func wipe(flags *mflag.FlagSet, action string, m storage.Store, args []string) (int, error) {
-	err := m.Wipe()
+	err := m.WipeWithOptions(&storage.WipeOptions{ProtectPinned: wipeProtectPinned})
 	if err != nil {
 		if jsonOutput {
 			_, err2 := outputJSON(err)
@@ -31,6 +33,7 @@ func init() {
 		action:  wipe,
 		addFlags: func(flags *mflag.FlagSet, cmd *command) {
 			flags.BoolVar(&jsonOutput, []string{"-json", "j"}, jsonOutput, "Prefer JSON output")
+			flags.BoolVar(&wipeProtectPinned, []string{"-protect-pinned"}, wipeProtectPinned, "Refuse to wipe anything if any images are pinned")
 		},
 	})
 }
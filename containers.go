@@ -84,15 +84,38 @@ type Container struct {
 
 	Flags map[string]any `json:"flags,omitempty"`
 
+	// Labels is a set of caller-specified labels which can be used to
+	// find the container using Store.ContainersByLabel.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Snapshots lists saved states of the container's read-write layer,
+	// oldest first, which it can be rolled back to.
+	Snapshots []ContainerSnapshot `json:"snapshots,omitempty"`
+
 	// volatileStore is true if the container is from the volatile json file
 	volatileStore bool `json:"-"`
 }
 
+// A ContainerSnapshot is a saved state of a container's read-write layer.
+type ContainerSnapshot struct {
+	// ID is a random value which the storage driver uses to identify the
+	// snapshot.
+	ID string `json:"id"`
+
+	// Name is the name which the snapshot was given when it was created.
+	// It is unique among the container's snapshots.
+	Name string `json:"name"`
+
+	// Created is the datestamp for when this snapshot was created.
+	Created time.Time `json:"created,omitempty"`
+}
+
 // rwContainerStore provides bookkeeping for information about Containers.
 type rwContainerStore interface {
 	metadataStore
 	containerBigDataStore
 	flaggableStore
+	rwLabelStore
 
 	// startWriting makes sure the store is fresh, and locks it for writing.
 	// If this succeeds, the caller MUST call stopWriting().
@@ -122,6 +145,24 @@ type rwContainerStore interface {
 	// Get retrieves information about a container given an ID or name.
 	Get(id string) (*Container, error)
 
+	// ByLabel returns a slice enumerating the containers whose labels
+	// meet the requirements, sorted by ID.
+	ByLabel(requirements []labelRequirement) ([]*Container, error)
+
+	// autoUserNSAllocations returns the allocations of IDs for automatic
+	// user namespaces, and reservations of IDs, recorded in the store.
+	autoUserNSAllocations() ([]AutoUserNSAllocation, error)
+
+	// setAutoUserNSAllocations replaces the recorded allocations.
+	setAutoUserNSAllocations(allocations []AutoUserNSAllocation) error
+
+	// addSnapshot records a new snapshot of a container's layer.
+	addSnapshot(id string, snapshot ContainerSnapshot) error
+
+	// removeSnapshots forgets about snapshots of a container's layer,
+	// given their IDs.
+	removeSnapshots(id string, snapshotIDs []string) error
+
 	// Exists checks if there is a container with the given ID or name.
 	Exists(id string) bool
 
@@ -138,6 +179,11 @@ type rwContainerStore interface {
 	// Containers returns a slice enumerating the known containers.
 	Containers() ([]Container, error)
 
+	// containersMatching returns copies of the known containers for which
+	// match returns true.  match must not modify or keep the containers it
+	// is passed.
+	containersMatching(match func(*Container) bool) []Container
+
 	// Clean up unreferenced datadirs
 	GarbageCollect() error
 }
@@ -148,6 +194,7 @@ type containerStore struct {
 	lockfile *lockfile.LockFile // Synchronizes readers vs. writers of the _filesystem data_, both cross-process and in-process.
 	dir      string
 	jsonPath [numContainerLocationIndex]string
+	pool     *bigDataPool // Where big data items are shared with images and other containers, or nil.
 
 	inProcessLock sync.RWMutex // Can _only_ be obtained with lockfile held.
 	// The following fields can only be read/written with read/write ownership of inProcessLock, respectively.
@@ -158,6 +205,10 @@ type containerStore struct {
 	byid       map[string]*Container
 	bylayer    map[string]*Container
 	byname     map[string]*Container
+	bylabel    labelIndex
+	// pooled is set once big data items which were written without
+	// using the pool have been moved into it.
+	pooled bool
 }
 
 func copyContainer(c *Container) *Container {
@@ -174,6 +225,8 @@ func copyContainer(c *Container) *Container {
 		UIDMap:         copySlicePreferringNil(c.UIDMap),
 		GIDMap:         copySlicePreferringNil(c.GIDMap),
 		Flags:          copyMapPreferringNil(c.Flags),
+		Labels:         copyMapPreferringNil(c.Labels),
+		Snapshots:      copySlicePreferringNil(c.Snapshots),
 		volatileStore:  c.volatileStore,
 	}
 }
@@ -192,6 +245,15 @@ func (c *Container) ProcessLabel() string {
 	return ""
 }
 
+// AutoUserNsSizeReason explains how the size of the container's automatically
+// created user namespace was chosen, if it has one.
+func (c *Container) AutoUserNsSizeReason() string {
+	if reason, ok := c.Flags[autoUserNsSizeReasonFlag].(string); ok {
+		return reason
+	}
+	return ""
+}
+
 func (c *Container) MountOpts() []string {
 	switch value := c.Flags[mountOptsFlag].(type) {
 	case []string:
@@ -246,7 +308,28 @@ func (r *containerStore) startWritingWithReload(canReload bool) error {
 // startWriting makes sure the store is fresh, and locks it for writing.
 // If this succeeds, the caller MUST call stopWriting().
 func (r *containerStore) startWriting() error {
-	return r.startWritingWithReload(true)
+	if err := r.startWritingWithReload(true); err != nil {
+		return err
+	}
+	r.migrateBigData()
+	return nil
+}
+
+// migrateBigData moves big data items which were written without using the
+// pool into it, if that hasn't been done yet.
+// Requires startWriting.
+func (r *containerStore) migrateBigData() {
+	if r.pool == nil || r.pooled {
+		return
+	}
+	r.pooled = true
+	var paths []string
+	for _, container := range r.containers {
+		paths = append(paths, r.bigDataPaths(container)...)
+	}
+	if err := r.pool.migrate(r.dir, paths); err != nil {
+		logrus.Warnf("Deduplicating big data items of containers in %q: %v", r.dir, err)
+	}
 }
 
 // stopWriting releases locks obtained by startWriting.
@@ -389,6 +472,17 @@ func (r *containerStore) reloadIfChanged(lockedForWriting bool) (bool, error) {
 	return false, nil
 }
 
+// Requires startReading or startWriting.
+func (r *containerStore) containersMatching(match func(*Container) bool) []Container {
+	var containers []Container
+	for _, container := range r.containers {
+		if match(container) {
+			containers = append(containers, *copyContainer(container))
+		}
+	}
+	return containers
+}
+
 // Requires startReading or startWriting.
 func (r *containerStore) Containers() ([]Container, error) {
 	containers := make([]Container, len(r.containers))
@@ -441,6 +535,15 @@ func (r *containerStore) datapath(id, key string) string {
 	return filepath.Join(r.datadir(id), makeBigDataBaseName(key))
 }
 
+// bigDataPaths returns the locations of a container's big data items.
+func (r *containerStore) bigDataPaths(c *Container) []string {
+	paths := make([]string, 0, len(c.BigDataNames))
+	for _, key := range c.BigDataNames {
+		paths = append(paths, r.datapath(c.ID, key))
+	}
+	return paths
+}
+
 // load reloads the contents of the store from disk.
 //
 // Most callers should call reloadIfChanged() instead, to avoid overhead and to correctly
@@ -491,6 +594,7 @@ func (r *containerStore) load(lockedForWriting bool) (bool, error) {
 	idlist := make([]string, 0, len(containers))
 	layers := make(map[string]*Container)
 	names := make(map[string]*Container)
+	labels := make(labelIndex)
 	var errorToResolveBySaving error // == nil
 	for n, container := range containers {
 		idlist = append(idlist, container.ID)
@@ -503,6 +607,7 @@ func (r *containerStore) load(lockedForWriting bool) (bool, error) {
 			}
 			names[name] = containers[n]
 		}
+		labels.add(container.ID, container.Labels)
 	}
 
 	r.containers = containers
@@ -510,6 +615,7 @@ func (r *containerStore) load(lockedForWriting bool) (bool, error) {
 	r.byid = ids
 	r.bylayer = layers
 	r.byname = names
+	r.bylabel = labels
 	if errorToResolveBySaving != nil {
 		if !lockedForWriting {
 			return true, errorToResolveBySaving
@@ -571,7 +677,7 @@ func (r *containerStore) saveFor(modifiedContainer *Container) error {
 	return r.save(containerLocation(modifiedContainer))
 }
 
-func newContainerStore(dir string, runDir string, transient bool) (rwContainerStore, error) {
+func newContainerStore(dir string, runDir string, transient bool, pool *bigDataPool) (rwContainerStore, error) {
 	if err := os.MkdirAll(dir, 0o700); err != nil {
 		return nil, err
 	}
@@ -589,6 +695,7 @@ func newContainerStore(dir string, runDir string, transient bool) (rwContainerSt
 	cstore := containerStore{
 		lockfile: lockfile,
 		dir:      dir,
+		pool:     pool,
 		jsonPath: [numContainerLocationIndex]string{
 			filepath.Join(dir, "containers.json"),
 			filepath.Join(volatileDir, "volatile-containers.json"),
@@ -598,6 +705,7 @@ func newContainerStore(dir string, runDir string, transient bool) (rwContainerSt
 		byid:       make(map[string]*Container),
 		bylayer:    make(map[string]*Container),
 		byname:     make(map[string]*Container),
+		bylabel:    make(labelIndex),
 	}
 
 	if err := cstore.startWritingWithReload(false); err != nil {
@@ -653,6 +761,36 @@ func (r *containerStore) SetFlag(id string, flag string, value any) error {
 	return r.saveFor(container)
 }
 
+// Requires startWriting.
+func (r *containerStore) addSnapshot(id string, snapshot ContainerSnapshot) error {
+	container, ok := r.lookup(id)
+	if !ok {
+		return ErrContainerUnknown
+	}
+	for _, s := range container.Snapshots {
+		if s.Name == snapshot.Name {
+			return fmt.Errorf("snapshot %q of container %q: %w", snapshot.Name, container.ID, ErrDuplicateName)
+		}
+	}
+	container.Snapshots = append(container.Snapshots, snapshot)
+	return r.saveFor(container)
+}
+
+// Requires startWriting.
+func (r *containerStore) removeSnapshots(id string, snapshotIDs []string) error {
+	container, ok := r.lookup(id)
+	if !ok {
+		return ErrContainerUnknown
+	}
+	container.Snapshots = slices.DeleteFunc(container.Snapshots, func(s ContainerSnapshot) bool {
+		return slices.Contains(snapshotIDs, s.ID)
+	})
+	if len(container.Snapshots) == 0 {
+		container.Snapshots = nil
+	}
+	return r.saveFor(container)
+}
+
 // Requires startWriting.
 func (r *containerStore) create(id string, names []string, image, layer string, options *ContainerOptions) (container *Container, err error) {
 	if options == nil {
@@ -675,6 +813,9 @@ func (r *containerStore) create(id string, names []string, image, layer string,
 			return nil, fmt.Errorf("the container name %q is already in use by %s. You have to remove that container to be able to reuse that name: %w", name, r.byname[name].ID, ErrDuplicateName)
 		}
 	}
+	if err := validateLabels(options.Labels); err != nil {
+		return nil, err
+	}
 	if err := hasOverlappingRanges(options.UIDMap); err != nil {
 		return nil, err
 	}
@@ -692,6 +833,7 @@ func (r *containerStore) create(id string, names []string, image, layer string,
 		BigDataDigests: make(map[string]digest.Digest),
 		Created:        time.Now().UTC(),
 		Flags:          newMapFrom(options.Flags),
+		Labels:         copyMapPreferringNil(options.Labels),
 		UIDMap:         copySlicePreferringNil(options.UIDMap),
 		GIDMap:         copySlicePreferringNil(options.GIDMap),
 		volatileStore:  options.Volatile,
@@ -713,6 +855,7 @@ func (r *containerStore) create(id string, names []string, image, layer string,
 	for _, name := range names {
 		r.byname[name] = container
 	}
+	r.bylabel.add(id, container.Labels)
 	defer func() {
 		if err != nil {
 			// now that the in-memory structures know about the new
@@ -753,6 +896,21 @@ func (r *containerStore) SetMetadata(id, metadata string) error {
 	return ErrContainerUnknown
 }
 
+// Requires startWriting.
+func (r *containerStore) SetLabels(id string, labels map[string]string) error {
+	if err := validateLabels(labels); err != nil {
+		return err
+	}
+	container, ok := r.lookup(id)
+	if !ok {
+		return ErrContainerUnknown
+	}
+	r.bylabel.remove(container.ID, container.Labels)
+	container.Labels = copyMapPreferringNil(labels)
+	r.bylabel.add(container.ID, container.Labels)
+	return r.saveFor(container)
+}
+
 // The caller must hold r.inProcessLock for writing.
 func (r *containerStore) removeName(container *Container, name string) {
 	container.Names = stringSliceWithoutValue(container.Names, name)
@@ -797,13 +955,19 @@ func (r *containerStore) Delete(id string) error {
 	for _, name := range container.Names {
 		delete(r.byname, name)
 	}
+	r.bylabel.remove(id, container.Labels)
 	r.containers = slices.DeleteFunc(r.containers, func(candidate *Container) bool {
 		return candidate.ID == id
 	})
 	if err := r.saveFor(container); err != nil {
 		return err
 	}
-	if err := os.RemoveAll(r.datadir(id)); err != nil {
+	if err := r.releaseAutoUserNS(id); err != nil {
+		// The allocation will be discarded the next time an automatic
+		// user namespace is allocated.
+		logrus.Warnf("Releasing IDs allocated for container %q: %v", id, err)
+	}
+	if err := r.pool.removeAll(r.datadir(id), r.bigDataPaths(container)); err != nil {
 		return err
 	}
 	return nil
@@ -817,6 +981,16 @@ func (r *containerStore) Get(id string) (*Container, error) {
 	return nil, ErrContainerUnknown
 }
 
+// Requires startReading or startWriting.
+func (r *containerStore) ByLabel(requirements []labelRequirement) ([]*Container, error) {
+	containers := selectByLabels(r.bylabel, r.containers, r.byid, func(container *Container) string { return container.ID }, func(container *Container) map[string]string { return container.Labels }, requirements)
+	result := make([]*Container, 0, len(containers))
+	for _, container := range containers {
+		result = append(result, copyContainer(container))
+	}
+	return result, nil
+}
+
 // Requires startReading or startWriting.
 func (r *containerStore) Lookup(name string) (id string, err error) {
 	if container, ok := r.lookup(name); ok {
@@ -920,7 +1094,7 @@ func (r *containerStore) SetBigData(id, key string, data []byte) error {
 	if err := os.MkdirAll(r.datadir(c.ID), 0o700); err != nil {
 		return err
 	}
-	err := ioutils.AtomicWriteFile(r.datapath(c.ID, key), data, 0o600)
+	err := r.pool.write(r.datapath(c.ID, key), data)
 	if err == nil {
 		save := false
 		if c.BigDataSizes == nil {
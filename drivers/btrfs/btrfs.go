@@ -18,6 +18,7 @@ static void set_name_btrfs_ioctl_vol_args_v2(struct btrfs_ioctl_vol_args_v2* btr
 import "C"
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io/fs"
 	"math"
@@ -34,6 +35,7 @@ import (
 	"github.com/containers/storage/pkg/directory"
 	"github.com/containers/storage/pkg/fileutils"
 	"github.com/containers/storage/pkg/idtools"
+	"github.com/containers/storage/pkg/ioutils"
 	"github.com/containers/storage/pkg/mount"
 	"github.com/containers/storage/pkg/parsers"
 	"github.com/containers/storage/pkg/system"
@@ -126,6 +128,8 @@ type Driver struct {
 	options      btrfsOptions
 	quotaEnabled bool
 	once         sync.Once
+	// staleQgroupsLock serializes updates to the stale qgroups file.
+	staleQgroupsLock sync.Mutex
 }
 
 // String prints the name of the driver (btrfs).
@@ -240,15 +244,19 @@ func isSubvolume(p string) (bool, error) {
 	return bufStat.Ino == C.BTRFS_FIRST_FREE_OBJECTID, nil
 }
 
-func subvolDelete(dirpath, name string, quotaEnabled bool) error {
+// subvolDelete deletes a subvolume and any subvolumes nested in it.  It
+// returns the IDs of the qgroups of deleted subvolumes which couldn't be
+// removed yet.
+func subvolDelete(dirpath, name string, quotaEnabled bool) ([]uint64, error) {
 	dir, err := openDir(dirpath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer closeDir(dir)
 	fullPath := path.Join(dirpath, name)
 
 	var args C.struct_btrfs_ioctl_vol_args
+	var deferred []uint64
 
 	// walk the btrfs subvolumes
 	walkSubvolumes := func(p string, d fs.DirEntry, err error) error {
@@ -268,7 +276,9 @@ func subvolDelete(dirpath, name string, quotaEnabled bool) error {
 				return fmt.Errorf("failed to test if %s is a btrfs subvolume: %w", p, err)
 			}
 			if sv {
-				if err := subvolDelete(path.Dir(p), d.Name(), quotaEnabled); err != nil {
+				childDeferred, err := subvolDelete(path.Dir(p), d.Name(), quotaEnabled)
+				deferred = append(deferred, childDeferred...)
+				if err != nil {
 					return fmt.Errorf("failed to destroy btrfs child subvolume (%s) of parent (%s): %w", p, dirpath, err)
 				}
 			}
@@ -276,20 +286,12 @@ func subvolDelete(dirpath, name string, quotaEnabled bool) error {
 		return nil
 	}
 	if err := filepath.WalkDir(path.Join(dirpath, name), walkSubvolumes); err != nil {
-		return fmt.Errorf("recursively walking subvolumes for %s failed: %w", dirpath, err)
+		return deferred, fmt.Errorf("recursively walking subvolumes for %s failed: %w", dirpath, err)
 	}
 
+	var qgroupid uint64
 	if quotaEnabled {
-		if qgroupid, err := subvolLookupQgroup(fullPath); err == nil {
-			var args C.struct_btrfs_ioctl_qgroup_create_args
-			args.qgroupid = C.__u64(qgroupid)
-
-			_, _, errno := unix.Syscall(unix.SYS_IOCTL, getDirFd(dir), C.BTRFS_IOC_QGROUP_CREATE,
-				uintptr(unsafe.Pointer(&args)))
-			if errno != 0 {
-				logrus.Errorf("Failed to delete btrfs qgroup %v for %s: %v", qgroupid, fullPath, errno.Error())
-			}
-		} else {
+		if qgroupid, err = subvolLookupQgroup(fullPath); err != nil {
 			logrus.Errorf("Failed to lookup btrfs qgroup for %s: %v", fullPath, err.Error())
 		}
 	}
@@ -302,9 +304,21 @@ func subvolDelete(dirpath, name string, quotaEnabled bool) error {
 	_, _, errno := unix.Syscall(unix.SYS_IOCTL, getDirFd(dir), C.BTRFS_IOC_SNAP_DESTROY,
 		uintptr(unsafe.Pointer(&args)))
 	if errno != 0 {
-		return fmt.Errorf("failed to destroy btrfs snapshot %s for %s: %w", dirpath, name, errno)
+		return deferred, fmt.Errorf("failed to destroy btrfs snapshot %s for %s: %w", dirpath, name, errno)
 	}
-	return nil
+
+	// The kernel refuses to remove the qgroup of a subvolume which still
+	// exists, so this has to wait until after the subvolume is gone.  If
+	// the subvolume's data hasn't been cleaned up yet, this can still
+	// fail, in which case the qgroup's ID is returned so that the caller
+	// can try again later.
+	if qgroupid != 0 {
+		if err := qgroupDestroy(dirpath, qgroupid); err != nil {
+			logrus.Debugf("Deferring removal of btrfs qgroup for %s: %v", fullPath, err)
+			deferred = append(deferred, qgroupid)
+		}
+	}
+	return deferred, nil
 }
 
 func (d *Driver) updateQuotaStatus() {
@@ -442,6 +456,222 @@ func subvolLookupQgroup(path string) (uint64, error) {
 	return uint64(args.treeid), nil
 }
 
+// qgroupLevelShift is the number of bits by which a qgroup's level is shifted
+// in its ID.  The qgroups which btrfs creates for subvolumes are at level 0,
+// and have the subvolume's ID as their IDs.
+const qgroupLevelShift = 48
+
+func qgroupDestroy(path string, qgroupid uint64) error {
+	dir, err := openDir(path)
+	if err != nil {
+		return err
+	}
+	defer closeDir(dir)
+
+	var args C.struct_btrfs_ioctl_qgroup_create_args
+	args.qgroupid = C.__u64(qgroupid)
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, getDirFd(dir), C.BTRFS_IOC_QGROUP_CREATE,
+		uintptr(unsafe.Pointer(&args)))
+	if errno != 0 {
+		return fmt.Errorf("failed to delete btrfs qgroup 0/%d for %s: %w", qgroupid, path, errno)
+	}
+	return nil
+}
+
+// searchTree performs BTRFS_IOC_TREE_SEARCH calls on the filesystem which
+// contains path, calling fn with the header and contents of each item whose
+// key falls within the range described by key, until fn returns false or
+// there are no more items.
+func searchTree(path string, key C.struct_btrfs_ioctl_search_key, fn func(sh *C.struct_btrfs_ioctl_search_header, item []byte) bool) error {
+	dir, err := openDir(path)
+	if err != nil {
+		return err
+	}
+	defer closeDir(dir)
+
+	var args C.struct_btrfs_ioctl_search_args
+	args.key = key
+	for {
+		args.key.nr_items = 4096
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, getDirFd(dir), C.BTRFS_IOC_TREE_SEARCH,
+			uintptr(unsafe.Pointer(&args)))
+		if errno != 0 {
+			return fmt.Errorf("failed to search btrfs tree %d for %s: %w", key.tree_id, path, errno)
+		}
+		if args.key.nr_items == 0 {
+			return nil
+		}
+		buf := unsafe.Slice((*byte)(unsafe.Pointer(&args.buf[0])), len(args.buf))
+		var sh *C.struct_btrfs_ioctl_search_header
+		offset := uintptr(0)
+		for i := 0; i < int(args.key.nr_items); i++ {
+			sh = (*C.struct_btrfs_ioctl_search_header)(unsafe.Pointer(&buf[offset]))
+			offset += unsafe.Sizeof(*sh)
+			item := buf[offset : offset+uintptr(sh.len)]
+			offset += uintptr(sh.len)
+			if !fn(sh, item) {
+				return nil
+			}
+		}
+		// Resume the search just past the last item we were given.
+		if sh.offset == math.MaxUint64 {
+			return nil
+		}
+		args.key.min_objectid = sh.objectid
+		args.key.min_type = sh._type
+		args.key.min_offset = sh.offset + 1
+	}
+}
+
+// qgroupUsage reads the numbers of bytes referenced by, and exclusive to, the
+// level 0 qgroup with the specified ID.  The counters are only updated when
+// transactions are committed, so callers which want current values should
+// sync the filesystem first.
+func qgroupUsage(path string, qgroupid uint64) (referenced, exclusive uint64, err error) {
+	var key C.struct_btrfs_ioctl_search_key
+	key.tree_id = C.BTRFS_QUOTA_TREE_OBJECTID
+	key.min_type = C.BTRFS_QGROUP_INFO_KEY
+	key.max_type = C.BTRFS_QGROUP_INFO_KEY
+	key.min_offset = C.__u64(qgroupid)
+	key.max_offset = C.__u64(qgroupid)
+	key.max_transid = C.__u64(math.MaxUint64)
+
+	found := false
+	err = searchTree(path, key, func(sh *C.struct_btrfs_ioctl_search_header, item []byte) bool {
+		// struct btrfs_qgroup_info_item: generation, rfer, rfer_cmpr, excl, excl_cmpr
+		if sh._type != C.BTRFS_QGROUP_INFO_KEY || uint64(sh.offset) != qgroupid || len(item) < 40 {
+			return true
+		}
+		referenced = binary.LittleEndian.Uint64(item[8:16])
+		exclusive = binary.LittleEndian.Uint64(item[24:32])
+		found = true
+		return false
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if !found {
+		return 0, 0, fmt.Errorf("no btrfs qgroup 0/%d found for %s", qgroupid, path)
+	}
+	return referenced, exclusive, nil
+}
+
+// subvolExists checks if the filesystem which contains path still has a
+// subvolume with the specified ID.
+func subvolExists(path string, subvolid uint64) (bool, error) {
+	var key C.struct_btrfs_ioctl_search_key
+	key.tree_id = C.BTRFS_ROOT_TREE_OBJECTID
+	key.min_objectid = C.__u64(subvolid)
+	key.max_objectid = C.__u64(subvolid)
+	key.min_type = C.BTRFS_ROOT_ITEM_KEY
+	key.max_type = C.BTRFS_ROOT_ITEM_KEY
+	key.max_offset = C.__u64(math.MaxUint64)
+	key.max_transid = C.__u64(math.MaxUint64)
+
+	exists := false
+	err := searchTree(path, key, func(sh *C.struct_btrfs_ioctl_search_header, item []byte) bool {
+		exists = sh._type == C.BTRFS_ROOT_ITEM_KEY && uint64(sh.objectid) == subvolid
+		return !exists
+	})
+	return exists, err
+}
+
+// staleQgroupsPath returns the location of the file which lists the IDs of
+// the qgroups of subvolumes which the driver deleted, but whose qgroups it
+// wasn't able to remove at the time.
+func (d *Driver) staleQgroupsPath() string {
+	return path.Join(d.home, "stale-qgroups")
+}
+
+// readStaleQgroups returns the IDs recorded in the stale qgroups file.
+func (d *Driver) readStaleQgroups() ([]uint64, error) {
+	data, err := os.ReadFile(d.staleQgroupsPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var qgroups []uint64
+	for _, field := range strings.Fields(string(data)) {
+		qgroupid, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			logrus.Warnf("Ignoring invalid btrfs qgroup ID %q in %s", field, d.staleQgroupsPath())
+			continue
+		}
+		qgroups = append(qgroups, qgroupid)
+	}
+	return qgroups, nil
+}
+
+// writeStaleQgroups replaces the contents of the stale qgroups file.
+func (d *Driver) writeStaleQgroups(qgroups []uint64) error {
+	if len(qgroups) == 0 {
+		if err := os.Remove(d.staleQgroupsPath()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	var b strings.Builder
+	for _, qgroupid := range qgroups {
+		b.WriteString(strconv.FormatUint(qgroupid, 10))
+		b.WriteByte('\n')
+	}
+	return ioutils.AtomicWriteFile(d.staleQgroupsPath(), []byte(b.String()), 0o600)
+}
+
+// deleteSubvolume deletes one of the driver's subvolumes, and records the IDs
+// of any of its qgroups which couldn't be removed yet for removeStaleQgroups
+// to retry.
+func (d *Driver) deleteSubvolume(dirpath, name string) error {
+	deferred, err := subvolDelete(dirpath, name, d.quotaEnabled)
+	if len(deferred) > 0 {
+		d.staleQgroupsLock.Lock()
+		defer d.staleQgroupsLock.Unlock()
+		qgroups, readErr := d.readStaleQgroups()
+		if readErr == nil {
+			readErr = d.writeStaleQgroups(append(qgroups, deferred...))
+		}
+		if readErr != nil {
+			logrus.Warnf("Recording stale btrfs qgroups: %v", readErr)
+		}
+	}
+	return err
+}
+
+// removeStaleQgroups retries removing the qgroups which deleteSubvolume
+// recorded because the kernel hadn't finished cleaning up after their
+// subvolumes yet.  Only qgroups of subvolumes which the driver itself deleted
+// are ever considered.
+func (d *Driver) removeStaleQgroups() error {
+	if !d.quotaEnabled {
+		return nil
+	}
+	d.staleQgroupsLock.Lock()
+	defer d.staleQgroupsLock.Unlock()
+	qgroups, err := d.readStaleQgroups()
+	if err != nil || len(qgroups) == 0 {
+		return err
+	}
+	var remaining []uint64
+	for _, qgroupid := range qgroups {
+		exists, err := subvolExists(d.home, qgroupid)
+		if err != nil {
+			return err
+		}
+		if exists {
+			// The ID was reused by a new subvolume, so the
+			// qgroup is no longer stale.
+			continue
+		}
+		if err := qgroupDestroy(d.home, qgroupid); err != nil {
+			logrus.Debugf("Deferring removal of stale btrfs qgroup: %v", err)
+			remaining = append(remaining, qgroupid)
+		}
+	}
+	return d.writeStaleQgroups(remaining)
+}
+
 func (d *Driver) subvolumesDir() string {
 	return path.Join(d.home, "subvolumes")
 }
@@ -585,7 +815,15 @@ func (d *Driver) Remove(id string) error {
 	// Call updateQuotaStatus() to invoke status update
 	d.updateQuotaStatus()
 
-	if err := subvolDelete(d.subvolumesDir(), id, d.quotaEnabled); err != nil {
+	if entries, err := os.ReadDir(d.snapshotsDirID(id)); err == nil {
+		for _, entry := range entries {
+			if err := d.RemoveLayerSnapshot(id, entry.Name()); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := d.deleteSubvolume(d.subvolumesDir(), id); err != nil {
 		if d.quotaEnabled {
 			return err
 		}
@@ -599,6 +837,9 @@ func (d *Driver) Remove(id string) error {
 	if err := d.subvolRescanQuota(); err != nil {
 		return err
 	}
+	if err := d.removeStaleQgroups(); err != nil {
+		logrus.Warnf("Failed to remove stale btrfs qgroups: %v", err)
+	}
 	return nil
 }
 
@@ -642,11 +883,48 @@ func (d *Driver) Put(id string) error {
 }
 
 // ReadWriteDiskUsage returns the disk usage of the writable directory for the ID.
-// For BTRFS, it queries the subvolumes path for this ID.
+// For BTRFS, it reads the exclusive size from the subvolume's qgroup if quotas
+// are enabled, and otherwise queries the subvolumes path for this ID.
 func (d *Driver) ReadWriteDiskUsage(id string) (*directory.DiskUsage, error) {
+	if usage, err := d.LayerUsage(id); err == nil {
+		// qgroups don't count inodes.
+		return &directory.DiskUsage{Size: usage.Exclusive, InodeCount: -1}, nil
+	}
 	return directory.Usage(d.subvolumesDirID(id))
 }
 
+// LayerUsage returns the numbers of bytes referenced by the layer's subvolume
+// and used exclusively by it, as tracked by the subvolume's qgroup.  It
+// requires quotas to be enabled on the filesystem.
+func (d *Driver) LayerUsage(id string) (graphdriver.LayerUsage, error) {
+	d.updateQuotaStatus()
+	if !d.quotaEnabled {
+		return graphdriver.LayerUsage{}, fmt.Errorf("btrfs quotas are not enabled for %s: %w", d.home, graphdriver.ErrNotSupported)
+	}
+	subvol := d.subvolumesDirID(id)
+	qgroupid, err := subvolLookupQgroup(subvol)
+	if err != nil {
+		return graphdriver.LayerUsage{}, err
+	}
+
+	// Commit any pending changes, so that they're reflected in the counters.
+	dir, err := openDir(subvol)
+	if err != nil {
+		return graphdriver.LayerUsage{}, err
+	}
+	err = unix.Syncfs(int(getDirFd(dir)))
+	closeDir(dir)
+	if err != nil {
+		return graphdriver.LayerUsage{}, fmt.Errorf("syncing filesystem for %s: %w", subvol, err)
+	}
+
+	referenced, exclusive, err := qgroupUsage(d.home, qgroupid)
+	if err != nil {
+		return graphdriver.LayerUsage{}, err
+	}
+	return graphdriver.LayerUsage{Referenced: int64(referenced), Exclusive: int64(exclusive)}, nil
+}
+
 // Exists checks if the id exists in the filesystem.
 func (d *Driver) Exists(id string) bool {
 	dir := d.subvolumesDirID(id)
@@ -690,3 +968,85 @@ func (d *Driver) DeferredRemove(id string) (tempdir.CleanupTempDirFunc, error) {
 func (d *Driver) GetTempDirRootDirs() []string {
 	return []string{}
 }
+
+func (d *Driver) snapshotsDir() string {
+	return path.Join(d.home, "snapshots")
+}
+
+func (d *Driver) snapshotsDirID(id string) string {
+	return path.Join(d.snapshotsDir(), id)
+}
+
+// CreateLayerSnapshot takes a btrfs snapshot of the layer's subvolume.
+func (d *Driver) CreateLayerSnapshot(id, snapshot string) error {
+	dir := d.snapshotsDirID(id)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	return subvolSnapshot(d.subvolumesDirID(id), dir, snapshot)
+}
+
+// restoringSnapshot is the name, in a layer's snapshots directory, of the new
+// snapshot which RestoreLayerSnapshot takes before swapping it with the
+// layer's subvolume.  Snapshots are named using random IDs, so it can't
+// collide with one of them.
+const restoringSnapshot = ".restoring"
+
+// RestoreLayerSnapshot replaces the layer's subvolume with a new snapshot of
+// the saved one.  The new snapshot is taken first and then atomically swapped
+// with the layer's subvolume, so that the layer is left as it was if the
+// snapshot can't be taken.  Other snapshots are never discarded.
+func (d *Driver) RestoreLayerSnapshot(id, snapshot string) ([]string, error) {
+	dir := d.snapshotsDirID(id)
+	snapDir := path.Join(dir, snapshot)
+	if err := fileutils.Exists(snapDir); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("btrfs: snapshot %q of layer %q: %w", snapshot, id, graphdriver.ErrLayerUnknown)
+		}
+		return nil, err
+	}
+	restoring := path.Join(dir, restoringSnapshot)
+	// Discard anything left behind by an earlier attempt which was interrupted.
+	if err := fileutils.Exists(restoring); err == nil {
+		if err := d.deleteSubvolume(dir, restoringSnapshot); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := subvolSnapshot(snapDir, dir, restoringSnapshot); err != nil {
+		return nil, err
+	}
+	if err := unix.Renameat2(unix.AT_FDCWD, restoring, unix.AT_FDCWD, d.subvolumesDirID(id), unix.RENAME_EXCHANGE); err != nil {
+		if err2 := d.deleteSubvolume(dir, restoringSnapshot); err2 != nil {
+			logrus.Warnf("Deleting unused btrfs snapshot %q: %v", restoring, err2)
+		}
+		return nil, fmt.Errorf("btrfs: replacing subvolume of layer %q with snapshot %q: %w", id, snapshot, err)
+	}
+	// The layer has been restored, and the old contents of its subvolume
+	// are now where the new snapshot was.  If they can't be deleted now,
+	// they will be the next time the layer is restored or removed.
+	if err := d.deleteSubvolume(dir, restoringSnapshot); err != nil {
+		logrus.Warnf("Deleting replaced btrfs subvolume of layer %q: %v", id, err)
+	}
+	// Get() reapplies any size limit to the new subvolume.
+	return nil, nil
+}
+
+// RemoveLayerSnapshot deletes a btrfs snapshot of the layer's subvolume.
+func (d *Driver) RemoveLayerSnapshot(id, snapshot string) error {
+	dir := d.snapshotsDirID(id)
+	if err := fileutils.Exists(path.Join(dir, snapshot)); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := d.deleteSubvolume(dir, snapshot); err != nil {
+		return err
+	}
+	// Clean up the per-layer directory once it's empty; this fails
+	// harmlessly while the layer has other snapshots.
+	_ = os.Remove(dir)
+	return nil
+}
@@ -74,6 +74,46 @@ func TestBtrfsListLayers(t *testing.T) {
 	graphtest.DriverTestListLayers(t, "btrfs")
 }
 
+func TestBtrfsLayerUsage(t *testing.T) {
+	d := graphtest.GetDriver(t, "btrfs")
+	driver := d.(*graphdriver.NaiveDiffDriver).ProtoDriver.(*Driver)
+	if err := driver.enableQuota(); err != nil {
+		t.Skipf("btrfs quotas are not available: %v", err)
+	}
+	if err := d.CreateReadWrite("usage", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := d.Get("usage", graphdriver.MountOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(dir, "data"), make([]byte, 1024*1024), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put("usage"); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := driver.LayerUsage("usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Exclusive < 1024*1024 || usage.Referenced < usage.Exclusive {
+		t.Fatalf("unexpected usage for a layer containing 1MiB of data: %+v", usage)
+	}
+	diskUsage, err := d.ReadWriteDiskUsage("usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diskUsage.Size != usage.Exclusive {
+		t.Fatalf("expected ReadWriteDiskUsage to report %d bytes, got %d", usage.Exclusive, diskUsage.Size)
+	}
+
+	if err := d.Remove("usage"); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestBtrfsTeardown(t *testing.T) {
 	graphtest.PutDriver(t)
 }
@@ -316,6 +316,184 @@ type CapabilityDriver interface {
 	Capabilities() Capabilities
 }
 
+// ResizableDriver is the interface for layered file system drivers which can
+// change the size limit of an existing read-write layer.
+type ResizableDriver interface {
+	// ResizeLayer changes the size limit of the layer to size bytes.
+	ResizeLayer(id string, size uint64) error
+}
+
+// AsResizableDriver returns driver as a ResizableDriver if it, or the driver
+// which it wraps in the case of a NaiveDiffDriver, implements that interface.
+func AsResizableDriver(driver Driver) (ResizableDriver, bool) {
+	rdriver, ok := unwrapNaiveDiffDriver(driver).(ResizableDriver)
+	return rdriver, ok
+}
+
+// SnapshotDriver is the interface for layered file system drivers which can
+// save the contents of a read-write layer and later roll the layer back to
+// them.  Snapshot names are chosen by the caller, and are only unique among
+// the snapshots of a single layer.
+type SnapshotDriver interface {
+	// CreateLayerSnapshot saves the current contents of the layer as
+	// snapshot.
+	CreateLayerSnapshot(id, snapshot string) error
+	// RestoreLayerSnapshot replaces the contents of the layer, which must
+	// not be mounted, with the ones saved in snapshot.  It returns the
+	// names of any other snapshots of the layer which were discarded as a
+	// side effect of restoring this one.
+	RestoreLayerSnapshot(id, snapshot string) ([]string, error)
+	// RemoveLayerSnapshot discards snapshot.
+	RemoveLayerSnapshot(id, snapshot string) error
+}
+
+// AsSnapshotDriver returns driver as a SnapshotDriver if it, or the driver
+// which it wraps in the case of a NaiveDiffDriver, implements that interface.
+func AsSnapshotDriver(driver Driver) (SnapshotDriver, bool) {
+	sdriver, ok := unwrapNaiveDiffDriver(driver).(SnapshotDriver)
+	return sdriver, ok
+}
+
+// CloneDriver is the interface for layered file system drivers whose
+// CreateFromTemplate can't produce a read-write layer which is independent of
+// its template, but which can copy a read-write layer's contents some other
+// way.
+type CloneDriver interface {
+	// CloneLayer creates a read-write layer with the specified id and
+	// parent, whose contents start as a copy of those of template, which
+	// must have the same parent.  The new layer doesn't depend on template
+	// continuing to exist.  If toIDMappings is not nil, the ownership of
+	// the copies of the files which are in template itself, and not in its
+	// parent, is changed from fromIDMappings to toIDMappings.
+	CloneLayer(id, template, parent string, opts *CreateOpts, fromIDMappings, toIDMappings *idtools.IDMappings) error
+}
+
+// AsCloneDriver returns driver as a CloneDriver if it, or the driver which it
+// wraps in the case of a NaiveDiffDriver, implements that interface.
+func AsCloneDriver(driver Driver) (CloneDriver, bool) {
+	cdriver, ok := unwrapNaiveDiffDriver(driver).(CloneDriver)
+	return cdriver, ok
+}
+
+// NativeDiffDriver is the interface for layered file system drivers which can
+// produce diffs between a layer and its parent in a format of their own, which
+// can be generated and applied more efficiently than a tar stream, but which
+// can only be applied by the same driver in another store, on top of a parent
+// layer which was itself created from such a diff, or from the same data.
+type NativeDiffDriver interface {
+	// NativeDiff returns a stream of the changes between the layer and
+	// its parent, which should be "" for a base layer.  The contents which
+	// the stream describes must be captured, for example in a snapshot,
+	// before it returns, since the stream is read after the caller stops
+	// holding the locks which keep the layer from being changed.
+	NativeDiff(id, parent string) (io.ReadCloser, error)
+	// ApplyNativeDiff replaces the contents of a newly-created layer with
+	// those in a stream produced by NativeDiff for the same parent.
+	ApplyNativeDiff(id, parent string, diff io.Reader) error
+}
+
+// AsNativeDiffDriver returns driver as a NativeDiffDriver if it, or the driver
+// which it wraps in the case of a NaiveDiffDriver, implements that interface.
+func AsNativeDiffDriver(driver Driver) (NativeDiffDriver, bool) {
+	ndriver, ok := unwrapNaiveDiffDriver(driver).(NativeDiffDriver)
+	return ndriver, ok
+}
+
+// LayerUsage describes the disk space used by a layer.
+type LayerUsage struct {
+	// Referenced is the number of bytes of data which the layer's
+	// contents occupy, including any which are shared with other layers.
+	Referenced int64
+	// Exclusive is the number of bytes of data which are used only by the
+	// layer, and which would be freed if it were removed.
+	Exclusive int64
+}
+
+// UsageDriver is the interface for layered file system drivers which keep
+// track of how much of the space used by a layer is shared with other layers,
+// so that it can be reported without walking the layer's contents.
+type UsageDriver interface {
+	// LayerUsage returns the disk space used by the layer.
+	LayerUsage(id string) (LayerUsage, error)
+}
+
+// AsUsageDriver returns driver as a UsageDriver if it, or the driver which it
+// wraps in the case of a NaiveDiffDriver, implements that interface.
+func AsUsageDriver(driver Driver) (UsageDriver, bool) {
+	udriver, ok := unwrapNaiveDiffDriver(driver).(UsageDriver)
+	return udriver, ok
+}
+
+// AdditionalImageStoreDriver is the interface for layered file system drivers
+// which can start or stop looking for layers in additional read-only image
+// stores after they have been initialized.
+type AdditionalImageStoreDriver interface {
+	// AddAdditionalImageStore adds store, which must be an absolute path
+	// to a directory, to the end of the list of additional image stores
+	// whose layers can be used as the parents of new layers.
+	AddAdditionalImageStore(store string) error
+	// RemoveAdditionalImageStore removes store from the list of
+	// additional image stores.
+	RemoveAdditionalImageStore(store string) error
+}
+
+// AsAdditionalImageStoreDriver returns driver as an AdditionalImageStoreDriver
+// if it, or the driver which it wraps in the case of a NaiveDiffDriver,
+// implements that interface.
+func AsAdditionalImageStoreDriver(driver Driver) (AdditionalImageStoreDriver, bool) {
+	adriver, ok := unwrapNaiveDiffDriver(driver).(AdditionalImageStoreDriver)
+	return adriver, ok
+}
+
+// TieredDriver is the interface for layered file system drivers which can move
+// the data of read-only layers to a cold store, a directory which is typically
+// on slower and larger storage, and back, while continuing to find the layers
+// wherever they are.  The cold store is set using Options.ColdStore.
+type TieredDriver interface {
+	// ColdStore returns the cold store, or "" if there is none.
+	ColdStore() string
+	// DemoteLayer moves the layer's data to the cold store.  Neither the
+	// layer nor any layer based on it may be mounted.  A copy made by
+	// StageDemotion is used if there is one.
+	DemoteLayer(id string) error
+	// StageDemotion copies the layer's data to the cold store, if moving
+	// it there requires a copy, so that DemoteLayer only has to rename the
+	// copy into place.  The layer isn't modified, so this can be called
+	// while the layer is in use.
+	StageDemotion(id string) error
+	// DiscardStagedDemotion removes a copy made by StageDemotion which
+	// isn't going to be used.
+	DiscardStagedDemotion(id string) error
+	// PromoteLayer moves the layer's data from the cold store back to
+	// the directory where read-only layers are created.  Neither the
+	// layer nor any layer based on it may be mounted.
+	PromoteLayer(id string) error
+	// LayerInColdStore returns true if the layer's data is in the cold
+	// store.
+	LayerInColdStore(id string) bool
+}
+
+// AsTieredDriver returns driver as a TieredDriver if it, or the driver which
+// it wraps in the case of a NaiveDiffDriver, implements that interface and
+// has a cold store.
+func AsTieredDriver(driver Driver) (TieredDriver, bool) {
+	tdriver, ok := unwrapNaiveDiffDriver(driver).(TieredDriver)
+	if !ok || tdriver.ColdStore() == "" {
+		return nil, false
+	}
+	return tdriver, true
+}
+
+// unwrapNaiveDiffDriver returns the ProtoDriver wrapped by driver if it is a
+// NaiveDiffDriver, so that optional interfaces which the NaiveDiffDriver
+// doesn't forward can be detected, and driver itself otherwise.
+func unwrapNaiveDiffDriver(driver Driver) any {
+	if naive, ok := driver.(*NaiveDiffDriver); ok {
+		return naive.ProtoDriver
+	}
+	return driver
+}
+
 // AdditionalLayer represents a layer that is stored in the additional layer store
 // This API is experimental and can be changed without bumping the major version number.
 type AdditionalLayer interface {
@@ -416,6 +594,7 @@ type Options struct {
 	Root                string
 	RunRoot             string
 	ImageStore          string
+	ColdStore           string
 	DriverPriority      []string
 	DriverOptions       []string
 	ExperimentalEnabled bool
@@ -0,0 +1,65 @@
+//go:build linux
+
+package overlay
+
+import (
+	"errors"
+	"fmt"
+	"path"
+
+	graphdriver "github.com/containers/storage/drivers"
+	"github.com/containers/storage/drivers/copy"
+	"github.com/containers/storage/pkg/fileutils"
+	"github.com/containers/storage/pkg/idtools"
+)
+
+// CloneLayer creates a read-write layer and copies the upper directory of the
+// template layer into it, using reflinks where the backing filesystem supports
+// them.  Unlike CreateFromTemplate, which stacks the new layer on top of the
+// template, the result doesn't refer to the template at all.
+func (d *Driver) CloneLayer(id, template, parent string, opts *graphdriver.CreateOpts, fromIDMappings, toIDMappings *idtools.IDMappings) (retErr error) {
+	templateDir := d.dir(template)
+	if err := fileutils.Exists(path.Join(templateDir, "diff")); err != nil {
+		return err
+	}
+	if err := d.CreateReadWrite(id, parent, opts); err != nil {
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			if err := d.Remove(id); err != nil {
+				retErr = errors.Join(retErr, err)
+			}
+		}
+	}()
+
+	deactivateTemplate, err := d.activateLoopbackUpper(templateDir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := deactivateTemplate(); err != nil {
+			retErr = errors.Join(retErr, err)
+		}
+	}()
+	dir := d.dir(id)
+	deactivate, err := d.activateLoopbackUpper(dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := deactivate(); err != nil {
+			retErr = errors.Join(retErr, err)
+		}
+	}()
+
+	if err := copy.DirCopy(path.Join(templateDir, "diff"), path.Join(dir, "diff"), copy.Content, true); err != nil {
+		return fmt.Errorf("overlay: copying layer %q to %q: %w", template, id, err)
+	}
+	if toIDMappings != nil {
+		if err := graphdriver.ChownPathByMaps(path.Join(dir, "diff"), fromIDMappings, toIDMappings); err != nil {
+			return fmt.Errorf("overlay: changing ownership of copy of layer %q: %w", template, err)
+		}
+	}
+	return nil
+}
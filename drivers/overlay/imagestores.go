@@ -0,0 +1,48 @@
+//go:build linux
+
+package overlay
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// AddAdditionalImageStore adds store to the end of the list of read-only image
+// stores in which lower layers are looked for.
+func (d *Driver) AddAdditionalImageStore(store string) error {
+	store = filepath.Clean(store)
+	if !filepath.IsAbs(store) {
+		return fmt.Errorf("overlay: image path %q is not absolute.  Can not be relative", store)
+	}
+	st, err := os.Stat(store)
+	if err != nil {
+		return fmt.Errorf("overlay: can't stat imageStore dir %s: %w", store, err)
+	}
+	if !st.IsDir() {
+		return fmt.Errorf("overlay: image path %q must be a directory", store)
+	}
+	d.imageStoresLock.Lock()
+	defer d.imageStoresLock.Unlock()
+	if slices.Contains(d.options.imageStores, store) {
+		return fmt.Errorf("overlay: image path %q is already in use", store)
+	}
+	d.options.imageStores = append(d.options.imageStores, store)
+	return nil
+}
+
+// RemoveAdditionalImageStore removes store from the list of read-only image
+// stores in which lower layers are looked for.  Layers which are already
+// mounted keep using the lower layers which they were mounted with.
+func (d *Driver) RemoveAdditionalImageStore(store string) error {
+	store = filepath.Clean(store)
+	d.imageStoresLock.Lock()
+	defer d.imageStoresLock.Unlock()
+	i := slices.Index(d.options.imageStores, store)
+	if i == -1 {
+		return fmt.Errorf("overlay: image path %q is not in use", store)
+	}
+	d.options.imageStores = slices.Delete(d.options.imageStores, i, i+1)
+	return nil
+}
@@ -0,0 +1,324 @@
+//go:build linux
+
+package overlay
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+
+	graphdriver "github.com/containers/storage/drivers"
+	"github.com/containers/storage/drivers/quota"
+	"github.com/containers/storage/pkg/directory"
+	"github.com/containers/storage/pkg/fileutils"
+	"github.com/containers/storage/pkg/idtools"
+	"github.com/containers/storage/pkg/loopback"
+	"github.com/containers/storage/pkg/mount"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// quotaBackendProject enforces size and inodes limits using XFS/ext4
+	// project quota on the backing filesystem.  This is the default.
+	quotaBackendProject = "project"
+	// quotaBackendLoopback enforces size and inodes limits by placing a
+	// layer's upper and work directories on a sparse filesystem image
+	// which is loop-mounted while the layer is in use.
+	quotaBackendLoopback = "loopback"
+
+	// loopbackImage is the name of the filesystem image in a layer's
+	// directory which holds its upper and work directories.
+	loopbackImage = "upper.img"
+	// loopbackMountDir is the directory in a layer's directory where the
+	// filesystem image is mounted.
+	loopbackMountDir = "loop"
+)
+
+// usingLoopbackQuota returns true if size and inodes limits for writable
+// layers are implemented using loop-mounted filesystem images.
+func (d *Driver) usingLoopbackQuota() bool {
+	return d.options.quotaBackend == quotaBackendLoopback
+}
+
+// loopbackImagePath returns the location of the filesystem image for the
+// layer in dir.
+func loopbackImagePath(dir string) string {
+	return path.Join(dir, loopbackImage)
+}
+
+// hasLoopbackUpper returns true if the layer in dir keeps its upper and work
+// directories in a filesystem image.
+func hasLoopbackUpper(dir string) bool {
+	return fileutils.Exists(loopbackImagePath(dir)) == nil
+}
+
+// createLoopbackUpper creates a sparse filesystem image of the requested size
+// for the layer in dir, formats it, and creates upper and work directories in
+// it which mirror the ownership, permissions and xattrs of the layer's
+// "diff" and "work" directories.
+func (d *Driver) createLoopbackUpper(dir string, q quota.Quota) (retErr error) {
+	if q.Size == 0 {
+		if q.Inodes > 0 {
+			return fmt.Errorf("overlay: inodes limit requires a size limit with quota_backend=%s", quotaBackendLoopback)
+		}
+		return nil
+	}
+	image := loopbackImagePath(dir)
+	f, err := os.OpenFile(image, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if retErr != nil {
+			if err := os.Remove(image); err != nil && !os.IsNotExist(err) {
+				logrus.Errorf("While recovering from a failure creating a loopback image, error deleting %q: %v", image, err)
+			}
+		}
+	}()
+	if err := f.Truncate(int64(q.Size)); err != nil {
+		f.Close()
+		return fmt.Errorf("allocating loopback image %q: %w", image, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	var args []string
+	switch d.options.loopbackFs {
+	case "xfs":
+		if q.Inodes > 0 {
+			return fmt.Errorf("overlay: inodes limits are not supported with loopback_fs=xfs")
+		}
+		args = []string{"mkfs.xfs", "-q", "-f", image}
+	default:
+		args = []string{"mkfs.ext4", "-q", "-F", "-m", "0"}
+		if q.Inodes > 0 {
+			args = append(args, "-N", strconv.FormatUint(q.Inodes, 10))
+		}
+		args = append(args, image)
+	}
+	if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		return fmt.Errorf("formatting loopback image %q: %s: %w", image, string(out), err)
+	}
+
+	loopDir := path.Join(dir, loopbackMountDir)
+	if err := os.MkdirAll(loopDir, 0o700); err != nil {
+		return err
+	}
+	if err := mountLoopbackImage(image, loopDir, d.options.loopbackFs); err != nil {
+		return err
+	}
+	defer func() {
+		if err := unix.Unmount(loopDir, unix.MNT_DETACH); err != nil {
+			logrus.Debugf("Failed to unmount loopback image %q: %v", loopDir, err)
+		}
+	}()
+	for _, sub := range []string{"diff", "work"} {
+		if err := cloneDirectoryAttributes(path.Join(dir, sub), path.Join(loopDir, sub)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cloneDirectoryAttributes creates dest with the same permissions, ownership
+// and containers override xattr as src.
+func cloneDirectoryAttributes(src, dest string) error {
+	var st unix.Stat_t
+	if err := unix.Lstat(src, &st); err != nil {
+		return &os.PathError{Op: "lstat", Path: src, Err: err}
+	}
+	mode := os.FileMode(st.Mode & 0o7777)
+	if err := idtools.MkdirAs(dest, mode, int(st.Uid), int(st.Gid)); err != nil {
+		return err
+	}
+	if err := os.Chmod(dest, mode); err != nil {
+		return err
+	}
+	if xSt, err := idtools.GetContainersOverrideXattr(src); err == nil {
+		if err := idtools.SetContainersOverrideXattr(dest, xSt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mountLoopbackImage attaches image to a loopback device and mounts it at
+// target.  The loopback device is released when it is unmounted.
+func mountLoopbackImage(image, target, fsType string) error {
+	if fsType == "" {
+		fsType = "ext4"
+	}
+	loopFile, err := loopback.AttachLoopDevice(image)
+	if err != nil {
+		return fmt.Errorf("attaching loopback image %q: %w", image, err)
+	}
+	defer loopFile.Close()
+	if err := unix.Mount(loopFile.Name(), target, fsType, 0, ""); err != nil {
+		return fmt.Errorf("mounting loopback image %q at %q: %w", image, target, err)
+	}
+	return nil
+}
+
+// activateLoopbackUpper mounts the filesystem image for the layer in dir, if
+// it has one and it is not already mounted, and bind-mounts the upper
+// directory in it over the layer's "diff" directory, so that everything which
+// reads the layer's contents finds them in the usual location.  The overlay
+// mount itself uses the directories in the image directly, since the upper
+// and work directories must be on the same mount.
+// The returned function undoes whatever was done, and is never nil.
+func (d *Driver) activateLoopbackUpper(dir string) (func() error, error) {
+	noop := func() error { return nil }
+	if !hasLoopbackUpper(dir) {
+		return noop, nil
+	}
+	loopDir := path.Join(dir, loopbackMountDir)
+	if mounted, err := mount.Mounted(loopDir); err != nil {
+		return noop, err
+	} else if mounted {
+		return noop, nil
+	}
+	if err := mountLoopbackImage(loopbackImagePath(dir), loopDir, d.options.loopbackFs); err != nil {
+		return noop, err
+	}
+	deactivate := func() error {
+		return deactivateLoopbackUpper(dir)
+	}
+	if err := unix.Mount(path.Join(loopDir, "diff"), path.Join(dir, "diff"), "", unix.MS_BIND, ""); err != nil {
+		err = fmt.Errorf("bind mounting loopback upper directory for %q: %w", dir, err)
+		if err2 := deactivate(); err2 != nil {
+			err = errors.Join(err, err2)
+		}
+		return noop, err
+	}
+	return deactivate, nil
+}
+
+// deactivateLoopbackUpper unmounts the bind mount and the filesystem image
+// set up by activateLoopbackUpper for the layer in dir.
+func deactivateLoopbackUpper(dir string) error {
+	if !hasLoopbackUpper(dir) {
+		return nil
+	}
+	var errs []error
+	for _, target := range []string{path.Join(dir, "diff"), path.Join(dir, loopbackMountDir)} {
+		if mounted, err := mount.Mounted(target); err != nil || !mounted {
+			continue
+		}
+		if err := unix.Unmount(target, unix.MNT_DETACH); err != nil && !errors.Is(err, unix.EINVAL) && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("unmounting %q: %w", target, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// loopbackDiskUsage reports the disk usage of a layer which keeps its upper
+// directory in a filesystem image.  The second return value is false if the
+// layer does not have such an image.
+func (d *Driver) loopbackDiskUsage(id string) (*directory.DiskUsage, bool, error) {
+	dir := d.dir(id)
+	if !hasLoopbackUpper(dir) {
+		return nil, false, nil
+	}
+	usage := &directory.DiskUsage{}
+	loopDir := path.Join(dir, loopbackMountDir)
+	if mounted, err := mount.Mounted(loopDir); err == nil && mounted {
+		var st unix.Statfs_t
+		if err := unix.Statfs(loopDir, &st); err != nil {
+			return nil, true, &os.PathError{Op: "statfs", Path: loopDir, Err: err}
+		}
+		usage.Size = int64(st.Blocks-st.Bfree) * st.Bsize
+		usage.InodeCount = int64(st.Files - st.Ffree)
+		return usage, true, nil
+	}
+	// Not mounted: the space actually allocated to the sparse image is the
+	// best approximation we have without mounting it.
+	var st unix.Stat_t
+	if err := unix.Stat(loopbackImagePath(dir), &st); err != nil {
+		return nil, true, &os.PathError{Op: "stat", Path: loopbackImagePath(dir), Err: err}
+	}
+	usage.Size = st.Blocks * 512
+	usage.InodeCount = -1
+	return usage, true, nil
+}
+
+// ResizeLayer changes the size limit of a writable layer whose upper
+// directory is kept in a loop-mounted filesystem image.  Images can only be
+// grown.  ext4 images of layers which are not mounted are resized offline,
+// everything else is resized while mounted.
+func (d *Driver) ResizeLayer(id string, size uint64) (retErr error) {
+	dir := d.dir(id)
+	if !hasLoopbackUpper(dir) {
+		return fmt.Errorf("overlay: layer %q does not have a size limit which can be changed: %w", id, graphdriver.ErrNotSupported)
+	}
+	image := loopbackImagePath(dir)
+	st, err := os.Stat(image)
+	if err != nil {
+		return err
+	}
+	if int64(size) < st.Size() {
+		return fmt.Errorf("overlay: shrinking layer %q from %d to %d bytes is not supported", id, st.Size(), size)
+	}
+	if int64(size) == st.Size() {
+		return nil
+	}
+	loopDir := path.Join(dir, loopbackMountDir)
+	mounted, err := mount.Mounted(loopDir)
+	if err != nil {
+		return err
+	}
+	if !mounted && d.options.loopbackFs != "xfs" {
+		if err := os.Truncate(image, int64(size)); err != nil {
+			return err
+		}
+		// resize2fs insists on a freshly-checked filesystem when resizing offline.
+		if out, err := exec.Command("e2fsck", "-f", "-p", image).CombinedOutput(); err != nil {
+			return fmt.Errorf("checking filesystem in %q: %s: %w", image, string(out), err)
+		}
+		if out, err := exec.Command("resize2fs", image).CombinedOutput(); err != nil {
+			return fmt.Errorf("growing filesystem in %q: %s: %w", image, string(out), err)
+		}
+		return nil
+	}
+
+	deactivate, err := d.activateLoopbackUpper(dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := deactivate(); err != nil {
+			retErr = errors.Join(retErr, err)
+		}
+	}()
+	if err := os.Truncate(image, int64(size)); err != nil {
+		return err
+	}
+	f, err := os.Open(image)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	loopFile := loopback.FindLoopDeviceFor(f)
+	if loopFile == nil {
+		return fmt.Errorf("overlay: unable to find the loopback device for %q", image)
+	}
+	defer loopFile.Close()
+	if err := loopback.SetCapacity(loopFile); err != nil {
+		return err
+	}
+	var cmd *exec.Cmd
+	switch d.options.loopbackFs {
+	case "xfs":
+		cmd = exec.Command("xfs_growfs", loopDir)
+	default:
+		cmd = exec.Command("resize2fs", loopFile.Name())
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("growing filesystem in %q: %s: %w", image, string(out), err)
+	}
+	return nil
+}
@@ -32,6 +32,7 @@ import (
 	"github.com/containers/storage/pkg/fsutils"
 	"github.com/containers/storage/pkg/idmap"
 	"github.com/containers/storage/pkg/idtools"
+	"github.com/containers/storage/pkg/ioutils"
 	"github.com/containers/storage/pkg/mount"
 	"github.com/containers/storage/pkg/parsers"
 	"github.com/containers/storage/pkg/system"
@@ -114,6 +115,8 @@ type overlayOptions struct {
 	ignoreChownErrors bool
 	forceMask         *os.FileMode
 	useComposefs      bool
+	quotaBackend      string
+	loopbackFs        string
 }
 
 // Driver contains information about the home directory and the list of active mounts that are created using this driver.
@@ -122,8 +125,10 @@ type Driver struct {
 	home             string
 	runhome          string
 	imageStore       string
+	coldStore        string
 	ctr              *graphdriver.RefCounter
 	quotaCtl         *quota.Control
+	imageStoresLock  sync.RWMutex // Protects options.imageStores after Init returns.
 	options          overlayOptions
 	naiveDiff        graphdriver.DiffDriver
 	supportsDType    bool
@@ -338,6 +343,12 @@ func Init(home string, options graphdriver.Options) (graphdriver.Driver, error)
 		}
 	}
 
+	if options.ColdStore != "" {
+		if err := os.MkdirAll(path.Join(options.ColdStore, filepath.Base(home), linkDir), 0o755); err != nil {
+			return nil, err
+		}
+	}
+
 	if err := os.MkdirAll(runhome, 0o700); err != nil {
 		return nil, err
 	}
@@ -436,6 +447,7 @@ func Init(home string, options graphdriver.Options) (graphdriver.Driver, error)
 		name:                  "overlay",
 		home:                  home,
 		imageStore:            options.ImageStore,
+		coldStore:             options.ColdStore,
 		runhome:               runhome,
 		ctr:                   graphdriver.NewRefCounter(graphdriver.NewFsChecker(fileSystemType)),
 		supportsDType:         supportsDType,
@@ -448,7 +460,13 @@ func Init(home string, options graphdriver.Options) (graphdriver.Driver, error)
 	}
 
 	d.naiveDiff = graphdriver.NewNaiveDiffDriver(d, graphdriver.NewNaiveLayerIDMapUpdater(d))
-	if backingFs == "xfs" {
+	if d.usingLoopbackQuota() {
+		// Limits are enforced by the size of each layer's filesystem image, so
+		// the backing filesystem does not need to support project quota.
+		if os.Geteuid() != 0 {
+			return nil, fmt.Errorf("overlay: quota_backend=%s requires root privileges", quotaBackendLoopback)
+		}
+	} else if backingFs == "xfs" {
 		// Try to enable project quota support over xfs.
 		if d.quotaCtl, err = quota.NewControl(home); err == nil {
 			projectQuotaSupported = true
@@ -495,6 +513,22 @@ func parseOptions(options []string) (*overlayOptions, error) {
 				return nil, err
 			}
 			o.quota.Inodes = inodes
+		case "quota_backend":
+			logrus.Debugf("overlay: quota_backend=%s", val)
+			switch val {
+			case "", quotaBackendProject, quotaBackendLoopback:
+				o.quotaBackend = val
+			default:
+				return nil, fmt.Errorf("overlay: unknown quota_backend %q, expected %q or %q", val, quotaBackendProject, quotaBackendLoopback)
+			}
+		case "loopback_fs":
+			logrus.Debugf("overlay: loopback_fs=%s", val)
+			switch val {
+			case "", "ext4", "xfs":
+				o.loopbackFs = val
+			default:
+				return nil, fmt.Errorf("overlay: unsupported loopback_fs %q, expected \"ext4\" or \"xfs\"", val)
+			}
 		case "imagestore", "additionalimagestore":
 			logrus.Debugf("overlay: imagestore=%s", val)
 			// Additional read only image stores to use for lower paths
@@ -598,6 +632,9 @@ func parseOptions(options []string) (*overlayOptions, error) {
 			return nil, fmt.Errorf("overlay: unknown option %s", key)
 		}
 	}
+	if o.quotaBackend == quotaBackendLoopback && o.quota.Inodes > 0 && o.quota.Size == 0 {
+		return nil, fmt.Errorf("overlay: inodes limit requires a size limit with quota_backend=%s", quotaBackendLoopback)
+	}
 	return o, nil
 }
 
@@ -827,6 +864,24 @@ func (d *Driver) Status() [][2]string {
 		{"Using metacopy", strconv.FormatBool(d.usingMetacopy)},
 		{"Supports shifting", strconv.FormatBool(d.SupportsShifting(nil, nil))},
 		{"Supports volatile", strconv.FormatBool(supportsVolatile)},
+		{"Quota backend", d.quotaBackendName()},
+	}
+}
+
+// quotaBackendName returns a description of the mechanism used to enforce
+// size and inodes limits on writable layers.
+func (d *Driver) quotaBackendName() string {
+	switch {
+	case d.usingLoopbackQuota():
+		fs := d.options.loopbackFs
+		if fs == "" {
+			fs = "ext4"
+		}
+		return quotaBackendLoopback + " (" + fs + ")"
+	case projectQuotaSupported:
+		return quotaBackendProject
+	default:
+		return "none"
 	}
 }
 
@@ -948,8 +1003,8 @@ func (d *Driver) CreateFromTemplate(id, template string, templateIDMappings *idt
 // CreateReadWrite creates a layer that is writable for use as a container
 // file system.
 func (d *Driver) CreateReadWrite(id, parent string, opts *graphdriver.CreateOpts) error {
-	if opts != nil && len(opts.StorageOpt) != 0 && !projectQuotaSupported {
-		return fmt.Errorf("--storage-opt is supported only for overlay over xfs with 'pquota' mount option")
+	if opts != nil && len(opts.StorageOpt) != 0 && !projectQuotaSupported && !d.usingLoopbackQuota() {
+		return fmt.Errorf("--storage-opt is supported only for overlay over xfs with 'pquota' mount option, or with quota_backend=%s", quotaBackendLoopback)
 	}
 
 	if opts == nil {
@@ -1067,23 +1122,23 @@ func (d *Driver) create(id, parent string, opts *graphdriver.CreateOpts, readOnl
 		}
 	}()
 
-	if d.quotaCtl != nil && !disableQuota {
-		quota := quota.Quota{}
-		if opts != nil && len(opts.StorageOpt) > 0 {
-			driver := &Driver{}
-			if err := d.parseStorageOpt(opts.StorageOpt, driver); err != nil {
-				return err
-			}
-			if driver.options.quota.Size > 0 {
-				quota.Size = driver.options.quota.Size
-			}
-			if driver.options.quota.Inodes > 0 {
-				quota.Inodes = driver.options.quota.Inodes
-			}
+	layerQuota := quota.Quota{}
+	if opts != nil && len(opts.StorageOpt) > 0 && !disableQuota {
+		driver := &Driver{}
+		if err := d.parseStorageOpt(opts.StorageOpt, driver); err != nil {
+			return err
+		}
+		if driver.options.quota.Size > 0 {
+			layerQuota.Size = driver.options.quota.Size
 		}
+		if driver.options.quota.Inodes > 0 {
+			layerQuota.Inodes = driver.options.quota.Inodes
+		}
+	}
+	if d.quotaCtl != nil && !disableQuota && !d.usingLoopbackQuota() {
 		// Set container disk quota limit
 		// If it is set to 0, we will track the disk usage, but not enforce a limit
-		if err := d.quotaCtl.SetQuota(dir, quota); err != nil {
+		if err := d.quotaCtl.SetQuota(dir, layerQuota); err != nil {
 			return err
 		}
 	}
@@ -1125,6 +1180,12 @@ func (d *Driver) create(id, parent string, opts *graphdriver.CreateOpts, readOnl
 		return err
 	}
 
+	if d.usingLoopbackQuota() && !disableQuota {
+		if err := d.createLoopbackUpper(dir, layerQuota); err != nil {
+			return err
+		}
+	}
+
 	// if no parent directory, create a dummy lower directory and skip writing a "lowers" file
 	if parent == "" {
 		return idtools.MkdirAs(path.Join(dir, "empty"), 0o700, forcedSt.IDs.UID, forcedSt.IDs.GID)
@@ -1209,6 +1270,9 @@ func (d *Driver) dir(id string) string {
 
 func (d *Driver) getAllImageStores() []string {
 	additionalImageStores := d.AdditionalImageStores()
+	if d.coldStore != "" {
+		additionalImageStores = append([]string{d.coldStore}, additionalImageStores...)
+	}
 	if d.imageStore != "" {
 		additionalImageStores = append([]string{d.imageStore}, additionalImageStores...)
 	}
@@ -1314,7 +1378,9 @@ func (d *Driver) removeCommon(id string, cleanup func(string) error) error {
 	dir := d.dir(id)
 	lid, err := os.ReadFile(path.Join(dir, "link"))
 	if err == nil {
-		linkPath := path.Join(d.home, linkDir, string(lid))
+		// The link is next to the layer's directory, which is not in
+		// d.home if the layer is in the image store or the cold store.
+		linkPath := path.Join(path.Dir(dir), linkDir, string(lid))
 		if err := cleanup(linkPath); err != nil {
 			logrus.Debugf("Failed to remove link: %v", err)
 		}
@@ -1322,6 +1388,10 @@ func (d *Driver) removeCommon(id string, cleanup func(string) error) error {
 
 	d.releaseAdditionalLayerByID(id)
 
+	if err := deactivateLoopbackUpper(dir); err != nil {
+		return err
+	}
+
 	if err := cleanup(dir); err != nil && !os.IsNotExist(err) {
 		return err
 	}
@@ -1504,6 +1574,7 @@ func (d *Driver) get(id string, disableShifting bool, options graphdriver.MountO
 	if count := d.ctr.Increment(mergedDir); count > 1 {
 		return mergedDir, nil
 	}
+	deactivateLoopback := func() error { return nil }
 	defer func() {
 		if retErr != nil {
 			if c := d.ctr.Decrement(mergedDir); c <= 0 {
@@ -1514,10 +1585,20 @@ func (d *Driver) get(id string, disableShifting bool, options graphdriver.MountO
 						logrus.Errorf("Unmounting %v: %v", mergedDir, mntErr)
 					}
 				}
+				if err := deactivateLoopback(); err != nil {
+					logrus.Errorf("Unmounting loopback upper directory for %v: %v", id, err)
+				}
 			}
 		}
 	}()
 
+	if !inAdditionalStore {
+		deactivateLoopback, err = d.activateLoopbackUpper(dir)
+		if err != nil {
+			return "", err
+		}
+	}
+
 	readWrite := !inAdditionalStore
 
 	if !d.SupportsShifting(options.UidMaps, options.GidMaps) || options.DisableShifting {
@@ -1758,6 +1839,16 @@ func (d *Driver) get(id string, disableShifting bool, options graphdriver.MountO
 	}
 
 	workdir := path.Join(dir, "work")
+	relUpperDir := path.Join(id, "diff")
+	relWorkDir := path.Join(id, "work")
+	if readWrite && hasLoopbackUpper(dir) {
+		// The kernel requires upperdir and workdir to be on the same mount, so
+		// use the directories on the layer's filesystem image directly.
+		diffDir = path.Join(dir, loopbackMountDir, "diff")
+		workdir = path.Join(dir, loopbackMountDir, "work")
+		relUpperDir = path.Join(id, loopbackMountDir, "diff")
+		relWorkDir = path.Join(id, loopbackMountDir, "work")
+	}
 
 	if d.options.mountProgram == "" && unshare.IsRootless() {
 		optsList = append(optsList, "userxattr")
@@ -1885,9 +1976,7 @@ func (d *Driver) get(id string, disableShifting bool, options graphdriver.MountO
 		// the mount data cannot fit within a page and relative links make the mount data much
 		// smaller at the expense of requiring a fork exec to chdir().
 		if readWrite {
-			diffDir := path.Join(id, "diff")
-			workDir := path.Join(id, "work")
-			opts = fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowerDirs, diffDir, workDir)
+			opts = fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowerDirs, relUpperDir, relWorkDir)
 		} else {
 			opts = fmt.Sprintf("lowerdir=%s:%s", diffDir, lowerDirs)
 		}
@@ -2043,6 +2132,9 @@ func (d *Driver) Put(id string) error {
 			logrus.Debugf("Failed to replace mountpoint %s overlay: %s: %v", id, mountpoint, err)
 			return fmt.Errorf("replacing mount point %q: %w", mountpoint, err)
 		}
+		if err := deactivateLoopbackUpper(dir); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -2439,6 +2531,16 @@ func (d *Driver) DiffSize(id string, idMappings *idtools.IDMappings, parent stri
 		return d.naiveDiff.DiffSize(id, idMappings, parent, parentMappings, mountLabel)
 	}
 
+	deactivate, err := d.activateLoopbackUpper(d.dir(id))
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err2 := deactivate(); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+
 	p, err := d.getDiffPath(id)
 	if err != nil {
 		return 0, err
@@ -2466,14 +2568,24 @@ func (d *Driver) Diff(id string, idMappings *idtools.IDMappings, parent string,
 	if err != nil {
 		return nil, err
 	}
+	deactivate, err := d.activateLoopbackUpper(d.dir(id))
+	if err != nil {
+		return nil, err
+	}
 	logrus.Debugf("Tar with options on %s", diffPath)
-	return archive.TarWithOptions(diffPath, &archive.TarOptions{
+	rc, err := archive.TarWithOptions(diffPath, &archive.TarOptions{
 		Compression:    archive.Uncompressed,
 		UIDMaps:        idMappings.UIDs(),
 		GIDMaps:        idMappings.GIDs(),
 		WhiteoutFormat: d.getWhiteoutFormat(),
 		WhiteoutData:   lowerDirs,
 	})
+	if err != nil {
+		return nil, errors.Join(err, deactivate())
+	}
+	return ioutils.NewReadCloserWrapper(rc, func() error {
+		return errors.Join(rc.Close(), deactivate())
+	}), nil
 }
 
 // Changes produces a list of changes between the specified layer
@@ -2492,6 +2604,15 @@ func (d *Driver) Changes(id string, idMappings *idtools.IDMappings, parent strin
 	if err != nil {
 		return nil, fmt.Errorf("failed to get lower diff path: %w", err)
 	}
+	deactivate, err := d.activateLoopbackUpper(d.dir(id))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := deactivate(); err != nil {
+			logrus.Debugf("Failed to unmount loopback upper directory for %s: %v", id, err)
+		}
+	}()
 
 	c, err := archive.OverlayChanges(layers, diffPath)
 	if err != nil {
@@ -2502,7 +2623,9 @@ func (d *Driver) Changes(id string, idMappings *idtools.IDMappings, parent strin
 
 // AdditionalImageStores returns additional image stores supported by the driver
 func (d *Driver) AdditionalImageStores() []string {
-	return d.options.imageStores
+	d.imageStoresLock.RLock()
+	defer d.imageStoresLock.RUnlock()
+	return slices.Clone(d.options.imageStores)
 }
 
 // UpdateLayerIDMap updates ID mappings in a from matching the ones specified
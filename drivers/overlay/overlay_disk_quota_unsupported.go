@@ -9,8 +9,12 @@ import (
 )
 
 // ReadWriteDiskUsage returns the disk usage of the writable directory for the ID.
-// For Overlay, it attempts to check the XFS quota for size, and falls back to
+// For Overlay, it checks the filesystem image of layers with loopback-backed
+// limits, then attempts to check the XFS quota for size, and falls back to
 // finding the size of the "diff" directory.
 func (d *Driver) ReadWriteDiskUsage(id string) (*directory.DiskUsage, error) {
+	if usage, ok, err := d.loopbackDiskUsage(id); ok {
+		return usage, err
+	}
 	return directory.Usage(path.Join(d.dir(id), "diff"))
 }
@@ -8,6 +8,7 @@ import (
 
 	graphdriver "github.com/containers/storage/drivers"
 	"github.com/containers/storage/drivers/graphtest"
+	"github.com/containers/storage/drivers/quota"
 	"github.com/containers/storage/pkg/archive"
 	"github.com/containers/storage/pkg/idtools"
 	"github.com/containers/storage/pkg/reexec"
@@ -177,3 +178,31 @@ func BenchmarkDiff20Layers(b *testing.B) {
 func BenchmarkRead20Layers(b *testing.B) {
 	graphtest.DriverBenchDeepLayerRead(b, 20, driverName)
 }
+
+func TestParseOptionsQuotaBackend(t *testing.T) {
+	opts, err := parseOptions([]string{"overlay.size=10M", "overlay.quota_backend=loopback", "overlay.loopback_fs=xfs"})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10*1024*1024), opts.quota.Size)
+	assert.Equal(t, quotaBackendLoopback, opts.quotaBackend)
+	assert.Equal(t, "xfs", opts.loopbackFs)
+
+	_, err = parseOptions([]string{"overlay.quota_backend=magic"})
+	assert.Error(t, err)
+	_, err = parseOptions([]string{"overlay.loopback_fs=vfat"})
+	assert.Error(t, err)
+	_, err = parseOptions([]string{"overlay.inodes=1000", "overlay.quota_backend=loopback"})
+	assert.Error(t, err)
+	_, err = parseOptions([]string{"overlay.inodes=1000", "overlay.size=10M", "overlay.quota_backend=loopback"})
+	assert.NoError(t, err)
+}
+
+func TestCreateLoopbackUpperInodesWithoutSize(t *testing.T) {
+	dir := t.TempDir()
+	d := &Driver{}
+	err := d.createLoopbackUpper(dir, quota.Quota{Inodes: 1000})
+	assert.Error(t, err)
+	assert.False(t, hasLoopbackUpper(dir))
+
+	require.NoError(t, d.createLoopbackUpper(dir, quota.Quota{}))
+	assert.False(t, hasLoopbackUpper(dir))
+}
@@ -0,0 +1,110 @@
+//go:build linux
+
+package overlay
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	graphdriver "github.com/containers/storage/drivers"
+	"github.com/containers/storage/drivers/copy"
+	"github.com/containers/storage/pkg/fileutils"
+	"github.com/containers/storage/pkg/system"
+)
+
+// snapshotsDir is the directory in a layer's directory which holds copies of
+// its "diff" directory made by CreateLayerSnapshot.
+const snapshotsDir = "snapshots"
+
+func (d *Driver) layerSnapshotDir(id, snapshot string) string {
+	return path.Join(d.dir(id), snapshotsDir, path.Base(snapshot))
+}
+
+// CreateLayerSnapshot copies the upper directory of the layer, using reflinks
+// where the backing filesystem supports them.
+func (d *Driver) CreateLayerSnapshot(id, snapshot string) (retErr error) {
+	dir := d.dir(id)
+	if err := fileutils.Exists(path.Join(dir, "diff")); err != nil {
+		return err
+	}
+	snapDir := d.layerSnapshotDir(id, snapshot)
+	if err := fileutils.Exists(snapDir); err == nil {
+		return fmt.Errorf("overlay: snapshot %q of layer %q already exists", snapshot, id)
+	}
+	if err := os.MkdirAll(path.Dir(snapDir), 0o700); err != nil {
+		return err
+	}
+
+	deactivate, err := d.activateLoopbackUpper(dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := deactivate(); err != nil {
+			retErr = errors.Join(retErr, err)
+		}
+	}()
+
+	if err := copy.DirCopy(path.Join(dir, "diff"), snapDir, copy.Content, true); err != nil {
+		if err2 := system.EnsureRemoveAll(snapDir); err2 != nil {
+			err = errors.Join(err, err2)
+		}
+		return fmt.Errorf("overlay: copying layer %q to snapshot %q: %w", id, snapshot, err)
+	}
+	return nil
+}
+
+// RestoreLayerSnapshot replaces the contents of the layer's upper directory
+// with a copy of the snapshot.  Other snapshots are never discarded.
+func (d *Driver) RestoreLayerSnapshot(id, snapshot string) (_ []string, retErr error) {
+	dir := d.dir(id)
+	snapDir := d.layerSnapshotDir(id, snapshot)
+	if err := fileutils.Exists(snapDir); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("overlay: snapshot %q of layer %q: %w", snapshot, id, graphdriver.ErrLayerUnknown)
+		}
+		return nil, err
+	}
+
+	deactivate, err := d.activateLoopbackUpper(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := deactivate(); err != nil {
+			retErr = errors.Join(retErr, err)
+		}
+	}()
+
+	// The "diff" directory may be a mount point, so empty it rather than
+	// replacing it.
+	diffDir := path.Join(dir, "diff")
+	if err := removeDirContents(diffDir); err != nil {
+		return nil, err
+	}
+	if err := copy.DirCopy(snapDir, diffDir, copy.Content, true); err != nil {
+		return nil, fmt.Errorf("overlay: restoring layer %q from snapshot %q: %w", id, snapshot, err)
+	}
+	return nil, nil
+}
+
+// RemoveLayerSnapshot removes the copy of the layer's upper directory.
+func (d *Driver) RemoveLayerSnapshot(id, snapshot string) error {
+	return system.EnsureRemoveAll(d.layerSnapshotDir(id, snapshot))
+}
+
+// removeDirContents removes everything in dir, but not dir itself.
+func removeDirContents(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := system.EnsureRemoveAll(path.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
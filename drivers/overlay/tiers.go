@@ -0,0 +1,130 @@
+//go:build linux
+
+package overlay
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	graphdriver "github.com/containers/storage/drivers"
+	"github.com/containers/storage/drivers/copy"
+	"github.com/containers/storage/pkg/fileutils"
+	"github.com/containers/storage/pkg/idtools"
+)
+
+// ColdStore returns the directory to which DemoteLayer moves layers, or "".
+func (d *Driver) ColdStore() string {
+	return d.coldStore
+}
+
+// coldStoreHome returns the directory in the cold store which holds layers.
+func (d *Driver) coldStoreHome() string {
+	return path.Join(d.coldStore, d.name)
+}
+
+// LayerInColdStore returns true if the layer's data is in the cold store.
+func (d *Driver) LayerInColdStore(id string) bool {
+	if d.coldStore == "" {
+		return false
+	}
+	dir := d.dir(id)
+	return path.Dir(dir) == d.coldStoreHome() && fileutils.Exists(dir) == nil
+}
+
+// DemoteLayer moves the layer's directory, and the link to its diff
+// directory, to the cold store.
+func (d *Driver) DemoteLayer(id string) error {
+	if d.coldStore == "" {
+		return fmt.Errorf("overlay: no cold store is configured: %w", graphdriver.ErrNotSupported)
+	}
+	dir := d.dir(id)
+	if err := fileutils.Exists(dir); err != nil {
+		return err
+	}
+	switch path.Dir(dir) {
+	case d.coldStoreHome():
+		return nil
+	case d.home, d.homeDirForImageStore():
+	default:
+		return fmt.Errorf("overlay: layer %q is in a read-only image store", id)
+	}
+	return d.moveLayer(id, dir, d.coldStoreHome())
+}
+
+// StageDemotion copies the layer's directory to the cold store's staging
+// directory.
+func (d *Driver) StageDemotion(id string) error {
+	if d.coldStore == "" {
+		return fmt.Errorf("overlay: no cold store is configured: %w", graphdriver.ErrNotSupported)
+	}
+	if err := graphdriver.StageLayerDir(d.dir(id), d.stagingDir(id, d.coldStoreHome()), copyLayerDir); err != nil {
+		return fmt.Errorf("overlay: staging layer %q: %w", id, err)
+	}
+	return nil
+}
+
+// DiscardStagedDemotion removes a copy made by StageDemotion.
+func (d *Driver) DiscardStagedDemotion(id string) error {
+	if d.coldStore == "" {
+		return nil
+	}
+	return graphdriver.DiscardStagedLayerDir(d.stagingDir(id, d.coldStoreHome()))
+}
+
+// stagingDir returns the directory to which the layer's directory is copied
+// before it's moved into home.
+func (d *Driver) stagingDir(id, home string) string {
+	return path.Join(home, tempDirName, "tier-"+id)
+}
+
+// copyLayerDir copies a layer's directory for moveLayer.
+func copyLayerDir(src, dst string) error {
+	return copy.DirCopy(src, dst, copy.Content, true)
+}
+
+// PromoteLayer moves the layer's directory, and the link to its diff
+// directory, from the cold store back to where read-only layers are created.
+func (d *Driver) PromoteLayer(id string) error {
+	if d.coldStore == "" {
+		return fmt.Errorf("overlay: no cold store is configured: %w", graphdriver.ErrNotSupported)
+	}
+	if !d.LayerInColdStore(id) {
+		return nil
+	}
+	return d.moveLayer(id, d.dir(id), d.homeDirForImageStore())
+}
+
+// moveLayer moves the layer's directory, dir, to home, and replaces the link
+// to its diff directory in the directory which held it with one in home.
+func (d *Driver) moveLayer(id, dir, home string) error {
+	lid, err := os.ReadFile(path.Join(dir, "link"))
+	if err != nil {
+		return err
+	}
+	dest := path.Join(home, id)
+	// The layer was found in dir, so anything at dest was left behind by
+	// an earlier attempt which didn't finish.
+	if err := os.RemoveAll(dest); err != nil {
+		return err
+	}
+	if err := graphdriver.MoveLayerDir(dir, dest, d.stagingDir(id, home), copyLayerDir); err != nil {
+		return fmt.Errorf("overlay: moving layer %q: %w", id, err)
+	}
+	if err := idtools.MkdirAllAs(path.Join(home, linkDir), 0o755, 0, 0); err != nil {
+		return err
+	}
+	newLink := path.Join(home, linkDir, string(lid))
+	if err := os.Remove(newLink); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Symlink(path.Join("..", id, "diff"), newLink); err != nil {
+		return err
+	}
+	oldLink := path.Join(path.Dir(dir), linkDir, string(lid))
+	if err := os.Remove(oldLink); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
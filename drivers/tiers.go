@@ -0,0 +1,110 @@
+package graphdriver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/containers/storage/pkg/fileutils"
+)
+
+// StageLayerDir copies a layer's directory, src, to staging, which must be on
+// the same file system as the directory the layer will be moved to, so that a
+// later MoveLayerDir only has to rename the copy into place.  It doesn't
+// modify src, so it can be used without holding locks which would keep the
+// layer from being used.  If staging is on the same file system as src, no
+// copy is needed, and none is made.
+func StageLayerDir(src, staging string, copyDir func(src, dst string) error) error {
+	if err := DiscardStagedLayerDir(staging); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(staging), 0o700); err != nil {
+		return err
+	}
+	// Renaming an empty directory is a cheap way to find out if renaming
+	// src would work.
+	probe, err := os.MkdirTemp(filepath.Dir(src), ".tier-probe-")
+	if err != nil {
+		return err
+	}
+	err = os.Rename(probe, staging)
+	if err == nil {
+		return os.Remove(staging)
+	}
+	if rmErr := os.Remove(probe); rmErr != nil {
+		return errors.Join(err, rmErr)
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	return copyLayerDir(src, staging, copyDir)
+}
+
+// DiscardStagedLayerDir removes a copy made by StageLayerDir, or left behind
+// by MoveLayerDir, which isn't going to be used, along with any incomplete
+// copies.
+func DiscardStagedLayerDir(staging string) error {
+	partials, err := filepath.Glob(staging + ".partial-*")
+	if err != nil {
+		return err
+	}
+	errs := []error{os.RemoveAll(staging)}
+	for _, partial := range partials {
+		errs = append(errs, os.RemoveAll(partial))
+	}
+	return errors.Join(errs...)
+}
+
+// copyLayerDir copies src to staging.  The copy is made in a uniquely-named
+// directory next to staging and renamed once it is complete, so that an
+// interrupted copy, or one which another process is making at the same time,
+// is never mistaken for a complete one.
+func copyLayerDir(src, staging string, copyDir func(src, dst string) error) (err error) {
+	if err := os.MkdirAll(filepath.Dir(staging), 0o700); err != nil {
+		return err
+	}
+	partial, err := os.MkdirTemp(filepath.Dir(staging), filepath.Base(staging)+".partial-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rmErr := os.RemoveAll(partial); rmErr != nil {
+			err = errors.Join(err, rmErr)
+		}
+	}()
+	copied := filepath.Join(partial, "layer")
+	if err := copyDir(src, copied); err != nil {
+		return fmt.Errorf("copying %q to %q: %w", src, staging, err)
+	}
+	return os.Rename(copied, staging)
+}
+
+// MoveLayerDir moves a layer's directory from src to dst, which must not
+// exist, for use by implementations of TieredDriver.  If the directories are
+// on different file systems, src is copied to staging, which must be on the
+// same file system as dst and which is renamed to dst before src is removed,
+// so that dst is never incomplete.  A copy which StageLayerDir already made
+// at staging is used instead of copying src again.
+func MoveLayerDir(src, dst, staging string, copyDir func(src, dst string) error) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+		return err
+	}
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := fileutils.Exists(staging); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := copyLayerDir(src, staging, copyDir); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(staging, dst); err != nil {
+		return err
+	}
+	return os.RemoveAll(src)
+}
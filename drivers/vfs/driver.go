@@ -6,8 +6,10 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 
 	graphdriver "github.com/containers/storage/drivers"
 	"github.com/containers/storage/internal/dedup"
@@ -39,11 +41,17 @@ func Init(home string, options graphdriver.Options) (graphdriver.Driver, error)
 		name:       "vfs",
 		home:       home,
 		imageStore: options.ImageStore,
+		coldStore:  options.ColdStore,
 	}
 
 	if err := os.MkdirAll(filepath.Join(home, "dir"), 0o700); err != nil {
 		return nil, err
 	}
+	if d.coldStore != "" {
+		if err := os.MkdirAll(filepath.Join(d.coldStore, d.String(), "dir"), 0o700); err != nil {
+			return nil, err
+		}
+	}
 	for _, option := range options.DriverOptions {
 		key, val, err := parsers.ParseKeyValueOpt(option)
 		if err != nil {
@@ -81,11 +89,13 @@ func Init(home string, options graphdriver.Options) (graphdriver.Driver, error)
 type Driver struct {
 	name              string
 	home              string
+	imageStoresLock   sync.RWMutex // Protects additionalHomes after Init returns.
 	additionalHomes   []string
 	ignoreChownErrors bool
 	naiveDiff         graphdriver.DiffDriver
 	updater           graphdriver.LayerIDMapUpdater
 	imageStore        string
+	coldStore         string
 }
 
 func (d *Driver) String() string {
@@ -224,10 +234,13 @@ func (d *Driver) dir2(id string, useImageStore bool) string {
 		homedir = filepath.Join(d.home, "dir", filepath.Base(id))
 	}
 	if err := fileutils.Exists(homedir); err != nil {
-		additionalHomes := d.additionalHomes[:]
+		additionalHomes := d.AdditionalImageStores()
 		if d.imageStore != "" {
 			additionalHomes = append(additionalHomes, d.imageStore)
 		}
+		if d.coldStore != "" {
+			additionalHomes = append(additionalHomes, d.coldStore)
+		}
 		for _, home := range additionalHomes {
 			candidate := filepath.Join(home, d.String(), "dir", filepath.Base(id))
 			fi, err := os.Stat(candidate)
@@ -245,6 +258,9 @@ func (d *Driver) dir(id string) string {
 
 // Remove deletes the content from the directory for a given id.
 func (d *Driver) Remove(id string) error {
+	if err := system.EnsureRemoveAll(d.layerSnapshotsDir(id)); err != nil {
+		return err
+	}
 	return system.EnsureRemoveAll(d.dir(id))
 }
 
@@ -277,6 +293,11 @@ func (d *Driver) DeferredRemove(id string) (tempdir.CleanupTempDirFunc, error) {
 		return nil, err
 	}
 
+	if snapDir := d.layerSnapshotsDir(id); fileutils.Exists(snapDir) == nil {
+		if err := t.StageDeletion(snapDir); err != nil {
+			return t.Cleanup, err
+		}
+	}
 	layerDir := d.dir(id)
 	if err := t.StageDeletion(layerDir); err != nil {
 		return t.Cleanup, err
@@ -346,8 +367,10 @@ func (d *Driver) ListLayers() ([]string, error) {
 
 // AdditionalImageStores returns additional image stores supported by the driver
 func (d *Driver) AdditionalImageStores() []string {
+	d.imageStoresLock.RLock()
+	defer d.imageStoresLock.RUnlock()
 	if len(d.additionalHomes) > 0 {
-		return d.additionalHomes
+		return slices.Clone(d.additionalHomes)
 	}
 	return nil
 }
@@ -0,0 +1,45 @@
+package vfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// AddAdditionalImageStore adds store to the end of the list of directories in
+// which layers are looked for when they aren't found in the driver's home.
+func (d *Driver) AddAdditionalImageStore(store string) error {
+	store = filepath.Clean(store)
+	if !filepath.IsAbs(store) {
+		return fmt.Errorf("vfs: image path %q is not absolute.  Can not be relative", store)
+	}
+	st, err := os.Stat(store)
+	if err != nil {
+		return fmt.Errorf("vfs: can't stat imageStore dir %s: %w", store, err)
+	}
+	if !st.IsDir() {
+		return fmt.Errorf("vfs: image path %q must be a directory", store)
+	}
+	d.imageStoresLock.Lock()
+	defer d.imageStoresLock.Unlock()
+	if slices.Contains(d.additionalHomes, store) {
+		return fmt.Errorf("vfs: image path %q is already in use", store)
+	}
+	d.additionalHomes = append(d.additionalHomes, store)
+	return nil
+}
+
+// RemoveAdditionalImageStore removes store from the list of directories in
+// which layers are looked for.
+func (d *Driver) RemoveAdditionalImageStore(store string) error {
+	store = filepath.Clean(store)
+	d.imageStoresLock.Lock()
+	defer d.imageStoresLock.Unlock()
+	i := slices.Index(d.additionalHomes, store)
+	if i == -1 {
+		return fmt.Errorf("vfs: image path %q is not in use", store)
+	}
+	d.additionalHomes = slices.Delete(d.additionalHomes, i, i+1)
+	return nil
+}
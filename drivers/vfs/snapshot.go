@@ -0,0 +1,82 @@
+package vfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	graphdriver "github.com/containers/storage/drivers"
+	"github.com/containers/storage/pkg/fileutils"
+	"github.com/containers/storage/pkg/system"
+)
+
+// snapshotsDir is the directory under the driver's home which holds copies
+// of layers made by CreateLayerSnapshot, one subdirectory per layer.
+const snapshotsDir = "snapshots"
+
+func (d *Driver) layerSnapshotsDir(id string) string {
+	return filepath.Join(d.home, snapshotsDir, filepath.Base(id))
+}
+
+func (d *Driver) layerSnapshotDir(id, snapshot string) string {
+	return filepath.Join(d.layerSnapshotsDir(id), filepath.Base(snapshot))
+}
+
+// CreateLayerSnapshot copies the contents of the layer.
+func (d *Driver) CreateLayerSnapshot(id, snapshot string) error {
+	dir := d.dir(id)
+	if err := fileutils.Exists(dir); err != nil {
+		return err
+	}
+	snapDir := d.layerSnapshotDir(id, snapshot)
+	if err := fileutils.Exists(snapDir); err == nil {
+		return fmt.Errorf("vfs: snapshot %q of layer %q already exists", snapshot, id)
+	}
+	if err := os.MkdirAll(filepath.Dir(snapDir), 0o700); err != nil {
+		return err
+	}
+	if err := dirCopy(dir, snapDir); err != nil {
+		if err2 := system.EnsureRemoveAll(snapDir); err2 != nil {
+			err = fmt.Errorf("%v: %w", err2, err)
+		}
+		return fmt.Errorf("vfs: copying layer %q to snapshot %q: %w", id, snapshot, err)
+	}
+	return nil
+}
+
+// RestoreLayerSnapshot replaces the contents of the layer with a copy of the
+// snapshot.  Other snapshots are never discarded.
+func (d *Driver) RestoreLayerSnapshot(id, snapshot string) ([]string, error) {
+	dir := d.dir(id)
+	snapDir := d.layerSnapshotDir(id, snapshot)
+	if err := fileutils.Exists(snapDir); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("vfs: snapshot %q of layer %q: %w", snapshot, id, graphdriver.ErrLayerUnknown)
+		}
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if err := system.EnsureRemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return nil, err
+		}
+	}
+	if err := dirCopy(snapDir, dir); err != nil {
+		return nil, fmt.Errorf("vfs: restoring layer %q from snapshot %q: %w", id, snapshot, err)
+	}
+	return nil, nil
+}
+
+// RemoveLayerSnapshot removes the copy of the layer.
+func (d *Driver) RemoveLayerSnapshot(id, snapshot string) error {
+	if err := system.EnsureRemoveAll(d.layerSnapshotDir(id, snapshot)); err != nil {
+		return err
+	}
+	// Clean up the per-layer directory once it's empty; this fails
+	// harmlessly while the layer has other snapshots.
+	_ = os.Remove(d.layerSnapshotsDir(id))
+	return nil
+}
@@ -0,0 +1,105 @@
+package vfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	graphdriver "github.com/containers/storage/drivers"
+	"github.com/containers/storage/pkg/fileutils"
+)
+
+// ColdStore returns the directory to which DemoteLayer moves layers, or "".
+func (d *Driver) ColdStore() string {
+	return d.coldStore
+}
+
+// storeLayerDir returns the directory which would hold the layer in the
+// specified store, which is laid out like a graph root.
+func (d *Driver) storeLayerDir(store, id string) string {
+	return filepath.Join(store, d.String(), "dir", filepath.Base(id))
+}
+
+// LayerInColdStore returns true if the layer's data is in the cold store.
+func (d *Driver) LayerInColdStore(id string) bool {
+	if d.coldStore == "" {
+		return false
+	}
+	dir := d.dir(id)
+	return dir == d.storeLayerDir(d.coldStore, id) && fileutils.Exists(dir) == nil
+}
+
+// DemoteLayer moves the layer's directory to the cold store.
+func (d *Driver) DemoteLayer(id string) error {
+	if d.coldStore == "" {
+		return fmt.Errorf("vfs: no cold store is configured: %w", graphdriver.ErrNotSupported)
+	}
+	dir := d.dir(id)
+	if err := fileutils.Exists(dir); err != nil {
+		return err
+	}
+	if dir == d.storeLayerDir(d.coldStore, id) {
+		return nil
+	}
+	if dir != filepath.Join(d.home, "dir", filepath.Base(id)) && (d.imageStore == "" || dir != d.storeLayerDir(d.imageStore, id)) {
+		return fmt.Errorf("vfs: layer %q is in a read-only image store", id)
+	}
+	return d.moveLayer(id, dir, filepath.Join(d.coldStore, d.String()))
+}
+
+// StageDemotion copies the layer's directory to the cold store's staging
+// directory.
+func (d *Driver) StageDemotion(id string) error {
+	if d.coldStore == "" {
+		return fmt.Errorf("vfs: no cold store is configured: %w", graphdriver.ErrNotSupported)
+	}
+	if err := graphdriver.StageLayerDir(d.dir(id), d.stagingDir(id, filepath.Join(d.coldStore, d.String())), dirCopy); err != nil {
+		return fmt.Errorf("vfs: staging layer %q: %w", id, err)
+	}
+	return nil
+}
+
+// DiscardStagedDemotion removes a copy made by StageDemotion.
+func (d *Driver) DiscardStagedDemotion(id string) error {
+	if d.coldStore == "" {
+		return nil
+	}
+	return graphdriver.DiscardStagedLayerDir(d.stagingDir(id, filepath.Join(d.coldStore, d.String())))
+}
+
+// stagingDir returns the directory to which the layer's directory is copied
+// before it's moved into home.
+func (d *Driver) stagingDir(id, home string) string {
+	return filepath.Join(home, tempDirName, "tier-"+filepath.Base(id))
+}
+
+// PromoteLayer moves the layer's directory from the cold store back to where
+// read-only layers are created.
+func (d *Driver) PromoteLayer(id string) error {
+	if d.coldStore == "" {
+		return fmt.Errorf("vfs: no cold store is configured: %w", graphdriver.ErrNotSupported)
+	}
+	if !d.LayerInColdStore(id) {
+		return nil
+	}
+	dest := d.home
+	if d.imageStore != "" {
+		dest = filepath.Join(d.imageStore, d.String())
+	}
+	return d.moveLayer(id, d.dir(id), dest)
+}
+
+// moveLayer moves the layer's directory, dir, into home, which is either
+// d.home or a directory laid out like it.
+func (d *Driver) moveLayer(id, dir, home string) error {
+	dest := filepath.Join(home, "dir", filepath.Base(id))
+	// The layer was found in dir, so anything at dest was left behind by
+	// an earlier attempt which didn't finish.
+	if err := os.RemoveAll(dest); err != nil {
+		return err
+	}
+	if err := graphdriver.MoveLayerDir(dir, dest, d.stagingDir(id, home), dirCopy); err != nil {
+		return fmt.Errorf("vfs: moving layer %q: %w", id, err)
+	}
+	return nil
+}
@@ -225,6 +225,18 @@ func (d *Driver) Metadata(id string) (map[string]string, error) {
 }
 
 func (d *Driver) cloneFilesystem(name, parentName string) error {
+	// Prefer the parent's long-lived snapshot, so that NativeDiff streams
+	// of the new layer can be received on top of a copy of the parent.
+	if snapshot, modified, err := layerSnapshot(parentName); err == nil && !modified {
+		_, err = snapshot.Clone(name, map[string]string{"mountpoint": "legacy"})
+		if err == nil {
+			d.Lock()
+			d.filesystemsCache[name] = true
+			d.Unlock()
+		}
+		return err
+	}
+
 	snapshotName := fmt.Sprintf("%d", time.Now().Nanosecond())
 	parentDataset := zfs.Dataset{Name: parentName}
 	snapshot, err := parentDataset.Snapshot(snapshotName /*recursive */, false)
@@ -528,3 +540,55 @@ func (d *Driver) Dedup(req graphdriver.DedupArgs) (graphdriver.DedupResult, erro
 func (d *Driver) GetTempDirRootDirs() []string {
 	return []string{}
 }
+
+// CreateLayerSnapshot takes a ZFS snapshot of the layer's dataset.
+func (d *Driver) CreateLayerSnapshot(id, snapshot string) error {
+	dataset := zfs.Dataset{Name: d.zfsPath(id)}
+	_, err := dataset.Snapshot(snapshot /*recursive */, false)
+	return err
+}
+
+// RestoreLayerSnapshot rolls the layer's dataset back to a ZFS snapshot.  ZFS
+// can only roll back to the most recent snapshot, so any snapshots taken after
+// this one are destroyed, and their names returned.
+func (d *Driver) RestoreLayerSnapshot(id, snapshot string) ([]string, error) {
+	name := d.zfsPath(id)
+	snap, err := zfs.GetDataset(name + "@" + snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("zfs: snapshot %q of layer %q: %v: %w", snapshot, id, err, graphdriver.ErrLayerUnknown)
+	}
+	dataset := zfs.Dataset{Name: name}
+	before, err := dataset.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	if err := snap.Rollback(true); err != nil {
+		return nil, err
+	}
+	after, err := dataset.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	remaining := make(map[string]struct{}, len(after))
+	for _, s := range after {
+		remaining[s.Name] = struct{}{}
+	}
+	var discarded []string
+	for _, s := range before {
+		if _, ok := remaining[s.Name]; !ok {
+			discarded = append(discarded, strings.TrimPrefix(s.Name, name+"@"))
+		}
+	}
+	return discarded, nil
+}
+
+// RemoveLayerSnapshot destroys a ZFS snapshot of the layer's dataset.
+func (d *Driver) RemoveLayerSnapshot(id, snapshot string) error {
+	snap, err := zfs.GetDataset(d.zfsPath(id) + "@" + snapshot)
+	if err != nil {
+		// As in Remove, tolerate snapshots which are already gone.
+		logrus.WithField("storage-driver", "zfs").Debugf("Snapshot %s of layer %s has already been removed: %v", snapshot, id, err)
+		return nil
+	}
+	return snap.Destroy(zfs.DestroyDefault)
+}
@@ -0,0 +1,126 @@
+//go:build linux || freebsd
+
+package zfs
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	zfs "github.com/mistifyio/go-zfs/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// layerSnapshotName is the name of the snapshot of a layer's dataset which
+// its child layers are cloned from, and which NativeDiff sends.  Because
+// "zfs receive" keeps the snapshot it receives, a layer received from another
+// store has the same snapshot, so the incremental streams of its children
+// can be received on top of it.
+const layerSnapshotName = "layer"
+
+// layerSnapshot returns the layerSnapshotName snapshot of the dataset,
+// creating it if it doesn't exist yet, or replacing it if the dataset has
+// been modified since it was taken and it is not the origin of any clones.
+// The returned boolean is true if the dataset has been modified since the
+// returned snapshot was taken.
+func layerSnapshot(name string) (*zfs.Dataset, bool, error) {
+	dataset := zfs.Dataset{Name: name}
+	snapshot, err := zfs.GetDataset(name + "@" + layerSnapshotName)
+	if err != nil {
+		snapshot, err = dataset.Snapshot(layerSnapshotName /*recursive */, false)
+		return snapshot, false, err
+	}
+	written, err := dataset.GetProperty("written@" + layerSnapshotName)
+	if err != nil {
+		return nil, false, err
+	}
+	if written == "0" {
+		return snapshot, false, nil
+	}
+	clones, err := snapshot.GetProperty("clones")
+	if err != nil {
+		return nil, false, err
+	}
+	if clones != "" && clones != "-" {
+		return snapshot, true, nil
+	}
+	if err := snapshot.Destroy(zfs.DestroyDefault); err != nil {
+		return nil, false, err
+	}
+	snapshot, err = dataset.Snapshot(layerSnapshotName /*recursive */, false)
+	return snapshot, false, err
+}
+
+// NativeDiff returns a "zfs send" stream of the layer's dataset.  For a layer
+// with a parent, it is an incremental stream from the snapshot of the
+// parent's dataset which the layer was cloned from.
+func (d *Driver) NativeDiff(id, parent string) (io.ReadCloser, error) {
+	name := d.zfsPath(id)
+	snapshot, modified, err := layerSnapshot(name)
+	if err != nil {
+		return nil, err
+	}
+	if modified {
+		return nil, fmt.Errorf("zfs: layer %q has been modified since it was last sent or used as a parent", id)
+	}
+	var base *zfs.Dataset
+	if parent != "" {
+		dataset := zfs.Dataset{Name: name}
+		origin, err := dataset.GetProperty("origin")
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(origin, d.zfsPath(parent)+"@") {
+			return nil, fmt.Errorf("zfs: layer %q is not a clone of layer %q", id, parent)
+		}
+		if base, err = zfs.GetDataset(origin); err != nil {
+			return nil, err
+		}
+	}
+
+	preader, pwriter := io.Pipe()
+	go func() {
+		if base != nil {
+			pwriter.CloseWithError(snapshot.IncrementalSend(base, pwriter))
+		} else {
+			pwriter.CloseWithError(snapshot.SendSnapshot(pwriter))
+		}
+	}()
+	return preader, nil
+}
+
+// ApplyNativeDiff replaces the layer's dataset with one received from a
+// "zfs send" stream produced by NativeDiff.
+func (d *Driver) ApplyNativeDiff(id, parent string, diff io.Reader) error {
+	name := d.zfsPath(id)
+	// "zfs receive" insists on creating the dataset itself.
+	dataset := zfs.Dataset{Name: name}
+	if err := dataset.Destroy(zfs.DestroyRecursive); err != nil {
+		return err
+	}
+	d.Lock()
+	delete(d.filesystemsCache, name)
+	d.Unlock()
+
+	logrus.WithField("storage-driver", "zfs").Debugf("zfs receive -u -o mountpoint=legacy %s", name)
+	cmd := exec.Command("zfs", "receive", "-u", "-o", "mountpoint=legacy", name)
+	cmd.Stdin = diff
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("zfs: receiving layer %q: %s: %w", id, strings.TrimSpace(string(out)), err)
+	}
+	d.Lock()
+	d.filesystemsCache[name] = true
+	d.Unlock()
+
+	if parent != "" {
+		origin, err := dataset.GetProperty("origin")
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(origin, d.zfsPath(parent)+"@") {
+			return fmt.Errorf("zfs: received layer %q is a clone of %q, not of layer %q", id, origin, parent)
+		}
+	}
+	return nil
+}
@@ -3,9 +3,16 @@
 package zfs
 
 import (
+	"os"
+	"os/exec"
+	"path/filepath"
 	"testing"
 
+	graphdriver "github.com/containers/storage/drivers"
 	"github.com/containers/storage/drivers/graphtest"
+	"github.com/containers/storage/pkg/stringid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // This avoids creating a new driver for each test if all tests are run
@@ -41,3 +48,95 @@ func TestZfsEcho(t *testing.T) {
 func TestZfsTeardown(t *testing.T) {
 	graphtest.PutDriver(t)
 }
+
+// newFileBackedPool creates a ZFS pool backed by a sparse file, and returns
+// its name.
+func newFileBackedPool(t *testing.T) string {
+	if os.Geteuid() != 0 {
+		t.Skip("creating a ZFS pool requires root")
+	}
+	if _, err := exec.LookPath("zpool"); err != nil {
+		t.Skip("zpool command is not available")
+	}
+	dir := t.TempDir()
+	image := filepath.Join(dir, "pool.img")
+	f, err := os.Create(image)
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(256*1024*1024))
+	require.NoError(t, f.Close())
+	pool := "storagetest" + stringid.GenerateRandomID()[:8]
+	if out, err := exec.Command("zpool", "create", "-m", filepath.Join(dir, "mnt"), pool, image).CombinedOutput(); err != nil {
+		t.Skipf("creating a file-backed ZFS pool: %v: %s", err, out)
+	}
+	t.Cleanup(func() {
+		if out, err := exec.Command("zpool", "destroy", "-f", pool).CombinedOutput(); err != nil {
+			t.Logf("destroying ZFS pool %s: %v: %s", pool, err, out)
+		}
+	})
+	return pool
+}
+
+func newPoolDriver(t *testing.T, dataset string) graphdriver.Driver {
+	out, err := exec.Command("zfs", "create", dataset).CombinedOutput()
+	require.NoError(t, err, string(out))
+	d, err := graphdriver.GetDriver("zfs", graphdriver.Options{
+		Root:          filepath.Join(t.TempDir(), "zfs"),
+		DriverOptions: []string{"zfs.fsname=" + dataset},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, d.Cleanup()) })
+	return d
+}
+
+func TestZfsNativeDiff(t *testing.T) {
+	pool := newFileBackedPool(t)
+	src := newPoolDriver(t, pool+"/src")
+	dst := newPoolDriver(t, pool+"/dst")
+	srcDriver, ok := graphdriver.AsNativeDiffDriver(src)
+	require.True(t, ok)
+	dstDriver, ok := graphdriver.AsNativeDiffDriver(dst)
+	require.True(t, ok)
+
+	writeFile := func(d graphdriver.Driver, id, name, contents string) {
+		dir, err := d.Get(id, graphdriver.MountOpts{})
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644))
+		require.NoError(t, d.Put(id))
+	}
+	transfer := func(id, parent string) {
+		require.NoError(t, dst.Create(id, parent, nil))
+		stream, err := srcDriver.NativeDiff(id, parent)
+		require.NoError(t, err)
+		defer stream.Close()
+		require.NoError(t, dstDriver.ApplyNativeDiff(id, parent, stream))
+	}
+
+	base := stringid.GenerateRandomID()
+	require.NoError(t, src.Create(base, "", nil))
+	writeFile(src, base, "base", "base contents")
+	child := stringid.GenerateRandomID()
+	require.NoError(t, src.Create(child, base, nil))
+	writeFile(src, child, "child", "child contents")
+
+	transfer(base, "")
+	transfer(child, base)
+
+	dir, err := dst.Get(child, graphdriver.MountOpts{})
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, dst.Put(child)) }()
+	for name, expected := range map[string]string{"base": "base contents", "child": "child contents"} {
+		contents, err := os.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(contents))
+	}
+
+	// A layer can't be received on top of anything other than a copy of
+	// the parent it was sent from.
+	other := stringid.GenerateRandomID()
+	require.NoError(t, dst.Create(other, "", nil))
+	stream, err := srcDriver.NativeDiff(child, base)
+	require.NoError(t, err)
+	defer stream.Close()
+	require.NoError(t, dst.Create(child+"-copy", other, nil))
+	assert.Error(t, dstDriver.ApplyNativeDiff(child+"-copy", other, stream))
+}
@@ -23,12 +23,16 @@ var (
 	ErrImageUnknown = types.ErrImageUnknown
 	// ErrImageUsedByContainer is returned when the caller attempts to delete an image that is a container's image.
 	ErrImageUsedByContainer = types.ErrImageUsedByContainer
+	// ErrImagePinned is returned when the caller attempts to remove an image that has been pinned.
+	ErrImagePinned = types.ErrImagePinned
 	// ErrIncompleteOptions is returned when the caller attempts to initialize a Store without providing required information.
 	ErrIncompleteOptions = types.ErrIncompleteOptions
 	// ErrInvalidBigDataName indicates that the name for a big data item is not acceptable; it may be empty.
 	ErrInvalidBigDataName = types.ErrInvalidBigDataName
 	// ErrLayerHasChildren is returned when the caller attempts to delete a layer that has children.
 	ErrLayerHasChildren = types.ErrLayerHasChildren
+	// ErrLayerInUse is returned when the caller attempts to move a layer which is mounted, or which a mounted layer is based on.
+	ErrLayerInUse = types.ErrLayerInUse
 	// ErrLayerNotMounted is returned when the requested information can only be computed for a mounted layer, and the layer is not mounted.
 	ErrLayerNotMounted = types.ErrLayerNotMounted
 	// ErrLayerUnknown indicates that there was no layer with the specified name or ID.
@@ -59,6 +63,25 @@ var (
 	ErrNotSupported = types.ErrNotSupported
 	// ErrInvalidMappings is returned when the specified mappings are invalid.
 	ErrInvalidMappings = types.ErrInvalidMappings
+	// ErrSnapshotUnknown indicates that a container has no snapshot with the specified name.
+	ErrSnapshotUnknown = types.ErrSnapshotUnknown
+	// ErrImagePlatformUnknown indicates that a manifest list has no instance for the specified platform or digest.
+	ErrImagePlatformUnknown = types.ErrImagePlatformUnknown
+	// ErrInvalidLabels is returned when labels or a label selector can't be used.
+	ErrInvalidLabels = types.ErrInvalidLabels
+	// ErrReservationUnknown indicates that there is no reservation of IDs with the specified name.
+	ErrReservationUnknown = types.ErrReservationUnknown
+	// ErrInvalidConfiguration is returned when problems are found in the storage configuration.
+	ErrInvalidConfiguration = types.ErrInvalidConfiguration
+	// ErrImageStoreUnknown indicates that the specified directory is not being used as an additional image store.
+	ErrImageStoreUnknown = types.ErrImageStoreUnknown
+	// ErrStoreQuotaExceeded is returned when creating or populating a layer would exceed the store's limit on the number of layers or on their total size.
+	ErrStoreQuotaExceeded = types.ErrStoreQuotaExceeded
+	// ErrDuplicateImageStore indicates that the specified directory is already being used as an image store.
+	ErrDuplicateImageStore = types.ErrDuplicateImageStore
+	// ErrImageStoreInUse indicates that an additional image store can't be removed because layers in the
+	// primary store are based on its layers.
+	ErrImageStoreInUse = types.ErrImageStoreInUse
 	// ErrInvalidNameOperation is returned when updateName is called with invalid operation.
 	// Internal error
 	errInvalidUpdateNameOperation = errors.New("invalid update name operation")
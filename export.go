@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"errors"
+	"io"
+
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/ioutils"
+)
+
+// ExportOptions are options for Store.ExportContainer.
+type ExportOptions struct {
+	// Compression is the compression to apply to the archive.
+	Compression archive.Compression
+	// IncludeFiles, if set, limits the archive to these paths, which are
+	// relative to the root of the container's filesystem.
+	IncludeFiles []string
+	// ExcludePatterns are patterns, in the format used by .dockerignore
+	// files, which match paths to leave out of the archive.
+	ExcludePatterns []string
+	// MountLabel is the SELinux label to mount the container's filesystem
+	// with while it's being read.  If it's empty, the container's own is
+	// used.
+	MountLabel string
+}
+
+func (s *store) ExportContainer(id string, options *ExportOptions) (io.ReadCloser, error) {
+	if options == nil {
+		options = &ExportOptions{}
+	}
+	container, err := s.Container(id)
+	if err != nil {
+		return nil, err
+	}
+	mountLabel := options.MountLabel
+	if mountLabel == "" {
+		mountLabel = container.MountLabel()
+	}
+	mountPoint, err := s.Mount(container.ID, mountLabel)
+	if err != nil {
+		return nil, err
+	}
+	// The tar writer maps the owners of files from host IDs to the IDs
+	// which they have inside of the container using the container's maps.
+	rc, err := archive.TarWithOptions(mountPoint, &archive.TarOptions{
+		IncludeFiles:    options.IncludeFiles,
+		ExcludePatterns: options.ExcludePatterns,
+		Compression:     options.Compression,
+		UIDMaps:         container.UIDMap,
+		GIDMaps:         container.GIDMap,
+	})
+	if err != nil {
+		if _, unmountErr := s.Unmount(container.ID, false); unmountErr != nil {
+			err = errors.Join(err, unmountErr)
+		}
+		return nil, err
+	}
+	return ioutils.NewReadCloserWrapper(rc, func() error {
+		err := rc.Close()
+		if _, unmountErr := s.Unmount(container.ID, false); unmountErr != nil {
+			err = errors.Join(err, unmountErr)
+		}
+		return err
+	}), nil
+}
@@ -1,7 +1,9 @@
 package storage
 
 import (
+	"cmp"
 	"fmt"
+	"slices"
 	"strings"
 
 	"github.com/containers/storage/pkg/idtools"
@@ -121,6 +123,33 @@ func (s *idSet) findAvailable(n int) (*idSet, error) {
 	return &idSet{set: intervalset.NewImmutableSet(intervals)}, nil
 }
 
+// coalesce returns a set which contains the ids in `s`, made up of at most `n`
+// intervals, filling in the smallest gaps between intervals to get there.
+// `s` is unchanged.
+func (s *idSet) coalesce(n int) *idSet {
+	var intervals []interval
+	iterator, cancel := s.iterator()
+	defer cancel()
+	for i := iterator(); i != nil; i = iterator() {
+		intervals = append(intervals, *i)
+	}
+	n = max(n, 1)
+	if len(intervals) <= n {
+		return s
+	}
+	gaps := make([]int, 0, len(intervals)-1)
+	for i := 1; i < len(intervals); i++ {
+		gaps = append(gaps, i)
+	}
+	slices.SortStableFunc(gaps, func(a, b int) int {
+		return cmp.Compare(intervals[a].start-intervals[a-1].end, intervals[b].start-intervals[b-1].end)
+	})
+	for _, i := range gaps[:len(intervals)-n] {
+		intervals = append(intervals, interval{start: intervals[i-1].end, end: intervals[i].start})
+	}
+	return newIDSet(intervals)
+}
+
 // zip creates an id map from `s` (host ids) and container ids.
 func (s *idSet) zip(container *idSet) []idtools.IDMap {
 	hostIterator, hostCancel := s.iterator()
@@ -492,6 +492,29 @@ func TestIDSetSize(t *testing.T) {
 	}
 }
 
+func TestIDSetCoalesce(t *testing.T) {
+	tests := []struct {
+		name string
+		set  *idSet
+		n    int
+		want []interval
+	}{
+		{"Nil", nil, 1, nil},
+		{"FewEnough", newIDSet([]interval{{0, 1}, {33, 34}, {65534, 65535}}), 3, []interval{{0, 1}, {33, 34}, {65534, 65535}}},
+		{"SmallestGap", newIDSet([]interval{{0, 1}, {33, 34}, {65534, 65535}}), 2, []interval{{0, 34}, {65534, 65535}}},
+		{"OneInterval", newIDSet([]interval{{0, 1}, {33, 34}, {65534, 65535}}), 1, []interval{{0, 65535}}},
+		{"AtLeastOne", newIDSet([]interval{{0, 1}, {33, 34}}), 0, []interval{{0, 34}}},
+		{"SeveralGaps", newIDSet([]interval{{0, 10}, {12, 20}, {100, 110}, {113, 120}, {1000, 1001}}), 3, []interval{{0, 20}, {100, 120}, {1000, 1001}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := allIntervals(tt.set.coalesce(tt.n)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("idSet.coalesce() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestIDSetFindAvailable(t *testing.T) {
 	tests := []struct {
 		name    string
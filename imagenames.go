@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ImageNamesOperation describes how an image's names were changed.
+type ImageNamesOperation string
+
+const (
+	// ImageNamesCreated means that an image was created with names.
+	ImageNamesCreated ImageNamesOperation = "create"
+	// ImageNamesSet means that an image's names were replaced, as by
+	// Store.SetNames.
+	ImageNamesSet ImageNamesOperation = "set"
+	// ImageNamesAdded means that names were added to an image, as by
+	// Store.AddNames.
+	ImageNamesAdded ImageNamesOperation = "add"
+	// ImageNamesRemoved means that names were removed from an image, as
+	// by Store.RemoveNames.
+	ImageNamesRemoved ImageNamesOperation = "remove"
+	// ImageNamesReassigned means that names were removed from an image
+	// because they were given to another image.
+	ImageNamesReassigned ImageNamesOperation = "reassign"
+	// ImageNamesDeleted means that an image which had names was deleted.
+	ImageNamesDeleted ImageNamesOperation = "delete"
+)
+
+// ImageNamesEvent records a change to the names of an image.
+type ImageNamesEvent struct {
+	Time      time.Time           `json:"time"`
+	ImageID   string              `json:"id"`
+	Operation ImageNamesOperation `json:"operation"`
+	OldNames  []string            `json:"old-names,omitempty"`
+	NewNames  []string            `json:"new-names,omitempty"`
+	// UID, PID, and Command identify the process which made the change.
+	UID     int    `json:"uid"`
+	PID     int    `json:"pid"`
+	Command string `json:"command,omitempty"`
+}
+
+// mentions checks if name is one of the names which the event is about.
+func (e *ImageNamesEvent) mentions(name string) bool {
+	return slices.Contains(e.OldNames, name) || slices.Contains(e.NewNames, name)
+}
+
+func nameOperationEvent(op updateNameOperation) ImageNamesOperation {
+	switch op {
+	case addNames:
+		return ImageNamesAdded
+	case removeNames:
+		return ImageNamesRemoved
+	default:
+		return ImageNamesSet
+	}
+}
+
+// namesLogMaxSize is how large the log of changes to image names can grow
+// before it's rotated.  Only one rotated log is kept, so the oldest changes
+// are discarded once the rotated log is replaced.
+const namesLogMaxSize = 4 * 1024 * 1024
+
+func (r *imageStore) namesLogPath() string {
+	return filepath.Join(r.dir, "names.log")
+}
+
+// rotatedNamesLogPath returns the location of the log which the current log
+// of changes to image names replaced.
+func (r *imageStore) rotatedNamesLogPath() string {
+	return r.namesLogPath() + ".1"
+}
+
+// logNames appends events to the store's log of changes to image names.
+// Since the changes have already been made by the time they're logged,
+// failing to log them is not treated as an error.
+// Requires startWriting.
+func (r *imageStore) logNames(events ...ImageNamesEvent) {
+	var buf bytes.Buffer
+	now := time.Now().UTC()
+	for _, event := range events {
+		if len(event.OldNames) == 0 && len(event.NewNames) == 0 {
+			continue
+		}
+		event.Time = now
+		event.UID = os.Getuid()
+		event.PID = os.Getpid()
+		if len(os.Args) > 0 {
+			event.Command = os.Args[0]
+		}
+		line, err := json.Marshal(&event)
+		if err != nil {
+			logrus.Warnf("Encoding change to names of image %q: %v", event.ImageID, err)
+			continue
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if buf.Len() == 0 {
+		return
+	}
+	f, err := os.OpenFile(r.namesLogPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		logrus.Warnf("Recording changes to image names in %q: %v", r.namesLogPath(), err)
+		return
+	}
+	_, err = f.Write(buf.Bytes())
+	var size int64
+	if err == nil {
+		var info os.FileInfo
+		if info, err = f.Stat(); err == nil {
+			size = info.Size()
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		logrus.Warnf("Recording changes to image names in %q: %v", r.namesLogPath(), err)
+		return
+	}
+	if size >= namesLogMaxSize {
+		if err := os.Rename(r.namesLogPath(), r.rotatedNamesLogPath()); err != nil {
+			logrus.Warnf("Rotating %q: %v", r.namesLogPath(), err)
+		}
+	}
+}
+
+// NamesLog returns the events recorded in the store's log of changes to
+// image names, and in the log which it was rotated from, oldest first.
+// Requires startReading or startWriting.
+func (r *imageStore) NamesLog() ([]ImageNamesEvent, error) {
+	events, err := readNamesLog(r.rotatedNamesLogPath())
+	if err != nil {
+		return nil, err
+	}
+	current, err := readNamesLog(r.namesLogPath())
+	if err != nil {
+		return nil, err
+	}
+	return append(events, current...), nil
+}
+
+// readNamesLog reads the events recorded in a log of changes to image names.
+// Lines which can't be decoded are skipped, so that one damaged entry
+// doesn't make the rest of the log unusable.
+func readNamesLog(path string) ([]ImageNamesEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var events []ImageNamesEvent
+	reader := bufio.NewReader(f)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				// An incomplete last line is an event which was
+				// being written when its writer was interrupted.
+				break
+			}
+			return nil, err
+		}
+		var event ImageNamesEvent
+		if err := json.Unmarshal(line, &event); err != nil {
+			logrus.Warnf("Skipping line %d of %q: %v", lineNumber, path, err)
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// imageWithNameAt replays events, which must be sorted by time, to find which
+// image had the specified name at the specified time.
+func imageWithNameAt(events []ImageNamesEvent, name string, when time.Time) string {
+	holder := ""
+	for _, event := range events {
+		if event.Time.After(when) {
+			break
+		}
+		if slices.Contains(event.NewNames, name) {
+			holder = event.ImageID
+		} else if event.ImageID == holder && slices.Contains(event.OldNames, name) {
+			holder = ""
+		}
+	}
+	return holder
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -27,6 +28,9 @@ const (
 	// ImageDigestBigDataKey is provided for compatibility with older
 	// versions of the image library.  It will be removed in the future.
 	ImageDigestBigDataKey = "manifest"
+	// ImagePinnedFlag is the name of the flag which Store.PinImage sets on
+	// images to protect them from being removed.
+	ImagePinnedFlag = "pinned"
 )
 
 // An Image is a reference to a layer and an associated metadata string.
@@ -94,6 +98,20 @@ type Image struct {
 	ReadOnly bool `json:"-"`
 
 	Flags map[string]any `json:"flags,omitempty"`
+
+	// Labels is a set of caller-specified labels which can be used to
+	// find the image using Store.ImagesByLabel.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// ManifestList is the digest of the manifest list (an OCI image index
+	// or a Docker manifest list) which was attached to the image using
+	// SetImageManifestList, if one was.  The list is stored as a big data
+	// item, so its digest is also one of the image's Digests.
+	ManifestList digest.Digest `json:"manifest-list,omitempty"`
+
+	// Platform describes the instance of the manifest list which the
+	// image's layers correspond to, if it's known.
+	Platform *ImagePlatform `json:"platform,omitempty"`
 }
 
 // roImageStore provides bookkeeping for information about Images.
@@ -117,11 +135,24 @@ type roImageStore interface {
 	// Images returns a slice enumerating the known images.
 	Images() ([]Image, error)
 
+	// imagesMatching returns copies of the known images for which match
+	// returns true.  match must not modify or keep the images it is
+	// passed.
+	imagesMatching(match func(*Image) bool) []Image
+
 	// ByDigest returns a slice enumerating the images which have either an
 	// explicitly-set digest, or a big data item with a name that starts
 	// with ImageDigestManifestBigDataNamePrefix, which matches the
 	// specified digest.
 	ByDigest(d digest.Digest) ([]*Image, error)
+
+	// ByLabel returns a slice enumerating the images whose labels meet
+	// the requirements, sorted by ID.
+	ByLabel(requirements []labelRequirement) ([]*Image, error)
+
+	// NamesLog returns the events recorded in the store's log of changes
+	// to image names, oldest first.
+	NamesLog() ([]ImageNamesEvent, error)
 }
 
 // rwImageStore provides bookkeeping for information about Images.
@@ -130,6 +161,7 @@ type rwImageStore interface {
 	rwMetadataStore
 	rwImageBigDataStore
 	flaggableStore
+	rwLabelStore
 
 	// startWriting makes sure the store is fresh, and locks it for writing.
 	// If this succeeds, the caller MUST call stopWriting().
@@ -154,6 +186,13 @@ type rwImageStore interface {
 	addMappedTopLayer(id, layer string) error
 	removeMappedTopLayer(id, layer string) error
 
+	// removeBigData removes a big data item from an image.
+	removeBigData(id, key string) error
+
+	// setManifestList stores a manifest list as a big data item for an
+	// image, and records it and the image's platform.
+	setManifestList(id string, list []byte, platform *ImagePlatform) error
+
 	// Clean up unreferenced per-image data.
 	GarbageCollect() error
 
@@ -166,6 +205,7 @@ type imageStore struct {
 	// They are safe to access without any other locking.
 	lockfile *lockfile.LockFile // lockfile.IsReadWrite can be used to distinguish between read-write and read-only image stores.
 	dir      string
+	pool     *bigDataPool // Where big data items are shared with other images and containers, or nil.
 
 	inProcessLock sync.RWMutex // Can _only_ be obtained with lockfile held.
 	// The following fields can only be read/written with read/write ownership of inProcessLock, respectively.
@@ -176,6 +216,16 @@ type imageStore struct {
 	byid      map[string]*Image
 	byname    map[string]*Image
 	bydigest  map[digest.Digest][]*Image
+	bylabel   labelIndex
+	journal   metadataJournal
+	// pooled is set once big data items which were written without
+	// using the pool have been moved into it.
+	pooled bool
+
+	// journaled is set if changes to images should be appended to the
+	// metadata journal instead of rewriting images.json.  It is only set
+	// when constructing imageStore.
+	journaled bool
 }
 
 func copyImage(i *Image) *Image {
@@ -194,6 +244,9 @@ func copyImage(i *Image) *Image {
 		Created:         i.Created,
 		ReadOnly:        i.ReadOnly,
 		Flags:           copyMapPreferringNil(i.Flags),
+		Labels:          copyMapPreferringNil(i.Labels),
+		ManifestList:    i.ManifestList,
+		Platform:        copyImagePlatform(i.Platform),
 	}
 }
 
@@ -237,7 +290,28 @@ func (r *imageStore) startWritingWithReload(canReload bool) error {
 // startWriting makes sure the store is fresh, and locks it for writing.
 // If this succeeds, the caller MUST call stopWriting().
 func (r *imageStore) startWriting() error {
-	return r.startWritingWithReload(true)
+	if err := r.startWritingWithReload(true); err != nil {
+		return err
+	}
+	r.migrateBigData()
+	return nil
+}
+
+// migrateBigData moves big data items which were written without using the
+// pool into it, if that hasn't been done yet.
+// Requires startWriting.
+func (r *imageStore) migrateBigData() {
+	if r.pool == nil || r.pooled {
+		return
+	}
+	r.pooled = true
+	var paths []string
+	for _, image := range r.images {
+		paths = append(paths, r.bigDataPaths(image)...)
+	}
+	if err := r.pool.migrate(r.dir, paths); err != nil {
+		logrus.Warnf("Deduplicating big data items of images in %q: %v", r.dir, err)
+	}
 }
 
 // stopWriting releases locks obtained by startWriting.
@@ -392,6 +466,17 @@ func (r *imageStore) reloadIfChanged(lockedForWriting bool) (bool, error) {
 	return false, nil
 }
 
+// Requires startReading or startWriting.
+func (r *imageStore) imagesMatching(match func(*Image) bool) []Image {
+	var images []Image
+	for _, image := range r.images {
+		if match(image) {
+			images = append(images, *copyImage(image))
+		}
+	}
+	return images
+}
+
 // Requires startReading or startWriting.
 func (r *imageStore) Images() ([]Image, error) {
 	images := make([]Image, len(r.images))
@@ -448,6 +533,15 @@ func (r *imageStore) datapath(id, key string) string {
 	return filepath.Join(r.datadir(id), makeBigDataBaseName(key))
 }
 
+// bigDataPaths returns the locations of an image's big data items.
+func (r *imageStore) bigDataPaths(image *Image) []string {
+	paths := make([]string, 0, len(image.BigDataNames))
+	for _, key := range image.BigDataNames {
+		paths = append(paths, r.datapath(image.ID, key))
+	}
+	return paths
+}
+
 // bigDataNameIsManifest determines if a big data item with the specified name
 // is considered to be representative of the image, in that its digest can be
 // said to also be the image's digest.  Currently, if its name is, or begins
@@ -502,21 +596,48 @@ func (i *Image) recomputeDigests() error {
 // retrying with lockedForWriting could succeed.
 func (r *imageStore) load(lockedForWriting bool) (bool, error) {
 	rpath := r.imagespath()
-	data, err := os.ReadFile(rpath)
-	if err != nil && !os.IsNotExist(err) {
+	var snapshot time.Time
+	info, err := os.Stat(rpath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return false, err
+		}
+	} else {
+		snapshot = info.ModTime()
+	}
+	if r.journal.path == "" {
+		r.journal = newMetadataJournal(rpath)
+	}
+	journal, entries, incremental, err := r.journal.read(snapshot, r.idindex != nil)
+	if err != nil {
 		return false, err
 	}
 
 	images := []*Image{}
-	if len(data) != 0 {
-		if err := json.Unmarshal(data, &images); err != nil {
+	if incremental {
+		// Only the journal has been added to since we last loaded, so
+		// start from copies of what we have instead of parsing the
+		// snapshot again.
+		images = copyImageSlice(r.images)
+	} else {
+		data, err := os.ReadFile(rpath)
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		images, journal.guarded, err = decodeMetadataSnapshot[Image](data)
+		if err != nil {
 			return false, fmt.Errorf("loading %q: %w", rpath, err)
 		}
 	}
+	images, err = applyMetadataJournal(images, func(image *Image) string { return image.ID }, entries)
+	if err != nil {
+		return false, fmt.Errorf("loading %q: %w", journal.path, err)
+	}
 	idlist := make([]string, 0, len(images))
 	ids := make(map[string]*Image)
 	names := make(map[string]*Image)
 	digests := make(map[digest.Digest][]*Image)
+	labels := make(labelIndex)
 	var errorToResolveBySaving error // == nil
 	for n, image := range images {
 		ids[image.ID] = images[n]
@@ -538,6 +659,7 @@ func (r *imageStore) load(lockedForWriting bool) (bool, error) {
 			list := digests[digest]
 			digests[digest] = append(list, image)
 		}
+		labels.add(image.ID, image.Labels)
 		image.ReadOnly = !r.lockfile.IsReadWrite()
 	}
 
@@ -550,10 +672,12 @@ func (r *imageStore) load(lockedForWriting bool) (bool, error) {
 		}
 	}
 	r.images = images
+	r.journal = journal
 	r.idindex = truncindex.NewTruncIndex(idlist) // Invalid values in idlist are ignored: they are not a reason to refuse processing the whole store.
 	r.byid = ids
 	r.byname = names
 	r.bydigest = digests
+	r.bylabel = labels
 	if errorToResolveBySaving != nil {
 		return false, r.Save()
 	}
@@ -572,7 +696,7 @@ func (r *imageStore) Save() error {
 	if err := os.MkdirAll(filepath.Dir(rpath), 0o700); err != nil {
 		return err
 	}
-	jdata, err := json.Marshal(&r.images)
+	jdata, err := encodeMetadataSnapshot(r.images, r.journaled)
 	if err != nil {
 		return err
 	}
@@ -583,13 +707,53 @@ func (r *imageStore) Save() error {
 		return err
 	}
 	r.lastWrite = lw
-	if err := ioutils.AtomicWriteFile(rpath, jdata, 0o600); err != nil {
+	opts := ioutils.AtomicFileWriterOptions{}
+	if err := ioutils.AtomicWriteFileWithOpts(rpath, jdata, 0o600, &opts); err != nil {
 		return err
 	}
+	r.journal.compacted(opts.ModTime, r.journaled)
 	return nil
 }
 
-func newImageStore(dir string) (rwImageStore, error) {
+// saveFor saves the changes to modifiedImages, which may have been deleted,
+// to disk, either by appending them to the journal, or by saving the contents
+// of the store.
+// The caller must hold r.lockfile locked for writing.
+// The caller must hold r.inProcessLock for WRITING.
+func (r *imageStore) saveFor(modifiedImages ...*Image) error {
+	if !r.journaled || r.journal.needsCompaction(len(r.images)) {
+		return r.Save()
+	}
+	if !r.lockfile.IsReadWrite() {
+		return fmt.Errorf("not allowed to modify the image store at %q: %w", r.imagespath(), ErrStoreIsReadOnly)
+	}
+	r.lockfile.AssertLockedForWriting()
+	entries := make([]metadataJournalEntry, 0, len(modifiedImages))
+	for _, image := range modifiedImages {
+		entry := metadataJournalEntry{ID: image.ID}
+		if r.byid[image.ID] == image {
+			record, err := json.Marshal(image)
+			if err != nil {
+				return err
+			}
+			entry.Record = record
+		}
+		entries = append(entries, entry)
+	}
+	if err := os.MkdirAll(filepath.Dir(r.journal.path), 0o700); err != nil {
+		return err
+	}
+	// This must be done before we write the journal, because the process could be terminated
+	// after the journal is written but before the lock file is updated.
+	lw, err := r.lockfile.RecordWrite()
+	if err != nil {
+		return err
+	}
+	r.lastWrite = lw
+	return r.journal.append(entries, false)
+}
+
+func newImageStore(dir string, journaled bool, pool *bigDataPool) (rwImageStore, error) {
 	if err := os.MkdirAll(dir, 0o700); err != nil {
 		return nil, err
 	}
@@ -600,11 +764,15 @@ func newImageStore(dir string) (rwImageStore, error) {
 	istore := imageStore{
 		lockfile: lockfile,
 		dir:      dir,
+		pool:     pool,
 
 		images:   []*Image{},
 		byid:     make(map[string]*Image),
 		byname:   make(map[string]*Image),
 		bydigest: make(map[digest.Digest][]*Image),
+		bylabel:  make(labelIndex),
+
+		journaled: journaled,
 	}
 	if err := istore.startWritingWithReload(false); err != nil {
 		return nil, err
@@ -633,6 +801,7 @@ func newROImageStore(dir string) (roImageStore, error) {
 		byid:     make(map[string]*Image),
 		byname:   make(map[string]*Image),
 		bydigest: make(map[digest.Digest][]*Image),
+		bylabel:  make(labelIndex),
 	}
 	if err := istore.startReadingWithReload(false); err != nil {
 		return nil, err
@@ -661,6 +830,12 @@ func (r *imageStore) lookup(id string) (*Image, bool) {
 	return nil, false
 }
 
+// Pinned returns true if the image has been pinned using Store.PinImage.
+func (i *Image) Pinned() bool {
+	pinned, _ := i.Flags[ImagePinnedFlag].(bool)
+	return pinned
+}
+
 // Requires startWriting.
 func (r *imageStore) ClearFlag(id string, flag string) error {
 	if !r.lockfile.IsReadWrite() {
@@ -671,7 +846,7 @@ func (r *imageStore) ClearFlag(id string, flag string) error {
 		return fmt.Errorf("locating image with ID %q: %w", id, ErrImageUnknown)
 	}
 	delete(image.Flags, flag)
-	return r.Save()
+	return r.saveFor(image)
 }
 
 // Requires startWriting.
@@ -687,7 +862,7 @@ func (r *imageStore) SetFlag(id string, flag string, value any) error {
 		image.Flags = make(map[string]any)
 	}
 	image.Flags[flag] = value
-	return r.Save()
+	return r.saveFor(image)
 }
 
 // Requires startWriting.
@@ -706,6 +881,9 @@ func (r *imageStore) create(id string, names []string, layer string, options Ima
 	if _, idInUse := r.byid[id]; idInUse {
 		return nil, fmt.Errorf("an image with ID %q already exists: %w", id, ErrDuplicateID)
 	}
+	if err := validateLabels(options.Labels); err != nil {
+		return nil, err
+	}
 	names = dedupeStrings(names)
 	for _, name := range names {
 		if image, nameInUse := r.byname[name]; nameInUse {
@@ -725,6 +903,7 @@ func (r *imageStore) create(id string, names []string, layer string, options Ima
 		BigDataDigests: make(map[string]digest.Digest),
 		Created:        options.CreationDate,
 		Flags:          newMapFrom(options.Flags),
+		Labels:         copyMapPreferringNil(options.Labels),
 	}
 	if image.Created.IsZero() {
 		image.Created = time.Now().UTC()
@@ -747,17 +926,18 @@ func (r *imageStore) create(id string, names []string, layer string, options Ima
 		list := r.bydigest[digest]
 		r.bydigest[digest] = append(list, image)
 	}
+	r.bylabel.add(id, image.Labels)
 	defer func() {
 		if err != nil {
 			// now that the in-memory structures know about the new
 			// record, we can use regular Delete() to clean up if
 			// anything breaks from here on out
-			if e := r.Delete(id); e != nil {
+			if e := r.delete(id, false); e != nil {
 				logrus.Debugf("while cleaning up partially-created image %q we failed to create: %v", id, e)
 			}
 		}
 	}()
-	err = r.Save()
+	err = r.saveFor(image)
 	if err != nil {
 		return nil, err
 	}
@@ -769,6 +949,7 @@ func (r *imageStore) create(id string, names []string, layer string, options Ima
 			return nil, err
 		}
 	}
+	r.logNames(ImageNamesEvent{ImageID: id, Operation: ImageNamesCreated, NewNames: names})
 	image = copyImage(image)
 	return image, err
 }
@@ -777,7 +958,7 @@ func (r *imageStore) create(id string, names []string, layer string, options Ima
 func (r *imageStore) addMappedTopLayer(id, layer string) error {
 	if image, ok := r.lookup(id); ok {
 		image.MappedTopLayers = append(image.MappedTopLayers, layer)
-		return r.Save()
+		return r.saveFor(image)
 	}
 	return fmt.Errorf("locating image with ID %q: %w", id, ErrImageUnknown)
 }
@@ -791,7 +972,7 @@ func (r *imageStore) removeMappedTopLayer(id, layer string) error {
 		if initialLen == len(image.MappedTopLayers) {
 			return nil
 		}
-		return r.Save()
+		return r.saveFor(image)
 	}
 	return fmt.Errorf("locating image with ID %q: %w", id, ErrImageUnknown)
 }
@@ -811,11 +992,29 @@ func (r *imageStore) SetMetadata(id, metadata string) error {
 	}
 	if image, ok := r.lookup(id); ok {
 		image.Metadata = metadata
-		return r.Save()
+		return r.saveFor(image)
 	}
 	return fmt.Errorf("locating image with ID %q: %w", id, ErrImageUnknown)
 }
 
+// Requires startWriting.
+func (r *imageStore) SetLabels(id string, labels map[string]string) error {
+	if !r.lockfile.IsReadWrite() {
+		return fmt.Errorf("not allowed to modify image labels at %q: %w", r.imagespath(), ErrStoreIsReadOnly)
+	}
+	if err := validateLabels(labels); err != nil {
+		return err
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return fmt.Errorf("locating image with ID %q: %w", id, ErrImageUnknown)
+	}
+	r.bylabel.remove(image.ID, image.Labels)
+	image.Labels = copyMapPreferringNil(labels)
+	r.bylabel.add(image.ID, image.Labels)
+	return r.saveFor(image)
+}
+
 // The caller must hold r.inProcessLock for writing.
 func (r *imageStore) removeName(image *Image, name string) {
 	image.Names = stringSliceWithoutValue(image.Names, name)
@@ -843,19 +1042,35 @@ func (r *imageStore) updateNames(id string, names []string, op updateNameOperati
 	for _, name := range oldNames {
 		delete(r.byname, name)
 	}
+	modifiedImages := []*Image{image}
+	events := []ImageNamesEvent{{ImageID: image.ID, Operation: nameOperationEvent(op), OldNames: oldNames, NewNames: names}}
 	for _, name := range names {
 		if otherImage, ok := r.byname[name]; ok {
+			otherNames := otherImage.Names
 			r.removeName(otherImage, name)
+			modifiedImages = append(modifiedImages, otherImage)
+			events = append(events, ImageNamesEvent{ImageID: otherImage.ID, Operation: ImageNamesReassigned, OldNames: otherNames, NewNames: otherImage.Names})
 		}
 		r.byname[name] = image
 		image.addNameToHistory(name)
 	}
 	image.Names = names
-	return r.Save()
+	if err := r.saveFor(modifiedImages...); err != nil {
+		return err
+	}
+	r.logNames(events...)
+	return nil
 }
 
 // Requires startWriting.
 func (r *imageStore) Delete(id string) error {
+	return r.delete(id, true)
+}
+
+// delete removes an image, and if logDeletion is set, records the removal of
+// its names in the log of changes to image names.
+// Requires startWriting.
+func (r *imageStore) delete(id string, logDeletion bool) error {
 	if !r.lockfile.IsReadWrite() {
 		return fmt.Errorf("not allowed to delete images at %q: %w", r.imagespath(), ErrStoreIsReadOnly)
 	}
@@ -881,13 +1096,17 @@ func (r *imageStore) Delete(id string) error {
 			r.bydigest[digest] = prunedList
 		}
 	}
+	r.bylabel.remove(id, image.Labels)
 	r.images = slices.DeleteFunc(r.images, func(candidate *Image) bool {
 		return candidate.ID == id
 	})
-	if err := r.Save(); err != nil {
+	if err := r.saveFor(image); err != nil {
 		return err
 	}
-	if err := os.RemoveAll(r.datadir(id)); err != nil {
+	if logDeletion {
+		r.logNames(ImageNamesEvent{ImageID: id, Operation: ImageNamesDeleted, OldNames: image.Names})
+	}
+	if err := r.pool.removeAll(r.datadir(id), r.bigDataPaths(image)); err != nil {
 		return err
 	}
 	return nil
@@ -915,6 +1134,12 @@ func (r *imageStore) ByDigest(d digest.Digest) ([]*Image, error) {
 	return nil, fmt.Errorf("locating image with digest %q: %w", d, ErrImageUnknown)
 }
 
+// Requires startReading or startWriting.
+func (r *imageStore) ByLabel(requirements []labelRequirement) ([]*Image, error) {
+	images := selectByLabels(r.bylabel, r.images, r.byid, func(image *Image) string { return image.ID }, func(image *Image) map[string]string { return image.Labels }, requirements)
+	return copyImageSlice(images), nil
+}
+
 // Requires startReading or startWriting.
 func (r *imageStore) BigData(id, key string) ([]byte, error) {
 	if key == "" {
@@ -1002,7 +1227,7 @@ func (r *imageStore) setBigData(image *Image, key string, data []byte, newDigest
 	if err != nil {
 		return err
 	}
-	err = ioutils.AtomicWriteFile(r.datapath(image.ID, key), data, 0o600)
+	err = r.pool.write(r.datapath(image.ID, key), data)
 	if err == nil {
 		save := false
 		if image.BigDataSizes == nil {
@@ -1047,12 +1272,74 @@ func (r *imageStore) setBigData(image *Image, key string, data []byte, newDigest
 			}
 		}
 		if save {
-			err = r.Save()
+			err = r.saveFor(image)
 		}
 	}
 	return err
 }
 
+// Requires startWriting.
+func (r *imageStore) removeBigData(id, key string) error {
+	if !r.lockfile.IsReadWrite() {
+		return fmt.Errorf("not allowed to remove data items associated with images at %q: %w", r.imagespath(), ErrStoreIsReadOnly)
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return fmt.Errorf("locating image with ID %q: %w", id, ErrImageUnknown)
+	}
+	if !slices.Contains(image.BigDataNames, key) {
+		return nil
+	}
+	if err := r.pool.remove(r.datapath(image.ID, key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	image.BigDataNames = slices.DeleteFunc(image.BigDataNames, func(name string) bool {
+		return name == key
+	})
+	delete(image.BigDataSizes, key)
+	delete(image.BigDataDigests, key)
+	for _, oldDigest := range image.Digests {
+		if list, ok := r.bydigest[oldDigest]; ok {
+			prunedList := slices.DeleteFunc(list, func(i *Image) bool {
+				return i == image
+			})
+			if len(prunedList) == 0 {
+				delete(r.bydigest, oldDigest)
+			} else {
+				r.bydigest[oldDigest] = prunedList
+			}
+		}
+	}
+	if err := image.recomputeDigests(); err != nil {
+		return fmt.Errorf("loading recomputing image digest information for %s: %w", image.ID, err)
+	}
+	for _, newDigest := range image.Digests {
+		list := r.bydigest[newDigest]
+		if !slices.Contains(list, image) {
+			r.bydigest[newDigest] = append(list, image)
+		}
+	}
+	return r.saveFor(image)
+}
+
+// Requires startWriting.
+func (r *imageStore) setManifestList(id string, list []byte, platform *ImagePlatform) error {
+	if !r.lockfile.IsReadWrite() {
+		return fmt.Errorf("not allowed to save data items associated with images at %q: %w", r.imagespath(), ErrStoreIsReadOnly)
+	}
+	image, ok := r.lookup(id)
+	if !ok {
+		return fmt.Errorf("locating image with ID %q: %w", id, ErrImageUnknown)
+	}
+	listDigest := digest.Canonical.FromBytes(list)
+	if err := r.setBigData(image, manifestListBigDataKey(listDigest), list, listDigest); err != nil {
+		return err
+	}
+	image.ManifestList = listDigest
+	image.Platform = copyImagePlatform(platform)
+	return r.saveFor(image)
+}
+
 // Requires startWriting.
 func (r *imageStore) Wipe() error {
 	if !r.lockfile.IsReadWrite() {
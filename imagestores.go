@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	drivers "github.com/containers/storage/drivers"
+	"github.com/sirupsen/logrus"
+)
+
+// roImageStoreDir returns the directory which holds a read-only image store's
+// data, or "" if it isn't known.
+func roImageStoreDir(store roImageStore) string {
+	if is, ok := store.(*imageStore); ok {
+		return is.dir
+	}
+	return ""
+}
+
+// roLayerStoreDir returns the directory which holds a read-only layer store's
+// data, or "" if it isn't known.
+func roLayerStoreDir(store roLayerStore) string {
+	if ls, ok := store.(*layerStore); ok {
+		return ls.layerdir
+	}
+	return ""
+}
+
+// reapplyImageStoreChangesLocked makes the changes which
+// AddAdditionalImageStore and RemoveAdditionalImageStore made to the list of
+// additional image stores to a newly initialized graph driver.
+// The caller must hold s.graphLock.
+func (s *store) reapplyImageStoreChangesLocked(driver drivers.Driver) error {
+	if len(s.addedImageStores) == 0 && len(s.removedImageStores) == 0 {
+		return nil
+	}
+	adriver, ok := drivers.AsAdditionalImageStoreDriver(driver)
+	if !ok {
+		return fmt.Errorf("changing the image stores of the %q driver: %w", driver.String(), ErrNotSupported)
+	}
+	for _, store := range s.removedImageStores {
+		if err := adriver.RemoveAdditionalImageStore(store); err != nil {
+			logrus.Warnf("Removing additional image store %q: %v", store, err)
+		}
+	}
+	for _, store := range s.addedImageStores {
+		if err := adriver.AddAdditionalImageStore(store); err != nil {
+			logrus.Warnf("Adding additional image store %q: %v", store, err)
+		}
+	}
+	return nil
+}
+
+func (s *store) AddAdditionalImageStore(path string) error {
+	path = filepath.Clean(path)
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("additional image store %q is not an absolute path", path)
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("additional image store: %w", err)
+	}
+	if !st.IsDir() {
+		return fmt.Errorf("additional image store %q is not a directory", path)
+	}
+	if path == s.graphRoot || path == s.imageStoreDir {
+		return fmt.Errorf("%q: %w", path, ErrDuplicateImageStore)
+	}
+
+	if err := s.startUsingGraphDriver(); err != nil {
+		return err
+	}
+	defer s.stopUsingGraphDriver()
+
+	driver, ok := drivers.AsAdditionalImageStoreDriver(s.graphDriver)
+	if !ok {
+		return fmt.Errorf("adding image stores to the %q driver: %w", s.graphDriverName, ErrNotSupported)
+	}
+	if slices.Contains(s.graphDriver.AdditionalImageStores(), path) {
+		return fmt.Errorf("%q: %w", path, ErrDuplicateImageStore)
+	}
+
+	// Load the new stores before changing anything, so that a store which
+	// can't be read is never half-added.
+	driverPrefix := s.graphDriverName + "-"
+	ris, err := newROImageStore(filepath.Join(path, driverPrefix+"images"))
+	if err != nil {
+		return fmt.Errorf("loading additional image store %q: %w", path, err)
+	}
+	var rls roLayerStore
+	if s.roLayerStoresUseGetters != nil {
+		// Otherwise, getROLayerStoresLocked() will load the layer
+		// stores, including this one, when they are first needed.
+		rlpath := filepath.Join(s.runRoot, driverPrefix+"layers")
+		if rls, err = newROLayerStore(rlpath, filepath.Join(path, driverPrefix+"layers"), s.graphDriver); err != nil {
+			return fmt.Errorf("loading additional layer store %q: %w", path, err)
+		}
+	}
+	if err := driver.AddAdditionalImageStore(path); err != nil {
+		return err
+	}
+
+	// Callers may still be using the old slices, so replace them instead
+	// of modifying them.
+	if rls != nil {
+		s.roLayerStoresUseGetters = append(slices.Clip(s.roLayerStoresUseGetters), rls)
+	}
+	s.roImageStoresLock.Lock()
+	s.roImageStoresUseGetters = append(slices.Clip(s.roImageStoresUseGetters), ris)
+	s.roImageStoresLock.Unlock()
+
+	if i := slices.Index(s.removedImageStores, path); i != -1 {
+		s.removedImageStores = slices.Delete(s.removedImageStores, i, i+1)
+	} else {
+		s.addedImageStores = append(s.addedImageStores, path)
+	}
+	return nil
+}
+
+func (s *store) RemoveAdditionalImageStore(path string) error {
+	path = filepath.Clean(path)
+
+	if err := s.startUsingGraphDriver(); err != nil {
+		return err
+	}
+	defer s.stopUsingGraphDriver()
+
+	driver, ok := drivers.AsAdditionalImageStoreDriver(s.graphDriver)
+	if !ok {
+		return fmt.Errorf("removing image stores from the %q driver: %w", s.graphDriverName, ErrNotSupported)
+	}
+	if !slices.Contains(s.graphDriver.AdditionalImageStores(), path) {
+		return fmt.Errorf("%q: %w", path, ErrImageStoreUnknown)
+	}
+
+	driverPrefix := s.graphDriverName + "-"
+	imagesDir := filepath.Join(path, driverPrefix+"images")
+	layersDir := filepath.Join(path, driverPrefix+"layers")
+	rlstore, lstores, err := s.bothLayerStoreKindsLocked()
+	if err != nil {
+		return err
+	}
+	if err := s.checkImageStoreUnused(path, rlstore, lstores, layersDir); err != nil {
+		return err
+	}
+	if err := driver.RemoveAdditionalImageStore(path); err != nil {
+		return err
+	}
+
+	// Callers may still be using the old slices, so replace them instead
+	// of modifying them.
+	s.roLayerStoresUseGetters = slices.DeleteFunc(slices.Clone(lstores), func(store roLayerStore) bool {
+		return roLayerStoreDir(store) == layersDir
+	})
+	s.roImageStoresLock.Lock()
+	s.roImageStoresUseGetters = slices.DeleteFunc(slices.Clone(s.roImageStoresUseGetters), func(store roImageStore) bool {
+		return roImageStoreDir(store) == imagesDir
+	})
+	s.roImageStoresLock.Unlock()
+
+	if i := slices.Index(s.addedImageStores, path); i != -1 {
+		s.addedImageStores = slices.Delete(s.addedImageStores, i, i+1)
+	} else {
+		s.removedImageStores = append(s.removedImageStores, path)
+	}
+	return nil
+}
+
+// checkImageStoreUnused returns ErrImageStoreInUse if a layer or image in the
+// primary stores uses a layer which is only available from the additional
+// layer store in layersDir.
+// The caller must hold s.graphLock.
+func (s *store) checkImageStoreUnused(path string, rlstore rwLayerStore, lstores []roLayerStore, layersDir string) error {
+	if err := rlstore.startReading(); err != nil {
+		return err
+	}
+	defer rlstore.stopReading()
+	var removed roLayerStore
+	for _, store := range lstores {
+		if err := store.startReading(); err != nil {
+			return err
+		}
+		defer store.stopReading()
+		if roLayerStoreDir(store) == layersDir {
+			removed = store
+		}
+	}
+	if removed == nil {
+		return nil
+	}
+	// onlyInRemoved returns true if the layer can only be found in the
+	// store which is being removed.
+	onlyInRemoved := func(id string) bool {
+		if id == "" || !removed.Exists(id) || rlstore.Exists(id) {
+			return false
+		}
+		for _, store := range lstores {
+			if store != removed && store.Exists(id) {
+				return false
+			}
+		}
+		return true
+	}
+	// Mounts of the removed store's layers couldn't be unmounted after it
+	// is gone, whether this process or another one using the same run root
+	// made them.
+	mounts, err := rlstore.mountCounts()
+	if err != nil {
+		return err
+	}
+	removedLayers, err := removed.Layers()
+	if err != nil {
+		return err
+	}
+	for _, layer := range removedLayers {
+		if onlyInRemoved(layer.ID) && (layer.MountCount > 0 || mounts[layer.ID] > 0) {
+			return fmt.Errorf("layer %s in %q is mounted: %w", layer.ID, path, ErrImageStoreInUse)
+		}
+	}
+	layers, err := rlstore.Layers()
+	if err != nil {
+		return err
+	}
+	for _, layer := range layers {
+		if onlyInRemoved(layer.Parent) {
+			return fmt.Errorf("layer %s is based on layer %s in %q: %w", layer.ID, layer.Parent, path, ErrImageStoreInUse)
+		}
+	}
+	if err := s.imageStore.startReading(); err != nil {
+		return err
+	}
+	defer s.imageStore.stopReading()
+	images, err := s.imageStore.Images()
+	if err != nil {
+		return err
+	}
+	for _, image := range images {
+		if onlyInRemoved(image.TopLayer) {
+			return fmt.Errorf("image %s uses layer %s in %q: %w", image.ID, image.TopLayer, path, ErrImageStoreInUse)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/storage/pkg/reexec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreAdditionalImageStores(t *testing.T) {
+	reexec.Init()
+
+	shared := newTestStore(t, StoreOptions{})
+	_, err := shared.CreateLayer("SharedLayer", "", nil, "", false, nil)
+	require.NoError(t, err)
+	_, err = shared.CreateImage("SharedImage", []string{"shared"}, "SharedLayer", "", nil)
+	require.NoError(t, err)
+	_, err = shared.Shutdown(true)
+	require.NoError(t, err)
+	shared.Free()
+	// This process already holds read-write locks for the files in the
+	// original location, so use a copy as a read-only store.
+	sharedRoot := filepath.Join(t.TempDir(), "shared")
+	require.NoError(t, os.CopyFS(sharedRoot, os.DirFS(shared.GraphRoot())))
+
+	store := newTestStore(t, StoreOptions{})
+	defer func() {
+		_, _ = store.Shutdown(true)
+		store.Free()
+	}()
+
+	_, err = store.Image("SharedImage")
+	assert.ErrorIs(t, err, ErrImageUnknown)
+	assert.ErrorIs(t, store.RemoveAdditionalImageStore(sharedRoot), ErrImageStoreUnknown)
+	assert.Error(t, store.AddAdditionalImageStore("relative"))
+	assert.ErrorIs(t, store.AddAdditionalImageStore(store.GraphRoot()), ErrDuplicateImageStore)
+
+	require.NoError(t, store.AddAdditionalImageStore(sharedRoot))
+	assert.ErrorIs(t, store.AddAdditionalImageStore(sharedRoot), ErrDuplicateImageStore)
+	image, err := store.Image("shared")
+	require.NoError(t, err)
+	assert.Equal(t, "SharedImage", image.ID)
+	assert.True(t, store.Exists("SharedLayer"))
+
+	// A container based on the image uses the shared store's layer, so
+	// the store can't be removed until the container is gone.
+	_, err = store.CreateContainer("Container", nil, "SharedImage", "", "", nil)
+	require.NoError(t, err)
+	assert.ErrorIs(t, store.RemoveAdditionalImageStore(sharedRoot), ErrImageStoreInUse)
+	_, err = store.Image("SharedImage")
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteContainer("Container"))
+
+	// Neither can it be removed while another process which uses the same
+	// run root has one of its layers mounted.
+	mountsPath := filepath.Join(store.RunRoot(), store.GraphDriverName()+"-layers", "mountpoints.json")
+	mounts, err := os.ReadFile(mountsPath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(mountsPath, []byte(`[{"id":"SharedLayer","path":"/mnt","count":1}]`), 0o600))
+	assert.ErrorIs(t, store.RemoveAdditionalImageStore(sharedRoot), ErrImageStoreInUse)
+	require.NoError(t, os.WriteFile(mountsPath, mounts, 0o600))
+
+	require.NoError(t, store.RemoveAdditionalImageStore(sharedRoot))
+	_, err = store.Image("SharedImage")
+	assert.ErrorIs(t, err, ErrImageUnknown)
+	assert.False(t, store.Exists("SharedLayer"))
+	assert.ErrorIs(t, store.RemoveAdditionalImageStore(sharedRoot), ErrImageStoreUnknown)
+
+	// Adding it again after it was removed works.
+	require.NoError(t, store.AddAdditionalImageStore(sharedRoot))
+	_, err = store.Image("SharedImage")
+	require.NoError(t, err)
+	layers, err := store.Layers()
+	require.NoError(t, err)
+	assert.Len(t, layers, 1)
+}
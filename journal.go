@@ -0,0 +1,327 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/containers/storage/pkg/stringid"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/sirupsen/logrus"
+)
+
+// A metadata journal is kept next to a JSON file which holds a list of
+// records (layers.json, images.json), so that changing a record only requires
+// appending the record to the journal instead of rewriting the whole file.
+// Readers apply the journal's entries on top of the JSON file, which remains
+// the snapshot that the journal is periodically compacted into.
+//
+// The journal is a series of lines, each of them a JSON object.  The first is
+// a metadataJournalHeader, and the rest are metadataJournalEntry values, in
+// the order in which the changes which they describe were made.
+//
+// Versions of this library which don't know about journals would ignore one,
+// and if they rewrote the JSON file, the journal's entries would be lost.  To
+// keep that from happening, a JSON file is only journaled once it has been
+// written as a metadataSnapshot, which those versions refuse to read, instead
+// of as a plain list.
+
+// metadataJournalVersion is the version of the journal format which we read
+// and write.  Journals which use a later version are refused rather than
+// ignored, since ignoring them would lose changes.
+const metadataJournalVersion = 1
+
+// metadataJournalMinCompaction is the number of entries which a journal can
+// hold before it's compacted, no matter how few records the snapshot holds.
+// Past that, a journal is compacted when it holds as many entries as there
+// are records, so that the cost of rewriting the snapshot is amortized over
+// the appends.
+const metadataJournalMinCompaction = 128
+
+type metadataJournalHeader struct {
+	Version int `json:"version"`
+	// Generation identifies this journal, so that readers which have read
+	// part of it can tell if it's been replaced since.
+	Generation string `json:"generation"`
+	// Snapshot is the modification time of the snapshot which the journal's
+	// entries are applied to.  If the snapshot has been rewritten since,
+	// the journal is stale, and is ignored.
+	Snapshot time.Time `json:"snapshot"`
+}
+
+type metadataJournalEntry struct {
+	ID string `json:"id"`
+	// Record is the complete new version of the record, or empty if the
+	// record was deleted.
+	Record jsoniter.RawMessage `json:"record,omitempty"`
+}
+
+// metadataSnapshot is the form in which a JSON file which is being journaled
+// is written.
+type metadataSnapshot[T any] struct {
+	// JournalVersion is the version of the journal format which the
+	// file's journal uses.
+	JournalVersion int  `json:"journal-version"`
+	Records        []*T `json:"records"`
+}
+
+// decodeMetadataSnapshot decodes the contents of a JSON file which holds a
+// list of records, either as a plain list or as a metadataSnapshot.  The
+// returned bool is true if it was a metadataSnapshot.
+func decodeMetadataSnapshot[T any](data []byte) ([]*T, bool, error) {
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	if len(trimmed) == 0 {
+		return []*T{}, false, nil
+	}
+	if trimmed[0] != '{' {
+		records := []*T{}
+		if err := json.Unmarshal(data, &records); err != nil {
+			return nil, false, err
+		}
+		return records, false, nil
+	}
+	var snapshot metadataSnapshot[T]
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, false, err
+	}
+	if snapshot.JournalVersion > metadataJournalVersion {
+		return nil, false, fmt.Errorf("journal format version %d is not supported, only versions up to %d are", snapshot.JournalVersion, metadataJournalVersion)
+	}
+	if snapshot.Records == nil {
+		snapshot.Records = []*T{}
+	}
+	return snapshot.Records, true, nil
+}
+
+// encodeMetadataSnapshot encodes records as a metadataSnapshot if journaled
+// is set, and as a plain list otherwise.
+func encodeMetadataSnapshot[T any](records []*T, journaled bool) ([]byte, error) {
+	if !journaled {
+		return json.Marshal(&records)
+	}
+	return json.Marshal(&metadataSnapshot[T]{JournalVersion: metadataJournalVersion, Records: records})
+}
+
+// metadataJournal tracks how much of a journal file has been read or written.
+type metadataJournal struct {
+	path       string
+	snapshot   time.Time // The modification time of the snapshot which our in-memory state is based on.
+	guarded    bool      // Set if the snapshot was written as a metadataSnapshot, so that it can be journaled.
+	generation string    // The generation of the journal whose entries we have applied, or "" if we haven't.
+	offset     int64     // How much of that journal we have applied.
+	entries    int       // How many entries we have applied.
+}
+
+func newMetadataJournal(snapshotPath string) metadataJournal {
+	return metadataJournal{path: strings.TrimSuffix(snapshotPath, ".json") + ".journal"}
+}
+
+// read reads the journal which accompanies a snapshot with modification time
+// snapshot.  If incremental is set and the snapshot is the one that j's state
+// is based on, only the entries which were added since j's state was recorded
+// are returned, and the returned bool is true.  Otherwise, all entries which
+// apply to the snapshot are returned.  The updated state is returned rather
+// than being recorded in j, so that the caller can discard it if it fails to
+// apply the entries.
+func (j metadataJournal) read(snapshot time.Time, incremental bool) (metadataJournal, []metadataJournalEntry, bool, error) {
+	incremental = incremental && snapshot.Equal(j.snapshot)
+	state := metadataJournal{path: j.path, snapshot: snapshot}
+	if incremental {
+		// The snapshot hasn't changed, so neither has its form.
+		state.guarded = j.guarded
+	}
+
+	f, err := os.Open(j.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// If we had read a journal, it has since been compacted,
+			// and then the snapshot would have changed, too.
+			return state, nil, incremental && j.generation == "", nil
+		}
+		return j, nil, false, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			// The header is incomplete, so no entries were written.
+			return state, nil, incremental && j.generation == "", nil
+		}
+		return j, nil, false, err
+	}
+	var header metadataJournalHeader
+	if err := json.Unmarshal(line, &header); err != nil {
+		return j, nil, false, fmt.Errorf("decoding header of %q: %w", j.path, err)
+	}
+	if header.Version > metadataJournalVersion {
+		return j, nil, false, fmt.Errorf("%q uses journal format version %d, only versions up to %d are supported", j.path, header.Version, metadataJournalVersion)
+	}
+	if !header.Snapshot.Equal(snapshot) {
+		logrus.Debugf("Ignoring %q, which applies to an older version of its snapshot", j.path)
+		return state, nil, incremental && j.generation == "", nil
+	}
+	state.generation = header.Generation
+	state.offset = int64(len(line))
+
+	if incremental && j.generation != "" {
+		if j.generation != header.Generation {
+			incremental = false
+		} else if j.offset > state.offset {
+			if _, err := f.Seek(j.offset, io.SeekStart); err != nil {
+				return j, nil, false, err
+			}
+			reader.Reset(f)
+			state.offset = j.offset
+			state.entries = j.entries
+		}
+	}
+
+	var entries []metadataJournalEntry
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				// An incomplete last line is an entry which was
+				// being written when its writer was interrupted.
+				break
+			}
+			return j, nil, false, err
+		}
+		var entry metadataJournalEntry
+		err = json.Unmarshal(line, &entry)
+		if err == nil && entry.ID == "" {
+			err = errors.New("entry has no ID")
+		}
+		if err != nil {
+			if _, peekErr := reader.Peek(1); errors.Is(peekErr, io.EOF) {
+				// Likewise for a last line which wasn't completely
+				// written out before the system went down.
+				break
+			}
+			return j, nil, false, fmt.Errorf("decoding entry at offset %d of %q: %w", state.offset, j.path, err)
+		}
+		entries = append(entries, entry)
+		state.offset += int64(len(line))
+		state.entries++
+	}
+	return state, entries, incremental, nil
+}
+
+// append writes entries to the end of the journal, starting a new journal if
+// we don't have one, and updates j to include them.  Anything which follows
+// the part of the journal that j's state covers, which can only be the
+// remains of an interrupted append, is overwritten.
+func (j *metadataJournal) append(entries []metadataJournalEntry, noSync bool) error {
+	var buf bytes.Buffer
+	generation, offset := j.generation, j.offset
+	if generation == "" {
+		generation, offset = stringid.GenerateRandomID(), 0
+		header, err := json.Marshal(&metadataJournalHeader{
+			Version:    metadataJournalVersion,
+			Generation: generation,
+			Snapshot:   j.snapshot,
+		})
+		if err != nil {
+			return err
+		}
+		buf.Write(header)
+		buf.WriteByte('\n')
+	}
+	for i := range entries {
+		entry, err := json.Marshal(&entries[i])
+		if err != nil {
+			return err
+		}
+		buf.Write(entry)
+		buf.WriteByte('\n')
+	}
+
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(buf.Bytes(), offset); err != nil {
+		return err
+	}
+	if err := f.Truncate(offset + int64(buf.Len())); err != nil {
+		return err
+	}
+	if !noSync {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	j.generation = generation
+	j.offset = offset + int64(buf.Len())
+	j.entries += len(entries)
+	return nil
+}
+
+// needsCompaction returns true if the journal should be compacted into a
+// snapshot which holds records records, either because it has grown long
+// enough, or because the snapshot isn't a metadataSnapshot yet.
+func (j *metadataJournal) needsCompaction(records int) bool {
+	return !j.guarded || j.entries >= max(metadataJournalMinCompaction, records)
+}
+
+// compacted records that a new snapshot with modification time snapshot was
+// written, as a metadataSnapshot if guarded is set, and removes the journal,
+// whose entries it includes.  If the journal can't be removed, it's stale
+// anyway, since it doesn't apply to the new snapshot.
+func (j *metadataJournal) compacted(snapshot time.Time, guarded bool) {
+	*j = metadataJournal{path: j.path, snapshot: snapshot, guarded: guarded}
+	if err := os.Remove(j.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logrus.Debugf("Removing %q: %v", j.path, err)
+	}
+}
+
+// applyMetadataJournal applies journal entries to records, which are in the
+// order in which they were added, and returns the updated list.  Records
+// which are added or replaced are decoded into new objects; others are reused.
+func applyMetadataJournal[T any](records []*T, id func(*T) string, entries []metadataJournalEntry) ([]*T, error) {
+	if len(entries) == 0 {
+		return records, nil
+	}
+	positions := make(map[string]int, len(records))
+	for i, record := range records {
+		positions[id(record)] = i
+	}
+	for _, entry := range entries {
+		i, ok := positions[entry.ID]
+		if len(entry.Record) == 0 {
+			if ok {
+				records[i] = nil
+				delete(positions, entry.ID)
+			}
+			continue
+		}
+		record := new(T)
+		if err := json.Unmarshal(entry.Record, record); err != nil {
+			return nil, fmt.Errorf("decoding journaled record for %q: %w", entry.ID, err)
+		}
+		if ok {
+			records[i] = record
+		} else {
+			positions[entry.ID] = len(records)
+			records = append(records, record)
+		}
+	}
+	updated := make([]*T, 0, len(positions))
+	for _, record := range records {
+		if record != nil {
+			updated = append(updated, record)
+		}
+	}
+	return updated, nil
+}
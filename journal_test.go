@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/storage/pkg/reexec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func imageIDs(t *testing.T, store rwImageStore) []string {
+	t.Helper()
+	require.NoError(t, store.startReading())
+	defer store.stopReading()
+	images, err := store.Images()
+	require.NoError(t, err)
+	ids := make([]string, 0, len(images))
+	for _, image := range images {
+		ids = append(ids, image.ID)
+	}
+	return ids
+}
+
+// readableByOlderVersions checks if a JSON file can be decoded as a plain list
+// of records, as versions of the library which don't know about journals
+// expect.
+func readableByOlderVersions(t *testing.T, path string) bool {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var records []map[string]any
+	return json.Unmarshal(data, &records) == nil
+}
+
+func TestImageStoreJournal(t *testing.T) {
+	dir := t.TempDir()
+	writer, err := newImageStore(dir, true, nil)
+	require.NoError(t, err)
+	reader, err := newImageStore(dir, true, nil)
+	require.NoError(t, err)
+	journalPath := filepath.Join(dir, "images.journal")
+
+	addTestImage(t, writer, "one", []string{"name"})
+	addTestImage(t, writer, "two", nil)
+	// images.json is rewritten in a form which older versions refuse
+	// before anything is journaled.
+	assert.False(t, readableByOlderVersions(t, filepath.Join(dir, "images.json")))
+	assert.FileExists(t, journalPath)
+	assert.Equal(t, []string{"one", "two"}, imageIDs(t, reader))
+
+	// Entries which were added since the reader last loaded are applied
+	// to what it has, including changes to images other than the one
+	// which was being modified.
+	require.NoError(t, writer.startWriting())
+	require.NoError(t, writer.updateNames("two", []string{"name"}, setNames))
+	require.NoError(t, writer.Delete("one"))
+	writer.stopWriting()
+	require.NoError(t, reader.startReading())
+	image, err := reader.Get("name")
+	require.NoError(t, err)
+	assert.Equal(t, "two", image.ID)
+	assert.False(t, reader.Exists("one"))
+	reader.stopReading()
+
+	// An entry which was only partially written is ignored, and
+	// overwritten by the next one.
+	f, err := os.OpenFile(journalPath, os.O_WRONLY|os.O_APPEND, 0o600)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"id":"three","rec`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	other, err := newImageStore(dir, true, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"two"}, imageIDs(t, other))
+	addTestImage(t, other, "three", nil)
+	assert.Equal(t, []string{"two", "three"}, imageIDs(t, reader))
+
+	// Once the journal is long enough, it's compacted into images.json.
+	for i := range metadataJournalMinCompaction {
+		addTestImage(t, writer, fmt.Sprintf("image-%d", i), nil)
+	}
+	assert.FileExists(t, filepath.Join(dir, "images.json"))
+	assert.Len(t, imageIDs(t, reader), metadataJournalMinCompaction+2)
+
+	// A writer which doesn't use the journal folds it into images.json.
+	unjournaled, err := newImageStore(dir, false, nil)
+	require.NoError(t, err)
+	addTestImage(t, unjournaled, "four", nil)
+	assert.NoFileExists(t, journalPath)
+	assert.True(t, readableByOlderVersions(t, filepath.Join(dir, "images.json")))
+	assert.Len(t, imageIDs(t, reader), metadataJournalMinCompaction+3)
+}
+
+func TestImageStoreJournalVersion(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "images.journal"), []byte(`{"version":99,"generation":"x"}`+"\n"), 0o600))
+	_, err := newImageStore(dir, true, nil)
+	assert.ErrorContains(t, err, "journal format version 99")
+}
+
+func TestLayerStoreJournal(t *testing.T) {
+	reexec.Init()
+
+	s := newTestStore(t, StoreOptions{MetadataJournal: true}).(*store)
+	defer s.Free()
+
+	base, err := s.CreateLayer("", "", []string{"base"}, "", false, nil)
+	require.NoError(t, err)
+	top, err := s.CreateLayer("", base.ID, nil, "", true, nil)
+	require.NoError(t, err)
+	require.NoError(t, s.SetNames(top.ID, []string{"base"}))
+	removed, err := s.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+	require.NoError(t, s.DeleteLayer(removed.ID))
+	assert.FileExists(t, filepath.Join(s.graphRoot, "vfs-layers", "layers.journal"))
+	assert.False(t, readableByOlderVersions(t, filepath.Join(s.graphRoot, "vfs-layers", "layers.json")))
+
+	// Another instance of the store sees the same layers.
+	other, err := s.newLayerStore(filepath.Join(s.runRoot, "vfs-layers"), filepath.Join(s.graphRoot, "vfs-layers"), "", s.graphDriver, false)
+	require.NoError(t, err)
+	require.NoError(t, other.startReading())
+	defer other.stopReading()
+	layers, err := other.Layers()
+	require.NoError(t, err)
+	require.Len(t, layers, 2)
+	assert.Equal(t, base.ID, layers[0].ID)
+	assert.Empty(t, layers[0].Names)
+	assert.Equal(t, top.ID, layers[1].ID)
+	assert.Equal(t, []string{"base"}, layers[1].Names)
+	assert.Equal(t, base.ID, layers[1].Parent)
+}
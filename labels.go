@@ -0,0 +1,244 @@
+package storage
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// labelRequirementOp is the kind of test which a labelRequirement makes.
+type labelRequirementOp int
+
+const (
+	labelExists labelRequirementOp = iota
+	labelDoesNotExist
+	labelEquals
+	labelNotEquals
+)
+
+// labelRequirement is one of the comma-separated terms in a label selector.
+type labelRequirement struct {
+	op    labelRequirementOp
+	key   string
+	value string
+}
+
+// parseLabelSelector parses a selector made up of comma-separated terms, each
+// of which is one of "key=value", "key==value", "key!=value", "key", which
+// requires that the label be set, or "!key", which requires that it not be.
+// A value which contains commas, or which starts or ends with whitespace, can
+// be written as a double-quoted Go string literal, such as "key=\"A, B\"".
+// An empty selector matches everything.
+func parseLabelSelector(selector string) ([]labelRequirement, error) {
+	var requirements []labelRequirement
+	if strings.TrimSpace(selector) == "" {
+		return nil, nil
+	}
+	terms, err := splitLabelSelector(selector)
+	if err != nil {
+		return nil, fmt.Errorf("parsing label selector %q: %w", selector, err)
+	}
+	for _, term := range terms {
+		term = strings.TrimSpace(term)
+		var requirement labelRequirement
+		// Keys can't contain '=' or '!', so the first of them starts
+		// the operator, even if the value contains more of them.
+		i := strings.IndexAny(term, "=!")
+		switch {
+		case i == -1:
+			requirement = labelRequirement{op: labelExists, key: term}
+		case i == 0 && term[0] == '!':
+			requirement = labelRequirement{op: labelDoesNotExist, key: term[1:]}
+		case strings.HasPrefix(term[i:], "!="):
+			requirement = labelRequirement{op: labelNotEquals, key: term[:i], value: term[i+2:]}
+		case strings.HasPrefix(term[i:], "=="):
+			requirement = labelRequirement{op: labelEquals, key: term[:i], value: term[i+2:]}
+		case term[i] == '=':
+			requirement = labelRequirement{op: labelEquals, key: term[:i], value: term[i+1:]}
+		default:
+			requirement = labelRequirement{op: labelExists, key: term}
+		}
+		requirement.key = strings.TrimSpace(requirement.key)
+		requirement.value = strings.TrimSpace(requirement.value)
+		if err := validateLabelKey(requirement.key); err != nil {
+			return nil, fmt.Errorf("parsing label selector %q: %w", selector, err)
+		}
+		if strings.HasPrefix(requirement.value, `"`) {
+			value, err := strconv.Unquote(requirement.value)
+			if err != nil {
+				return nil, fmt.Errorf("parsing label selector %q: value %s is not a valid quoted string: %w", selector, requirement.value, ErrInvalidLabels)
+			}
+			requirement.value = value
+		}
+		requirements = append(requirements, requirement)
+	}
+	return requirements, nil
+}
+
+// splitLabelSelector splits a selector into its terms at the commas which
+// aren't inside of values which start with a double quote.
+func splitLabelSelector(selector string) ([]string, error) {
+	var terms []string
+	start, quoted, escaped := 0, false, false
+	for i, c := range selector {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"' && (quoted || strings.HasSuffix(strings.TrimSpace(selector[start:i]), "=")):
+			quoted = !quoted
+		case !quoted && c == ',':
+			terms = append(terms, selector[start:i])
+			start = i + 1
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quoted value: %w", ErrInvalidLabels)
+	}
+	return append(terms, selector[start:]), nil
+}
+
+// validateLabelKey checks that key can be used in a label selector.
+func validateLabelKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("label names can not be empty: %w", ErrInvalidLabels)
+	}
+	if strings.ContainsAny(key, "=!, \t\n") {
+		return fmt.Errorf("label name %q contains one of '=', '!', ',', or whitespace: %w", key, ErrInvalidLabels)
+	}
+	return nil
+}
+
+// validateLabels checks that labels can be matched by label selectors.  Any
+// value can be, since values can be quoted in selectors.
+func validateLabels(labels map[string]string) error {
+	for key := range labels {
+		if err := validateLabelKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchesLabels checks if labels meet all of the requirements.
+func matchesLabels(labels map[string]string, requirements []labelRequirement) bool {
+	for _, requirement := range requirements {
+		value, ok := labels[requirement.key]
+		switch requirement.op {
+		case labelExists:
+			if !ok {
+				return false
+			}
+		case labelDoesNotExist:
+			if ok {
+				return false
+			}
+		case labelEquals:
+			if !ok || value != requirement.value {
+				return false
+			}
+		case labelNotEquals:
+			if ok && value == requirement.value {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// labelIndex maps label names to their values, and the values to the IDs of
+// the items which have that label set to that value.
+type labelIndex map[string]map[string]map[string]struct{}
+
+// add records that the item with the specified ID has labels.
+func (x labelIndex) add(id string, labels map[string]string) {
+	for key, value := range labels {
+		values, ok := x[key]
+		if !ok {
+			values = make(map[string]map[string]struct{})
+			x[key] = values
+		}
+		ids, ok := values[value]
+		if !ok {
+			ids = make(map[string]struct{})
+			values[value] = ids
+		}
+		ids[id] = struct{}{}
+	}
+}
+
+// remove forgets that the item with the specified ID has labels.
+func (x labelIndex) remove(id string, labels map[string]string) {
+	for key, value := range labels {
+		values := x[key]
+		delete(values[value], id)
+		if len(values[value]) == 0 {
+			delete(values, value)
+		}
+		if len(values) == 0 {
+			delete(x, key)
+		}
+	}
+}
+
+// candidates returns the IDs of the items which might meet the requirements,
+// based on those requirements which can only be met by items which have a
+// particular label.  If there are no such requirements, every item might
+// meet them, and candidates returns false.
+func (x labelIndex) candidates(requirements []labelRequirement) (map[string]struct{}, bool) {
+	var result map[string]struct{}
+	narrowed := false
+	for _, requirement := range requirements {
+		matching := make(map[string]struct{})
+		switch requirement.op {
+		case labelEquals:
+			for id := range x[requirement.key][requirement.value] {
+				matching[id] = struct{}{}
+			}
+		case labelExists:
+			for _, ids := range x[requirement.key] {
+				for id := range ids {
+					matching[id] = struct{}{}
+				}
+			}
+		default:
+			continue
+		}
+		if narrowed {
+			for id := range result {
+				if _, ok := matching[id]; !ok {
+					delete(result, id)
+				}
+			}
+		} else {
+			result = matching
+			narrowed = true
+		}
+	}
+	return result, narrowed
+}
+
+// selectByLabels returns the items which meet the requirements, sorted by
+// ID, consulting the index to avoid checking items which can't meet them.
+func selectByLabels[T any](index labelIndex, all []*T, byid map[string]*T, id func(*T) string, labels func(*T) map[string]string, requirements []labelRequirement) []*T {
+	var selected []*T
+	if candidates, narrowed := index.candidates(requirements); narrowed {
+		for candidate := range candidates {
+			if item, ok := byid[candidate]; ok && matchesLabels(labels(item), requirements) {
+				selected = append(selected, item)
+			}
+		}
+	} else {
+		for _, item := range all {
+			if matchesLabels(labels(item), requirements) {
+				selected = append(selected, item)
+			}
+		}
+	}
+	slices.SortFunc(selected, func(a, b *T) int {
+		return strings.Compare(id(a), id(b))
+	})
+	return selected
+}
@@ -166,6 +166,9 @@ type Layer struct {
 	// Flags is arbitrary data about the layer.
 	Flags map[string]any `json:"flags,omitempty"`
 
+	// Labels is a set of caller-specified labels.
+	Labels map[string]string `json:"labels,omitempty"`
+
 	// UIDMap and GIDMap are used for setting up a layer's contents
 	// for use inside of a user namespace where UID mapping is being used.
 	UIDMap []idtools.IDMap `json:"uidmap,omitempty"`
@@ -174,6 +177,15 @@ type Layer struct {
 	// ReadOnly is true if this layer resides in a read-only layer store.
 	ReadOnly bool `json:"-"`
 
+	// Tier is ColdLayerTier if the layer's data has been moved to the
+	// store's cold store, and "" if it is where it was created.
+	Tier string `json:"tier,omitempty"`
+
+	// LastUsed is approximately when the layer, or a layer based on it,
+	// was most recently mounted, or had a layer created on top of it.  It
+	// is only recorded by stores which have a cold store.
+	LastUsed time.Time `json:"last-used,omitempty"`
+
 	// location is the location of the store where the layer is present.
 	location layerLocations `json:"-"`
 
@@ -195,11 +207,55 @@ type DiffOptions struct {
 	Compression *archive.Compression
 }
 
+// LayerUsage describes how much of the disk space used by a layer is shared
+// with other layers.
+type LayerUsage struct {
+	// Exclusive is the number of bytes used only by the layer, which would
+	// be freed if it were deleted.
+	Exclusive int64 `json:"exclusive"`
+	// Shared is the number of bytes of the layer's contents which are
+	// shared with other layers, typically its parent and its children.
+	Shared int64 `json:"shared"`
+}
+
 // stagedLayerOptions are the options passed to .create to populate a staged
 // layer
 type stagedLayerOptions struct {
 	DiffOutput  *drivers.DriverWithDifferOutput
 	DiffOptions *drivers.ApplyDiffWithDifferOpts
+
+	// NativeDiff, if set, is a stream produced by nativeDiff which is used
+	// to populate the layer instead of DiffOutput.
+	NativeDiff io.Reader
+
+	// Clone, if set, has a read-write TemplateLayer, which must have the
+	// same parent as the new layer, copied using the driver's CloneLayer,
+	// if it has one, so that the copy doesn't depend on the template.
+	Clone bool
+
+	// CloneFromIDMappings and CloneToIDMappings, if the latter is set,
+	// are the mappings to change the ownership of the copy of a
+	// read-write TemplateLayer's own contents from and to, when the
+	// driver copies it using CloneLayer.
+	CloneFromIDMappings, CloneToIDMappings *idtools.IDMappings
+}
+
+// nativeDiffHeader precedes the storage driver's data in streams produced by
+// layerStore.nativeDiff.  Along with the layer's digests, it carries the
+// tar-split data which lets the receiving store recreate the layer's tar
+// diff, so that the received contents can be verified against TarDigest.
+type nativeDiffHeader struct {
+	Driver             string              `json:"driver"`
+	CompressedDigest   digest.Digest       `json:"compressed-diff-digest,omitempty"`
+	CompressedSize     int64               `json:"compressed-size,omitempty"`
+	UncompressedDigest digest.Digest       `json:"diff-digest,omitempty"`
+	UncompressedSize   int64               `json:"diff-size,omitempty"`
+	CompressionType    archive.Compression `json:"compression,omitempty"`
+	UIDs               []uint32            `json:"uidset,omitempty"`
+	GIDs               []uint32            `json:"gidset,omitempty"`
+	TarSplit           []byte              `json:"tar-split"`
+	TarDigest          digest.Digest       `json:"tar-digest"`
+	TarSize            int64               `json:"tar-size"`
 }
 
 // roLayerStore wraps a graph driver, adding the ability to refer to layers by
@@ -243,6 +299,14 @@ type roLayerStore interface {
 	// produced by Diff.
 	DiffSize(from, to string) (int64, error)
 
+	// verifyVerity checks that the files in a layer which was sealed when
+	// it was populated still match the fs-verity digests recorded for them.
+	verifyVerity(id string) error
+
+	// Usage returns how much of the disk space used by the layer is shared
+	// with other layers, if the storage driver keeps track of that.
+	Usage(id string) (*LayerUsage, error)
+
 	// Size produces a cached value for the uncompressed size of the layer,
 	// if one is known, or -1 if it is not known.  If the layer can not be
 	// found, it returns an error.
@@ -262,6 +326,11 @@ type roLayerStore interface {
 
 	// Layers returns a slice of the known layers.
 	Layers() ([]Layer, error)
+
+	// layersMatching returns copies of the known layers for which match
+	// returns true.  match must not modify or keep the layers it is
+	// passed.
+	layersMatching(match func(*Layer) bool) []Layer
 }
 
 // rwLayerStore wraps a graph driver, adding the ability to refer to layers by
@@ -271,6 +340,7 @@ type rwLayerStore interface {
 	roLayerStore
 	rwMetadataStore
 	flaggableStore
+	rwLabelStore
 	rwLayerBigDataStore
 
 	// startWriting makes sure the store is fresh, and locks it for writing.
@@ -354,6 +424,45 @@ type rwLayerStore interface {
 
 	// Dedup deduplicates layers in the store.
 	dedup(drivers.DedupArgs) (drivers.DedupResult, error)
+
+	// createSnapshot saves the current contents of a read-write layer under
+	// the given snapshot name.
+	createSnapshot(id, snapshot string) error
+
+	// restoreSnapshot replaces the contents of a read-write layer, which
+	// must not be mounted, with those saved in a snapshot.  It returns the
+	// names of other snapshots which the driver discarded while doing so.
+	restoreSnapshot(id, snapshot string) ([]string, error)
+
+	// removeSnapshot discards a snapshot of a read-write layer.
+	removeSnapshot(id, snapshot string) error
+
+	// resize changes the size limit of a read-write layer.
+	resize(id string, size uint64) error
+
+	// mountCounts returns the mount counts recorded in the run root for
+	// every mounted layer, including layers which this store doesn't know.
+	mountCounts() (map[string]int, error)
+
+	// nativeDiff returns the changes between a layer and its parent in a
+	// format specific to the storage driver, which can be used to
+	// populate a layer in another store by passing it to create() as part
+	// of a stagedLayerOptions.
+	nativeDiff(id string) (io.ReadCloser, error)
+
+	// moveToTier moves a layer's data to the cold store if tier is
+	// ColdLayerTier, or back from it if tier is "".
+	moveToTier(id, tier string) error
+
+	// usageStatus returns status information about the number of layers
+	// in the store and the total size of their contents, and the limits
+	// on them, if any.
+	usageStatus() [][2]string
+
+	// markUsed records that a layer, and the layers it is based on, were
+	// used, and moves any of them which are in the cold store, and which
+	// aren't being used by mounted layers, back out of it.
+	markUsed(id string) error
 }
 
 type multipleLockFile struct {
@@ -432,6 +541,7 @@ type layerStore struct {
 	lastWrite           lockfile.LastWrite
 	mountsLastWrite     lockfile.LastWrite // Only valid if lockfile.IsReadWrite()
 	layers              []*Layer
+	layersUsage         layerStoreUsage // Kept in sync with layers; see storequota.go.
 	idindex             *truncindex.TruncIndex
 	byid                map[string]*Layer
 	byname              map[string]*Layer
@@ -440,10 +550,29 @@ type layerStore struct {
 	byuncompressedsum   map[digest.Digest][]string
 	bytocsum            map[digest.Digest][]string
 	layerspathsModified [numLayerLocationIndex]time.Time
+	journals            [numLayerLocationIndex]metadataJournal
 
 	// FIXME: This field is only set when constructing layerStore, but locking rules of the driver
 	// interface itself are not documented here.
 	driver drivers.Driver
+
+	// verity is set if files in newly-populated read-only layers should
+	// have fs-verity enabled.
+	verity bool
+	// verifiedLayers maps the IDs of sealed layers which have already been
+	// verified before being mounted to the digests of the records which
+	// they were verified against.
+	verifiedLayers     map[string]digest.Digest
+	verifiedLayersLock sync.Mutex
+
+	// journaled is set if changes to layers should be appended to the
+	// metadata journals instead of rewriting the layers.json files.
+	journaled bool
+
+	// quotaLayers and quotaSize limit the number of layers in the store,
+	// and the total size of their contents, if they are set.
+	quotaLayers int
+	quotaSize   int64
 }
 
 func copyLayer(l *Layer) *Layer {
@@ -463,9 +592,12 @@ func copyLayer(l *Layer) *Layer {
 		TOCDigest:          l.TOCDigest,
 		CompressionType:    l.CompressionType,
 		ReadOnly:           l.ReadOnly,
+		Tier:               l.Tier,
+		LastUsed:           l.LastUsed,
 		location:           l.location,
 		BigDataNames:       copySlicePreferringNil(l.BigDataNames),
 		Flags:              copyMapPreferringNil(l.Flags),
+		Labels:             copyMapPreferringNil(l.Labels),
 		UIDMap:             copySlicePreferringNil(l.UIDMap),
 		GIDMap:             copySlicePreferringNil(l.GIDMap),
 		UIDs:               copySlicePreferringNil(l.UIDs),
@@ -741,6 +873,17 @@ func (r *layerStore) reloadMountsIfChanged() error {
 	return nil
 }
 
+// Requires startReading or startWriting.
+func (r *layerStore) layersMatching(match func(*Layer) bool) []Layer {
+	var layers []Layer
+	for _, layer := range r.layers {
+		if match(layer) {
+			layers = append(layers, *copyLayer(layer))
+		}
+	}
+	return layers
+}
+
 // Requires startReading or startWriting.
 func (r *layerStore) Layers() ([]Layer, error) {
 	layers := make([]Layer, len(r.layers))
@@ -802,6 +945,7 @@ func (r *layerStore) load(lockedForWriting bool) (bool, error) {
 
 	layers := []*Layer{}
 	ids := make(map[string]*Layer)
+	journals := r.journals
 
 	if r.lockfile.IsReadWrite() {
 		if err := tempdir.RecoverStaleDirs(filepath.Join(r.layerdir, tempDirPath)); err != nil {
@@ -820,25 +964,49 @@ func (r *layerStore) load(lockedForWriting bool) (bool, error) {
 		if rpath == "" {
 			continue
 		}
+		var snapshot time.Time
 		info, err := os.Stat(rpath)
 		if err != nil {
 			if !os.IsNotExist(err) {
 				return false, err
 			}
 		} else {
-			r.layerspathsModified[locationIndex] = info.ModTime()
+			snapshot = info.ModTime()
+			r.layerspathsModified[locationIndex] = snapshot
 		}
-		data, err := os.ReadFile(rpath)
-		if err != nil && !os.IsNotExist(err) {
+		if journals[locationIndex].path == "" {
+			journals[locationIndex] = newMetadataJournal(rpath)
+		}
+		journal, entries, incremental, err := journals[locationIndex].read(snapshot, r.layers != nil)
+		if err != nil {
 			return false, err
 		}
 
 		locationLayers := []*Layer{}
-		if len(data) != 0 {
-			if err := json.Unmarshal(data, &locationLayers); err != nil {
+		if incremental {
+			// Only the journal has been added to since we last loaded, so
+			// start from copies of what we have instead of parsing the
+			// snapshot again.
+			for _, layer := range r.layers {
+				if layer.location == location {
+					locationLayers = append(locationLayers, copyLayer(layer))
+				}
+			}
+		} else {
+			data, err := os.ReadFile(rpath)
+			if err != nil && !os.IsNotExist(err) {
+				return false, err
+			}
+			locationLayers, journal.guarded, err = decodeMetadataSnapshot[Layer](data)
+			if err != nil {
 				return false, fmt.Errorf("loading %q: %w", rpath, err)
 			}
 		}
+		locationLayers, err = applyMetadataJournal(locationLayers, func(layer *Layer) string { return layer.ID }, entries)
+		if err != nil {
+			return false, fmt.Errorf("loading %q: %w", journal.path, err)
+		}
+		journals[locationIndex] = journal
 
 		for _, layer := range locationLayers {
 			// There should be no duplicated ids between json files, but lets check to be sure
@@ -902,6 +1070,8 @@ func (r *layerStore) load(lockedForWriting bool) (bool, error) {
 		}
 	}
 	r.layers = layers
+	r.layersUsage = computeUsage(layers)
+	r.journals = journals
 	r.idindex = truncindex.NewTruncIndex(idlist) // Invalid values in idlist are ignored: they are not a reason to refuse processing the whole store.
 	r.byid = ids
 	r.byname = names
@@ -1033,11 +1203,84 @@ func (r *layerStore) save(saveLocations layerLocations) error {
 	return r.saveMounts()
 }
 
-// saveFor saves the contents of the store relevant for modifiedLayer to disk.
+// saveFor saves the contents of the store relevant for modifiedLayers, which
+// may have been deleted, to disk.
 // The caller must hold r.lockfile locked for writing.
 // The caller must hold r.inProcessLock for WRITING.
-func (r *layerStore) saveFor(modifiedLayer *Layer) error {
-	return r.save(modifiedLayer.location)
+func (r *layerStore) saveFor(modifiedLayers ...*Layer) error {
+	if !r.journaled {
+		var saveLocations layerLocations
+		for _, layer := range modifiedLayers {
+			saveLocations |= layer.location
+		}
+		return r.save(saveLocations)
+	}
+	r.mountsLockfile.Lock()
+	defer r.mountsLockfile.Unlock()
+	if err := r.journalLayers(modifiedLayers); err != nil {
+		return err
+	}
+	return r.saveMounts()
+}
+
+// journalLayers appends the current state of modifiedLayers, which may have
+// been deleted, to the journals for their locations, or compacts the journals
+// into new snapshots if they have grown long enough.
+// The caller must hold r.lockfile locked for writing.
+// The caller must hold r.inProcessLock for WRITING.
+func (r *layerStore) journalLayers(modifiedLayers []*Layer) error {
+	if !r.lockfile.IsReadWrite() {
+		return fmt.Errorf("not allowed to modify the layer store at %q: %w", r.layerdir, ErrStoreIsReadOnly)
+	}
+	r.lockfile.AssertLockedForWriting()
+
+	var entries [numLayerLocationIndex][]metadataJournalEntry
+	for _, layer := range modifiedLayers {
+		entry := metadataJournalEntry{ID: layer.ID}
+		if r.byid[layer.ID] == layer {
+			record, err := json.Marshal(layer)
+			if err != nil {
+				return err
+			}
+			entry.Record = record
+		}
+		locationIndex := indexFromLayerLocation(layer.location)
+		entries[locationIndex] = append(entries[locationIndex], entry)
+	}
+
+	// This must be done before we write the journal, because the process could be terminated
+	// after the journal is written but before the lock file is updated.
+	lw, err := r.lockfile.RecordWrite()
+	if err != nil {
+		return err
+	}
+	r.lastWrite = lw
+
+	var compactLocations layerLocations
+	for locationIndex := range numLayerLocationIndex {
+		if len(entries[locationIndex]) == 0 {
+			continue
+		}
+		location := layerLocationFromIndex(locationIndex)
+		if r.jsonPath[locationIndex] == "" {
+			return fmt.Errorf("internal error: no path for location %v", location)
+		}
+		journal := &r.journals[locationIndex]
+		if journal.needsCompaction(len(r.layers)) {
+			compactLocations |= location
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(journal.path), 0o700); err != nil {
+			return err
+		}
+		if err := journal.append(entries[locationIndex], location == volatileLayerLocation); err != nil {
+			return err
+		}
+	}
+	if compactLocations != 0 {
+		return r.saveLayers(compactLocations)
+	}
+	return nil
 }
 
 // The caller must hold r.lockfile locked for writing.
@@ -1075,7 +1318,7 @@ func (r *layerStore) saveLayers(saveLocations layerLocations) error {
 			}
 		}
 
-		jldata, err := json.Marshal(&subsetLayers)
+		jldata, err := encodeMetadataSnapshot(subsetLayers, r.journaled)
 		if err != nil {
 			return err
 		}
@@ -1087,6 +1330,7 @@ func (r *layerStore) saveLayers(saveLocations layerLocations) error {
 			return err
 		}
 		r.layerspathsModified[locationIndex] = opts.ModTime
+		r.journals[locationIndex].compacted(opts.ModTime, r.journaled)
 	}
 	return nil
 }
@@ -1189,7 +1433,11 @@ func (s *store) newLayerStore(rundir, layerdir, imagedir string, driver drivers.
 		byname:  make(map[string]*Layer),
 		bymount: make(map[string]*Layer),
 
-		driver: driver,
+		driver:      driver,
+		verity:      s.layerVerity,
+		journaled:   s.metadataJournal,
+		quotaLayers: s.quotaLayers,
+		quotaSize:   s.quotaSize,
 	}
 	if err := rlstore.startWritingWithReload(false); err != nil {
 		return nil, err
@@ -1340,6 +1588,7 @@ func (r *layerStore) PutAdditionalLayer(id string, parentLayer *Layer, names []s
 
 	// TODO: check if necessary fields are filled
 	r.layers = append(r.layers, layer)
+	r.addUsage(layer)
 	// This can only fail on duplicate IDs, which shouldn’t happen — and in
 	// that case the index is already in the desired state anyway.
 	// Implementing recovery from an unlikely and unimportant failure here
@@ -1403,6 +1652,9 @@ func (r *layerStore) create(id string, parentLayer *Layer, names []string, mount
 	if duplicateLayer, idInUse := r.byid[id]; idInUse {
 		return duplicateLayer, -1, ErrDuplicateID
 	}
+	if err := validateLabels(moreOptions.Labels); err != nil {
+		return nil, -1, err
+	}
 	names = dedupeStrings(names)
 	for _, name := range names {
 		if _, nameInUse := r.byname[name]; nameInUse {
@@ -1412,6 +1664,11 @@ func (r *layerStore) create(id string, parentLayer *Layer, names []string, mount
 	parent := ""
 	if parentLayer != nil {
 		parent = parentLayer.ID
+		if _, ok := r.byid[parent]; ok {
+			if err := r.markUsed(parent); err != nil {
+				return nil, -1, err
+			}
+		}
 	}
 	var (
 		templateIDMappings         *idtools.IDMappings
@@ -1430,6 +1687,9 @@ func (r *layerStore) create(id string, parentLayer *Layer, names []string, mount
 		if !ok {
 			return nil, -1, ErrLayerUnknown
 		}
+		if slo != nil && slo.Clone && templateLayer.Parent != parent {
+			return nil, -1, fmt.Errorf("cloning layer %q, whose parent is %q, as a layer whose parent is %q: parents must match", templateLayer.ID, templateLayer.Parent, parent)
+		}
 		templateMetadata = templateLayer.Metadata
 		templateIDMappings = idtools.NewIDMappingsFromMaps(templateLayer.UIDMap, templateLayer.GIDMap)
 		templateTOCDigest = templateLayer.TOCDigest
@@ -1444,6 +1704,9 @@ func (r *layerStore) create(id string, parentLayer *Layer, names []string, mount
 	} else {
 		templateIDMappings = &idtools.IDMappings{}
 	}
+	if err := r.checkQuota(1, max(templateUncompressedSize, 0)); err != nil {
+		return nil, -1, err
+	}
 	if mountLabel != "" {
 		selinux.ReserveLabel(mountLabel)
 	}
@@ -1467,14 +1730,20 @@ func (r *layerStore) create(id string, parentLayer *Layer, names []string, mount
 		UIDs:               templateUIDs,
 		GIDs:               templateGIDs,
 		Flags:              newMapFrom(moreOptions.Flags),
+		Labels:             copyMapPreferringNil(moreOptions.Labels),
 		UIDMap:             copySlicePreferringNil(moreOptions.UIDMap),
 		GIDMap:             copySlicePreferringNil(moreOptions.GIDMap),
 		BigDataNames:       []string{},
 		location:           r.pickStoreLocation(moreOptions.Volatile, writeable),
 	}
 	layer.Flags[incompleteFlag] = true
+	if r.verity && !writeable && diff == nil && slo == nil {
+		// Seal the layer when a diff is applied to it later.
+		layer.Flags[verityPendingFlag] = true
+	}
 
 	r.layers = append(r.layers, layer)
+	r.addUsage(layer)
 	// This can only fail if the ID is already missing, which shouldn’t
 	// happen — and in that case the index is already in the desired state
 	// anyway.  This is on various paths to recover from failures, so this
@@ -1526,7 +1795,16 @@ func (r *layerStore) create(id string, parentLayer *Layer, names []string, mount
 		parentMappings = &idtools.IDMappings{}
 	}
 	if moreOptions.TemplateLayer != "" {
-		if err = r.driver.CreateFromTemplate(id, moreOptions.TemplateLayer, templateIDMappings, parent, parentMappings, &opts, writeable); err != nil {
+		// A driver's CreateFromTemplate can produce a layer which
+		// depends on the template, which is fine for a read-only copy
+		// of an image's layer, but not for a copy of a container's
+		// layer, which can be changed or deleted at any time.
+		if cdriver, ok := drivers.AsCloneDriver(r.driver); ok && writeable && slo != nil && slo.Clone {
+			err = cdriver.CloneLayer(id, moreOptions.TemplateLayer, parent, &opts, slo.CloneFromIDMappings, slo.CloneToIDMappings)
+		} else {
+			err = r.driver.CreateFromTemplate(id, moreOptions.TemplateLayer, templateIDMappings, parent, parentMappings, &opts, writeable)
+		}
+		if err != nil {
 			cleanupFailureContext = fmt.Sprintf("creating a layer from template layer %q", moreOptions.TemplateLayer)
 			return nil, -1, fmt.Errorf("creating copy of template layer %q with ID %q: %w", moreOptions.TemplateLayer, id, err)
 		}
@@ -1573,7 +1851,12 @@ func (r *layerStore) create(id string, parentLayer *Layer, names []string, mount
 			cleanupFailureContext = "applying layer diff"
 			return nil, -1, err
 		}
-	} else if slo != nil {
+	} else if slo != nil && slo.NativeDiff != nil {
+		if err := r.applyNativeDiff(layer.ID, slo.NativeDiff); err != nil {
+			cleanupFailureContext = "applying native diff"
+			return nil, -1, err
+		}
+	} else if slo != nil && slo.DiffOutput != nil {
 		if err := r.applyDiffFromStagingDirectory(layer.ID, slo.DiffOutput, slo.DiffOptions); err != nil {
 			cleanupFailureContext = "applying staged directory diff"
 			return nil, -1, err
@@ -1594,6 +1877,13 @@ func (r *layerStore) create(id string, parentLayer *Layer, names []string, mount
 		}
 	}
 
+	if r.verity && !writeable && (diff != nil || slo != nil) {
+		if err = r.sealLayer(layer); err != nil {
+			cleanupFailureContext = "sealing layer contents"
+			return nil, -1, err
+		}
+	}
+
 	delete(layer.Flags, incompleteFlag)
 	if err = r.saveFor(layer); err != nil {
 		cleanupFailureContext = "saving finished layer metadata"
@@ -1664,6 +1954,9 @@ func (r *layerStore) Mount(id string, options drivers.MountOpts) (string, error)
 			return "", fmt.Errorf("cannot mount layer %v: shifting not enabled", layer.ID)
 		}
 	}
+	if err := r.verifyLayerChain(layer); err != nil {
+		return "", err
+	}
 	mountpoint, err := r.driver.Get(id, options)
 	if mountpoint != "" && err == nil {
 		if layer.MountPoint != "" {
@@ -1822,14 +2115,16 @@ func (r *layerStore) updateNames(id string, names []string, op updateNameOperati
 	for _, name := range oldNames {
 		delete(r.byname, name)
 	}
+	modifiedLayers := []*Layer{layer}
 	for _, name := range names {
 		if otherLayer, ok := r.byname[name]; ok {
 			r.removeName(otherLayer, name)
+			modifiedLayers = append(modifiedLayers, otherLayer)
 		}
 		r.byname[name] = layer
 	}
 	layer.Names = names
-	return r.saveFor(layer)
+	return r.saveFor(modifiedLayers...)
 }
 
 func (r *layerStore) datadir(id string) string {
@@ -1926,6 +2221,21 @@ func (r *layerStore) SetMetadata(id, metadata string) error {
 	return ErrLayerUnknown
 }
 
+// Requires startWriting.
+func (r *layerStore) SetLabels(id string, labels map[string]string) error {
+	if !r.lockfile.IsReadWrite() {
+		return fmt.Errorf("not allowed to modify layer labels at %q: %w", r.layerdir, ErrStoreIsReadOnly)
+	}
+	if err := validateLabels(labels); err != nil {
+		return err
+	}
+	if layer, ok := r.lookup(id); ok {
+		layer.Labels = copyMapPreferringNil(labels)
+		return r.saveFor(layer)
+	}
+	return ErrLayerUnknown
+}
+
 func (r *layerStore) tspath(id string) string {
 	return filepath.Join(r.layerdir, id+tarSplitSuffix)
 }
@@ -2001,9 +2311,13 @@ func (r *layerStore) internalDelete(id string) ([]tempdir.CleanupTempDirFunc, er
 		delete(r.bymount, layer.MountPoint)
 	}
 	r.deleteInDigestMap(id)
+	count := len(r.layers)
 	r.layers = slices.DeleteFunc(r.layers, func(candidate *Layer) bool {
 		return candidate.ID == id
 	})
+	if len(r.layers) < count {
+		r.removeUsage(layer)
+	}
 	if mountLabel != "" && !slices.ContainsFunc(r.layers, func(candidate *Layer) bool {
 		return candidate.MountLabel == mountLabel
 	}) {
@@ -2374,6 +2688,29 @@ func (r *layerStore) DiffSize(from, to string) (size int64, err error) {
 	return r.driver.DiffSize(to, r.layerMappings(toLayer), from, r.layerMappings(fromLayer), toLayer.MountLabel)
 }
 
+// Requires startReading or startWriting.
+func (r *layerStore) Usage(id string) (*LayerUsage, error) {
+	layer, ok := r.lookup(id)
+	if !ok {
+		return nil, ErrLayerUnknown
+	}
+	udriver, ok := drivers.AsUsageDriver(r.driver)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	usage, err := udriver.LayerUsage(layer.ID)
+	if err != nil {
+		if errors.Is(err, drivers.ErrNotSupported) {
+			return nil, fmt.Errorf("%w: %w", ErrNotSupported, err)
+		}
+		return nil, err
+	}
+	return &LayerUsage{
+		Exclusive: usage.Exclusive,
+		Shared:    usage.Referenced - usage.Exclusive,
+	}, nil
+}
+
 func updateDigestMap(m *map[digest.Digest][]string, oldvalue, newvalue digest.Digest, id string) {
 	var newList []string
 	if oldvalue != "" {
@@ -2477,7 +2814,8 @@ func (r *layerStore) applyDiffWithOptions(to string, layerOptions *LayerOptions,
 		if uncompressedDigester != nil {
 			uncompressedWriter = io.MultiWriter(uncompressedWriter, uncompressedDigester.Hash())
 		}
-		payload, err := asm.NewInputTarStream(io.TeeReader(uncompressed, uncompressedWriter), metadata, storage.NewDiscardFilePutter())
+		quota := r.quotaReader(layer, uncompressed)
+		payload, err := asm.NewInputTarStream(io.TeeReader(quota, uncompressedWriter), metadata, storage.NewDiscardFilePutter())
 		if err != nil {
 			return -1, err
 		}
@@ -2488,6 +2826,10 @@ func (r *layerStore) applyDiffWithOptions(to string, layerOptions *LayerOptions,
 		}
 		size, err := r.driver.ApplyDiff(layer.ID, layer.Parent, options)
 		if err != nil {
+			if quota.err != nil {
+				// The driver may have only noticed that the diff was cut short.
+				return -1, quota.err
+			}
 			return -1, err
 		}
 		return size, err
@@ -2521,7 +2863,7 @@ func (r *layerStore) applyDiffWithOptions(to string, layerOptions *LayerOptions,
 	}
 	updateDigestMap(&r.byuncompressedsum, layer.UncompressedDigest, uncompressedDigest, layer.ID)
 	layer.UncompressedDigest = uncompressedDigest
-	layer.UncompressedSize = uncompressedCounter.Count
+	r.setUncompressedSize(layer, uncompressedCounter.Count)
 	layer.CompressionType = compression
 	layer.UIDs = make([]uint32, 0, len(uidLog))
 	for uid := range uidLog {
@@ -2534,6 +2876,9 @@ func (r *layerStore) applyDiffWithOptions(to string, layerOptions *LayerOptions,
 	}
 	slices.Sort(layer.GIDs)
 
+	if err := r.resealLayer(layer); err != nil {
+		return -1, err
+	}
 	err = r.saveFor(layer)
 
 	return size, err
@@ -2572,6 +2917,11 @@ func (r *layerStore) applyDiffFromStagingDirectory(id string, diffOutput *driver
 		}
 	}
 
+	oldQuotaSize := layerQuotaSize(layer)
+	if err := r.checkQuota(0, diffOutput.Size-oldQuotaSize); err != nil {
+		return err
+	}
+
 	err := ddriver.ApplyDiffFromStagingDirectory(layer.ID, layer.Parent, diffOutput, options)
 	if err != nil {
 		return err
@@ -2584,7 +2934,7 @@ func (r *layerStore) applyDiffFromStagingDirectory(id string, diffOutput *driver
 	layer.CompressedDigest = diffOutput.CompressedDigest
 	updateDigestMap(&r.bytocsum, layer.TOCDigest, diffOutput.TOCDigest, layer.ID)
 	layer.TOCDigest = diffOutput.TOCDigest
-	layer.UncompressedSize = diffOutput.Size
+	r.setUncompressedSize(layer, diffOutput.Size)
 	layer.Metadata = diffOutput.Metadata
 	if options != nil && options.Flags != nil {
 		if layer.Flags == nil {
@@ -2592,6 +2942,9 @@ func (r *layerStore) applyDiffFromStagingDirectory(id string, diffOutput *driver
 		}
 		maps.Copy(layer.Flags, options.Flags)
 	}
+	if err := r.resealLayer(layer); err != nil {
+		return err
+	}
 	if err = r.saveFor(layer); err != nil {
 		return err
 	}
@@ -2684,6 +3037,99 @@ func (r *layerStore) dedup(req drivers.DedupArgs) (drivers.DedupResult, error) {
 	return r.driver.Dedup(req)
 }
 
+// Requires startWriting.
+func (r *layerStore) createSnapshot(id, snapshot string) error {
+	sdriver, ok := drivers.AsSnapshotDriver(r.driver)
+	if !ok {
+		return ErrNotSupported
+	}
+	layer, ok := r.lookup(id)
+	if !ok {
+		return ErrLayerUnknown
+	}
+	return sdriver.CreateLayerSnapshot(layer.ID, snapshot)
+}
+
+// Requires startWriting.
+func (r *layerStore) restoreSnapshot(id, snapshot string) ([]string, error) {
+	sdriver, ok := drivers.AsSnapshotDriver(r.driver)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	// Keep the layer from being mounted while its contents are replaced.
+	r.mountsLockfile.Lock()
+	defer r.mountsLockfile.Unlock()
+	if err := r.reloadMountsIfChanged(); err != nil {
+		return nil, err
+	}
+	layer, ok := r.lookup(id)
+	if !ok {
+		return nil, ErrLayerUnknown
+	}
+	if layer.MountCount > 0 {
+		return nil, fmt.Errorf("restoring snapshot %q of layer %q, which is mounted", snapshot, layer.ID)
+	}
+	return sdriver.RestoreLayerSnapshot(layer.ID, snapshot)
+}
+
+// Requires startWriting.
+func (r *layerStore) removeSnapshot(id, snapshot string) error {
+	sdriver, ok := drivers.AsSnapshotDriver(r.driver)
+	if !ok {
+		return ErrNotSupported
+	}
+	layer, ok := r.lookup(id)
+	if !ok {
+		return ErrLayerUnknown
+	}
+	return sdriver.RemoveLayerSnapshot(layer.ID, snapshot)
+}
+
+// Requires startWriting.
+func (r *layerStore) resize(id string, size uint64) error {
+	rdriver, ok := drivers.AsResizableDriver(r.driver)
+	if !ok {
+		return ErrNotSupported
+	}
+	layer, ok := r.lookup(id)
+	if !ok {
+		return ErrLayerUnknown
+	}
+	if err := rdriver.ResizeLayer(layer.ID, size); err != nil {
+		if errors.Is(err, drivers.ErrNotSupported) {
+			return fmt.Errorf("%w: %w", ErrNotSupported, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// Requires startReading or startWriting.
+func (r *layerStore) mountCounts() (map[string]int, error) {
+	r.mountsLockfile.RLock()
+	defer r.mountsLockfile.Unlock()
+	// Unlike loadMounts, keep entries for layers which aren't in this
+	// store: other processes record mounts of layers from additional image
+	// stores in the same file.
+	data, err := os.ReadFile(r.mountspath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	layerMounts := []layerMountPoint{}
+	if len(data) != 0 {
+		if err := json.Unmarshal(data, &layerMounts); err != nil {
+			return nil, err
+		}
+	}
+	counts := make(map[string]int)
+	for _, mount := range layerMounts {
+		if mount.MountPoint != "" && mount.MountCount > 0 {
+			counts[mount.ID] += mount.MountCount
+		}
+	}
+	return counts, nil
+}
+
 func closeAll(closes ...func() error) (rErr error) {
 	for _, f := range closes {
 		if err := f(); err != nil {
@@ -2696,3 +3142,148 @@ func closeAll(closes ...func() error) (rErr error) {
 	}
 	return
 }
+
+// Requires startWriting.
+func (r *layerStore) nativeDiff(id string) (io.ReadCloser, error) {
+	ndriver, ok := drivers.AsNativeDiffDriver(r.driver)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	layer, ok := r.lookup(id)
+	if !ok {
+		return nil, ErrLayerUnknown
+	}
+	header := nativeDiffHeader{
+		Driver:             r.driver.String(),
+		CompressedDigest:   layer.CompressedDigest,
+		CompressedSize:     layer.CompressedSize,
+		UncompressedDigest: layer.UncompressedDigest,
+		UncompressedSize:   layer.UncompressedSize,
+		CompressionType:    layer.CompressionType,
+		UIDs:               layer.UIDs,
+		GIDs:               layer.GIDs,
+	}
+	tsdata, err := os.ReadFile(r.tspath(layer.ID))
+	switch {
+	case err == nil && layer.UncompressedDigest != "":
+		header.TarSplit = tsdata
+		header.TarDigest = layer.UncompressedDigest
+		header.TarSize = layer.UncompressedSize
+	case err == nil || errors.Is(err, os.ErrNotExist):
+		// We don't know what the layer's original tar diff looked like,
+		// so describe the one which the driver generates instead.
+		if header.TarSplit, header.TarDigest, header.TarSize, err = r.generateTarSplit(layer); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	hdata, err := json.Marshal(&header)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := ndriver.NativeDiff(layer.ID, layer.Parent)
+	if err != nil {
+		return nil, err
+	}
+	return ioutils.NewReadCloserWrapper(io.MultiReader(bytes.NewReader(hdata), stream), stream.Close), nil
+}
+
+// generateTarSplit returns compressed tar-split data describing the tar diff
+// which the driver generates for the layer, along with that diff's digest and
+// size.
+// Requires startWriting.
+func (r *layerStore) generateTarSplit(layer *Layer) ([]byte, digest.Digest, int64, error) {
+	uncompressed := archive.Uncompressed
+	diff, err := r.Diff(layer.Parent, layer.ID, &DiffOptions{Compression: &uncompressed})
+	if err != nil {
+		return nil, "", -1, err
+	}
+	defer diff.Close()
+
+	tsdata := bytes.Buffer{}
+	digester := digest.Canonical.Digester()
+	counter := ioutils.NewWriteCounter(digester.Hash())
+	err = func() error { // A scope for defer
+		compressor, err := pgzip.NewWriterLevel(&tsdata, pgzip.BestSpeed)
+		if err != nil {
+			return err
+		}
+		defer compressor.Close() // This must happen before tsdata is consumed.
+		metadata := storage.NewJSONPacker(compressor)
+		payload, err := asm.NewInputTarStream(io.TeeReader(diff, counter), metadata, storage.NewDiscardFilePutter())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(io.Discard, payload)
+		return err
+	}()
+	if err != nil {
+		return nil, "", -1, err
+	}
+	return tsdata.Bytes(), digester.Digest(), counter.Count, nil
+}
+
+// Requires startWriting.
+func (r *layerStore) applyNativeDiff(id string, diff io.Reader) error {
+	ndriver, ok := drivers.AsNativeDiffDriver(r.driver)
+	if !ok {
+		return ErrNotSupported
+	}
+	layer, ok := r.lookup(id)
+	if !ok {
+		return ErrLayerUnknown
+	}
+	decoder := json.NewDecoder(diff)
+	var header nativeDiffHeader
+	if err := decoder.Decode(&header); err != nil {
+		return fmt.Errorf("reading native diff header: %w", err)
+	}
+	if header.Driver != r.driver.String() {
+		return fmt.Errorf("applying a native diff from the %q driver using the %q driver: %w", header.Driver, r.driver.String(), ErrNotSupported)
+	}
+	oldQuotaSize := layerQuotaSize(layer)
+	if err := r.checkQuota(0, header.UncompressedSize-oldQuotaSize); err != nil {
+		return err
+	}
+	if err := ndriver.ApplyNativeDiff(layer.ID, layer.Parent, io.MultiReader(decoder.Buffered(), diff)); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(r.tspath(layer.ID)), 0o700); err != nil {
+		return err
+	}
+	if err := ioutils.AtomicWriteFile(r.tspath(layer.ID), header.TarSplit, 0o600); err != nil {
+		return err
+	}
+
+	// Verify what we received by putting the tar diff back together.
+	uncompressed := archive.Uncompressed
+	rc, err := r.Diff(layer.Parent, layer.ID, &DiffOptions{Compression: &uncompressed})
+	if err != nil {
+		return err
+	}
+	digester := digest.Canonical.Digester()
+	size, err := io.Copy(digester.Hash(), rc)
+	if err2 := rc.Close(); err2 != nil && err == nil {
+		err = err2
+	}
+	if err != nil {
+		return fmt.Errorf("recomputing the diff of layer %q: %w", layer.ID, err)
+	}
+	if digester.Digest() != header.TarDigest || size != header.TarSize {
+		return fmt.Errorf("layer %q received as a native diff has diff digest %s (%d bytes), expected %s (%d bytes)", layer.ID, digester.Digest(), size, header.TarDigest, header.TarSize)
+	}
+
+	updateDigestMap(&r.bycompressedsum, layer.CompressedDigest, header.CompressedDigest, layer.ID)
+	layer.CompressedDigest = header.CompressedDigest
+	layer.CompressedSize = header.CompressedSize
+	updateDigestMap(&r.byuncompressedsum, layer.UncompressedDigest, header.UncompressedDigest, layer.ID)
+	layer.UncompressedDigest = header.UncompressedDigest
+	r.setUncompressedSize(layer, header.UncompressedSize)
+	layer.CompressionType = header.CompressionType
+	layer.UIDs = header.UIDs
+	layer.GIDs = header.GIDs
+	return r.saveFor(layer)
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	ociImageIndexMediaType      = "application/vnd.oci.image.index.v1+json"
+	dockerManifestListMediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// ImagePlatform identifies the platform which an image's layers were stored
+// for, and which instance of the image's manifest list describes them.
+type ImagePlatform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+	// Instance is the digest of the manifest, listed in the image's
+	// manifest list, which describes the image's layers.
+	Instance digest.Digest `json:"instance,omitempty"`
+}
+
+// LookupOptions are options for Store.LookupWithOptions.
+type LookupOptions struct {
+	// Platform, if set, limits the lookup to images whose layers were
+	// stored for a matching platform.  Its Instance is ignored, and if its
+	// Variant is empty, images for any variant match.
+	Platform *ImagePlatform
+}
+
+func copyImagePlatform(p *ImagePlatform) *ImagePlatform {
+	if p == nil {
+		return nil
+	}
+	copied := *p
+	return &copied
+}
+
+// matches checks if p is the platform described by wanted, ignoring the
+// instance digest, and the variant if wanted doesn't specify one.
+func (p *ImagePlatform) matches(wanted *ImagePlatform) bool {
+	return p.OS == wanted.OS && p.Architecture == wanted.Architecture &&
+		(wanted.Variant == "" || p.Variant == wanted.Variant)
+}
+
+// manifestListBigDataKey returns the name of the big data item which holds
+// the manifest list with the specified digest.  It's named like other
+// manifests, so that the image can be found using the list's digest, too.
+func manifestListBigDataKey(d digest.Digest) string {
+	return ImageDigestManifestBigDataNamePrefix + "-" + d.String()
+}
+
+// manifestList is the part of an OCI image index or a Docker manifest list
+// which we need to look at.
+type manifestList struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	MediaType     string `json:"mediaType,omitempty"`
+	Manifests     []struct {
+		Digest   digest.Digest `json:"digest"`
+		Platform *struct {
+			Architecture string `json:"architecture"`
+			OS           string `json:"os"`
+			Variant      string `json:"variant,omitempty"`
+		} `json:"platform,omitempty"`
+	} `json:"manifests"`
+}
+
+// parseManifestList returns the platforms of the instances in a manifest list
+// which specify their platforms.
+func parseManifestList(list []byte) ([]ImagePlatform, error) {
+	var parsed manifestList
+	if err := json.Unmarshal(list, &parsed); err != nil {
+		return nil, fmt.Errorf("decoding manifest list: %w", err)
+	}
+	if parsed.SchemaVersion != 2 || parsed.Manifests == nil ||
+		(parsed.MediaType != "" && parsed.MediaType != ociImageIndexMediaType && parsed.MediaType != dockerManifestListMediaType) {
+		return nil, errors.New("data is not an OCI image index or a Docker manifest list")
+	}
+	instances := make([]ImagePlatform, 0, len(parsed.Manifests))
+	for _, manifest := range parsed.Manifests {
+		if manifest.Platform == nil {
+			continue
+		}
+		instances = append(instances, ImagePlatform{
+			OS:           manifest.Platform.OS,
+			Architecture: manifest.Platform.Architecture,
+			Variant:      manifest.Platform.Variant,
+			Instance:     manifest.Digest,
+		})
+	}
+	return instances, nil
+}
+
+// resolveImagePlatform determines which of the instances in a manifest list
+// an image's layers correspond to.  If platform is nil, it's the instance
+// whose manifest is stored with the image, if there is one.  Otherwise it's
+// the instance with platform's Instance digest, or the first instance which
+// matches platform if it doesn't specify a digest.
+func resolveImagePlatform(instances []ImagePlatform, image *Image, platform *ImagePlatform) (*ImagePlatform, error) {
+	if platform == nil {
+		for i := range instances {
+			if slices.Contains(image.Digests, instances[i].Instance) {
+				return &instances[i], nil
+			}
+		}
+		return nil, nil
+	}
+	for i := range instances {
+		if platform.Instance != "" {
+			if instances[i].Instance != platform.Instance {
+				continue
+			}
+			if platform.OS != "" && !instances[i].matches(platform) {
+				return nil, fmt.Errorf("instance %s is listed for %s/%s, not %s/%s: %w", platform.Instance, instances[i].OS, instances[i].Architecture, platform.OS, platform.Architecture, ErrImagePlatformUnknown)
+			}
+			return &instances[i], nil
+		}
+		if instances[i].matches(platform) {
+			return &instances[i], nil
+		}
+	}
+	if platform.Instance != "" {
+		return nil, fmt.Errorf("instance %s: %w", platform.Instance, ErrImagePlatformUnknown)
+	}
+	return nil, fmt.Errorf("%s/%s: %w", platform.OS, platform.Architecture, ErrImagePlatformUnknown)
+}
@@ -0,0 +1,355 @@
+package storage
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// MultiListFilter narrows down which layers, images, and containers MultiList
+// returns.  Each field which is set must match for an item to be returned,
+// and a criterion which doesn't apply to a kind of item never matches it:
+// for example, containers are never returned if Digests is set.  The zero
+// value matches everything.
+type MultiListFilter struct {
+	// Names are patterns, at least one of which must match one of an
+	// item's names.  In a pattern, "*" matches any run of characters and
+	// "?" matches any single character, including "/" and ":".
+	Names []string
+	// IDPrefixes are prefixes, one of which an item's ID must begin with.
+	IDPrefixes []string
+	// Digests are digests, one of which must be an image's digest, or
+	// one of a layer's compressed, uncompressed, or TOC digests.
+	Digests []digest.Digest
+	// CreatedAfter and CreatedBefore, if not zero, bound items' creation
+	// times.
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// Flags maps the names of flags to the values which they must have,
+	// as formatted by fmt.Sprint.
+	Flags map[string]string
+	// Dangling, if set, selects images which have no names, or layers
+	// which are not the top layer of any image, not used by any container,
+	// and not the parent of any other layer; or the opposite, if false.
+	Dangling *bool
+	// InUse, if set, selects images which are used by a container, or
+	// layers which are a container's layer or one of its ancestors; or
+	// the opposite, if false.
+	InUse *bool
+}
+
+// ParseMultiListFilter parses a list of "key=value" filter specifications,
+// as accepted by the "containers-storage list" command, into a
+// MultiListFilter.  The recognized keys are:
+//
+//	name=PATTERN            (may be repeated)
+//	id=PREFIX               (may be repeated)
+//	digest=DIGEST           (may be repeated)
+//	created-after=TIME      an RFC 3339 time, or a duration before now, like "24h"
+//	created-before=TIME     likewise
+//	flag=NAME=VALUE         (may be repeated)
+//	dangling=BOOL           ("untagged" is accepted as a synonym)
+//	in-use=BOOL
+func ParseMultiListFilter(specs []string) (MultiListFilter, error) {
+	var filter MultiListFilter
+	now := time.Now()
+	for _, spec := range specs {
+		key, value, ok := strings.Cut(spec, "=")
+		if !ok {
+			return MultiListFilter{}, fmt.Errorf("filter %q is not in the form KEY=VALUE", spec)
+		}
+		switch key {
+		case "name":
+			filter.Names = append(filter.Names, value)
+		case "id":
+			filter.IDPrefixes = append(filter.IDPrefixes, value)
+		case "digest":
+			d, err := digest.Parse(value)
+			if err != nil {
+				return MultiListFilter{}, fmt.Errorf("parsing filter %q: %w", spec, err)
+			}
+			filter.Digests = append(filter.Digests, d)
+		case "created-after", "created-before":
+			t, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				d, durationErr := time.ParseDuration(value)
+				if durationErr != nil {
+					return MultiListFilter{}, fmt.Errorf("parsing filter %q: not a time or a duration: %w", spec, err)
+				}
+				t = now.Add(-d)
+			}
+			if key == "created-after" {
+				filter.CreatedAfter = t
+			} else {
+				filter.CreatedBefore = t
+			}
+		case "flag":
+			name, flagValue, ok := strings.Cut(value, "=")
+			if !ok {
+				return MultiListFilter{}, fmt.Errorf("filter %q is not in the form flag=NAME=VALUE", spec)
+			}
+			if filter.Flags == nil {
+				filter.Flags = make(map[string]string)
+			}
+			filter.Flags[name] = flagValue
+		case "dangling", "untagged", "in-use":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return MultiListFilter{}, fmt.Errorf("parsing filter %q: %w", spec, err)
+			}
+			if key == "in-use" {
+				filter.InUse = &b
+			} else {
+				filter.Dangling = &b
+			}
+		default:
+			return MultiListFilter{}, fmt.Errorf("unknown filter key %q", key)
+		}
+	}
+	return filter, nil
+}
+
+// needsReferences returns true if matching items against the filter requires
+// knowing which items refer to which other items.
+func (f *MultiListFilter) needsReferences() bool {
+	return f.Dangling != nil || f.InUse != nil
+}
+
+// compileNamePatterns turns the filter's name patterns into regular expressions.
+func (f *MultiListFilter) compileNamePatterns() ([]*regexp.Regexp, error) {
+	patterns := make([]*regexp.Regexp, 0, len(f.Names))
+	for _, name := range f.Names {
+		var expr strings.Builder
+		expr.WriteString("^")
+		for _, r := range name {
+			switch r {
+			case '*':
+				expr.WriteString(".*")
+			case '?':
+				expr.WriteString(".")
+			default:
+				expr.WriteString(regexp.QuoteMeta(string(r)))
+			}
+		}
+		expr.WriteString("$")
+		pattern, err := regexp.Compile(expr.String())
+		if err != nil {
+			return nil, fmt.Errorf("compiling name pattern %q: %w", name, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// multiListMatcher evaluates a MultiListFilter against items.
+type multiListMatcher struct {
+	filter   *MultiListFilter
+	patterns []*regexp.Regexp
+
+	// The following are only set if filter.needsReferences().
+	parentLayers        map[string]struct{} // IDs of layers which have children
+	layerParents        map[string]string   // IDs of layers' parents, by layer ID
+	imageLayers         map[string]struct{} // IDs of images' top layers
+	containerLayers     map[string]struct{} // IDs of containers' layers and their ancestors
+	containerOnlyLayers map[string]struct{} // IDs of containers' own layers
+	containerImages     map[string]struct{} // IDs of images used by containers
+}
+
+func newMultiListMatcher(filter *MultiListFilter) (*multiListMatcher, error) {
+	patterns, err := filter.compileNamePatterns()
+	if err != nil {
+		return nil, err
+	}
+	m := &multiListMatcher{filter: filter, patterns: patterns}
+	if filter.needsReferences() {
+		m.parentLayers = make(map[string]struct{})
+		m.layerParents = make(map[string]string)
+		m.imageLayers = make(map[string]struct{})
+		m.containerLayers = make(map[string]struct{})
+		m.containerOnlyLayers = make(map[string]struct{})
+		m.containerImages = make(map[string]struct{})
+	}
+	return m, nil
+}
+
+// noteLayer records which layer a layer refers to.  It returns false so that
+// it can be passed to layersMatching without copying anything.
+func (m *multiListMatcher) noteLayer(layer *Layer) bool {
+	if layer.Parent != "" {
+		m.parentLayers[layer.Parent] = struct{}{}
+	}
+	if _, ok := m.layerParents[layer.ID]; !ok {
+		m.layerParents[layer.ID] = layer.Parent
+	}
+	return false
+}
+
+// noteImage records which layers an image refers to.  It returns false so
+// that it can be passed to imagesMatching without copying anything.
+func (m *multiListMatcher) noteImage(image *Image) bool {
+	if image.TopLayer != "" {
+		m.imageLayers[image.TopLayer] = struct{}{}
+	}
+	for _, layer := range image.MappedTopLayers {
+		m.imageLayers[layer] = struct{}{}
+	}
+	return false
+}
+
+// noteContainer records which image and layer a container refers to.  It
+// returns false so that it can be passed to containersMatching without
+// copying anything.
+func (m *multiListMatcher) noteContainer(container *Container) bool {
+	m.containerImages[container.ImageID] = struct{}{}
+	m.containerOnlyLayers[container.LayerID] = struct{}{}
+	return false
+}
+
+// finishReferences computes which layers containers use, after every layer
+// and container has been noted.
+func (m *multiListMatcher) finishReferences() {
+	for containerLayer := range m.containerOnlyLayers {
+		for id := containerLayer; id != ""; id = m.layerParents[id] {
+			if _, seen := m.containerLayers[id]; seen {
+				break
+			}
+			m.containerLayers[id] = struct{}{}
+		}
+	}
+}
+
+// matchesCommon checks the criteria which apply to every kind of item.
+func (m *multiListMatcher) matchesCommon(id string, names []string, created time.Time, flags map[string]any) bool {
+	f := m.filter
+	if len(m.patterns) > 0 && !slices.ContainsFunc(names, func(name string) bool {
+		return slices.ContainsFunc(m.patterns, func(pattern *regexp.Regexp) bool { return pattern.MatchString(name) })
+	}) {
+		return false
+	}
+	if len(f.IDPrefixes) > 0 && !slices.ContainsFunc(f.IDPrefixes, func(prefix string) bool { return strings.HasPrefix(id, prefix) }) {
+		return false
+	}
+	if !f.CreatedAfter.IsZero() && !created.After(f.CreatedAfter) {
+		return false
+	}
+	if !f.CreatedBefore.IsZero() && !created.Before(f.CreatedBefore) {
+		return false
+	}
+	for name, value := range f.Flags {
+		flag, ok := flags[name]
+		if !ok || fmt.Sprint(flag) != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *multiListMatcher) matchesLayer(layer *Layer) bool {
+	f := m.filter
+	if !m.matchesCommon(layer.ID, layer.Names, layer.Created, layer.Flags) {
+		return false
+	}
+	if len(f.Digests) > 0 && !slices.ContainsFunc(f.Digests, func(d digest.Digest) bool {
+		return d == layer.CompressedDigest || d == layer.UncompressedDigest || d == layer.TOCDigest
+	}) {
+		return false
+	}
+	if f.Dangling != nil {
+		_, isParent := m.parentLayers[layer.ID]
+		_, isImageLayer := m.imageLayers[layer.ID]
+		_, isContainerLayer := m.containerOnlyLayers[layer.ID]
+		if *f.Dangling != !(isParent || isImageLayer || isContainerLayer) {
+			return false
+		}
+	}
+	if f.InUse != nil {
+		if _, inUse := m.containerLayers[layer.ID]; *f.InUse != inUse {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *multiListMatcher) matchesImage(image *Image) bool {
+	f := m.filter
+	if !m.matchesCommon(image.ID, image.Names, image.Created, image.Flags) {
+		return false
+	}
+	if len(f.Digests) > 0 && !slices.ContainsFunc(f.Digests, func(d digest.Digest) bool {
+		return d == image.Digest || slices.Contains(image.Digests, d)
+	}) {
+		return false
+	}
+	if f.Dangling != nil && *f.Dangling != (len(image.Names) == 0) {
+		return false
+	}
+	if f.InUse != nil {
+		if _, inUse := m.containerImages[image.ID]; *f.InUse != inUse {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *multiListMatcher) matchesContainer(container *Container) bool {
+	f := m.filter
+	if len(f.Digests) > 0 || f.Dangling != nil || f.InUse != nil {
+		return false
+	}
+	return m.matchesCommon(container.ID, container.Names, container.Created, container.Flags)
+}
+
+// multiListProjection is a set of lowercased field names to keep, or nil
+// to keep every field.
+type multiListProjection map[string]struct{}
+
+func newMultiListProjection(fields []string) (multiListProjection, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	known := make(map[string]struct{})
+	for _, t := range []reflect.Type{reflect.TypeFor[Layer](), reflect.TypeFor[Image](), reflect.TypeFor[Container]()} {
+		for i := range t.NumField() {
+			if field := t.Field(i); field.IsExported() {
+				known[strings.ToLower(field.Name)] = struct{}{}
+			}
+		}
+	}
+	projection := make(multiListProjection, len(fields))
+	for _, field := range fields {
+		name := strings.ToLower(field)
+		if _, ok := known[name]; !ok {
+			return nil, fmt.Errorf("%q is not a field of layers, images, or containers", field)
+		}
+		projection[name] = struct{}{}
+	}
+	return projection, nil
+}
+
+// project returns a copy of item with only the fields in the projection, and
+// the ID, set.
+func project[T any](p multiListProjection, item *T) T {
+	if p == nil {
+		return *item
+	}
+	var projected T
+	src := reflect.ValueOf(item).Elem()
+	dst := reflect.ValueOf(&projected).Elem()
+	t := src.Type()
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if _, ok := p[strings.ToLower(field.Name)]; ok || field.Name == "ID" {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+	return projected
+}
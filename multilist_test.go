@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMultiListFilter(t *testing.T) {
+	d := digest.FromString("data")
+	filter, err := ParseMultiListFilter([]string{
+		"name=docker.io/*",
+		"name=localhost/*",
+		"id=0123",
+		"digest=" + d.String(),
+		"created-after=2024-01-02T03:04:05Z",
+		"created-before=1h",
+		"flag=pinned=true",
+		"untagged=true",
+		"in-use=false",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"docker.io/*", "localhost/*"}, filter.Names)
+	assert.Equal(t, []string{"0123"}, filter.IDPrefixes)
+	assert.Equal(t, []digest.Digest{d}, filter.Digests)
+	assert.Equal(t, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), filter.CreatedAfter.UTC())
+	assert.WithinDuration(t, time.Now().Add(-time.Hour), filter.CreatedBefore, time.Minute)
+	assert.Equal(t, map[string]string{"pinned": "true"}, filter.Flags)
+	require.NotNil(t, filter.Dangling)
+	assert.True(t, *filter.Dangling)
+	require.NotNil(t, filter.InUse)
+	assert.False(t, *filter.InUse)
+
+	for _, spec := range []string{"name", "bogus=1", "digest=sha256:nope", "created-after=yesterday", "flag=pinned", "dangling=maybe"} {
+		_, err := ParseMultiListFilter([]string{spec})
+		assert.Error(t, err, spec)
+	}
+}
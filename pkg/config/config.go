@@ -29,6 +29,12 @@ type OverlayOptionsConfig struct {
 	Size string `toml:"size,omitempty"`
 	// Inodes is used to set a maximum inodes of the container image.
 	Inodes string `toml:"inodes,omitempty"`
+	// QuotaBackend selects how size and inodes limits are enforced:
+	// "project" (project quota) or "loopback" (per-layer filesystem images)
+	QuotaBackend string `toml:"quota_backend,omitempty"`
+	// LoopbackFs is the filesystem created in per-layer images when
+	// QuotaBackend is "loopback"
+	LoopbackFs string `toml:"loopback_fs,omitempty"`
 	// Do not create a bind mount on the storage home
 	SkipMountHome string `toml:"skip_mount_home,omitempty"`
 	// Specify whether composefs must be used to mount the data layers
@@ -131,6 +137,31 @@ type OptionsConfig struct {
 
 	// DisableVolatile doesn't allow volatile mounts when it is set.
 	DisableVolatile bool `toml:"disable-volatile,omitempty"`
+
+	// LayerVerity enables fs-verity on the files in read-only layers and
+	// verifies them when the layers are mounted.
+	LayerVerity bool `toml:"layer_verity,omitempty"`
+
+	// MetadataJournal appends changes to layer and image metadata to
+	// journals instead of rewriting the JSON files which hold it.
+	MetadataJournal bool `toml:"metadata_journal,omitempty"`
+
+	// TierDemoteAfter is how long a layer must go unused before it is
+	// moved to the cold store, as a duration such as "720h".
+	TierDemoteAfter string `toml:"tier_demote_after,omitempty"`
+
+	// TierDemoteMinSize is the smallest size of a layer which will be
+	// moved to the cold store, such as "100M".
+	TierDemoteMinSize string `toml:"tier_demote_min_size,omitempty"`
+
+	// StoreQuotaLayers is the largest number of layers which the store
+	// can hold.
+	StoreQuotaLayers uint32 `toml:"store_quota_layers,omitempty"`
+
+	// StoreQuotaSize is the largest total size of the diffs which have been
+	// applied to the layers in the store, such as "50G".  Data written
+	// into containers' read-write layers is not counted.
+	StoreQuotaSize string `toml:"store_quota_size,omitempty"`
 }
 
 // GetGraphDriverOptions returns the driver specific options
@@ -179,6 +210,12 @@ func GetGraphDriverOptions(driverName string, options OptionsConfig) []string {
 		if options.Overlay.Inodes != "" {
 			doptions = append(doptions, fmt.Sprintf("%s.inodes=%s", driverName, options.Overlay.Inodes))
 		}
+		if options.Overlay.QuotaBackend != "" {
+			doptions = append(doptions, fmt.Sprintf("%s.quota_backend=%s", driverName, options.Overlay.QuotaBackend))
+		}
+		if options.Overlay.LoopbackFs != "" {
+			doptions = append(doptions, fmt.Sprintf("%s.loopback_fs=%s", driverName, options.Overlay.LoopbackFs))
+		}
 		if options.Overlay.SkipMountHome != "" {
 			doptions = append(doptions, fmt.Sprintf("%s.skip_mount_home=%s", driverName, options.Overlay.SkipMountHome))
 		} else if options.SkipMountHome != "" {
@@ -195,6 +195,16 @@ func TestOverlayOptions(t *testing.T) {
 		t.Fatalf("Expected to find 'use_composefs' options, got %v", doptions)
 	}
 
+	options.Overlay.QuotaBackend = "loopback"
+	options.Overlay.LoopbackFs = "xfs"
+	doptions = GetGraphDriverOptions("overlay", options)
+	if !searchOptions(doptions, "overlay.quota_backend=loopback") {
+		t.Fatalf("Expected to find 'quota_backend' options, got %v", doptions)
+	}
+	if !searchOptions(doptions, "overlay.loopback_fs=xfs") {
+		t.Fatalf("Expected to find 'loopback_fs' options, got %v", doptions)
+	}
+
 	// Make sure legacy mountopt still works
 	options = OptionsConfig{}
 	options.SkipMountHome = "true"
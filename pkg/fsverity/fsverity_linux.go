@@ -43,3 +43,10 @@ func MeasureVerity(description string, fd int) (string, error) {
 	}
 	return fmt.Sprintf("%x", digest.Buf[:digest.Fsv.Size]), nil
 }
+
+// IsNotSupported returns true if err, returned by EnableVerity or
+// MeasureVerity, indicates that the filesystem doesn't support fs-verity, or
+// doesn't have it enabled.
+func IsNotSupported(err error) bool {
+	return errors.Is(err, unix.ENOTTY) || errors.Is(err, unix.EOPNOTSUPP)
+}
@@ -3,18 +3,27 @@
 package fsverity
 
 import (
-	"fmt"
+	"errors"
 )
 
+var errNotSupported = errors.New("fs-verity is not supported on this platform")
+
 // EnableVerity enables the verity feature on a file represented by the file descriptor 'fd'.  The file must be opened
 // in read-only mode.
 // The 'description' parameter is a human-readable description of the file.
 func EnableVerity(description string, fd int) error {
-	return fmt.Errorf("fs-verity is not supported on this platform")
+	return errNotSupported
 }
 
 // MeasureVerity measures and returns the verity digest for the file represented by 'fd'.
 // The 'description' parameter is a human-readable description of the file.
 func MeasureVerity(description string, fd int) (string, error) {
-	return "", fmt.Errorf("fs-verity is not supported on this platform")
+	return "", errNotSupported
+}
+
+// IsNotSupported returns true if err, returned by EnableVerity or
+// MeasureVerity, indicates that the filesystem doesn't support fs-verity, or
+// doesn't have it enabled.
+func IsNotSupported(err error) bool {
+	return errors.Is(err, errNotSupported)
 }
@@ -29,6 +29,7 @@ import (
 	"github.com/containers/storage/pkg/ioutils"
 	"github.com/containers/storage/pkg/lockfile"
 	"github.com/containers/storage/pkg/parsers"
+	"github.com/containers/storage/pkg/stringid"
 	"github.com/containers/storage/pkg/stringutils"
 	"github.com/containers/storage/pkg/system"
 	"github.com/containers/storage/types"
@@ -50,6 +51,9 @@ const (
 	mountLabelFlag   = "MountLabel"
 	processLabelFlag = "ProcessLabel"
 	mountOptsFlag    = "MountOpts"
+	// autoUserNsSizeReasonFlag explains how the size of a container's
+	// automatically created user namespace was chosen.
+	autoUserNsSizeReasonFlag = "AutoUserNsSizeReason"
 )
 
 var (
@@ -69,6 +73,12 @@ type rwMetadataStore interface {
 	SetMetadata(id, metadata string) error
 }
 
+// rwLabelStore wraps a method for setting the labels of an item with an ID.
+type rwLabelStore interface {
+	// SetLabels replaces the labels of the item with the specified ID.
+	SetLabels(id string, labels map[string]string) error
+}
+
 // metadataStore wraps up methods for getting and setting metadata associated with IDs.
 type metadataStore interface {
 	roMetadataStore
@@ -93,6 +103,15 @@ type MultiListOptions struct {
 	Images     bool // if true, Images will be listed in the result
 	Layers     bool // if true, layers will be listed in the result
 	Containers bool // if true, containers will be listed in the result
+
+	// Filter, if set, limits which of the selected kinds of items are
+	// listed in the result.
+	Filter MultiListFilter
+	// Fields, if not empty, lists the names of the fields, compared
+	// without regard to case, which should be set in the items which are
+	// listed in the result.  The ID field is always set; others are left
+	// at their zero values.
+	Fields []string
 }
 
 // MultiListResult contains slices of Images, Layers or Containers listed by MultiList method
@@ -210,7 +229,9 @@ type Store interface {
 	// CreateLayer creates a new layer in the underlying storage driver,
 	// optionally having the specified ID (one will be assigned if none is
 	// specified), with the specified layer (or no layer) as its parent,
-	// and with optional names.  (The writeable flag is ignored.)
+	// and with optional names.  (The writeable flag is ignored.)  It fails
+	// with ErrStoreQuotaExceeded if the store already holds as many layers
+	// as it is allowed to.
 	CreateLayer(id, parent string, names []string, mountLabel string, writeable bool, options *LayerOptions) (*Layer, error)
 
 	// PutLayer combines the functions of CreateLayer and ApplyDiff,
@@ -234,6 +255,15 @@ type Store interface {
 	// convenience of its caller.
 	CreateImage(id string, names []string, layer, metadata string, options *ImageOptions) (*Image, error)
 
+	// Transaction runs fn with the layer, image, and container stores
+	// locked for writing, and either keeps all of the changes which fn
+	// makes using the Transaction that it's passed, if fn succeeds, or
+	// undoes all of them, including removing any layers that it created,
+	// if fn fails.  If the process exits while fn is running, the changes
+	// are undone the next time the store is opened.  fn must not call
+	// other methods of the Store.
+	Transaction(fn func(tx Transaction) error) error
+
 	// CreateContainer creates a new container, optionally with the
 	// specified ID (one will be assigned if none is specified), with
 	// optional names, using the specified image's top layer as the basis
@@ -243,6 +273,61 @@ type Store interface {
 	// which the library stores for the convenience of its caller.
 	CreateContainer(id string, names []string, image, layer, metadata string, options *ContainerOptions) (*Container, error)
 
+	// CloneContainer creates a new container, optionally with the
+	// specified ID (one will be assigned if none is specified), with
+	// optional names, whose layer starts as a copy of the current contents
+	// of the source container's layer.  The source container's big data
+	// items and the contents of its directories are copied, too.  The
+	// source container's layer should not be modified while it is being
+	// copied.
+	CloneContainer(source, id string, names []string, options *CloneContainerOptions) (*Container, error)
+
+	// AutoUserNSUsage reports which of the host IDs that automatically
+	// created user namespaces can use are free, which are used by
+	// containers or reservations, and which allocations are recorded.
+	AutoUserNSUsage() (*AutoUserNSUsage, error)
+
+	// ReserveAutoUserNS sets aside size host UIDs and GIDs, recording them
+	// under the specified name, so that automatically created user
+	// namespaces won't use them until ReleaseAutoUserNS is called.
+	ReserveAutoUserNS(name string, size uint32) (*AutoUserNSAllocation, error)
+
+	// ReleaseAutoUserNS forgets a reservation which was made using
+	// ReserveAutoUserNS.
+	ReleaseAutoUserNS(name string) error
+
+	// AddAdditionalImageStore starts using the read-only image and layer
+	// stores in the specified directory, which is laid out like a graph
+	// root, in addition to the ones which the store was configured with.
+	// Layers in it can then be used as the parents of new layers.  The
+	// change only affects this Store object.
+	AddAdditionalImageStore(path string) error
+
+	// RemoveAdditionalImageStore stops using the read-only image and
+	// layer stores in the specified directory.  It fails with
+	// ErrImageStoreInUse if any layers or images in the primary stores
+	// are based on layers which can only be found in it, or if any of its
+	// layers are mounted.
+	RemoveAdditionalImageStore(path string) error
+
+	// DemoteLayer moves a layer's data from the primary store to the
+	// store's cold store.  It fails with ErrLayerInUse if the layer is
+	// mounted, or if a mounted layer is based on it, and with
+	// ErrNotSupported if no cold store is configured.  Layers in the cold
+	// store can still be used, and are moved back when they are mounted
+	// or have new layers created on top of them.
+	DemoteLayer(id string) error
+
+	// PromoteLayer moves a layer's data from the store's cold store back
+	// to the primary store.
+	PromoteLayer(id string) error
+
+	// DemoteLayers moves the layers in the primary store which match the
+	// policy, and which aren't in use by mounted layers or by containers,
+	// to the store's cold store, and returns their IDs.  If policy is nil,
+	// the policy from the store's options is used.
+	DemoteLayers(policy *TierPolicy) ([]string, error)
+
 	// Metadata retrieves the metadata which is associated with a layer,
 	// image, or container (whichever the passed-in ID refers to).
 	Metadata(id string) (string, error)
@@ -254,13 +339,20 @@ type Store interface {
 	// the object directly.
 	SetMetadata(id, metadata string) error
 
+	// SetLabels replaces the labels of a layer, image, or container
+	// (whichever the passed-in ID refers to).  Label names can not be
+	// empty or contain '=', '!', ',', or whitespace.
+	SetLabels(id string, labels map[string]string) error
+
 	// Exists checks if there is a layer, image, or container which has the
 	// passed-in ID or name.
 	Exists(id string) bool
 
 	// Status asks for a status report, in the form of key-value pairs,
 	// from the underlying storage driver.  The contents vary from driver
-	// to driver.
+	// to driver.  The report ends with the number of layers in the store
+	// and the total size of their contents, in bytes, along with the
+	// limits on them if quotas are configured.
 	Status() ([][2]string, error)
 
 	// Delete removes the layer, image, or container which has the
@@ -284,16 +376,53 @@ type Store interface {
 	// reached, at which point the list of removed layers is returned.  If
 	// the commit argument is false, the image and layers are not removed,
 	// but the list of layers which would be removed is still returned.
+	// Pinned images are not removed, and ErrImagePinned is returned.
 	DeleteImage(id string, commit bool) (layers []string, err error)
 
+	// DeleteImageWithOptions is like DeleteImage, but can also remove
+	// pinned images.
+	DeleteImageWithOptions(id string, options *DeleteImageOptions) (layers []string, err error)
+
+	// PinImage marks an image as pinned, which protects it from being
+	// removed by DeleteImage, Delete, Repair, and optionally, Wipe.
+	PinImage(id string) error
+
+	// UnpinImage reverses the effect of PinImage.
+	UnpinImage(id string) error
+
 	// DeleteContainer removes the specified container and its layer.  If
 	// there is no matching container, or if the container exists but its
 	// layer does not, an error will be returned.
 	DeleteContainer(id string) error
 
+	// SnapshotContainer saves the current contents of the container's
+	// read-write layer under a name which is not already used by one of
+	// the container's snapshots, so that the layer can later be rolled
+	// back to them using RestoreContainerSnapshot.  Snapshots are removed
+	// along with the container.
+	SnapshotContainer(id, name string) (*ContainerSnapshot, error)
+
+	// RestoreContainerSnapshot replaces the contents of the container's
+	// read-write layer, which must not be mounted, with the ones saved in
+	// the named snapshot.  Some drivers (e.g. zfs) can only roll back to
+	// the most recent snapshot, and discard any snapshots which were taken
+	// after the one being restored.
+	RestoreContainerSnapshot(id, name string) error
+
+	// ListContainerSnapshots returns the container's snapshots, oldest
+	// first.
+	ListContainerSnapshots(id string) ([]ContainerSnapshot, error)
+
+	// DeleteContainerSnapshot discards one of the container's snapshots.
+	DeleteContainerSnapshot(id, name string) error
+
 	// Wipe removes all known layers, images, and containers.
 	Wipe() error
 
+	// WipeWithOptions is like Wipe, but can refuse to remove pinned
+	// images.
+	WipeWithOptions(options *WipeOptions) error
+
 	// MountImage mounts an image to temp directory and returns the mount point.
 	// MountImage allows caller to mount an image. Images will always
 	// be mounted read/only
@@ -344,15 +473,55 @@ type Store interface {
 	// specify the changes returned by Changes.
 	DiffSize(from, to string) (int64, error)
 
+	// LayerUsage returns how many bytes of the disk space used by a layer
+	// are used only by it, and how many are shared with other layers.  It
+	// is only supported by storage drivers which keep track of that, such
+	// as btrfs when quotas are enabled, and returns an error wrapping
+	// ErrNotSupported otherwise.
+	LayerUsage(id string) (*LayerUsage, error)
+
+	// ResizeLayer changes the size limit of a read-write layer which was
+	// created with one, such as a container's layer when the overlay
+	// driver is configured with quota_backend=loopback.  It returns an
+	// error wrapping ErrNotSupported if the driver, or the layer, doesn't
+	// support that.
+	ResizeLayer(id string, size uint64) error
+
 	// Diff returns the tarstream which would specify the changes returned
 	// by Changes.  If options are passed in, they can override default
 	// behaviors.
 	Diff(from, to string, options *DiffOptions) (io.ReadCloser, error)
 
+	// NativeLayerDiff returns the changes between a layer and its parent
+	// in a format specific to the storage driver, which is usually much
+	// cheaper to produce and apply than a tarstream, and which can be
+	// passed to PutLayerFromNativeDiff in another store which uses the
+	// same driver.  ErrNotSupported is returned if the driver doesn't have
+	// such a format.  The store isn't kept locked while the stream is read,
+	// so reading it fails if the layer is deleted in the meantime.
+	NativeLayerDiff(id string) (io.ReadCloser, error)
+
+	// ExportContainer returns a tarstream of the entire contents of a
+	// container's filesystem, as the container sees it, rather than just
+	// the changes made in its layer.  The owners of files are recorded
+	// using the IDs which they have inside of the container.  The
+	// container's layer remains mounted until the stream is closed.
+	ExportContainer(id string, options *ExportOptions) (io.ReadCloser, error)
+
+	// PutLayerFromNativeDiff is like PutLayer, but populates the new layer
+	// using a stream produced by NativeLayerDiff.  The parent must be a
+	// copy of the parent of the layer that the stream was produced from,
+	// which was itself created using PutLayerFromNativeDiff, and the
+	// contents are verified by recomputing the layer's diff and comparing
+	// its digest to the one recorded in the stream.
+	PutLayerFromNativeDiff(id, parent string, names []string, mountLabel string, options *LayerOptions, diff io.Reader) (*Layer, error)
+
 	// ApplyDiff applies a tarstream to a layer.  Information about the
 	// tarstream is cached with the layer.  Typically, a layer which is
 	// populated using a tarstream will be expected to not be modified in
-	// any other way, either before or after the diff is applied.
+	// any other way, either before or after the diff is applied.  It fails
+	// with ErrStoreQuotaExceeded if the uncompressed tarstream would make
+	// the total size of the store's layers exceed its limit.
 	//
 	// Note that we do some of this work in a child process.  The calling
 	// process's main() function needs to import our pkg/reexec package and
@@ -518,6 +687,55 @@ type Store interface {
 	// named ImageDigestBigDataKey whose contents have the specified digest.
 	ImagesByDigest(d digest.Digest) ([]*Image, error)
 
+	// ImagesByLabel returns a list of images whose labels match a
+	// selector, which is a comma-separated list of requirements, each of
+	// which is one of "name=value", "name!=value", "name", which requires
+	// that the label be set, or "!name", which requires that it not be.
+	// A value which contains commas, or starts or ends with whitespace, can
+	// be written as a double-quoted Go string literal, as in
+	// `org.opencontainers.image.authors="A, B"`.
+	// An empty selector matches every image.
+	ImagesByLabel(selector string) ([]*Image, error)
+
+	// ContainersByLabel returns a list of containers whose labels match a
+	// selector, as described for ImagesByLabel.
+	ContainersByLabel(selector string) ([]*Container, error)
+
+	// SetImageManifestList attaches a manifest list (an OCI image index or
+	// a Docker manifest list) to an image, so that the image can also be
+	// found using the list's digest.  If platform is nil, the image's
+	// platform is the one of the list's instances whose manifest is stored
+	// with the image, if there is one.  Otherwise it's the instance which
+	// platform's Instance digest identifies, or if that isn't set, the
+	// first instance which matches platform.  If the list has no such
+	// instance, ErrImagePlatformUnknown is returned.
+	SetImageManifestList(id string, list []byte, platform *ImagePlatform) error
+
+	// ImagesByPlatform returns the images which are named or have the ID
+	// name, or, if name is a digest, whose manifest list or one of whose
+	// manifests has that digest, and whose layers were recorded as being
+	// for the specified platform by SetImageManifestList.  The platform's
+	// Instance is ignored, and if its Variant is empty, images for any
+	// variant match.
+	ImagesByPlatform(name string, platform ImagePlatform) ([]*Image, error)
+
+	// ImagesByHistoricalName returns the images which have, or according
+	// to their NamesHistory or the recorded changes to the names of
+	// images, have had, the specified name.
+	ImagesByHistoricalName(name string) ([]*Image, error)
+
+	// ImageNamesHistory returns the recorded changes to the names of
+	// images which involved the specified name, or all recorded changes if
+	// name is empty, oldest first.  The record is rotated as it grows, so
+	// the oldest changes are eventually discarded.
+	ImageNamesHistory(name string) ([]ImageNamesEvent, error)
+
+	// ImageByNameAt returns the ID of the image which had the specified
+	// name at the specified time, according to the recorded changes to
+	// the names of images.  The image may since have been deleted.  If no
+	// image had the name at that time, ErrImageUnknown is returned.
+	ImageByNameAt(name string, when time.Time) (string, error)
+
 	// Container returns a specific container.
 	Container(id string) (*Container, error)
 
@@ -566,6 +784,11 @@ type Store interface {
 	// name or ID.
 	Lookup(name string) (string, error)
 
+	// LookupWithOptions is like Lookup, but if options specify a
+	// platform, it only returns the ID of an image which is for that
+	// platform.
+	LookupWithOptions(name string, options *LookupOptions) (string, error)
+
 	// Shutdown attempts to free any kernel resources which are being used
 	// by the underlying driver.  If "force" is true, any mounted (i.e., in
 	// use) layers are unmounted beforehand.  If "force" is not true, then
@@ -670,6 +893,8 @@ type LayerOptions struct {
 	// Currently these can only be set when the layer record is created, but that
 	// could change in the future.
 	Flags map[string]any
+	// Labels is a set of labels to store with the layer.
+	Labels map[string]string
 }
 
 type LayerBigDataOption struct {
@@ -677,6 +902,23 @@ type LayerBigDataOption struct {
 	Data io.Reader
 }
 
+// DeleteImageOptions is used for passing options to a Store's
+// DeleteImageWithOptions() method.
+type DeleteImageOptions struct {
+	// Commit is the DeleteImage method's commit argument.
+	Commit bool
+	// RemovePinned allows the image to be removed even if it's pinned.
+	RemovePinned bool
+}
+
+// WipeOptions is used for passing options to a Store's WipeWithOptions()
+// method.
+type WipeOptions struct {
+	// ProtectPinned causes nothing to be removed, and ErrImagePinned to
+	// be returned, if any images are pinned.
+	ProtectPinned bool
+}
+
 // ImageOptions is used for passing options to a Store's CreateImage() method.
 type ImageOptions struct {
 	// CreationDate, if not zero, will override the default behavior of marking the image as having been
@@ -698,6 +940,9 @@ type ImageOptions struct {
 	// Flags is a set of named flags and their values to store with the image.  Currently these can only
 	// be set when the image record is created, but that could change in the future.
 	Flags map[string]any
+	// Labels is a set of labels to store with the image, which can be
+	// used to find it using ImagesByLabel().
+	Labels map[string]string
 }
 
 type ImageBigDataOption struct {
@@ -725,6 +970,9 @@ type ContainerOptions struct {
 	Metadata string
 	// BigData is a set of items which should be stored for the container.
 	BigData []ContainerBigDataOption
+	// Labels is a set of labels to store with the container, which can
+	// be used to find it using ContainersByLabel().
+	Labels map[string]string
 }
 
 type ContainerBigDataOption struct {
@@ -732,6 +980,20 @@ type ContainerBigDataOption struct {
 	Data []byte
 }
 
+// CloneContainerOptions is used for passing options to a Store's
+// CloneContainer() method.
+type CloneContainerOptions struct {
+	// IDMappingOptions specifies the ID mappings which should be used for
+	// the new container.  If nothing is specified, the source container's
+	// mappings are used.  Otherwise, unless the driver can shift IDs at
+	// mount time, the copy of the layer is chowned to match.
+	types.IDMappingOptions
+	// Metadata, if set, is used instead of the source container's metadata.
+	Metadata string
+	// Labels, if set, are used instead of the source container's labels.
+	Labels map[string]string
+}
+
 type store struct {
 	// # Locking hierarchy:
 	// These locks do not all need to be held simultaneously, but if some code does need to lock more than one, it MUST do so in this order:
@@ -739,7 +1001,7 @@ type store struct {
 	// - layerStore.start{Reading,Writing}
 	// - roLayerStores[].startReading (in the order of the items of the roLayerStores array)
 	// - imageStore.start{Reading,Writing}
-	// - roImageStores[].startReading (in the order of the items of the roImageStores array)
+	// - roImageStoresUseGetters[].startReading (in the order of the items of the roImageStoresUseGetters array)
 	// - containerStore.start{Reading,Writing}
 
 	// The following fields are only set when constructing store, and must never be modified afterwards.
@@ -761,6 +1023,10 @@ type store struct {
 	graphRoot       string
 	graphOptions    []string
 	imageStoreDir   string
+	coldStoreDir    string
+	tierPolicy      TierPolicy
+	quotaLayers     int
+	quotaSize       int64
 	pullOptions     map[string]string
 	uidMap          []idtools.IDMap
 	gidMap          []idtools.IDMap
@@ -769,11 +1035,13 @@ type store struct {
 	autoNsMaxSize   uint32
 	imageStore      rwImageStore
 	rwImageStores   []rwImageStore
-	roImageStores   []roImageStore
 	containerStore  rwContainerStore
+	bigDataPool     *bigDataPool
 	digestLockRoot  string
 	disableVolatile bool
 	transientStore  bool
+	layerVerity     bool
+	metadataJournal bool
 
 	// The following fields can only be accessed with graphLock held.
 	graphLockLastWrite lockfile.LastWrite
@@ -783,6 +1051,18 @@ type store struct {
 	layerStoreUseGetters    rwLayerStore   // Almost all users should use the provided accessors instead of accessing this field directly.
 	roLayerStoresUseGetters []roLayerStore // Almost all users should use the provided accessors instead of accessing this field directly.
 
+	// roImageStoresLock protects roImageStoresUseGetters, which
+	// AddAdditionalImageStore and RemoveAdditionalImageStore replace.
+	roImageStoresLock       sync.RWMutex
+	roImageStoresUseGetters []roImageStore // Almost all users should use getROImageStores() instead of accessing this field directly.
+
+	// The following fields can only be accessed with graphLock held.  They
+	// record the additional image stores which were added or removed
+	// after the store was constructed, so that the changes can be made
+	// again if the graph driver is reinitialized.
+	addedImageStores   []string
+	removedImageStores []string
+
 	// FIXME: The following fields need locking, and don’t have it.
 	additionalUIDs *idSet // Set by getAvailableIDs()
 	additionalGIDs *idSet // Set by getAvailableIDs()
@@ -861,6 +1141,11 @@ func GetStore(options types.StoreOptions) (Store, error) {
 			return nil, err
 		}
 	}
+	if options.ColdStore != "" {
+		if err := os.MkdirAll(options.ColdStore, 0o700); err != nil {
+			return nil, err
+		}
+	}
 	if err := os.MkdirAll(filepath.Join(options.GraphRoot, options.GraphDriverName), 0o700); err != nil {
 		return nil, err
 	}
@@ -897,6 +1182,7 @@ func GetStore(options types.StoreOptions) (Store, error) {
 		graphRoot:           options.GraphRoot,
 		graphOptions:        options.GraphDriverOptions,
 		imageStoreDir:       options.ImageStore,
+		coldStoreDir:        options.ColdStore,
 		pullOptions:         options.PullOptions,
 		uidMap:              copySlicePreferringNil(options.UIDMap),
 		gidMap:              copySlicePreferringNil(options.GIDMap),
@@ -905,6 +1191,15 @@ func GetStore(options types.StoreOptions) (Store, error) {
 		autoNsMaxSize:       autoNsMaxSize,
 		disableVolatile:     options.DisableVolatile,
 		transientStore:      options.TransientStore,
+		layerVerity:         options.LayerVerity,
+		metadataJournal:     options.MetadataJournal,
+		quotaLayers:         options.StoreQuotaLayers,
+		quotaSize:           options.StoreQuotaSize,
+
+		tierPolicy: TierPolicy{
+			UnusedFor: options.TierDemoteAfter,
+			MinSize:   options.TierDemoteMinSize,
+		},
 
 		additionalUIDs: nil,
 		additionalGIDs: nil,
@@ -912,6 +1207,9 @@ func GetStore(options types.StoreOptions) (Store, error) {
 	if err := s.load(); err != nil {
 		return nil, err
 	}
+	if err := s.recoverTransaction(); err != nil {
+		logrus.Errorf("Rolling back an interrupted transaction in %s: %v", s.graphRoot, err)
+	}
 
 	stores = append(stores, s)
 
@@ -987,7 +1285,17 @@ func (s *store) load() error {
 	if err := os.MkdirAll(gipath, 0o700); err != nil {
 		return err
 	}
-	imageStore, err := newImageStore(gipath)
+	var pool *bigDataPool
+	if bigDataPoolSupported {
+		var err error
+		if pool, err = newBigDataPool(filepath.Join(s.graphRoot, driverPrefix+"bigdata")); err != nil {
+			return err
+		}
+	}
+
+	s.bigDataPool = pool
+
+	imageStore, err := newImageStore(gipath, s.metadataJournal, pool)
 	if err != nil {
 		return err
 	}
@@ -1004,7 +1312,7 @@ func (s *store) load() error {
 		return err
 	}
 
-	rcs, err := newContainerStore(gcpath, rcpath, s.transientStore)
+	rcs, err := newContainerStore(gcpath, rcpath, s.transientStore, pool)
 	if err != nil {
 		return err
 	}
@@ -1021,7 +1329,7 @@ func (s *store) load() error {
 		var ris roImageStore
 		// both the graphdriver and the imagestore must be used read-write.
 		if store == s.imageStoreDir || store == s.graphRoot {
-			imageStore, err := newImageStore(gipath)
+			imageStore, err := newImageStore(gipath, s.metadataJournal, pool)
 			if err != nil {
 				return err
 			}
@@ -1037,7 +1345,7 @@ func (s *store) load() error {
 				return err
 			}
 		}
-		s.roImageStores = append(s.roImageStores, ris)
+		s.roImageStoresUseGetters = append(s.roImageStoresUseGetters, ris)
 	}
 
 	s.digestLockRoot = filepath.Join(s.runRoot, driverPrefix+"locks")
@@ -1108,11 +1416,19 @@ func (s *store) createGraphDriverLocked() (drivers.Driver, error) {
 	config := drivers.Options{
 		Root:           s.graphRoot,
 		ImageStore:     s.imageStoreDir,
+		ColdStore:      s.coldStoreDir,
 		RunRoot:        s.runRoot,
 		DriverPriority: s.graphDriverPriority,
 		DriverOptions:  s.graphOptions,
 	}
-	return drivers.New(s.graphDriverName, config)
+	driver, err := drivers.New(s.graphDriverName, config)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.reapplyImageStoreChangesLocked(driver); err != nil {
+		return nil, err
+	}
+	return driver, nil
 }
 
 func (s *store) GraphDriver() (drivers.Driver, error) {
@@ -1340,7 +1656,16 @@ func readOrWriteAllLayerStores[T any](s *store, fn func(store roLayerStore) (T,
 // allImageStores returns a list of all image store objects used by the Store.
 // This is a convenience method for read-only users of the Store.
 func (s *store) allImageStores() []roImageStore {
-	return append([]roImageStore{s.imageStore}, s.roImageStores...)
+	return append([]roImageStore{s.imageStore}, s.getROImageStores()...)
+}
+
+// getROImageStores returns the additional image store objects used by the
+// Store.  The returned slice is never modified, so it can be used after
+// AddAdditionalImageStore or RemoveAdditionalImageStore replaces it.
+func (s *store) getROImageStores() []roImageStore {
+	s.roImageStoresLock.RLock()
+	defer s.roImageStoresLock.RUnlock()
+	return s.roImageStoresUseGetters
 }
 
 // readAllImageStores processes allImageStores() in order:
@@ -1453,12 +1778,28 @@ func (s *store) canUseShifting(uidmap, gidmap []idtools.IDMap) bool {
 // - rlstore must be locked for writing
 // - rlstores MUST NOT be locked
 func (s *store) putLayer(rlstore rwLayerStore, rlstores []roLayerStore, id, parent string, names []string, mountLabel string, writeable bool, lOptions *LayerOptions, diff io.Reader, slo *stagedLayerOptions) (*Layer, int64, error) {
+	// FIXME? It’s unclear why we are holding containerStore locked here at all
+	// when the layer has no parent (and because we are not modifying it, why it
+	// is a write lock, not a read lock).
+	if err := s.containerStore.startWriting(); err != nil {
+		return nil, -1, err
+	}
+	defer s.containerStore.stopWriting()
+	return s.putLayerLocked(rlstore, rlstores, id, parent, names, mountLabel, writeable, lOptions, diff, slo)
+}
+
+// On entry:
+// - rlstore must be locked for writing
+// - rlstores MUST NOT be locked
+// - s.containerStore must be locked for writing
+func (s *store) putLayerLocked(rlstore rwLayerStore, rlstores []roLayerStore, id, parent string, names []string, mountLabel string, writeable bool, lOptions *LayerOptions, diff io.Reader, slo *stagedLayerOptions) (*Layer, int64, error) {
 	var parentLayer *Layer
 	var options LayerOptions
 	if lOptions != nil {
 		options = *lOptions
 		options.BigData = slices.Clone(lOptions.BigData)
 		options.Flags = copyMapPreferringNil(lOptions.Flags)
+		options.Labels = copyMapPreferringNil(lOptions.Labels)
 	}
 	if options.HostUIDMapping {
 		options.UIDMap = nil
@@ -1489,10 +1830,6 @@ func (s *store) putLayer(rlstore rwLayerStore, rlstores []roLayerStore, id, pare
 		}
 		parentLayer = ilayer
 
-		if err := s.containerStore.startWriting(); err != nil {
-			return nil, -1, err
-		}
-		defer s.containerStore.stopWriting()
 		containers, err := s.containerStore.Containers()
 		if err != nil {
 			return nil, -1, err
@@ -1509,13 +1846,6 @@ func (s *store) putLayer(rlstore rwLayerStore, rlstores []roLayerStore, id, pare
 			gidMap = ilayer.GIDMap
 		}
 	} else {
-		// FIXME? It’s unclear why we are holding containerStore locked here at all
-		// (and because we are not modifying it, why it is a write lock, not a read lock).
-		if err := s.containerStore.startWriting(); err != nil {
-			return nil, -1, err
-		}
-		defer s.containerStore.stopWriting()
-
 		if !options.HostUIDMapping && len(options.UIDMap) == 0 {
 			uidMap = s.uidMap
 		}
@@ -1548,6 +1878,19 @@ func (s *store) PutLayer(id, parent string, names []string, mountLabel string, w
 	return s.putLayer(rlstore, rlstores, id, parent, names, mountLabel, writeable, lOptions, diff, nil)
 }
 
+func (s *store) PutLayerFromNativeDiff(id, parent string, names []string, mountLabel string, lOptions *LayerOptions, diff io.Reader) (*Layer, error) {
+	rlstore, rlstores, err := s.bothLayerStoreKinds()
+	if err != nil {
+		return nil, err
+	}
+	if err := rlstore.startWriting(); err != nil {
+		return nil, err
+	}
+	defer rlstore.stopWriting()
+	layer, _, err := s.putLayer(rlstore, rlstores, id, parent, names, mountLabel, false, lOptions, nil, &stagedLayerOptions{NativeDiff: diff})
+	return layer, err
+}
+
 func (s *store) CreateLayer(id, parent string, names []string, mountLabel string, writeable bool, options *LayerOptions) (*Layer, error) {
 	layer, _, err := s.PutLayer(id, parent, names, mountLabel, writeable, options, nil)
 	return layer, err
@@ -1578,85 +1921,102 @@ func (s *store) CreateImage(id string, names []string, layer, metadata string, i
 	}
 
 	return writeToImageStore(s, func() (*Image, error) {
-		var options ImageOptions
-		var namesToAddAfterCreating []string
-
-		// Check if the ID refers to an image in a read-only store -- we want
-		// to allow images in read-only stores to have their names changed, so
-		// if we find one, merge the new values in with what we know about the
-		// image that's already there.
-		if id != "" {
-			for _, is := range s.roImageStores {
-				store := is
-				if err := store.startReading(); err != nil {
-					return nil, err
+		return s.createImageLocked(id, names, layer, metadata, iOptions)
+	})
+}
+
+// createImageLocked creates an image record in s.imageStore, pulling up
+// information about an image with the same ID in a read-only image store.
+// On entry:
+// - s.imageStore must be locked for writing
+// - s.getROImageStores() MUST NOT be locked
+// - layer must be the full ID of an existing layer, or ""
+func (s *store) createImageLocked(id string, names []string, layer, metadata string, iOptions *ImageOptions) (*Image, error) {
+	var options ImageOptions
+	var namesToAddAfterCreating []string
+
+	// Check if the ID refers to an image in a read-only store -- we want
+	// to allow images in read-only stores to have their names changed, so
+	// if we find one, merge the new values in with what we know about the
+	// image that's already there.
+	if id != "" {
+		for _, is := range s.getROImageStores() {
+			store := is
+			if err := store.startReading(); err != nil {
+				return nil, err
+			}
+			defer store.stopReading()
+			if i, err := store.Get(id); err == nil {
+				// set information about this image in "options"
+				options = ImageOptions{
+					Metadata:     i.Metadata,
+					CreationDate: i.Created,
+					Digest:       i.Digest,
+					Digests:      copySlicePreferringNil(i.Digests),
+					NamesHistory: copySlicePreferringNil(i.NamesHistory),
+					Labels:       copyMapPreferringNil(i.Labels),
 				}
-				defer store.stopReading()
-				if i, err := store.Get(id); err == nil {
-					// set information about this image in "options"
-					options = ImageOptions{
-						Metadata:     i.Metadata,
-						CreationDate: i.Created,
-						Digest:       i.Digest,
-						Digests:      copySlicePreferringNil(i.Digests),
-						NamesHistory: copySlicePreferringNil(i.NamesHistory),
+				for _, key := range i.BigDataNames {
+					data, err := store.BigData(id, key)
+					if err != nil {
+						return nil, err
 					}
-					for _, key := range i.BigDataNames {
-						data, err := store.BigData(id, key)
-						if err != nil {
-							return nil, err
-						}
-						dataDigest, err := store.BigDataDigest(id, key)
-						if err != nil {
-							return nil, err
-						}
-						options.BigData = append(options.BigData, ImageBigDataOption{
-							Key:    key,
-							Data:   data,
-							Digest: dataDigest,
-						})
+					dataDigest, err := store.BigDataDigest(id, key)
+					if err != nil {
+						return nil, err
 					}
-					namesToAddAfterCreating = dedupeStrings(slices.Concat(i.Names, names))
-					break
+					options.BigData = append(options.BigData, ImageBigDataOption{
+						Key:    key,
+						Data:   data,
+						Digest: dataDigest,
+					})
 				}
+				namesToAddAfterCreating = dedupeStrings(slices.Concat(i.Names, names))
+				break
 			}
 		}
+	}
 
-		// merge any passed-in options into "options" as best we can
-		if iOptions != nil {
-			if !iOptions.CreationDate.IsZero() {
-				options.CreationDate = iOptions.CreationDate
-			}
-			if iOptions.Digest != "" {
-				options.Digest = iOptions.Digest
-			}
-			options.Digests = append(options.Digests, iOptions.Digests...)
-			if iOptions.Metadata != "" {
-				options.Metadata = iOptions.Metadata
-			}
-			options.BigData = append(options.BigData, copyImageBigDataOptionSlice(iOptions.BigData)...)
-			options.NamesHistory = append(options.NamesHistory, iOptions.NamesHistory...)
-			if options.Flags == nil {
-				options.Flags = make(map[string]any)
-			}
-			maps.Copy(options.Flags, iOptions.Flags)
+	// merge any passed-in options into "options" as best we can
+	if iOptions != nil {
+		if !iOptions.CreationDate.IsZero() {
+			options.CreationDate = iOptions.CreationDate
 		}
-
-		if options.CreationDate.IsZero() {
-			options.CreationDate = time.Now().UTC()
+		if iOptions.Digest != "" {
+			options.Digest = iOptions.Digest
 		}
-		if metadata != "" {
-			options.Metadata = metadata
+		options.Digests = append(options.Digests, iOptions.Digests...)
+		if iOptions.Metadata != "" {
+			options.Metadata = iOptions.Metadata
 		}
-
-		res, err := s.imageStore.create(id, names, layer, options)
-		if err == nil && len(namesToAddAfterCreating) > 0 {
-			// set any names we pulled up from an additional image store, now that we won't be
-			// triggering a duplicate names error
-			err = s.imageStore.updateNames(res.ID, namesToAddAfterCreating, addNames)
+		options.BigData = append(options.BigData, copyImageBigDataOptionSlice(iOptions.BigData)...)
+		options.NamesHistory = append(options.NamesHistory, iOptions.NamesHistory...)
+		if options.Flags == nil {
+			options.Flags = make(map[string]any)
 		}
-		return res, err
-	})
+		maps.Copy(options.Flags, iOptions.Flags)
+		if len(iOptions.Labels) > 0 {
+			if options.Labels == nil {
+				options.Labels = make(map[string]string)
+			}
+			maps.Copy(options.Labels, iOptions.Labels)
+		}
+	}
+
+	if options.CreationDate.IsZero() {
+		options.CreationDate = time.Now().UTC()
+	}
+	if metadata != "" {
+		options.Metadata = metadata
+	}
+
+	res, err := s.imageStore.create(id, names, layer, options)
+	if err == nil && len(namesToAddAfterCreating) > 0 {
+		// set any names we pulled up from an additional image store, now that we won't be
+		// triggering a duplicate names error
+		err = s.imageStore.updateNames(res.ID, namesToAddAfterCreating, addNames)
+	}
+	return res, err
 }
 
 // imageTopLayerForMapping locates the layer that can take the place of the
@@ -1778,6 +2138,7 @@ func (s *store) CreateContainer(id string, names []string, image, layer, metadat
 		options.MountOpts = copySlicePreferringNil(cOptions.MountOpts)
 		options.StorageOpt = copyMapPreferringNil(cOptions.StorageOpt)
 		options.BigData = copyContainerBigDataOptionSlice(cOptions.BigData)
+		options.Labels = copyMapPreferringNil(cOptions.Labels)
 	}
 	if options.HostUIDMapping {
 		options.UIDMap = nil
@@ -1805,7 +2166,7 @@ func (s *store) CreateContainer(id string, names []string, image, layer, metadat
 
 	var imageHomeStore roImageStore // Set if image != ""
 	// s.imageStore is locked read-write, if image != ""
-	// s.roImageStores are NOT NECESSARILY ALL locked read-only if image != ""
+	// s.getROImageStores() are NOT NECESSARILY ALL locked read-only if image != ""
 	var cimage *Image // Set if image != ""
 	if image != "" {
 		if err := rlstore.startWriting(); err != nil {
@@ -1827,7 +2188,7 @@ func (s *store) CreateContainer(id string, names []string, image, layer, metadat
 		if err == nil {
 			imageHomeStore = s.imageStore
 		} else {
-			for _, s := range s.roImageStores {
+			for _, s := range s.getROImageStores() {
 				store := s
 				if err := store.startReading(); err != nil {
 					return nil, err
@@ -1846,9 +2207,10 @@ func (s *store) CreateContainer(id string, names []string, image, layer, metadat
 		imageID = cimage.ID
 	}
 
+	autoUserNsSizeReason := ""
 	if options.AutoUserNs {
 		var err error
-		options.UIDMap, options.GIDMap, err = s.getAutoUserNS(&options.AutoUserNsOpts, cimage, rlstore, lstores)
+		options.UIDMap, options.GIDMap, autoUserNsSizeReason, err = s.getAutoUserNS(&options.AutoUserNsOpts, cimage, rlstore, lstores)
 		if err != nil {
 			return nil, err
 		}
@@ -1908,6 +2270,9 @@ func (s *store) CreateContainer(id string, names []string, image, layer, metadat
 	if options.Flags == nil {
 		options.Flags = make(map[string]any)
 	}
+	if autoUserNsSizeReason != "" {
+		options.Flags[autoUserNsSizeReasonFlag] = autoUserNsSizeReason
+	}
 	plabel, _ := options.Flags[processLabelFlag].(string)
 	mlabel, _ := options.Flags[mountLabelFlag].(string)
 	if (plabel == "" && mlabel != "") || (plabel != "" && mlabel == "") {
@@ -1935,6 +2300,8 @@ func (s *store) CreateContainer(id string, names []string, image, layer, metadat
 		options.Volatile = true
 	}
 
+	autoUserNs := options.AutoUserNs
+	autoUserNsGroup, autoUserNsImage := autoUserNSGroup(&options.AutoUserNsOpts, imageID)
 	return writeToContainerStore(s, func() (*Container, error) {
 		options.IDMappingOptions = types.IDMappingOptions{
 			HostUIDMapping: len(options.UIDMap) == 0,
@@ -1943,6 +2310,15 @@ func (s *store) CreateContainer(id string, names []string, image, layer, metadat
 			GIDMap:         copySlicePreferringNil(options.GIDMap),
 		}
 		container, err := s.containerStore.create(id, names, imageID, layer, &options)
+		if err == nil && container != nil && autoUserNs {
+			if err = s.recordAutoUserNS(container.ID, autoUserNsGroup, autoUserNsImage, options.UIDMap, options.GIDMap); err != nil {
+				err = fmt.Errorf("recording user namespace of container %q: %w", container.ID, err)
+				if err2 := s.containerStore.Delete(container.ID); err2 != nil {
+					logrus.Errorf("While recovering from a failure to create a container, error deleting container %#v: %v", container.ID, err2)
+				}
+				container = nil
+			}
+		}
 		if err != nil || container == nil {
 			if err2 := rlstore.deleteWhileHoldingLock(layer); err2 != nil {
 				if err == nil {
@@ -1971,6 +2347,21 @@ func (s *store) SetMetadata(id, metadata string) error {
 	})
 }
 
+func (s *store) SetLabels(id string, labels map[string]string) error {
+	return s.writeToAllStores(func(rlstore rwLayerStore) error {
+		if rlstore.Exists(id) {
+			return rlstore.SetLabels(id, labels)
+		}
+		if s.imageStore.Exists(id) {
+			return s.imageStore.SetLabels(id, labels)
+		}
+		if s.containerStore.Exists(id) {
+			return s.containerStore.SetLabels(id, labels)
+		}
+		return ErrNotAnID
+	})
+}
+
 func (s *store) Metadata(id string) (string, error) {
 	if res, done, err := readAllLayerStores(s, func(store roLayerStore) (string, bool, error) {
 		if store.Exists(id) {
@@ -2421,16 +2812,63 @@ func (s *store) updateNames(id string, names []string, op updateNameOperation) e
 		return err
 	}
 	defer s.imageStore.stopWriting()
+	if found, err := s.updateImageNamesLocked(id, deduped, op); err != nil || found {
+		return err
+	}
+
+	if found, err := writeToContainerStore(s, func() (bool, error) {
+		if !s.containerStore.Exists(id) {
+			return false, nil
+		}
+		return true, s.containerStore.updateNames(id, deduped, op)
+	}); err != nil || found {
+		return err
+	}
+
+	return ErrLayerUnknown
+}
+
+// updateNamesLocked modifies the names of the layer, image, or container with
+// the specified ID, looking for it in that order, for use in transactions,
+// which already hold all of the locks which it could need.
+// On entry:
+// - rlstore, s.imageStore and s.containerStore must be locked for writing
+// - s.getROImageStores() MUST NOT be locked
+func (s *store) updateNamesLocked(rlstore rwLayerStore, id string, names []string, op updateNameOperation) error {
+	deduped := dedupeStrings(names)
+
+	if rlstore.Exists(id) {
+		return rlstore.updateNames(id, deduped, op)
+	}
+
+	if found, err := s.updateImageNamesLocked(id, deduped, op); err != nil || found {
+		return err
+	}
+
+	if s.containerStore.Exists(id) {
+		return s.containerStore.updateNames(id, deduped, op)
+	}
+
+	return ErrLayerUnknown
+}
+
+// updateImageNamesLocked modifies the names of the image with the specified
+// ID, copying it into the read-write image store first if it is only in a
+// read-only one.  It returns false if there is no such image.
+// On entry:
+// - s.imageStore must be locked for writing
+// - s.getROImageStores() MUST NOT be locked
+func (s *store) updateImageNamesLocked(id string, deduped []string, op updateNameOperation) (bool, error) {
 	if s.imageStore.Exists(id) {
-		return s.imageStore.updateNames(id, deduped, op)
+		return true, s.imageStore.updateNames(id, deduped, op)
 	}
 
 	// Check if the id refers to a read-only image store -- we want to allow images in
 	// read-only stores to have their names changed.
-	for _, is := range s.roImageStores {
+	for _, is := range s.getROImageStores() {
 		store := is
 		if err := store.startReading(); err != nil {
-			return err
+			return false, err
 		}
 		defer store.stopReading()
 		if i, err := store.Get(id); err == nil {
@@ -2442,15 +2880,16 @@ func (s *store) updateNames(id string, names []string, op updateNameOperation) e
 				Metadata:     i.Metadata,
 				NamesHistory: copySlicePreferringNil(i.NamesHistory),
 				Flags:        copyMapPreferringNil(i.Flags),
+				Labels:       copyMapPreferringNil(i.Labels),
 			}
 			for _, key := range i.BigDataNames {
 				data, err := store.BigData(id, key)
 				if err != nil {
-					return err
+					return true, err
 				}
 				dataDigest, err := store.BigDataDigest(id, key)
 				if err != nil {
-					return err
+					return true, err
 				}
 				options.BigData = append(options.BigData, ImageBigDataOption{
 					Key:    key,
@@ -2460,23 +2899,14 @@ func (s *store) updateNames(id string, names []string, op updateNameOperation) e
 			}
 			_, err = s.imageStore.create(id, i.Names, i.TopLayer, options)
 			if err != nil {
-				return err
+				return true, err
 			}
 			// now make the changes to the writeable image record's names list
-			return s.imageStore.updateNames(id, deduped, op)
+			return true, s.imageStore.updateNames(id, deduped, op)
 		}
 	}
 
-	if found, err := writeToContainerStore(s, func() (bool, error) {
-		if !s.containerStore.Exists(id) {
-			return false, nil
-		}
-		return true, s.containerStore.updateNames(id, deduped, op)
-	}); err != nil || found {
-		return err
-	}
-
-	return ErrLayerUnknown
+	return false, nil
 }
 
 func (s *store) Names(id string) ([]string, error) {
@@ -2510,6 +2940,20 @@ func (s *store) Names(id string) ([]string, error) {
 	return nil, ErrLayerUnknown
 }
 
+func (s *store) LookupWithOptions(name string, options *LookupOptions) (string, error) {
+	if options == nil || options.Platform == nil {
+		return s.Lookup(name)
+	}
+	images, err := s.ImagesByPlatform(name, *options.Platform)
+	if err != nil {
+		return "", err
+	}
+	if len(images) == 0 {
+		return "", ErrImageUnknown
+	}
+	return images[0].ID, nil
+}
+
 func (s *store) Lookup(name string) (string, error) {
 	if res, done, err := readAllLayerStores(s, func(store roLayerStore) (string, bool, error) {
 		if l, err := store.Get(name); l != nil && err == nil {
@@ -2601,6 +3045,14 @@ func (s *store) DeleteLayer(id string) (retErr error) {
 }
 
 func (s *store) DeleteImage(id string, commit bool) (layers []string, retErr error) {
+	return s.DeleteImageWithOptions(id, &DeleteImageOptions{Commit: commit})
+}
+
+func (s *store) DeleteImageWithOptions(id string, options *DeleteImageOptions) (layers []string, retErr error) {
+	if options == nil {
+		options = &DeleteImageOptions{}
+	}
+	commit := options.Commit
 	layersToRemove := []string{}
 	cleanupFunctions := []tempdir.CleanupTempDirFunc{}
 	defer func() {
@@ -2629,6 +3081,9 @@ func (s *store) DeleteImage(id string, commit bool) (layers []string, retErr err
 				return err
 			}
 			id = image.ID
+			if image.Pinned() && !options.RemovePinned {
+				return fmt.Errorf("deleting image %s: %w", id, ErrImagePinned)
+			}
 			containers, err := s.containerStore.Containers()
 			if err != nil {
 				return err
@@ -2727,6 +3182,20 @@ func (s *store) DeleteImage(id string, commit bool) (layers []string, retErr err
 	return layersToRemove, nil
 }
 
+func (s *store) PinImage(id string) error {
+	_, err := writeToImageStore(s, func() (struct{}, error) {
+		return struct{}{}, s.imageStore.SetFlag(id, ImagePinnedFlag, true)
+	})
+	return err
+}
+
+func (s *store) UnpinImage(id string) error {
+	_, err := writeToImageStore(s, func() (struct{}, error) {
+		return struct{}{}, s.imageStore.ClearFlag(id, ImagePinnedFlag)
+	})
+	return err
+}
+
 func (s *store) DeleteContainer(id string) (retErr error) {
 	cleanupFunctions := []tempdir.CleanupTempDirFunc{}
 	defer func() {
@@ -2749,6 +3218,9 @@ func (s *store) DeleteContainer(id string) (retErr error) {
 		// the container record that refers to it, effectively losing
 		// track of it
 		if rlstore.Exists(container.LayerID) {
+			if err := s.deleteContainerSnapshots(rlstore, container); err != nil {
+				return err
+			}
 			cf, err := rlstore.deferredDelete(container.LayerID)
 			cleanupFunctions = append(cleanupFunctions, cf...)
 			if err != nil {
@@ -2777,6 +3249,115 @@ func (s *store) DeleteContainer(id string) (retErr error) {
 	})
 }
 
+// deleteContainerSnapshots discards all of the container's snapshots.
+// Requires startWriting on both the layer and container stores.
+func (s *store) deleteContainerSnapshots(rlstore rwLayerStore, container *Container) error {
+	if len(container.Snapshots) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(container.Snapshots))
+	for _, snapshot := range container.Snapshots {
+		if err := rlstore.removeSnapshot(container.LayerID, snapshot.ID); err != nil {
+			return fmt.Errorf("removing snapshot %q of container %q: %w", snapshot.Name, container.ID, err)
+		}
+		ids = append(ids, snapshot.ID)
+	}
+	return s.containerStore.removeSnapshots(container.ID, ids)
+}
+
+func (s *store) SnapshotContainer(id, name string) (*ContainerSnapshot, error) {
+	if name == "" {
+		return nil, fmt.Errorf("creating a snapshot of container %q: snapshot name must not be empty", id)
+	}
+	var res *ContainerSnapshot
+	err := s.writeToAllStores(func(rlstore rwLayerStore) error {
+		container, err := s.containerStore.Get(id)
+		if err != nil {
+			return err
+		}
+		if findContainerSnapshot(container, name) != nil {
+			return fmt.Errorf("snapshot %q of container %q: %w", name, container.ID, ErrDuplicateName)
+		}
+		snapshot := ContainerSnapshot{
+			ID:      stringid.GenerateRandomID(),
+			Name:    name,
+			Created: time.Now().UTC(),
+		}
+		if err := rlstore.createSnapshot(container.LayerID, snapshot.ID); err != nil {
+			return err
+		}
+		if err := s.containerStore.addSnapshot(container.ID, snapshot); err != nil {
+			if err2 := rlstore.removeSnapshot(container.LayerID, snapshot.ID); err2 != nil {
+				logrus.Errorf("While recovering from a failure to record snapshot %q of container %q, error removing it: %v", name, container.ID, err2)
+			}
+			return err
+		}
+		res = &snapshot
+		return nil
+	})
+	return res, err
+}
+
+func (s *store) RestoreContainerSnapshot(id, name string) error {
+	return s.writeToAllStores(func(rlstore rwLayerStore) error {
+		container, err := s.containerStore.Get(id)
+		if err != nil {
+			return err
+		}
+		snapshot := findContainerSnapshot(container, name)
+		if snapshot == nil {
+			return fmt.Errorf("snapshot %q of container %q: %w", name, container.ID, ErrSnapshotUnknown)
+		}
+		discarded, err := rlstore.restoreSnapshot(container.LayerID, snapshot.ID)
+		if err != nil {
+			return err
+		}
+		if len(discarded) == 0 {
+			return nil
+		}
+		return s.containerStore.removeSnapshots(container.ID, discarded)
+	})
+}
+
+func (s *store) ListContainerSnapshots(id string) ([]ContainerSnapshot, error) {
+	res, _, err := readContainerStore(s, func() ([]ContainerSnapshot, bool, error) {
+		container, err := s.containerStore.Get(id)
+		if err != nil {
+			return nil, true, err
+		}
+		return slices.Clone(container.Snapshots), true, nil
+	})
+	return res, err
+}
+
+func (s *store) DeleteContainerSnapshot(id, name string) error {
+	return s.writeToAllStores(func(rlstore rwLayerStore) error {
+		container, err := s.containerStore.Get(id)
+		if err != nil {
+			return err
+		}
+		snapshot := findContainerSnapshot(container, name)
+		if snapshot == nil {
+			return fmt.Errorf("snapshot %q of container %q: %w", name, container.ID, ErrSnapshotUnknown)
+		}
+		if err := rlstore.removeSnapshot(container.LayerID, snapshot.ID); err != nil {
+			return err
+		}
+		return s.containerStore.removeSnapshots(container.ID, []string{snapshot.ID})
+	})
+}
+
+// findContainerSnapshot returns the container's snapshot with the given
+// name, or nil if there is none.
+func findContainerSnapshot(container *Container, name string) *ContainerSnapshot {
+	for i := range container.Snapshots {
+		if container.Snapshots[i].Name == name {
+			return &container.Snapshots[i]
+		}
+	}
+	return nil
+}
+
 func (s *store) Delete(id string) (retErr error) {
 	cleanupFunctions := []tempdir.CleanupTempDirFunc{}
 	defer func() {
@@ -2788,6 +3369,9 @@ func (s *store) Delete(id string) (retErr error) {
 		if s.containerStore.Exists(id) {
 			if container, err := s.containerStore.Get(id); err == nil {
 				if rlstore.Exists(container.LayerID) {
+					if err := s.deleteContainerSnapshots(rlstore, container); err != nil {
+						return err
+					}
 					cf, err := rlstore.deferredDelete(container.LayerID)
 					cleanupFunctions = append(cleanupFunctions, cf...)
 					if err != nil {
@@ -2811,6 +3395,13 @@ func (s *store) Delete(id string) (retErr error) {
 			}
 		}
 		if s.imageStore.Exists(id) {
+			image, err := s.imageStore.Get(id)
+			if err != nil {
+				return err
+			}
+			if image.Pinned() {
+				return fmt.Errorf("deleting image %s: %w", image.ID, ErrImagePinned)
+			}
 			return s.imageStore.Delete(id)
 		}
 		if rlstore.Exists(id) {
@@ -2823,7 +3414,22 @@ func (s *store) Delete(id string) (retErr error) {
 }
 
 func (s *store) Wipe() error {
+	return s.WipeWithOptions(nil)
+}
+
+func (s *store) WipeWithOptions(options *WipeOptions) error {
 	return s.writeToAllStores(func(rlstore rwLayerStore) error {
+		if options != nil && options.ProtectPinned {
+			images, err := s.imageStore.Images()
+			if err != nil {
+				return err
+			}
+			for _, image := range images {
+				if image.Pinned() {
+					return fmt.Errorf("wiping storage: image %s: %w", image.ID, ErrImagePinned)
+				}
+			}
+		}
 		if err := s.containerStore.Wipe(); err != nil {
 			return err
 		}
@@ -2839,7 +3445,15 @@ func (s *store) Status() ([][2]string, error) {
 	if err != nil {
 		return nil, err
 	}
-	return rlstore.Status()
+	status, err := rlstore.Status()
+	if err != nil {
+		return nil, err
+	}
+	if err := rlstore.startReading(); err != nil {
+		return nil, err
+	}
+	defer rlstore.stopReading()
+	return append(status, rlstore.usageStatus()...), nil
 }
 
 //go:embed VERSION
@@ -2889,7 +3503,7 @@ func (s *store) MountImage(id string, mountOpts []string, mountLabel string) (st
 	if err == nil {
 		imageHomeStore = s.imageStore
 	} else {
-		for _, s := range s.roImageStores {
+		for _, s := range s.getROImageStores() {
 			if err := s.startReading(); err != nil {
 				return "", err
 			}
@@ -2965,6 +3579,9 @@ func (s *store) Mount(id, mountLabel string) (string, error) {
 	}
 	defer rlstore.stopWriting()
 	if rlstore.Exists(id) {
+		if err := rlstore.markUsed(id); err != nil {
+			return "", err
+		}
 		return rlstore.Mount(id, options)
 	}
 
@@ -3078,6 +3695,29 @@ func (s *store) Changes(from, to string) ([]archive.Change, error) {
 	return nil, ErrLayerUnknown
 }
 
+func (s *store) NativeLayerDiff(id string) (io.ReadCloser, error) {
+	// Like Diff, this can cause mounts to happen.
+	if err := s.startUsingGraphDriver(); err != nil {
+		return nil, err
+	}
+	defer s.stopUsingGraphDriver()
+
+	rlstore, err := s.getLayerStoreLocked()
+	if err != nil {
+		return nil, err
+	}
+	if err := rlstore.startWriting(); err != nil {
+		return nil, err
+	}
+	defer rlstore.stopWriting()
+	if !rlstore.Exists(id) {
+		return nil, ErrLayerUnknown
+	}
+	// The driver captures the layer's contents before it returns, so the
+	// stream can be read without keeping the store locked.
+	return rlstore.nativeDiff(id)
+}
+
 func (s *store) DiffSize(from, to string) (int64, error) {
 	if res, done, err := readAllLayerStores(s, func(store roLayerStore) (int64, bool, error) {
 		if store.Exists(to) {
@@ -3094,6 +3734,26 @@ func (s *store) DiffSize(from, to string) (int64, error) {
 	return -1, ErrLayerUnknown
 }
 
+func (s *store) ResizeLayer(id string, size uint64) error {
+	_, err := writeToLayerStore(s, func(rlstore rwLayerStore) (struct{}, error) {
+		return struct{}{}, rlstore.resize(id, size)
+	})
+	return err
+}
+
+func (s *store) LayerUsage(id string) (*LayerUsage, error) {
+	if res, done, err := readAllLayerStores(s, func(store roLayerStore) (*LayerUsage, bool, error) {
+		if store.Exists(id) {
+			res, err := store.Usage(id)
+			return res, true, err
+		}
+		return nil, false, nil
+	}); done {
+		return res, err
+	}
+	return nil, ErrLayerUnknown
+}
+
 func (s *store) Diff(from, to string, options *DiffOptions) (io.ReadCloser, error) {
 	// NaiveDiff could cause mounts to happen without a lock, so be safe
 	// and treat the .Diff operation as a Mount.
@@ -3523,6 +4183,162 @@ func (s *store) ImagesByDigest(d digest.Digest) ([]*Image, error) {
 	return images, nil
 }
 
+func (s *store) ImagesByLabel(selector string) ([]*Image, error) {
+	requirements, err := parseLabelSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	images := []*Image{}
+	if _, _, err := readAllImageStores(s, func(store roImageStore) (struct{}, bool, error) {
+		imageList, err := store.ByLabel(requirements)
+		if err != nil {
+			return struct{}{}, true, err
+		}
+		images = append(images, imageList...)
+		return struct{}{}, false, nil
+	}); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (s *store) ContainersByLabel(selector string) ([]*Container, error) {
+	requirements, err := parseLabelSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	res, _, err := readContainerStore(s, func() ([]*Container, bool, error) {
+		res, err := s.containerStore.ByLabel(requirements)
+		return res, true, err
+	})
+	return res, err
+}
+
+func (s *store) SetImageManifestList(id string, list []byte, platform *ImagePlatform) error {
+	instances, err := parseManifestList(list)
+	if err != nil {
+		return err
+	}
+	_, err = writeToImageStore(s, func() (struct{}, error) {
+		image, err := s.imageStore.Get(id)
+		if err != nil {
+			return struct{}{}, err
+		}
+		resolved, err := resolveImagePlatform(instances, image, platform)
+		if err != nil {
+			return struct{}{}, fmt.Errorf("attaching manifest list to image %q: %w", id, err)
+		}
+		return struct{}{}, s.imageStore.setManifestList(image.ID, list, resolved)
+	})
+	return err
+}
+
+func (s *store) ImagesByPlatform(name string, platform ImagePlatform) ([]*Image, error) {
+	nameDigest, err := digest.Parse(name)
+	if err != nil {
+		nameDigest = ""
+	}
+	images := []*Image{}
+	if _, _, err := readAllImageStores(s, func(store roImageStore) (struct{}, bool, error) {
+		var candidates []*Image
+		image, err := store.Get(name)
+		if err == nil {
+			candidates = append(candidates, image)
+		} else if !errors.Is(err, ErrImageUnknown) {
+			return struct{}{}, true, err
+		}
+		if nameDigest != "" {
+			// A manifest list's digest is one of the Digests of each
+			// image which it was attached to, so this finds the
+			// images for all of the list's instances.
+			byDigest, err := store.ByDigest(nameDigest)
+			if err != nil && !errors.Is(err, ErrImageUnknown) {
+				return struct{}{}, true, err
+			}
+			for _, image := range byDigest {
+				if image.ManifestList != nameDigest && !slices.Contains(image.Digests, nameDigest) {
+					continue
+				}
+				if !slices.ContainsFunc(candidates, func(c *Image) bool { return c.ID == image.ID }) {
+					candidates = append(candidates, image)
+				}
+			}
+		}
+		for _, image := range candidates {
+			if image.Platform != nil && image.Platform.matches(&platform) {
+				images = append(images, image)
+			}
+		}
+		return struct{}{}, false, nil
+	}); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (s *store) ImagesByHistoricalName(name string) ([]*Image, error) {
+	images := []*Image{}
+	if _, _, err := readAllImageStores(s, func(store roImageStore) (struct{}, bool, error) {
+		storeImages, err := store.Images()
+		if err != nil {
+			return struct{}{}, true, err
+		}
+		events, err := store.NamesLog()
+		if err != nil {
+			return struct{}{}, true, err
+		}
+		logged := make(map[string]struct{})
+		for i := range events {
+			if events[i].mentions(name) {
+				logged[events[i].ImageID] = struct{}{}
+			}
+		}
+		for i := range storeImages {
+			_, wasLogged := logged[storeImages[i].ID]
+			if wasLogged || slices.Contains(storeImages[i].Names, name) || slices.Contains(storeImages[i].NamesHistory, name) {
+				images = append(images, &storeImages[i])
+			}
+		}
+		return struct{}{}, false, nil
+	}); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (s *store) ImageNamesHistory(name string) ([]ImageNamesEvent, error) {
+	var events []ImageNamesEvent
+	if _, _, err := readAllImageStores(s, func(store roImageStore) (struct{}, bool, error) {
+		storeEvents, err := store.NamesLog()
+		if err != nil {
+			return struct{}{}, true, err
+		}
+		for i := range storeEvents {
+			if name == "" || storeEvents[i].mentions(name) {
+				events = append(events, storeEvents[i])
+			}
+		}
+		return struct{}{}, false, nil
+	}); err != nil {
+		return nil, err
+	}
+	slices.SortStableFunc(events, func(a, b ImageNamesEvent) int {
+		return a.Time.Compare(b.Time)
+	})
+	return events, nil
+}
+
+func (s *store) ImageByNameAt(name string, when time.Time) (string, error) {
+	events, err := s.ImageNamesHistory(name)
+	if err != nil {
+		return "", err
+	}
+	if id := imageWithNameAt(events, name, when); id != "" {
+		return id, nil
+	}
+	return "", fmt.Errorf("locating image which was named %q at %s: %w", name, when.Format(time.RFC3339), ErrImageUnknown)
+}
+
 func (s *store) Container(id string) (*Container, error) {
 	res, _, err := readContainerStore(s, func() (*Container, bool, error) {
 		res, err := s.containerStore.Get(id)
@@ -3897,6 +4713,13 @@ func (s *store) GarbageCollect() error {
 		firstErr = moreErr
 	}
 
+	if s.bigDataPool != nil {
+		moreErr = s.bigDataPool.prune()
+		if firstErr == nil {
+			firstErr = moreErr
+		}
+	}
+
 	return firstErr
 }
 
@@ -3906,8 +4729,22 @@ func (s *store) MultiList(options MultiListOptions) (MultiListResult, error) {
 	// TODO: Possible optimization: Deduplicate content from multiple stores.
 	out := MultiListResult{}
 
+	projection, err := newMultiListProjection(options.Fields)
+	if err != nil {
+		return MultiListResult{}, err
+	}
+	matcher, err := newMultiListMatcher(&options.Filter)
+	if err != nil {
+		return MultiListResult{}, err
+	}
+	// Telling which items are in use by which others requires looking at
+	// the kinds of items which might refer to them, too.  Only the items
+	// which match are copied out of the stores.
+	references := options.Filter.needsReferences()
+
+	var layerStores []roLayerStore
 	if options.Layers {
-		layerStores, err := s.allLayerStores()
+		layerStores, err = s.allLayerStores()
 		if err != nil {
 			return MultiListResult{}, err
 		}
@@ -3916,38 +4753,57 @@ func (s *store) MultiList(options MultiListOptions) (MultiListResult, error) {
 				return MultiListResult{}, err
 			}
 			defer roStore.stopReading()
-			layers, err := roStore.Layers()
-			if err != nil {
-				return MultiListResult{}, err
+			if references {
+				roStore.layersMatching(matcher.noteLayer)
 			}
-			out.Layers = append(out.Layers, layers...)
 		}
 	}
 
-	if options.Images {
-		for _, roStore := range s.allImageStores() {
+	var imageStores []roImageStore
+	if options.Images || (options.Layers && references) {
+		imageStores = s.allImageStores()
+		for _, roStore := range imageStores {
 			if err := roStore.startReading(); err != nil {
 				return MultiListResult{}, err
 			}
 			defer roStore.stopReading()
-
-			images, err := roStore.Images()
-			if err != nil {
-				return MultiListResult{}, err
+			if references {
+				roStore.imagesMatching(matcher.noteImage)
 			}
-			out.Images = append(out.Images, images...)
 		}
 	}
 
-	if options.Containers {
-		containers, _, err := readContainerStore(s, func() ([]Container, bool, error) {
-			res, err := s.containerStore.Containers()
-			return res, true, err
-		})
-		if err != nil {
+	if options.Containers || ((options.Layers || options.Images) && references) {
+		if err := s.containerStore.startReading(); err != nil {
 			return MultiListResult{}, err
 		}
-		out.Containers = append(out.Containers, containers...)
+		defer s.containerStore.stopReading()
+		if references {
+			s.containerStore.containersMatching(matcher.noteContainer)
+		}
+	}
+	if references {
+		matcher.finishReferences()
+	}
+
+	if options.Layers {
+		for _, roStore := range layerStores {
+			for _, layer := range roStore.layersMatching(matcher.matchesLayer) {
+				out.Layers = append(out.Layers, project(projection, &layer))
+			}
+		}
+	}
+	if options.Images {
+		for _, roStore := range imageStores {
+			for _, image := range roStore.imagesMatching(matcher.matchesImage) {
+				out.Images = append(out.Images, project(projection, &image))
+			}
+		}
+	}
+	if options.Containers {
+		for _, container := range s.containerStore.containersMatching(matcher.matchesContainer) {
+			out.Containers = append(out.Containers, project(projection, &container))
+		}
 	}
 	return out, nil
 }
@@ -1,12 +1,22 @@
 package storage
 
 import (
+	"archive/tar"
+	"errors"
+	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/containers/storage/pkg/archive"
 	"github.com/containers/storage/pkg/idtools"
 	"github.com/containers/storage/pkg/reexec"
+	"github.com/containers/storage/pkg/system"
+	"github.com/containers/storage/types"
 	digest "github.com/opencontainers/go-digest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -629,3 +639,938 @@ func TestStoreDelete(t *testing.T) {
 
 	store.Free()
 }
+
+func TestStoreContainerSnapshots(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+	defer store.Free()
+
+	_, err := store.CreateLayer("Layer", "", nil, "", false, nil)
+	require.NoError(t, err)
+	_, err = store.CreateImage("Image", nil, "Layer", "", nil)
+	require.NoError(t, err)
+	container, err := store.CreateContainer("Container", []string{"c"}, "Image", "", "", nil)
+	require.NoError(t, err)
+
+	writeFile := func(name, contents string) {
+		mountPoint, err := store.Mount(container.ID, "")
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(mountPoint, name), []byte(contents), 0o644))
+		_, err = store.Unmount(container.ID, false)
+		require.NoError(t, err)
+	}
+
+	writeFile("a", "before")
+	snapshot, err := store.SnapshotContainer("c", "first")
+	require.NoError(t, err)
+	assert.Equal(t, "first", snapshot.Name)
+	assert.NotEmpty(t, snapshot.ID)
+
+	_, err = store.SnapshotContainer("c", "first")
+	assert.ErrorIs(t, err, ErrDuplicateName)
+
+	writeFile("a", "after")
+	writeFile("b", "new")
+	_, err = store.SnapshotContainer("c", "second")
+	require.NoError(t, err)
+
+	snapshots, err := store.ListContainerSnapshots("c")
+	require.NoError(t, err)
+	require.Len(t, snapshots, 2)
+	assert.Equal(t, "first", snapshots[0].Name)
+	assert.Equal(t, "second", snapshots[1].Name)
+
+	mountPoint, err := store.Mount(container.ID, "")
+	require.NoError(t, err)
+	assert.Error(t, store.RestoreContainerSnapshot("c", "first"), "restoring a mounted container should fail")
+	_, err = store.Unmount(container.ID, false)
+	require.NoError(t, err)
+
+	require.NoError(t, store.RestoreContainerSnapshot("c", "first"))
+	err = store.RestoreContainerSnapshot("c", "missing")
+	assert.ErrorIs(t, err, ErrSnapshotUnknown)
+
+	mountPoint, err = store.Mount(container.ID, "")
+	require.NoError(t, err)
+	contents, err := os.ReadFile(filepath.Join(mountPoint, "a"))
+	require.NoError(t, err)
+	assert.Equal(t, "before", string(contents))
+	assert.NoFileExists(t, filepath.Join(mountPoint, "b"))
+	_, err = store.Unmount(container.ID, false)
+	require.NoError(t, err)
+
+	require.NoError(t, store.DeleteContainerSnapshot("c", "first"))
+	snapshots, err = store.ListContainerSnapshots("c")
+	require.NoError(t, err)
+	require.Len(t, snapshots, 1)
+	assert.Equal(t, "second", snapshots[0].Name)
+
+	snapshotsDir := filepath.Join(store.GraphRoot(), "vfs", "snapshots", container.LayerID)
+	assert.DirExists(t, snapshotsDir)
+	require.NoError(t, store.DeleteContainer("c"))
+	assert.NoDirExists(t, snapshotsDir)
+
+	_, err = store.Shutdown(true)
+	require.NoError(t, err)
+}
+
+func TestStoreNativeLayerDiffUnsupported(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+	defer store.Free()
+
+	layer, err := store.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+
+	_, err = store.NativeLayerDiff(layer.ID)
+	assert.ErrorIs(t, err, ErrNotSupported)
+	_, err = store.NativeLayerDiff("no-such-layer")
+	assert.ErrorIs(t, err, ErrLayerUnknown)
+}
+
+func TestStoreResizeLayer(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+	defer store.Free()
+	layer, err := store.CreateLayer("", "", nil, "", true, nil)
+	require.NoError(t, err)
+	assert.ErrorIs(t, store.ResizeLayer(layer.ID, 64*1024*1024), ErrNotSupported)
+
+	if os.Getuid() != 0 {
+		t.Skip("test requires root privileges")
+	}
+	for _, program := range []string{"mkfs.ext4", "e2fsck", "resize2fs"} {
+		if _, err := exec.LookPath(program); err != nil {
+			t.Skipf("test requires %s", program)
+		}
+	}
+	limited := newTestStore(t, StoreOptions{
+		GraphDriverName:    "overlay",
+		GraphDriverOptions: []string{"overlay.quota_backend=loopback", "overlay.size=32M"},
+	})
+	defer func() {
+		_, err := limited.Shutdown(true)
+		assert.NoError(t, err)
+	}()
+	layer, err = limited.CreateLayer("", "", nil, "", true, nil)
+	require.NoError(t, err)
+	// A file which doesn't fit in the layer's original size limit fits
+	// once the limit has been raised.
+	write := func() error {
+		t.Helper()
+		mountPoint, err := limited.Mount(layer.ID, "")
+		require.NoError(t, err)
+		defer func() {
+			_, err := limited.Unmount(layer.ID, true)
+			require.NoError(t, err)
+		}()
+		path := filepath.Join(mountPoint, "large")
+		err = os.WriteFile(path, make([]byte, 40*1024*1024), 0o644)
+		if err != nil {
+			require.NoError(t, os.Remove(path))
+		}
+		return err
+	}
+	assert.Error(t, write())
+	require.NoError(t, limited.ResizeLayer(layer.ID, 64*1024*1024))
+	assert.NoError(t, write())
+
+	assert.Error(t, limited.ResizeLayer(layer.ID, 16*1024*1024))
+	assert.ErrorIs(t, limited.ResizeLayer("no-such-layer", 64*1024*1024), ErrLayerUnknown)
+}
+
+func TestStoreLayerUsageUnsupported(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+	defer store.Free()
+
+	layer, err := store.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+
+	_, err = store.LayerUsage(layer.ID)
+	assert.ErrorIs(t, err, ErrNotSupported)
+	_, err = store.LayerUsage("no-such-layer")
+	assert.ErrorIs(t, err, ErrLayerUnknown)
+}
+
+func TestStoreLayerVerity(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{LayerVerity: true})
+	defer store.Free()
+
+	contents := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(contents, "file"), []byte("contents"), 0o644))
+	diff, err := archive.Tar(contents, archive.Uncompressed)
+	require.NoError(t, err)
+	defer diff.Close()
+	layer, _, err := store.PutLayer("", "", nil, "", false, nil, diff)
+	require.NoError(t, err)
+	if !slices.Contains(layer.BigDataNames, layerVerityBigDataKey) {
+		t.Skip("fs-verity is not supported by the filesystem")
+	}
+
+	_, err = store.Mount(layer.ID, "")
+	require.NoError(t, err)
+	_, err = store.Unmount(layer.ID, true)
+	require.NoError(t, err)
+
+	// A layer which is populated after it is created is sealed, too.
+	empty, err := store.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+	diff, err = archive.Tar(contents, archive.Uncompressed)
+	require.NoError(t, err)
+	defer diff.Close()
+	_, err = store.ApplyDiff(empty.ID, diff)
+	require.NoError(t, err)
+	empty, err = store.Layer(empty.ID)
+	require.NoError(t, err)
+	assert.Contains(t, empty.BigDataNames, layerVerityBigDataKey)
+	assert.NotContains(t, empty.Flags, verityPendingFlag)
+
+	// Files with fs-verity enabled can't be modified, but they can be
+	// replaced.  Layers are only verified the first time they are mounted,
+	// so the replacement is found by Check.
+	path := filepath.Join(store.GraphRoot(), "vfs", "dir", layer.ID, "file")
+	require.NoError(t, os.Remove(path))
+	require.NoError(t, os.WriteFile(path, []byte("replaced"), 0o644))
+
+	report, err := store.Check(&CheckOptions{LayerVerity: true})
+	require.NoError(t, err)
+	require.Len(t, report.Layers[layer.ID], 1)
+	assert.ErrorIs(t, report.Layers[layer.ID][0], ErrLayerVerityMismatch)
+	assert.Empty(t, report.Layers[empty.ID])
+
+	path = filepath.Join(store.GraphRoot(), "vfs", "dir", empty.ID, "file")
+	require.NoError(t, os.Remove(path))
+	require.NoError(t, os.WriteFile(path, []byte("replaced"), 0o644))
+	_, err = store.Mount(empty.ID, "")
+	assert.ErrorIs(t, err, ErrLayerVerityMismatch)
+}
+
+func TestStoreTransaction(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+	defer store.Free()
+
+	image, err := store.CreateImage("", []string{"old"}, "", "", nil)
+	require.NoError(t, err)
+	require.NoError(t, store.SetImageBigData(image.ID, "item", []byte("before"), nil))
+
+	// A failed transaction leaves everything as it was.
+	errFailed := errors.New("failed")
+	var layerID, imageID string
+	err = store.Transaction(func(tx Transaction) error {
+		layer, err := tx.CreateLayer("", "", []string{"layer"}, "", false, nil)
+		require.NoError(t, err)
+		layerID = layer.ID
+		created, err := tx.CreateImage("", []string{"new"}, layer.ID, "", nil)
+		require.NoError(t, err)
+		imageID = created.ID
+		require.NoError(t, tx.SetImageBigData(image.ID, "item", []byte("after"), nil))
+		require.NoError(t, tx.SetImageBigData(image.ID, "other", []byte("added"), nil))
+		require.NoError(t, tx.SetNames(image.ID, []string{"renamed"}))
+		return errFailed
+	})
+	assert.ErrorIs(t, err, errFailed)
+	assert.False(t, store.Exists(layerID))
+	assert.False(t, store.Exists(imageID))
+	image, err = store.Image(image.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"old"}, image.Names)
+	assert.Equal(t, []string{"item"}, image.BigDataNames)
+	data, err := store.ImageBigData(image.ID, "item")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("before"), data)
+
+	// A successful transaction keeps all of its changes.
+	err = store.Transaction(func(tx Transaction) error {
+		layer, err := tx.CreateLayer("", "", nil, "", false, nil)
+		if err != nil {
+			return err
+		}
+		layerID = layer.ID
+		created, err := tx.CreateImage("", nil, layer.ID, "", nil)
+		if err != nil {
+			return err
+		}
+		imageID = created.ID
+		return tx.AddNames(image.ID, []string{"added"})
+	})
+	require.NoError(t, err)
+	assert.True(t, store.Exists(layerID))
+	assert.True(t, store.Exists(imageID))
+	image, err = store.Image(image.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"added", "old"}, image.Names)
+
+	// A transaction which was interrupted is rolled back later.
+	assert.Panics(t, func() {
+		_ = store.Transaction(func(tx Transaction) error {
+			layer, err := tx.CreateLayer("", "", nil, "", false, nil)
+			require.NoError(t, err)
+			layerID = layer.ID
+			panic("interrupted")
+		})
+	})
+	assert.True(t, store.Exists(layerID))
+	require.NoError(t, store.Transaction(func(Transaction) error { return nil }))
+	assert.False(t, store.Exists(layerID))
+	assert.NoDirExists(t, filepath.Join(store.GraphRoot(), store.GraphDriverName()+"-transaction"))
+
+	// Changes which were made again after an interrupted transaction made
+	// them are not undone.
+	assert.Panics(t, func() {
+		_ = store.Transaction(func(tx Transaction) error {
+			require.NoError(t, tx.SetNames(image.ID, []string{"interrupted"}))
+			require.NoError(t, tx.SetImageBigData(image.ID, "item", []byte("interrupted"), nil))
+			panic("interrupted")
+		})
+	})
+	require.NoError(t, store.SetNames(image.ID, []string{"later"}))
+	require.NoError(t, store.SetImageBigData(image.ID, "item", []byte("later"), nil))
+	require.NoError(t, store.Transaction(func(Transaction) error { return nil }))
+	image, err = store.Image(image.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"later"}, image.Names)
+	data, err = store.ImageBigData(image.ID, "item")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("later"), data)
+
+	// Names which a transaction took from other images are given back.
+	owner, err := store.CreateImage("", []string{"app:latest", "app:stable"}, "", "", nil)
+	require.NoError(t, err)
+	err = store.Transaction(func(tx Transaction) error {
+		created, err := tx.CreateImage("", nil, "", "", nil)
+		require.NoError(t, err)
+		require.NoError(t, tx.SetNames(created.ID, []string{"app:latest"}))
+		require.NoError(t, tx.AddNames(image.ID, []string{"app:stable"}))
+		return errFailed
+	})
+	assert.ErrorIs(t, err, errFailed)
+	owner, err = store.Image(owner.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"app:latest", "app:stable"}, owner.Names)
+	image, err = store.Image(image.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"later"}, image.Names)
+}
+
+func TestStoreMultiListFilter(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+	defer store.Free()
+
+	base, err := store.CreateLayer("", "", []string{"base"}, "", false, nil)
+	require.NoError(t, err)
+	unused, err := store.CreateLayer("", "", []string{"unused"}, "", false, nil)
+	require.NoError(t, err)
+	used, err := store.CreateImage("", []string{"example.com/used:latest"}, base.ID, "", nil)
+	require.NoError(t, err)
+	untagged, err := store.CreateImage("", nil, base.ID, "", nil)
+	require.NoError(t, err)
+	container, err := store.CreateContainer("", []string{"ctr"}, used.ID, "", "", nil)
+	require.NoError(t, err)
+
+	// Depending on the ID mappings, the container's layer may be based on
+	// a mapped copy of the image's top layer.
+	var notInUse []string
+	inUse := make(map[string]bool)
+	for id := container.LayerID; id != ""; {
+		inUse[id] = true
+		layer, err := store.Layer(id)
+		require.NoError(t, err)
+		id = layer.Parent
+	}
+	allLayers, err := store.Layers()
+	require.NoError(t, err)
+	for _, layer := range allLayers {
+		if !inUse[layer.ID] {
+			notInUse = append(notInUse, layer.ID)
+		}
+	}
+
+	yes, no := true, false
+	ids := func(result MultiListResult) (layers, images, containers []string) {
+		for _, layer := range result.Layers {
+			layers = append(layers, layer.ID)
+		}
+		for _, image := range result.Images {
+			images = append(images, image.ID)
+		}
+		for _, container := range result.Containers {
+			containers = append(containers, container.ID)
+		}
+		return layers, images, containers
+	}
+	for _, test := range []struct {
+		filter     MultiListFilter
+		layers     []string
+		images     []string
+		containers []string
+	}{
+		{
+			filter: MultiListFilter{Names: []string{"example.com/*"}},
+			images: []string{used.ID},
+		},
+		{
+			filter:     MultiListFilter{Names: []string{"?tr", "unused"}},
+			layers:     []string{unused.ID},
+			containers: []string{container.ID},
+		},
+		{
+			filter: MultiListFilter{IDPrefixes: []string{untagged.ID[:12]}},
+			images: []string{untagged.ID},
+		},
+		{
+			filter: MultiListFilter{Dangling: &yes},
+			layers: []string{unused.ID},
+			images: []string{untagged.ID},
+		},
+		{
+			filter: MultiListFilter{InUse: &no},
+			layers: notInUse,
+			images: []string{untagged.ID},
+		},
+		{
+			filter:     MultiListFilter{CreatedBefore: time.Now().Add(-time.Hour)},
+			layers:     nil,
+			images:     nil,
+			containers: nil,
+		},
+	} {
+		result, err := store.MultiList(MultiListOptions{Layers: true, Images: true, Containers: true, Filter: test.filter})
+		require.NoError(t, err)
+		layers, images, containers := ids(result)
+		assert.ElementsMatch(t, test.layers, layers, "layers matching %+v", test.filter)
+		assert.ElementsMatch(t, test.images, images, "images matching %+v", test.filter)
+		assert.ElementsMatch(t, test.containers, containers, "containers matching %+v", test.filter)
+	}
+
+	result, err := store.MultiList(MultiListOptions{Images: true, Fields: []string{"names"}})
+	require.NoError(t, err)
+	require.Len(t, result.Images, 2)
+	for _, image := range result.Images {
+		assert.NotEmpty(t, image.ID)
+		assert.Empty(t, image.TopLayer)
+		assert.True(t, image.Created.IsZero())
+	}
+	_, err = store.MultiList(MultiListOptions{Images: true, Fields: []string{"no-such-field"}})
+	assert.Error(t, err)
+}
+
+func TestStoreImageManifestList(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+	defer store.Free()
+
+	image, err := store.CreateImage("", []string{"example.com/multi:latest"}, "", "", nil)
+	require.NoError(t, err)
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`)
+	manifestDigest := digest.Canonical.FromBytes(manifest)
+	require.NoError(t, store.SetImageBigData(image.ID, ImageDigestManifestBigDataNamePrefix+"-"+manifestDigest.String(), manifest, func([]byte) (digest.Digest, error) {
+		return manifestDigest, nil
+	}))
+	otherDigest := digest.Canonical.FromString("other")
+	list := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[` +
+		`{"digest":"` + otherDigest.String() + `","platform":{"architecture":"amd64","os":"linux"}},` +
+		`{"digest":"` + manifestDigest.String() + `","platform":{"architecture":"arm64","os":"linux","variant":"v8"}}]}`)
+	listDigest := digest.Canonical.FromBytes(list)
+
+	// Data which isn't a manifest list is refused.
+	assert.Error(t, store.SetImageManifestList(image.ID, manifest, nil))
+	// So is a platform which the list doesn't include.
+	err = store.SetImageManifestList(image.ID, list, &ImagePlatform{OS: "linux", Architecture: "s390x"})
+	assert.ErrorIs(t, err, ErrImagePlatformUnknown)
+	err = store.SetImageManifestList(image.ID, list, &ImagePlatform{OS: "linux", Architecture: "arm64", Instance: otherDigest})
+	assert.ErrorIs(t, err, ErrImagePlatformUnknown)
+
+	// Without a platform, it's inferred from the manifest which the image has.
+	require.NoError(t, store.SetImageManifestList(image.ID, list, nil))
+	image, err = store.Image(image.ID)
+	require.NoError(t, err)
+	assert.Equal(t, listDigest, image.ManifestList)
+	assert.Equal(t, &ImagePlatform{OS: "linux", Architecture: "arm64", Variant: "v8", Instance: manifestDigest}, image.Platform)
+	stored, err := store.ImageBigData(image.ID, manifestListBigDataKey(listDigest))
+	require.NoError(t, err)
+	assert.Equal(t, list, stored)
+
+	images, err := store.ImagesByDigest(listDigest)
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	assert.Equal(t, image.ID, images[0].ID)
+
+	images, err = store.ImagesByPlatform("example.com/multi:latest", ImagePlatform{OS: "linux", Architecture: "arm64"})
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	assert.Equal(t, image.ID, images[0].ID)
+	images, err = store.ImagesByPlatform("example.com/multi:latest", ImagePlatform{OS: "linux", Architecture: "arm64", Variant: "v7"})
+	require.NoError(t, err)
+	assert.Empty(t, images)
+	images, err = store.ImagesByPlatform("example.com/multi:latest", ImagePlatform{OS: "linux", Architecture: "amd64"})
+	require.NoError(t, err)
+	assert.Empty(t, images)
+
+	// The list's digest finds the image for each of its instances.
+	other, err := store.CreateImage("", nil, "", "", nil)
+	require.NoError(t, err)
+	require.NoError(t, store.SetImageManifestList(other.ID, list, &ImagePlatform{Instance: otherDigest}))
+	images, err = store.ImagesByPlatform(listDigest.String(), ImagePlatform{OS: "linux", Architecture: "arm64"})
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	assert.Equal(t, image.ID, images[0].ID)
+	images, err = store.ImagesByPlatform(listDigest.String(), ImagePlatform{OS: "linux", Architecture: "amd64"})
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+	assert.Equal(t, other.ID, images[0].ID)
+	_, err = store.DeleteImage(other.ID, true)
+	require.NoError(t, err)
+
+	id, err := store.LookupWithOptions("example.com/multi:latest", &LookupOptions{Platform: &ImagePlatform{OS: "linux", Architecture: "arm64"}})
+	require.NoError(t, err)
+	assert.Equal(t, image.ID, id)
+	_, err = store.LookupWithOptions("example.com/multi:latest", &LookupOptions{Platform: &ImagePlatform{OS: "linux", Architecture: "amd64"}})
+	assert.ErrorIs(t, err, ErrImageUnknown)
+	id, err = store.LookupWithOptions("example.com/multi:latest", nil)
+	require.NoError(t, err)
+	assert.Equal(t, image.ID, id)
+
+	// An explicitly chosen instance is recorded as given.
+	require.NoError(t, store.SetImageManifestList(image.ID, list, &ImagePlatform{Instance: otherDigest}))
+	image, err = store.Image(image.ID)
+	require.NoError(t, err)
+	assert.Equal(t, &ImagePlatform{OS: "linux", Architecture: "amd64", Instance: otherDigest}, image.Platform)
+}
+
+func TestStoreImagePinning(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+	defer store.Free()
+
+	layer, err := store.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+	image, err := store.CreateImage("", []string{"pinned"}, layer.ID, "", nil)
+	require.NoError(t, err)
+	require.NoError(t, store.PinImage("pinned"))
+	image, err = store.Image(image.ID)
+	require.NoError(t, err)
+	assert.True(t, image.Pinned())
+
+	// Pinned images aren't removed without an override.
+	_, err = store.DeleteImage(image.ID, true)
+	assert.ErrorIs(t, err, ErrImagePinned)
+	_, err = store.DeleteImage(image.ID, false)
+	assert.ErrorIs(t, err, ErrImagePinned)
+	assert.ErrorIs(t, store.Delete(image.ID), ErrImagePinned)
+	assert.ErrorIs(t, store.WipeWithOptions(&WipeOptions{ProtectPinned: true}), ErrImagePinned)
+	assert.True(t, store.Exists(image.ID))
+	assert.True(t, store.Exists(layer.ID))
+
+	// The pin persists.
+	require.NoError(t, store.SetNames(image.ID, []string{"renamed"}))
+	image, err = store.Image(image.ID)
+	require.NoError(t, err)
+	assert.True(t, image.Pinned())
+
+	// Unpinned images can be removed again.
+	require.NoError(t, store.UnpinImage(image.ID))
+	image, err = store.Image(image.ID)
+	require.NoError(t, err)
+	assert.False(t, image.Pinned())
+	_, err = store.DeleteImage(image.ID, false)
+	assert.NoError(t, err)
+
+	// So can pinned images, if that's asked for explicitly.
+	require.NoError(t, store.PinImage(image.ID))
+	layers, err := store.DeleteImageWithOptions(image.ID, &DeleteImageOptions{Commit: true, RemovePinned: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{layer.ID}, layers)
+	assert.False(t, store.Exists(image.ID))
+
+	// Wipe still removes everything unless told otherwise.
+	image, err = store.CreateImage("", nil, "", "", nil)
+	require.NoError(t, err)
+	require.NoError(t, store.PinImage(image.ID))
+	require.NoError(t, store.Wipe())
+	assert.False(t, store.Exists(image.ID))
+}
+
+func TestStoreExportContainer(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("test requires root privileges")
+	}
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+	defer store.Free()
+
+	layer, err := store.CreateLayer("", "", nil, "", true, nil)
+	require.NoError(t, err)
+	mountPoint, err := store.Mount(layer.ID, "")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(mountPoint, "base"), []byte("base"), 0o644))
+	_, err = store.Unmount(layer.ID, true)
+	require.NoError(t, err)
+	image, err := store.CreateImage("", nil, layer.ID, "", nil)
+	require.NoError(t, err)
+
+	idMap := []idtools.IDMap{{ContainerID: 0, HostID: 100000, Size: 65536}}
+	container, err := store.CreateContainer("", nil, image.ID, "", "", &ContainerOptions{
+		IDMappingOptions: types.IDMappingOptions{UIDMap: idMap, GIDMap: idMap},
+	})
+	require.NoError(t, err)
+	mountPoint, err = store.Mount(container.ID, "")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(mountPoint, "added"), []byte("added"), 0o644))
+	require.NoError(t, os.Lchown(filepath.Join(mountPoint, "added"), 100005, 100006))
+	require.NoError(t, os.WriteFile(filepath.Join(mountPoint, "skipped"), []byte("skipped"), 0o644))
+	require.NoError(t, os.Lchown(filepath.Join(mountPoint, "skipped"), 100000, 100000))
+	_, err = store.Unmount(container.ID, true)
+	require.NoError(t, err)
+
+	export := func(options *ExportOptions) map[string]*tar.Header {
+		rc, err := store.ExportContainer(container.ID, options)
+		require.NoError(t, err)
+		defer rc.Close()
+		decompressed, err := archive.DecompressStream(rc)
+		require.NoError(t, err)
+		defer decompressed.Close()
+		headers := make(map[string]*tar.Header)
+		tr := tar.NewReader(decompressed)
+		for {
+			hdr, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+			headers[filepath.Clean(hdr.Name)] = hdr
+		}
+		return headers
+	}
+
+	// The archive has the whole filesystem, owned by the container's IDs.
+	headers := export(nil)
+	require.Contains(t, headers, "base")
+	assert.Equal(t, 0, headers["base"].Uid)
+	require.Contains(t, headers, "added")
+	assert.Equal(t, 5, headers["added"].Uid)
+	assert.Equal(t, 6, headers["added"].Gid)
+	assert.Contains(t, headers, "skipped")
+
+	headers = export(&ExportOptions{Compression: archive.Gzip, ExcludePatterns: []string{"skipped"}})
+	assert.Contains(t, headers, "base")
+	assert.Contains(t, headers, "added")
+	assert.NotContains(t, headers, "skipped")
+
+	headers = export(&ExportOptions{IncludeFiles: []string{"added"}})
+	assert.Contains(t, headers, "added")
+	assert.NotContains(t, headers, "base")
+
+	// The container isn't left mounted.
+	mounted, err := store.Mounted(container.ID)
+	require.NoError(t, err)
+	assert.Zero(t, mounted)
+}
+
+func TestStoreImageNamesHistory(t *testing.T) {
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+	defer store.Free()
+
+	old, err := store.CreateImage("", []string{"app:latest"}, "", "", nil)
+	require.NoError(t, err)
+	beforeMove := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	current, err := store.CreateImage("", nil, "", "", nil)
+	require.NoError(t, err)
+	require.NoError(t, store.AddNames(current.ID, []string{"app:latest"}))
+	afterMove := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, store.RemoveNames(current.ID, []string{"app:latest"}))
+	require.NoError(t, store.SetNames(old.ID, []string{"app:old"}))
+
+	images, err := store.ImagesByHistoricalName("app:latest")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{old.ID, current.ID}, []string{images[0].ID, images[1].ID})
+
+	events, err := store.ImageNamesHistory("app:latest")
+	require.NoError(t, err)
+	require.Len(t, events, 4)
+	assert.Equal(t, ImageNamesCreated, events[0].Operation)
+	assert.Equal(t, old.ID, events[0].ImageID)
+	// Giving the name to another image is recorded for both images.
+	assert.ElementsMatch(t, []ImageNamesOperation{ImageNamesAdded, ImageNamesReassigned}, []ImageNamesOperation{events[1].Operation, events[2].Operation})
+	assert.Equal(t, ImageNamesRemoved, events[3].Operation)
+	assert.Equal(t, []string{"app:latest"}, events[3].OldNames)
+	assert.Empty(t, events[3].NewNames)
+	assert.Equal(t, os.Getpid(), events[3].PID)
+	assert.Equal(t, os.Getuid(), events[3].UID)
+
+	id, err := store.ImageByNameAt("app:latest", beforeMove)
+	require.NoError(t, err)
+	assert.Equal(t, old.ID, id)
+	id, err = store.ImageByNameAt("app:latest", afterMove)
+	require.NoError(t, err)
+	assert.Equal(t, current.ID, id)
+	_, err = store.ImageByNameAt("app:latest", time.Now())
+	assert.ErrorIs(t, err, ErrImageUnknown)
+	_, err = store.ImageByNameAt("app:latest", beforeMove.Add(-time.Hour))
+	assert.ErrorIs(t, err, ErrImageUnknown)
+
+	// Deleted images are still accounted for.
+	beforeDelete := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	_, err = store.DeleteImage(old.ID, true)
+	require.NoError(t, err)
+	id, err = store.ImageByNameAt("app:old", beforeDelete)
+	require.NoError(t, err)
+	assert.Equal(t, old.ID, id)
+	_, err = store.ImageByNameAt("app:old", time.Now())
+	assert.ErrorIs(t, err, ErrImageUnknown)
+	events, err = store.ImageNamesHistory("")
+	require.NoError(t, err)
+	assert.Equal(t, ImageNamesDeleted, events[len(events)-1].Operation)
+
+	// A damaged line is skipped, and the log is rotated once it grows too
+	// large, without losing the events which it held.
+	logPath := filepath.Join(store.GraphRoot(), "vfs-images", "names.log")
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0o600)
+	require.NoError(t, err)
+	_, err = f.WriteString("{damaged" + strings.Repeat(" ", namesLogMaxSize) + "\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	_, err = store.CreateImage("", []string{"app:new"}, "", "", nil)
+	require.NoError(t, err)
+	assert.FileExists(t, logPath+".1")
+	assert.NoFileExists(t, logPath)
+	rotated, err := store.ImageNamesHistory("")
+	require.NoError(t, err)
+	require.Len(t, rotated, len(events)+1)
+	assert.Equal(t, events, rotated[:len(events)])
+	assert.Equal(t, []string{"app:new"}, rotated[len(events)].NewNames)
+}
+
+func TestStoreLabels(t *testing.T) {
+	reexec.Init()
+
+	wd := t.TempDir()
+	options := StoreOptions{RunRoot: filepath.Join(wd, "run"), GraphRoot: filepath.Join(wd, "root")}
+	store := newTestStore(t, options)
+
+	layer, err := store.CreateLayer("", "", nil, "", false, &LayerOptions{Labels: map[string]string{"tier": "base"}})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"tier": "base"}, layer.Labels)
+	web, err := store.CreateImage("web", nil, layer.ID, "", &ImageOptions{Labels: map[string]string{"app": "web", "env": "prod"}})
+	require.NoError(t, err)
+	db, err := store.CreateImage("db", nil, layer.ID, "", &ImageOptions{Labels: map[string]string{"app": "db", "env": "test"}})
+	require.NoError(t, err)
+	plain, err := store.CreateImage("plain", nil, layer.ID, "", nil)
+	require.NoError(t, err)
+	container, err := store.CreateContainer("", nil, web.ID, "", "", &ContainerOptions{Labels: map[string]string{"app": "web"}})
+	require.NoError(t, err)
+
+	imageIDs := func(selector string) []string {
+		t.Helper()
+		images, err := store.ImagesByLabel(selector)
+		require.NoError(t, err)
+		ids := []string{}
+		for _, image := range images {
+			ids = append(ids, image.ID)
+		}
+		return ids
+	}
+	assert.Equal(t, []string{web.ID}, imageIDs("app=web"))
+	assert.Equal(t, []string{db.ID, web.ID}, imageIDs("app"))
+	assert.Equal(t, []string{plain.ID}, imageIDs("!app"))
+	assert.Equal(t, []string{db.ID, plain.ID}, imageIDs("env!=prod"))
+	assert.Equal(t, []string{db.ID}, imageIDs("app, env==test"))
+	assert.Empty(t, imageIDs("app=web,env=test"))
+	assert.Equal(t, []string{db.ID, plain.ID, web.ID}, imageIDs(""))
+	_, err = store.ImagesByLabel("app=web,")
+	assert.ErrorIs(t, err, ErrInvalidLabels)
+	_, err = store.ImagesByLabel(`app="web`)
+	assert.ErrorIs(t, err, ErrInvalidLabels)
+
+	// Values which the selector syntax can't express directly can be
+	// quoted.
+	authors, err := store.CreateImage("authors", nil, layer.ID, "", &ImageOptions{Labels: map[string]string{"authors": "A, B", "note": " x!=y "}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{authors.ID}, imageIDs(`authors="A, B"`))
+	assert.Equal(t, []string{authors.ID}, imageIDs(`note == " x!=y ", authors`))
+	assert.Equal(t, []string{db.ID, plain.ID, web.ID}, imageIDs(`authors!="A, B"`))
+	_, err = store.DeleteImage(authors.ID, true)
+	require.NoError(t, err)
+
+	containers, err := store.ContainersByLabel("app=web")
+	require.NoError(t, err)
+	require.Len(t, containers, 1)
+	assert.Equal(t, container.ID, containers[0].ID)
+
+	// Replacing labels updates the index.
+	require.NoError(t, store.SetLabels(db.ID, map[string]string{"app": "web"}))
+	assert.Equal(t, []string{db.ID, web.ID}, imageIDs("app=web"))
+	assert.Empty(t, imageIDs("env=test"))
+	require.NoError(t, store.SetLabels(container.ID, nil))
+	containers, err = store.ContainersByLabel("app")
+	require.NoError(t, err)
+	assert.Empty(t, containers)
+	require.NoError(t, store.SetLabels(layer.ID, map[string]string{"tier": "top"}))
+	layer, err = store.Layer(layer.ID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"tier": "top"}, layer.Labels)
+	assert.ErrorIs(t, store.SetLabels(web.ID, map[string]string{"a=b": "c"}), ErrInvalidLabels)
+	assert.ErrorIs(t, store.SetLabels("unknown", nil), ErrNotAnID)
+
+	// The index is rebuilt when the store is loaded again.
+	_, err = store.Shutdown(true)
+	require.NoError(t, err)
+	store.Free()
+	store = newTestStore(t, options)
+	defer store.Free()
+	assert.Equal(t, []string{db.ID, web.ID}, imageIDs("app=web"))
+	image, err := store.Image(web.ID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"app": "web", "env": "prod"}, image.Labels)
+
+	// Deleted images are removed from the index.
+	_, err = store.DeleteImage(db.ID, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{web.ID}, imageIDs("app=web"))
+}
+
+func TestStoreCloneLayerParent(t *testing.T) {
+	reexec.Init()
+
+	s := newTestStore(t, StoreOptions{}).(*store)
+	defer s.Free()
+
+	base, err := s.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+	template, err := s.CreateLayer("", base.ID, nil, "", true, nil)
+	require.NoError(t, err)
+
+	// A clone must have the same parent as its template.
+	_, err = writeToLayerStore(s, func(rlstore rwLayerStore) (*Layer, error) {
+		layer, _, err := rlstore.create("", nil, nil, "", nil, &LayerOptions{TemplateLayer: template.ID}, true, nil, &stagedLayerOptions{Clone: true})
+		return layer, err
+	})
+	assert.ErrorContains(t, err, "parents must match")
+	clone, err := writeToLayerStore(s, func(rlstore rwLayerStore) (*Layer, error) {
+		parent, err := rlstore.Get(base.ID)
+		if err != nil {
+			return nil, err
+		}
+		layer, _, err := rlstore.create("", parent, nil, "", nil, &LayerOptions{TemplateLayer: template.ID}, true, nil, &stagedLayerOptions{Clone: true})
+		return layer, err
+	})
+	require.NoError(t, err)
+	assert.Equal(t, base.ID, clone.Parent)
+
+	// Other copies of a layer aren't affected.
+	copied, err := s.CreateLayer("", "", nil, "", true, &LayerOptions{TemplateLayer: template.ID})
+	require.NoError(t, err)
+	assert.Equal(t, "", copied.Parent)
+}
+
+func TestStoreCloneContainer(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("test requires root privileges")
+	}
+	reexec.Init()
+
+	store := newTestStore(t, StoreOptions{})
+	defer store.Free()
+
+	layer, err := store.CreateLayer("", "", nil, "", true, nil)
+	require.NoError(t, err)
+	mountPoint, err := store.Mount(layer.ID, "")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(mountPoint, "base"), []byte("base"), 0o644))
+	_, err = store.Unmount(layer.ID, true)
+	require.NoError(t, err)
+	image, err := store.CreateImage("", nil, layer.ID, "", nil)
+	require.NoError(t, err)
+
+	source, err := store.CreateContainer("", []string{"source"}, image.ID, "", "metadata", &ContainerOptions{Labels: map[string]string{"role": "worker"}})
+	require.NoError(t, err)
+	mountPoint, err = store.Mount(source.ID, "")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(mountPoint, "prepared"), []byte("prepared"), 0o644))
+	_, err = store.Unmount(source.ID, true)
+	require.NoError(t, err)
+	require.NoError(t, store.SetContainerBigData(source.ID, "config", []byte("config")))
+	dir, err := store.ContainerDirectory(source.ID)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "state"), []byte("state"), 0o600))
+
+	clone, err := store.CloneContainer("source", "", []string{"clone"}, nil)
+	require.NoError(t, err)
+	assert.NotEqual(t, source.LayerID, clone.LayerID)
+	assert.Equal(t, image.ID, clone.ImageID)
+	assert.Equal(t, "metadata", clone.Metadata)
+	assert.Equal(t, map[string]string{"role": "worker"}, clone.Labels)
+	data, err := store.ContainerBigData(clone.ID, "config")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("config"), data)
+	dir, err = store.ContainerDirectory(clone.ID)
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(dir, "state"))
+	_, err = store.CloneContainer("source", "", []string{"clone"}, nil)
+	assert.ErrorIs(t, err, ErrDuplicateName)
+
+	// The clone is independent of the source.
+	require.NoError(t, store.DeleteContainer(source.ID))
+	mountPoint, err = store.Mount(clone.ID, "")
+	require.NoError(t, err)
+	for _, name := range []string{"base", "prepared"} {
+		data, err := os.ReadFile(filepath.Join(mountPoint, name))
+		require.NoError(t, err)
+		assert.Equal(t, name, string(data))
+	}
+	_, err = store.Unmount(clone.ID, true)
+	require.NoError(t, err)
+
+	// Clones can use different ID mappings.
+	idMap := []idtools.IDMap{{ContainerID: 0, HostID: 100000, Size: 65536}}
+	mapped, err := store.CloneContainer(clone.ID, "", nil, &CloneContainerOptions{
+		IDMappingOptions: types.IDMappingOptions{UIDMap: idMap, GIDMap: idMap},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, idMap, mapped.UIDMap)
+	mountPoint, err = store.Mount(mapped.ID, "")
+	require.NoError(t, err)
+	for _, name := range []string{"base", "prepared"} {
+		st, err := system.Lstat(filepath.Join(mountPoint, name))
+		require.NoError(t, err)
+		assert.Equal(t, uint32(100000), st.UID())
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(mountPoint, "mapped"), []byte("mapped"), 0o644))
+	require.NoError(t, os.Lchown(filepath.Join(mountPoint, "mapped"), 100001, 100001))
+	_, err = store.Unmount(mapped.ID, true)
+	require.NoError(t, err)
+
+	otherMap := []idtools.IDMap{{ContainerID: 0, HostID: 200000, Size: 65536}}
+	remapped, err := store.CloneContainer(mapped.ID, "", nil, &CloneContainerOptions{
+		IDMappingOptions: types.IDMappingOptions{UIDMap: otherMap, GIDMap: otherMap},
+	})
+	require.NoError(t, err)
+	mountPoint, err = store.Mount(remapped.ID, "")
+	require.NoError(t, err)
+	expected := map[string]uint32{"base": 200000, "prepared": 200000, "mapped": 200001}
+	for name, uid := range expected {
+		st, err := system.Lstat(filepath.Join(mountPoint, name))
+		require.NoError(t, err)
+		assert.Equal(t, uid, st.UID(), name)
+	}
+	_, err = store.Unmount(remapped.ID, true)
+	require.NoError(t, err)
+}
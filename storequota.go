@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// layerStoreUsage is how much of a store's quota its layers use.
+type layerStoreUsage struct {
+	// Layers is the number of layers in the store.
+	Layers int
+	// Size is the sum of the uncompressed sizes of the diffs which have
+	// been applied to the layers.
+	Size int64
+}
+
+// layerQuotaSize returns the amount of the store's size quota which a layer
+// uses: the uncompressed size of the diff which was applied to it.  The size
+// quota only covers layers populated from diffs, such as image layers.  A
+// container's read-write layer counts as 0 no matter how much data is written
+// into it, because measuring that would mean asking the driver to scan the
+// layer; the drivers' own per-layer size options limit those layers.
+func layerQuotaSize(layer *Layer) int64 {
+	return max(layer.UncompressedSize, 0)
+}
+
+// computeUsage sums up the usage of a list of layers.  The layer store calls
+// it whenever it loads layers.json, because the per-layer sizes recorded there
+// are what persists the store's usage, no matter which version of this
+// library last changed it.
+func computeUsage(layers []*Layer) layerStoreUsage {
+	usage := layerStoreUsage{Layers: len(layers)}
+	for _, layer := range layers {
+		usage.Size += layerQuotaSize(layer)
+	}
+	return usage
+}
+
+// addUsage accounts for a layer which was just added to r.layers.
+// Requires startWriting.
+func (r *layerStore) addUsage(layer *Layer) {
+	r.layersUsage.Layers++
+	r.layersUsage.Size += layerQuotaSize(layer)
+}
+
+// removeUsage accounts for a layer which was just removed from r.layers.
+// Requires startWriting.
+func (r *layerStore) removeUsage(layer *Layer) {
+	r.layersUsage.Layers--
+	r.layersUsage.Size -= layerQuotaSize(layer)
+}
+
+// setUncompressedSize updates a layer's UncompressedSize, and the layer
+// store's usage along with it.
+// Requires startWriting.
+func (r *layerStore) setUncompressedSize(layer *Layer, size int64) {
+	r.layersUsage.Size += max(size, 0) - layerQuotaSize(layer)
+	layer.UncompressedSize = size
+}
+
+// usage returns the layer store's usage, which is computed when layers.json
+// is loaded and updated as layers are added, populated, and deleted.
+// Requires startReading or startWriting.
+func (r *layerStore) usage() layerStoreUsage {
+	return r.layersUsage
+}
+
+// checkQuota returns ErrStoreQuotaExceeded if adding the specified numbers of
+// layers and bytes to the layer store would exceed its quota.
+// Requires startReading or startWriting.
+func (r *layerStore) checkQuota(layers int, size int64) error {
+	if (r.quotaLayers <= 0 || layers <= 0) && (r.quotaSize <= 0 || size <= 0) {
+		return nil
+	}
+	usage := r.usage()
+	if r.quotaLayers > 0 && layers > 0 && usage.Layers+layers > r.quotaLayers {
+		return fmt.Errorf("the store already has %d of the %d layers it is allowed: %w", usage.Layers, r.quotaLayers, ErrStoreQuotaExceeded)
+	}
+	if r.quotaSize > 0 && size > 0 && usage.Size+size > r.quotaSize {
+		return fmt.Errorf("adding %d bytes to the %d bytes which the store's layers use would exceed its limit of %d bytes: %w", size, usage.Size, r.quotaSize, ErrStoreQuotaExceeded)
+	}
+	return nil
+}
+
+// quotaReader returns a reader for a layer's uncompressed diff which fails
+// with ErrStoreQuotaExceeded if the diff would make the layer store exceed its
+// size quota.
+// Requires startWriting.
+func (r *layerStore) quotaReader(layer *Layer, diff io.Reader) *quotaLimitReader {
+	quota := &quotaLimitReader{
+		reader: diff,
+		limit:  r.quotaSize,
+	}
+	if r.quotaSize > 0 {
+		quota.remaining = r.quotaSize - (r.usage().Size - layerQuotaSize(layer))
+	}
+	return quota
+}
+
+// quotaLimitReader fails with ErrStoreQuotaExceeded once more than remaining
+// bytes have been read from reader, unless limit is not set.
+type quotaLimitReader struct {
+	reader    io.Reader
+	remaining int64
+	limit     int64
+	err       error // Set once the limit has been exceeded.
+}
+
+func (q *quotaLimitReader) Read(p []byte) (int, error) {
+	if q.err != nil {
+		return 0, q.err
+	}
+	n, err := q.reader.Read(p)
+	if q.limit <= 0 {
+		return n, err
+	}
+	q.remaining -= int64(n)
+	if q.remaining < 0 {
+		q.err = fmt.Errorf("the layer's contents would exceed the store's limit of %d bytes: %w", q.limit, ErrStoreQuotaExceeded)
+		return n, q.err
+	}
+	return n, err
+}
+
+// usageStatus returns status information about the layer store's usage and
+// quota.
+// Requires startReading or startWriting.
+func (r *layerStore) usageStatus() [][2]string {
+	usage := r.usage()
+	status := [][2]string{{"Store Layers", strconv.Itoa(usage.Layers)}}
+	if r.quotaLayers > 0 {
+		status = append(status, [2]string{"Store Layers Limit", strconv.Itoa(r.quotaLayers)})
+	}
+	status = append(status, [2]string{"Store Size", strconv.FormatInt(usage.Size, 10)})
+	if r.quotaSize > 0 {
+		status = append(status, [2]string{"Store Size Limit", strconv.FormatInt(r.quotaSize, 10)})
+	}
+	return status
+}
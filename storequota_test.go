@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/containers/storage/pkg/archive"
+	"github.com/containers/storage/pkg/reexec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreQuota(t *testing.T) {
+	reexec.Init()
+
+	storeImpl := newTestStore(t, StoreOptions{StoreQuotaLayers: 3, StoreQuotaSize: 16 * 1024}).(*store)
+	store := Store(storeImpl)
+	defer func() {
+		_, _ = store.Shutdown(true)
+		store.Free()
+	}()
+
+	status := func() map[string]string {
+		pairs, err := store.Status()
+		require.NoError(t, err)
+		res := make(map[string]string)
+		for _, pair := range pairs {
+			res[pair[0]] = pair[1]
+		}
+		return res
+	}
+	usage := func() layerStoreUsage {
+		s := status()
+		layers, err := strconv.Atoi(s["Store Layers"])
+		require.NoError(t, err)
+		size, err := strconv.ParseInt(s["Store Size"], 10, 64)
+		require.NoError(t, err)
+		return layerStoreUsage{Layers: layers, Size: size}
+	}
+
+	small, err := archive.Generate("small", "small")
+	require.NoError(t, err)
+	layer, _, err := store.PutLayer("Small", "", nil, "", false, nil, small)
+	require.NoError(t, err)
+	smallSize := layer.UncompressedSize
+	assert.Equal(t, layerStoreUsage{Layers: 1, Size: smallSize}, usage())
+
+	// A layer whose contents would exceed the size limit is not kept.
+	large, err := archive.Generate("large", strings.Repeat("x", 64*1024))
+	require.NoError(t, err)
+	_, _, err = store.PutLayer("Large", "", nil, "", false, nil, large)
+	assert.ErrorIs(t, err, ErrStoreQuotaExceeded)
+	assert.False(t, store.Exists("Large"))
+	assert.Equal(t, layerStoreUsage{Layers: 1, Size: smallSize}, usage())
+
+	_, err = store.CreateLayer("Empty", "", nil, "", true, nil)
+	require.NoError(t, err)
+	large, err = archive.Generate("large", strings.Repeat("x", 64*1024))
+	require.NoError(t, err)
+	_, err = store.ApplyDiff("Empty", large)
+	assert.ErrorIs(t, err, ErrStoreQuotaExceeded)
+	small, err = archive.Generate("small", "small")
+	require.NoError(t, err)
+	_, err = store.ApplyDiff("Empty", small)
+	require.NoError(t, err)
+	assert.Equal(t, layerStoreUsage{Layers: 2, Size: 2 * smallSize}, usage())
+
+	_, err = store.CreateLayer("Third", "", nil, "", true, nil)
+	require.NoError(t, err)
+	_, err = store.CreateLayer("Fourth", "", nil, "", true, nil)
+	assert.ErrorIs(t, err, ErrStoreQuotaExceeded)
+
+	s := status()
+	assert.Equal(t, "3", s["Store Layers"])
+	assert.Equal(t, "3", s["Store Layers Limit"])
+	assert.Equal(t, "16384", s["Store Size Limit"])
+
+	require.NoError(t, store.DeleteLayer("Small"))
+	_, err = store.CreateLayer("Fourth", "", nil, "", true, nil)
+	require.NoError(t, err)
+	assert.Equal(t, layerStoreUsage{Layers: 3, Size: smallSize}, usage())
+	s = status()
+	assert.Equal(t, "3", s["Store Layers"])
+	assert.Equal(t, strconv.FormatInt(smallSize, 10), s["Store Size"])
+
+	// The usage which was kept up to date as layers were added and removed
+	// matches what the records in layers.json add up to.
+	_, err = writeToLayerStore(storeImpl, func(rlstore rwLayerStore) (struct{}, error) {
+		r := rlstore.(*layerStore)
+		assert.Equal(t, computeUsage(r.layers), r.usage())
+		_, err := r.load(true)
+		require.NoError(t, err)
+		assert.Equal(t, layerStoreUsage{Layers: 3, Size: smallSize}, r.usage())
+		return struct{}{}, nil
+	})
+	require.NoError(t, err)
+}
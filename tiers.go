@@ -0,0 +1,361 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	drivers "github.com/containers/storage/drivers"
+	"github.com/sirupsen/logrus"
+)
+
+// ColdLayerTier is the value of a Layer's Tier field when the layer's data has
+// been moved to the store's cold store.
+const ColdLayerTier = "cold"
+
+// layerLastUsedResolution is how stale a layer's LastUsed time has to be
+// before using the layer updates it, so that mounting layers doesn't rewrite
+// the layer store's metadata every time.
+const layerLastUsedResolution = time.Hour
+
+// TierPolicy selects the layers which Store.DemoteLayers moves to the cold
+// store.
+type TierPolicy struct {
+	// UnusedFor is how long a layer must have gone without being used.
+	// Layers which have never been used are measured from when they were
+	// created.
+	UnusedFor time.Duration
+	// MinSize is the smallest uncompressed size, in bytes, of a layer
+	// which will be moved.  If it is not zero, layers whose sizes aren't
+	// known are not moved.
+	MinSize int64
+}
+
+// layersInUse returns the IDs of the layers which are mounted, or which
+// mounted layers are based on.
+// The caller must hold r.mountsLockfile, and have reloaded the mounts.
+func (r *layerStore) layersInUse() map[string]struct{} {
+	inUse := make(map[string]struct{})
+	for _, layer := range r.layers {
+		if layer.MountCount == 0 {
+			continue
+		}
+		for l := layer; l != nil; l = r.byid[l.Parent] {
+			if _, ok := inUse[l.ID]; ok {
+				break
+			}
+			inUse[l.ID] = struct{}{}
+		}
+	}
+	return inUse
+}
+
+// Requires startWriting.
+func (r *layerStore) moveToTier(id, tier string) error {
+	if !r.lockfile.IsReadWrite() {
+		return fmt.Errorf("not allowed to move layers at %q: %w", r.layerdir, ErrStoreIsReadOnly)
+	}
+	if tier != "" && tier != ColdLayerTier {
+		return fmt.Errorf("unknown storage tier %q", tier)
+	}
+	tdriver, ok := drivers.AsTieredDriver(r.driver)
+	if !ok {
+		return fmt.Errorf("moving layers to or from a cold store with the %q driver: %w", r.driver.String(), ErrNotSupported)
+	}
+	layer, ok := r.lookup(id)
+	if !ok {
+		return ErrLayerUnknown
+	}
+	if err := func() error {
+		r.mountsLockfile.RLock()
+		defer r.mountsLockfile.Unlock()
+		if err := r.reloadMountsIfChanged(); err != nil {
+			return err
+		}
+		if _, inUse := r.layersInUse()[layer.ID]; inUse {
+			return fmt.Errorf("moving layer %s: %w", layer.ID, ErrLayerInUse)
+		}
+		return nil
+	}(); err != nil {
+		return err
+	}
+
+	var err error
+	if tier == ColdLayerTier {
+		err = tdriver.DemoteLayer(layer.ID)
+	} else {
+		err = tdriver.PromoteLayer(layer.ID)
+	}
+	// Record where the layer's data is now, even if moving it failed.
+	newTier := ""
+	if tdriver.LayerInColdStore(layer.ID) {
+		newTier = ColdLayerTier
+	}
+	if newTier != layer.Tier {
+		layer.Tier = newTier
+		if saveErr := r.saveFor(layer); saveErr != nil {
+			err = errors.Join(err, saveErr)
+		}
+	}
+	return err
+}
+
+// Requires startWriting.
+func (r *layerStore) markUsed(id string) error {
+	tdriver, ok := drivers.AsTieredDriver(r.driver)
+	if !ok || !r.lockfile.IsReadWrite() {
+		return nil
+	}
+	layer, ok := r.lookup(id)
+	if !ok {
+		return ErrLayerUnknown
+	}
+	var inUse map[string]struct{}
+	if err := func() error {
+		r.mountsLockfile.RLock()
+		defer r.mountsLockfile.Unlock()
+		if err := r.reloadMountsIfChanged(); err != nil {
+			return err
+		}
+		inUse = r.layersInUse()
+		return nil
+	}(); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	var modified []*Layer
+	for l := layer; l != nil; l = r.byid[l.Parent] {
+		changed := false
+		if _, ok := inUse[l.ID]; !ok && l.Tier == ColdLayerTier {
+			// The layer can still be used where it is, so failing to
+			// move it isn't fatal.
+			if err := tdriver.PromoteLayer(l.ID); err != nil {
+				logrus.Warnf("Moving layer %s out of the cold store: %v", l.ID, err)
+			}
+			if !tdriver.LayerInColdStore(l.ID) {
+				l.Tier = ""
+				changed = true
+			}
+		}
+		if now.Sub(l.LastUsed) >= layerLastUsedResolution {
+			l.LastUsed = now
+			changed = true
+		}
+		if changed {
+			modified = append(modified, l)
+		}
+	}
+	if len(modified) == 0 {
+		return nil
+	}
+	return r.saveFor(modified...)
+}
+
+func (s *store) DemoteLayer(id string) error {
+	return s.moveLayerToTier(id, ColdLayerTier)
+}
+
+func (s *store) PromoteLayer(id string) error {
+	return s.moveLayerToTier(id, "")
+}
+
+// moveLayerToTier moves a layer in the primary layer store to or from the
+// cold store.
+func (s *store) moveLayerToTier(id, tier string) error {
+	if err := s.startUsingGraphDriver(); err != nil {
+		return err
+	}
+	defer s.stopUsingGraphDriver()
+
+	rlstore, err := s.getLayerStoreLocked()
+	if err != nil {
+		return err
+	}
+	// Holding the layer store's lock keeps the layer from being mounted,
+	// by this process or any other, while its data is being moved.
+	if err := rlstore.startWriting(); err != nil {
+		return err
+	}
+	defer rlstore.stopWriting()
+	layer, err := rlstore.Get(id)
+	if err != nil {
+		return err
+	}
+	if tier == ColdLayerTier {
+		containerLayers, err := s.containerLayers()
+		if err != nil {
+			return err
+		}
+		if containerID, ok := containerLayers[layer.ID]; ok {
+			return fmt.Errorf("layer %v used by container %v: %w", layer.ID, containerID, ErrLayerUsedByContainer)
+		}
+		// A copy which DemoteLayers staged may be out of date.
+		if tdriver, ok := drivers.AsTieredDriver(s.graphDriver); ok {
+			if err := tdriver.DiscardStagedDemotion(layer.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return rlstore.moveToTier(layer.ID, tier)
+}
+
+// shouldDemote returns true if policy calls for moving layer to the cold
+// store, ignoring its size, given the cutoff computed from policy.UnusedFor.
+func shouldDemote(layer *Layer, containerLayers map[string]string, cutoff time.Time) bool {
+	if layer.Tier == ColdLayerTier {
+		return false
+	}
+	if _, ok := containerLayers[layer.ID]; ok {
+		return false
+	}
+	lastUsed := layer.LastUsed
+	if lastUsed.IsZero() {
+		lastUsed = layer.Created
+	}
+	return !lastUsed.After(cutoff)
+}
+
+func (s *store) DemoteLayers(policy *TierPolicy) ([]string, error) {
+	if policy == nil {
+		policy = &s.tierPolicy
+	}
+	cutoff := time.Now().Add(-policy.UnusedFor)
+
+	tdriver, candidates, err := s.demotionCandidates(policy, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	var demoted []string
+	for _, layer := range candidates {
+		// Copying the data can take a long time, so it's done without
+		// holding any locks, and the locks are only taken to move the
+		// copy into place.  If it fails, DemoteLayer copies the data
+		// itself.
+		if err := tdriver.StageDemotion(layer.ID); err != nil {
+			logrus.Debugf("Staging layer %s for the cold store: %v", layer.ID, err)
+		}
+		moved, err := s.demoteStagedLayer(tdriver, &layer, cutoff)
+		if err != nil {
+			return demoted, err
+		}
+		if moved {
+			demoted = append(demoted, layer.ID)
+		}
+	}
+	return demoted, nil
+}
+
+// demotionCandidates returns the layers in the primary layer store which
+// policy calls for moving to the cold store, along with the driver which
+// would move them.
+func (s *store) demotionCandidates(policy *TierPolicy, cutoff time.Time) (drivers.TieredDriver, []Layer, error) {
+	if err := s.startUsingGraphDriver(); err != nil {
+		return nil, nil, err
+	}
+	defer s.stopUsingGraphDriver()
+
+	tdriver, ok := drivers.AsTieredDriver(s.graphDriver)
+	if !ok {
+		return nil, nil, fmt.Errorf("moving layers to a cold store with the %q driver: %w", s.graphDriverName, ErrNotSupported)
+	}
+	rlstore, err := s.getLayerStoreLocked()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := rlstore.startWriting(); err != nil {
+		return nil, nil, err
+	}
+	defer rlstore.stopWriting()
+	containerLayers, err := s.containerLayers()
+	if err != nil {
+		return nil, nil, err
+	}
+	layers, err := rlstore.Layers()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var candidates []Layer
+	for _, layer := range layers {
+		if !shouldDemote(&layer, containerLayers, cutoff) {
+			continue
+		}
+		if policy.MinSize > 0 {
+			size, err := rlstore.Size(layer.ID)
+			if err != nil {
+				return nil, nil, err
+			}
+			if size < policy.MinSize {
+				continue
+			}
+		}
+		candidates = append(candidates, layer)
+	}
+	return tdriver, candidates, nil
+}
+
+// demoteStagedLayer moves a layer which demotionCandidates returned, and
+// whose data may have been staged, to the cold store, if it still should be.
+// Otherwise, the staged copy is discarded.
+func (s *store) demoteStagedLayer(tdriver drivers.TieredDriver, candidate *Layer, cutoff time.Time) (moved bool, err error) {
+	defer func() {
+		if !moved {
+			if discardErr := tdriver.DiscardStagedDemotion(candidate.ID); discardErr != nil {
+				err = errors.Join(err, discardErr)
+			}
+		}
+	}()
+
+	if err := s.startUsingGraphDriver(); err != nil {
+		return false, err
+	}
+	defer s.stopUsingGraphDriver()
+
+	rlstore, err := s.getLayerStoreLocked()
+	if err != nil {
+		return false, err
+	}
+	if err := rlstore.startWriting(); err != nil {
+		return false, err
+	}
+	defer rlstore.stopWriting()
+	// The layer may have been changed, or deleted and recreated, while
+	// its data was being copied.
+	layer, err := rlstore.Get(candidate.ID)
+	if err != nil || layer.ID != candidate.ID || !layer.Created.Equal(candidate.Created) ||
+		layer.UncompressedDigest != candidate.UncompressedDigest || layer.UncompressedSize != candidate.UncompressedSize {
+		return false, nil
+	}
+	containerLayers, err := s.containerLayers()
+	if err != nil {
+		return false, err
+	}
+	if !shouldDemote(layer, containerLayers, cutoff) {
+		return false, nil
+	}
+	if err := rlstore.moveToTier(layer.ID, ColdLayerTier); err != nil {
+		if errors.Is(err, ErrLayerInUse) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// containerLayers returns a map from the IDs of the layers which containers
+// use as their read-write layers to the IDs of the containers.
+func (s *store) containerLayers() (map[string]string, error) {
+	res, _, err := readContainerStore(s, func() (map[string]string, bool, error) {
+		containers, err := s.containerStore.Containers()
+		if err != nil {
+			return nil, true, err
+		}
+		layers := make(map[string]string, len(containers))
+		for _, container := range containers {
+			layers[container.LayerID] = container.ID
+		}
+		return layers, true, nil
+	})
+	return res, err
+}
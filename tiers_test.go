@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/storage/pkg/fileutils"
+	"github.com/containers/storage/pkg/reexec"
+	"github.com/containers/storage/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreColdStore(t *testing.T) {
+	reexec.Init()
+
+	coldStore := filepath.Join(t.TempDir(), "cold")
+	store := newTestStore(t, StoreOptions{ColdStore: coldStore})
+	defer func() {
+		_, _ = store.Shutdown(true)
+		store.Free()
+	}()
+
+	layerInColdStore := func(id string) bool {
+		layer, err := store.Layer(id)
+		require.NoError(t, err)
+		inColdStore := fileutils.Exists(filepath.Join(coldStore, "vfs", "dir", id)) == nil
+		assert.Equal(t, inColdStore, layer.Tier == ColdLayerTier, "layer %s has tier %q", id, layer.Tier)
+		return inColdStore
+	}
+
+	_, err := store.CreateLayer("Base", "", nil, "", false, nil)
+	require.NoError(t, err)
+	_, err = store.CreateLayer("Top", "Base", nil, "", false, nil)
+	require.NoError(t, err)
+	_, err = store.CreateImage("Image", nil, "Top", "", nil)
+	require.NoError(t, err)
+	assert.ErrorIs(t, store.DemoteLayer("Missing"), ErrLayerUnknown)
+
+	require.NoError(t, store.DemoteLayer("Base"))
+	require.NoError(t, store.DemoteLayer("Top"))
+	assert.True(t, layerInColdStore("Base"))
+	assert.True(t, layerInColdStore("Top"))
+	assert.NoDirExists(t, filepath.Join(store.GraphRoot(), "vfs", "dir", "Base"))
+
+	// Creating a layer on top of the image's layers moves them back.
+	top, err := store.Layer("Top")
+	require.NoError(t, err)
+	container, err := store.CreateContainer("Container", nil, "Image", "", "", &ContainerOptions{
+		IDMappingOptions: types.IDMappingOptions{UIDMap: top.UIDMap, GIDMap: top.GIDMap},
+	})
+	require.NoError(t, err)
+	containerLayer, err := store.Layer(container.LayerID)
+	require.NoError(t, err)
+	assert.Equal(t, "Top", containerLayer.Parent)
+	assert.False(t, layerInColdStore("Base"))
+	assert.False(t, layerInColdStore("Top"))
+	top, err = store.Layer("Top")
+	require.NoError(t, err)
+	assert.False(t, top.LastUsed.IsZero())
+
+	assert.ErrorIs(t, store.DemoteLayer(container.LayerID), ErrLayerUsedByContainer)
+	_, err = store.Mount("Container", "")
+	require.NoError(t, err)
+	assert.ErrorIs(t, store.DemoteLayer("Base"), ErrLayerInUse)
+	demoted, err := store.DemoteLayers(&TierPolicy{})
+	require.NoError(t, err)
+	assert.Empty(t, demoted)
+	_, err = store.Unmount("Container", false)
+	require.NoError(t, err)
+
+	demoted, err = store.DemoteLayers(&TierPolicy{MinSize: 1 << 40})
+	require.NoError(t, err)
+	assert.Empty(t, demoted)
+	demoted, err = store.DemoteLayers(&TierPolicy{})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"Base", "Top"}, demoted)
+	assert.True(t, layerInColdStore("Top"))
+
+	// Layers can be mounted from the cold store, and are moved back when
+	// they are.
+	require.NoError(t, store.DeleteContainer("Container"))
+	_, err = store.Mount("Top", "")
+	require.NoError(t, err)
+	assert.False(t, layerInColdStore("Top"))
+	assert.False(t, layerInColdStore("Base"))
+	_, err = store.Unmount("Top", false)
+	require.NoError(t, err)
+
+	require.NoError(t, store.DemoteLayer("Base"))
+	require.NoError(t, store.PromoteLayer("Base"))
+	assert.False(t, layerInColdStore("Base"))
+
+	plain := newTestStore(t, StoreOptions{})
+	defer func() {
+		_, _ = plain.Shutdown(true)
+		plain.Free()
+	}()
+	_, err = plain.CreateLayer("Layer", "", nil, "", false, nil)
+	require.NoError(t, err)
+	assert.ErrorIs(t, plain.DemoteLayer("Layer"), ErrNotSupported)
+	_, err = plain.DemoteLayers(nil)
+	assert.ErrorIs(t, err, ErrNotSupported)
+}
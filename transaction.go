@@ -0,0 +1,553 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/containers/storage/internal/tempdir"
+	"github.com/containers/storage/pkg/fileutils"
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/containers/storage/pkg/stringid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// Transaction is the set of operations which can be grouped together by
+// calling Store.Transaction.  The methods behave like the Store methods with
+// the same names, except that the store is already locked when they are
+// called, and any changes which they make are undone if the transaction is
+// rolled back.
+type Transaction interface {
+	// PutLayer creates a layer and populates it using the contents of
+	// diff, as Store.PutLayer does.
+	PutLayer(id, parent string, names []string, mountLabel string, writeable bool, options *LayerOptions, diff io.Reader) (*Layer, int64, error)
+
+	// CreateLayer creates an empty layer, as Store.CreateLayer does.
+	CreateLayer(id, parent string, names []string, mountLabel string, writeable bool, options *LayerOptions) (*Layer, error)
+
+	// CreateImage creates an image, as Store.CreateImage does.
+	CreateImage(id string, names []string, layer, metadata string, options *ImageOptions) (*Image, error)
+
+	// SetImageBigData stores a piece of data for an image, as
+	// Store.SetImageBigData does.
+	SetImageBigData(id, key string, data []byte, digestManifest func([]byte) (digest.Digest, error)) error
+
+	// SetNames replaces the names of a layer, image, or container, as
+	// Store.SetNames does.
+	SetNames(id string, names []string) error
+
+	// AddNames adds names to a layer, image, or container, as
+	// Store.AddNames does.
+	AddNames(id string, names []string) error
+}
+
+// transactionJournalFile is the name of the file, in the transaction
+// directory, in which the changes that a transaction is making are recorded.
+const transactionJournalFile = "journal.json"
+
+// transactionNames records the names which a layer, image, or container had
+// before a transaction first changed them, and the names which the
+// transaction last gave it.  Written is nil until a change has succeeded.
+type transactionNames struct {
+	ID      string   `json:"id"`
+	Names   []string `json:"names,omitempty"`
+	Written []string `json:"written"`
+}
+
+// transactionBigData records an image's big data item as it was before a
+// transaction first changed it, and the digest of the value which the
+// transaction last wrote.  If Backup is empty, the item didn't exist.
+type transactionBigData struct {
+	Image   string        `json:"image"`
+	Key     string        `json:"key"`
+	Digest  digest.Digest `json:"digest,omitempty"`
+	Backup  string        `json:"backup,omitempty"`
+	Written digest.Digest `json:"written,omitempty"`
+}
+
+// transactionJournal is the record of the changes which a transaction has
+// made, or is about to make, in the order in which they were made.
+type transactionJournal struct {
+	Layers  []string             `json:"layers,omitempty"`
+	Images  []string             `json:"images,omitempty"`
+	Names   []transactionNames   `json:"names,omitempty"`
+	BigData []transactionBigData `json:"big-data,omitempty"`
+}
+
+type transaction struct {
+	s        *store
+	rlstore  rwLayerStore
+	rlstores []roLayerStore
+	dir      string
+	journal  transactionJournal
+}
+
+// transactionDir returns the directory which holds the journal of the
+// transaction which is in progress, or which was interrupted.
+func (s *store) transactionDir() string {
+	return filepath.Join(s.graphRoot, s.graphDriverName+"-transaction")
+}
+
+// record updates the journal and writes it out.  It must be called before
+// the change which it describes is made.
+func (t *transaction) record(change func(journal *transactionJournal)) error {
+	change(&t.journal)
+	data, err := json.Marshal(&t.journal)
+	if err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(filepath.Join(t.dir, transactionJournalFile), data, 0o600)
+}
+
+// layerExists checks if store has a layer with exactly this ID, as opposed to
+// one with this name or an ID with this prefix.
+// Requires startReading or startWriting.
+func layerExists(store roLayerStore, id string) bool {
+	layer, err := store.Get(id)
+	return err == nil && layer.ID == id
+}
+
+// imageExists checks if store has an image with exactly this ID, as opposed
+// to one with this name or an ID with this prefix.
+// Requires startReading or startWriting.
+func imageExists(store roImageStore, id string) bool {
+	image, err := store.Get(id)
+	return err == nil && image.ID == id
+}
+
+func (t *transaction) PutLayer(id, parent string, names []string, mountLabel string, writeable bool, options *LayerOptions, diff io.Reader) (*Layer, int64, error) {
+	if id == "" {
+		id = stringid.GenerateRandomID()
+	}
+	if !layerExists(t.rlstore, id) {
+		if err := t.record(func(journal *transactionJournal) {
+			journal.Layers = append(journal.Layers, id)
+		}); err != nil {
+			return nil, -1, err
+		}
+	}
+	return t.s.putLayerLocked(t.rlstore, t.rlstores, id, parent, names, mountLabel, writeable, options, diff, nil)
+}
+
+func (t *transaction) CreateLayer(id, parent string, names []string, mountLabel string, writeable bool, options *LayerOptions) (*Layer, error) {
+	layer, _, err := t.PutLayer(id, parent, names, mountLabel, writeable, options, nil)
+	return layer, err
+}
+
+// findLayer looks up a layer in any of the layer stores.
+func (t *transaction) findLayer(id string) (*Layer, error) {
+	if layer, err := t.rlstore.Get(id); err == nil {
+		return layer, nil
+	}
+	for _, s := range t.rlstores {
+		store := s
+		if err := store.startReading(); err != nil {
+			return nil, err
+		}
+		layer, err := store.Get(id)
+		store.stopReading()
+		if err == nil {
+			return layer, nil
+		}
+	}
+	return nil, ErrLayerUnknown
+}
+
+func (t *transaction) CreateImage(id string, names []string, layer, metadata string, options *ImageOptions) (*Image, error) {
+	if layer != "" {
+		ilayer, err := t.findLayer(layer)
+		if err != nil {
+			return nil, err
+		}
+		layer = ilayer.ID
+	}
+	if id == "" {
+		id = stringid.GenerateRandomID()
+	}
+	if !imageExists(t.s.imageStore, id) {
+		if err := t.record(func(journal *transactionJournal) {
+			journal.Images = append(journal.Images, id)
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return t.s.createImageLocked(id, names, layer, metadata, options)
+}
+
+func (t *transaction) SetImageBigData(id, key string, data []byte, digestManifest func([]byte) (digest.Digest, error)) error {
+	if image, err := t.s.imageStore.Get(id); err == nil && !slices.Contains(t.journal.Images, image.ID) &&
+		!slices.ContainsFunc(t.journal.BigData, func(b transactionBigData) bool { return b.Image == image.ID && b.Key == key }) {
+		saved := transactionBigData{Image: image.ID, Key: key}
+		if slices.Contains(image.BigDataNames, key) {
+			old, err := t.s.imageStore.BigData(image.ID, key)
+			if err != nil {
+				return err
+			}
+			saved.Digest = image.BigDataDigests[key]
+			saved.Backup = fmt.Sprintf("big-data-%d", len(t.journal.BigData))
+			if err := ioutils.AtomicWriteFile(filepath.Join(t.dir, saved.Backup), old, 0o600); err != nil {
+				return err
+			}
+		}
+		if err := t.record(func(journal *transactionJournal) {
+			journal.BigData = append(journal.BigData, saved)
+		}); err != nil {
+			return err
+		}
+	}
+	if err := t.s.imageStore.SetBigData(id, key, data, digestManifest); err != nil {
+		return err
+	}
+	image, err := t.s.imageStore.Get(id)
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(t.journal.BigData, func(b transactionBigData) bool { return b.Image == image.ID && b.Key == key })
+	if i == -1 {
+		return nil
+	}
+	return t.record(func(journal *transactionJournal) {
+		journal.BigData[i].Written = image.BigDataDigests[key]
+	})
+}
+
+func (t *transaction) SetNames(id string, names []string) error {
+	return t.updateNames(id, names, setNames)
+}
+
+func (t *transaction) AddNames(id string, names []string) error {
+	return t.updateNames(id, names, addNames)
+}
+
+// updateNames records the current names of whatever updateNamesLocked is
+// going to change, including any layers, images, or containers which are
+// going to lose names to it, and then changes them.  An image which is only
+// in a read-only image store is copied into the read-write store by
+// updateNamesLocked, so the copy is recorded as having been created.
+func (t *transaction) updateNames(id string, names []string, op updateNameOperation) error {
+	var created string
+	if !t.rlstore.Exists(id) && !t.s.imageStore.Exists(id) {
+		for _, s := range t.s.getROImageStores() {
+			store := s
+			if err := store.startReading(); err != nil {
+				return err
+			}
+			image, err := store.Get(id)
+			store.stopReading()
+			if err == nil {
+				created = image.ID
+				break
+			}
+		}
+	}
+	ids := t.nameOwners(names)
+	if target, ok := t.s.namesLocked(t.rlstore, id); ok && created == "" {
+		// Record the target last, so that it is rolled back first,
+		// and gives up its new names before the others get them back.
+		ids = slices.DeleteFunc(ids, func(owner string) bool { return owner == target.ID })
+		ids = append(ids, target.ID)
+	}
+	if err := t.saveNames(ids, created); err != nil {
+		return err
+	}
+	if err := t.s.updateNamesLocked(t.rlstore, id, names, op); err != nil {
+		return err
+	}
+	return t.saveWrittenNames(ids)
+}
+
+// nameOwners returns the IDs of the layers, images, and containers which
+// currently have any of names.
+func (t *transaction) nameOwners(names []string) []string {
+	var owners []string
+	for _, name := range names {
+		if layer, err := t.rlstore.Get(name); err == nil && slices.Contains(layer.Names, name) {
+			owners = append(owners, layer.ID)
+		}
+		if image, err := t.s.imageStore.Get(name); err == nil && slices.Contains(image.Names, name) {
+			owners = append(owners, image.ID)
+		}
+		if container, err := t.s.containerStore.Get(name); err == nil && slices.Contains(container.Names, name) {
+			owners = append(owners, container.ID)
+		}
+	}
+	return owners
+}
+
+// saveNames records the current names of the layers, images, or containers
+// with the specified IDs, in that order, skipping any which the transaction
+// created or whose names it has already recorded.  If created isn't "", it is
+// recorded as the ID of an image which is about to be created.
+func (t *transaction) saveNames(ids []string, created string) error {
+	var saved []transactionNames
+	for _, id := range ids {
+		current, ok := t.s.namesLocked(t.rlstore, id)
+		if !ok || slices.Contains(t.journal.Layers, current.ID) || slices.Contains(t.journal.Images, current.ID) ||
+			slices.ContainsFunc(t.journal.Names, func(n transactionNames) bool { return n.ID == current.ID }) ||
+			slices.ContainsFunc(saved, func(n transactionNames) bool { return n.ID == current.ID }) {
+			continue
+		}
+		saved = append(saved, current)
+	}
+	if len(saved) == 0 && created == "" {
+		return nil
+	}
+	return t.record(func(journal *transactionJournal) {
+		journal.Names = append(journal.Names, saved...)
+		if created != "" {
+			journal.Images = append(journal.Images, created)
+		}
+	})
+}
+
+// saveWrittenNames records the names which the layers, images, or containers
+// with the specified IDs have after the transaction changed them.
+func (t *transaction) saveWrittenNames(ids []string) error {
+	written := make(map[int][]string)
+	for _, id := range ids {
+		current, ok := t.s.namesLocked(t.rlstore, id)
+		if !ok {
+			continue
+		}
+		i := slices.IndexFunc(t.journal.Names, func(n transactionNames) bool { return n.ID == current.ID })
+		if i == -1 {
+			continue
+		}
+		written[i] = slices.Clone(current.Names)
+		if written[i] == nil {
+			written[i] = []string{}
+		}
+	}
+	if len(written) == 0 {
+		return nil
+	}
+	return t.record(func(journal *transactionJournal) {
+		for i, names := range written {
+			journal.Names[i].Written = names
+		}
+	})
+}
+
+// namesLocked returns the ID and names of the layer in rlstore, the image in
+// the read-write image store, or the container with the specified ID or name.
+// On entry:
+// - rlstore must be locked for writing
+// - s.imageStore must be locked for writing
+// - s.containerStore must be locked for writing
+func (s *store) namesLocked(rlstore rwLayerStore, id string) (transactionNames, bool) {
+	if layer, err := rlstore.Get(id); err == nil {
+		return transactionNames{ID: layer.ID, Names: layer.Names}, true
+	}
+	if image, err := s.imageStore.Get(id); err == nil {
+		return transactionNames{ID: image.ID, Names: image.Names}, true
+	}
+	if container, err := s.containerStore.Get(id); err == nil {
+		return transactionNames{ID: container.ID, Names: container.Names}, true
+	}
+	return transactionNames{}, false
+}
+
+// Transaction runs fn, holding write locks on the layer, image, and container
+// stores for its duration, and journaling the changes which fn makes through
+// the Transaction it's passed.  If fn returns an error, or the process exits
+// before fn returns, the changes are undone, and any layers which were
+// created are removed from the storage driver.
+//
+// fn must not call other methods of the Store, which would try to lock it
+// again.
+func (s *store) Transaction(fn func(tx Transaction) error) (retErr error) {
+	_, rlstores, err := s.bothLayerStoreKinds()
+	if err != nil {
+		return err
+	}
+	cleanupFunctions := []tempdir.CleanupTempDirFunc{}
+	defer func() {
+		if cleanupErr := tempdir.CleanupTemporaryDirectories(cleanupFunctions...); cleanupErr != nil {
+			retErr = errors.Join(cleanupErr, retErr)
+		}
+	}()
+	return s.writeToAllStores(func(rlstore rwLayerStore) error {
+		cf, err := s.rollBackTransactionLocked(rlstore)
+		cleanupFunctions = append(cleanupFunctions, cf...)
+		if err != nil {
+			return fmt.Errorf("rolling back an interrupted transaction: %w", err)
+		}
+
+		tx := &transaction{
+			s:        s,
+			rlstore:  rlstore,
+			rlstores: rlstores,
+			dir:      s.transactionDir(),
+		}
+		if err := os.MkdirAll(tx.dir, 0o700); err != nil {
+			return err
+		}
+		if err := tx.record(func(*transactionJournal) {}); err != nil {
+			return err
+		}
+		if err := fn(tx); err != nil {
+			cf, rollbackErr := s.rollBackTransactionLocked(rlstore)
+			cleanupFunctions = append(cleanupFunctions, cf...)
+			if rollbackErr != nil {
+				return errors.Join(err, fmt.Errorf("rolling back transaction: %w", rollbackErr))
+			}
+			return err
+		}
+		return os.RemoveAll(tx.dir)
+	})
+}
+
+// recoverTransaction rolls back a transaction which was interrupted, if one
+// left its journal behind.
+func (s *store) recoverTransaction() (retErr error) {
+	if err := fileutils.Exists(filepath.Join(s.transactionDir(), transactionJournalFile)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	cleanupFunctions := []tempdir.CleanupTempDirFunc{}
+	defer func() {
+		if cleanupErr := tempdir.CleanupTemporaryDirectories(cleanupFunctions...); cleanupErr != nil {
+			retErr = errors.Join(cleanupErr, retErr)
+		}
+	}()
+	return s.writeToAllStores(func(rlstore rwLayerStore) error {
+		cf, err := s.rollBackTransactionLocked(rlstore)
+		cleanupFunctions = append(cleanupFunctions, cf...)
+		return err
+	})
+}
+
+// rollBackTransactionLocked undoes the changes recorded in the transaction
+// journal, if there is one, in the reverse of the order in which they were
+// made.  Layers and images which have come into use since they were created
+// are left alone, as are names and big data which were changed again after
+// the transaction wrote them.  The journal is only removed if everything could be undone,
+// so that another attempt can be made later.
+// On entry:
+// - rlstore must be locked for writing
+// - s.imageStore must be locked for writing
+// - s.containerStore must be locked for writing
+func (s *store) rollBackTransactionLocked(rlstore rwLayerStore) ([]tempdir.CleanupTempDirFunc, error) {
+	dir := s.transactionDir()
+	data, err := os.ReadFile(filepath.Join(dir, transactionJournalFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// Nothing was changed before the journal was written.
+			return nil, os.RemoveAll(dir)
+		}
+		return nil, err
+	}
+	var journal transactionJournal
+	if err := json.Unmarshal(data, &journal); err != nil {
+		return nil, fmt.Errorf("decoding transaction journal: %w", err)
+	}
+
+	var errs []error
+	cleanupFunctions := []tempdir.CleanupTempDirFunc{}
+
+	containers, err := s.containerStore.Containers()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range slices.Backward(journal.Images) {
+		if !imageExists(s.imageStore, id) {
+			continue
+		}
+		if i := slices.IndexFunc(containers, func(c Container) bool { return c.ImageID == id }); i != -1 {
+			logrus.Warnf("Not rolling back creation of image %s: it is used by container %s", id, containers[i].ID)
+			continue
+		}
+		if err := s.imageStore.Delete(id); err != nil {
+			errs = append(errs, fmt.Errorf("deleting image %s: %w", id, err))
+		}
+	}
+
+	images, err := s.imageStore.Images()
+	if err != nil {
+		return nil, errors.Join(append(errs, err)...)
+	}
+	for _, id := range slices.Backward(journal.Layers) {
+		if !layerExists(rlstore, id) {
+			continue
+		}
+		layers, err := rlstore.Layers()
+		if err != nil {
+			errs = append(errs, err)
+			break
+		}
+		if slices.ContainsFunc(layers, func(l Layer) bool { return l.Parent == id }) ||
+			slices.ContainsFunc(images, func(i Image) bool { return i.TopLayer == id || slices.Contains(i.MappedTopLayers, id) }) ||
+			slices.ContainsFunc(containers, func(c Container) bool { return c.LayerID == id }) {
+			logrus.Warnf("Not rolling back creation of layer %s: it is in use", id)
+			continue
+		}
+		cf, err := rlstore.deferredDelete(id)
+		cleanupFunctions = append(cleanupFunctions, cf...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("deleting layer %s: %w", id, err))
+		}
+	}
+
+	for _, saved := range slices.Backward(journal.BigData) {
+		image, err := s.imageStore.Get(saved.Image)
+		if err != nil || image.ID != saved.Image {
+			continue
+		}
+		present := slices.Contains(image.BigDataNames, saved.Key)
+		var current digest.Digest
+		if present {
+			current = image.BigDataDigests[saved.Key]
+		}
+		if saved.Written == "" || current != saved.Written {
+			if present != (saved.Backup != "") || current != saved.Digest {
+				logrus.Warnf("Not rolling back big data %q of image %s: it was changed after the transaction wrote it", saved.Key, saved.Image)
+			}
+			continue
+		}
+		if saved.Backup == "" {
+			if err := s.imageStore.removeBigData(saved.Image, saved.Key); err != nil {
+				errs = append(errs, fmt.Errorf("removing big data %q of image %s: %w", saved.Key, saved.Image, err))
+			}
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, saved.Backup))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		savedDigest := saved.Digest
+		if savedDigest == "" {
+			savedDigest = digest.Canonical.FromBytes(data)
+		}
+		if err := s.imageStore.SetBigData(saved.Image, saved.Key, data, func([]byte) (digest.Digest, error) { return savedDigest, nil }); err != nil {
+			errs = append(errs, fmt.Errorf("restoring big data %q of image %s: %w", saved.Key, saved.Image, err))
+		}
+	}
+
+	for _, saved := range slices.Backward(journal.Names) {
+		current, ok := s.namesLocked(rlstore, saved.ID)
+		if !ok || current.ID != saved.ID {
+			continue
+		}
+		if saved.Written == nil || !slices.Equal(current.Names, saved.Written) {
+			if !slices.Equal(current.Names, saved.Names) {
+				logrus.Warnf("Not rolling back names of %s: they were changed after the transaction set them", saved.ID)
+			}
+			continue
+		}
+		if err := s.updateNamesLocked(rlstore, saved.ID, saved.Names, setNames); err != nil && !errors.Is(err, ErrLayerUnknown) {
+			errs = append(errs, fmt.Errorf("restoring names of %s: %w", saved.ID, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return cleanupFunctions, errors.Join(errs...)
+	}
+	return cleanupFunctions, os.RemoveAll(dir)
+}
@@ -0,0 +1,236 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/containers/storage/pkg/homedir"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// configDropInDirName is the name of the directories which hold
+	// drop-in configuration files.
+	configDropInDirName = "storage.conf.d"
+	// configDropInSuffix is the suffix which drop-in configuration files
+	// need to have to be read.
+	configDropInSuffix = ".conf"
+)
+
+// systemConfigDropInDirs are the directories which hold system-wide drop-in
+// configuration files.  A file in a later directory replaces one with the same
+// name in an earlier directory.
+var systemConfigDropInDirs = []string{
+	filepath.Join(filepath.Dir(SystemConfigFile), configDropInDirName),
+	filepath.Join(filepath.Dir(defaultOverrideConfigFile), configDropInDirName),
+}
+
+// userConfigDropInDir returns the directory which holds the current user's
+// drop-in configuration files, or "" if it can't be determined.
+func userConfigDropInDir() string {
+	if configHome := os.Getenv("XDG_CONFIG_HOME"); configHome != "" {
+		return filepath.Join(configHome, "containers", configDropInDirName)
+	}
+	home := homedir.Get()
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(home, ".config", "containers", configDropInDirName)
+}
+
+// readConfigDropInDir returns the names of the drop-in configuration files in
+// dir, which need not exist.
+func readConfigDropInDir(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), configDropInSuffix) || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
+
+// ConfigDropInFiles returns the drop-in configuration files which are read
+// after a configuration file, in the order in which they are applied, each
+// one overriding the values which it sets.  The system-wide drop-ins come
+// first, sorted by name, with one in /etc/containers/storage.conf.d replacing
+// one with the same name in /usr/share/containers/storage.conf.d.  The
+// current user's drop-ins in $XDG_CONFIG_HOME/containers/storage.conf.d come
+// after them, sorted by name.  No drop-ins are used when the
+// CONTAINERS_STORAGE_CONF environment variable is set.
+func ConfigDropInFiles() ([]string, error) {
+	if _, ok := os.LookupEnv(storageConfEnv); ok {
+		return nil, nil
+	}
+	system := make(map[string]string)
+	for _, dir := range systemConfigDropInDirs {
+		names, err := readConfigDropInDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			system[name] = filepath.Join(dir, name)
+		}
+	}
+	var files []string
+	for _, name := range slices.Sorted(maps.Keys(system)) {
+		files = append(files, system[name])
+	}
+	if dir := userConfigDropInDir(); dir != "" && !slices.Contains(systemConfigDropInDirs, dir) {
+		names, err := readConfigDropInDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+	return files, nil
+}
+
+// decodeConfigDropIns applies the drop-in configuration files to config.
+func decodeConfigDropIns(config *TomlConfig) error {
+	files, err := ConfigDropInFiles()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		meta, err := toml.DecodeFile(file, config)
+		if err != nil {
+			return fmt.Errorf("reading drop-in configuration file %q: %w", file, err)
+		}
+		if keys := meta.Undecoded(); len(keys) > 0 {
+			logrus.Warningf("Failed to decode the keys %q from %q", keys, file)
+		}
+	}
+	return nil
+}
+
+// configModTime returns the most recent modification time of the
+// configuration file, whose information is fi, or nil if it doesn't exist, the
+// drop-in configuration files, and the directories which hold them, so that
+// adding, removing, or changing any of them can be noticed.
+func configModTime(fi os.FileInfo) time.Time {
+	var mtime time.Time
+	if fi != nil {
+		mtime = fi.ModTime()
+	}
+	dirs := append([]string{}, systemConfigDropInDirs...)
+	if dir := userConfigDropInDir(); dir != "" {
+		dirs = append(dirs, dir)
+	}
+	files, err := ConfigDropInFiles()
+	if err != nil {
+		return mtime
+	}
+	for _, path := range append(dirs, files...) {
+		if fi, err := os.Stat(path); err == nil && fi.ModTime().After(mtime) {
+			mtime = fi.ModTime()
+		}
+	}
+	return mtime
+}
+
+// ConfigSetting is an effective configuration value, identified by its key in
+// dotted TOML form, such as "storage.options.overlay.mountopt", along with
+// the file or environment variable which set it.
+type ConfigSetting struct {
+	Key    string `json:"key"`
+	Value  any    `json:"value"`
+	Source string `json:"source"`
+}
+
+// ConfigExplanation describes how the configuration which is read from a
+// configuration file and the drop-in configuration files is put together.
+type ConfigExplanation struct {
+	// Files are the files which were read, in the order in which they
+	// were applied.
+	Files []string `json:"files"`
+	// Settings are the values which were set, sorted by key.
+	Settings []ConfigSetting `json:"settings"`
+}
+
+// Source returns the file or environment variable which set the value of the
+// specified key, or "" if nothing set it.
+func (e *ConfigExplanation) Source(key string) string {
+	for _, setting := range e.Settings {
+		if setting.Key == key {
+			return setting.Source
+		}
+	}
+	return ""
+}
+
+// flattenConfig calls fn for each value in table which isn't itself a table,
+// with the value's key in dotted form.
+func flattenConfig(prefix string, table map[string]any, fn func(key string, value any)) {
+	for key, value := range table {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		if subtable, ok := value.(map[string]any); ok {
+			flattenConfig(key, subtable, fn)
+			continue
+		}
+		fn(key, value)
+	}
+}
+
+// ExplainConfigurationFile reads the specified configuration file, the drop-in
+// configuration files, and the environment variables which override options in
+// the same way that ReloadConfigurationFile does, and reports which of them set
+// each value.
+func ExplainConfigurationFile(configFile string) (*ConfigExplanation, error) {
+	dropIns, err := ConfigDropInFiles()
+	if err != nil {
+		return nil, err
+	}
+	explanation := &ConfigExplanation{}
+	settings := make(map[string]ConfigSetting)
+	for _, file := range append([]string{configFile}, dropIns...) {
+		var table map[string]any
+		if _, err := toml.DecodeFile(file, &table); err != nil {
+			if file == configFile && errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("reading configuration file %q: %w", file, err)
+		}
+		explanation.Files = append(explanation.Files, file)
+		flattenConfig("", table, func(key string, value any) {
+			settings[key] = ConfigSetting{Key: key, Value: value, Source: file}
+		})
+	}
+	envSettings, envErrs := applyConfigEnvOverrides(new(TomlConfig))
+	if len(envErrs) > 0 {
+		return nil, envErrs[0]
+	}
+	for _, setting := range envSettings {
+		settings[setting.Key] = setting
+	}
+	if driver := os.Getenv("STORAGE_DRIVER"); driver != "" {
+		settings["storage.driver"] = ConfigSetting{Key: "storage.driver", Value: driver, Source: "$STORAGE_DRIVER"}
+	}
+	for _, setting := range settings {
+		explanation.Settings = append(explanation.Settings, setting)
+	}
+	slices.SortFunc(explanation.Settings, func(a, b ConfigSetting) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return explanation, nil
+}
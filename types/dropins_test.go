@@ -0,0 +1,118 @@
+package types
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, path, contents string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o644))
+}
+
+// unsetenv unsets an environment variable until the test is over.
+func unsetenv(t *testing.T, key string) {
+	t.Helper()
+	t.Setenv(key, "")
+	require.NoError(t, os.Unsetenv(key))
+}
+
+func TestConfigDropIns(t *testing.T) {
+	dir := t.TempDir()
+	usrDir := filepath.Join(dir, "usr", configDropInDirName)
+	etcDir := filepath.Join(dir, "etc", configDropInDirName)
+	userDir := filepath.Join(dir, "home", "containers", configDropInDirName)
+	saved := systemConfigDropInDirs
+	systemConfigDropInDirs = []string{usrDir, etcDir}
+	defer func() { systemConfigDropInDirs = saved }()
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "home"))
+	t.Setenv("STORAGE_DRIVER", "")
+	unsetenv(t, "STORAGE_OPTS")
+	unsetenv(t, storageConfEnv)
+
+	configFile := filepath.Join(dir, "storage.conf")
+	writeConfigFile(t, configFile, `[storage]
+driver = "overlay"
+runroot = "/run/main"
+graphroot = "/var/lib/main"
+[storage.options]
+additionalimagestores = ["/main"]
+`)
+	// Masked by the file with the same name in etc.
+	writeConfigFile(t, filepath.Join(usrDir, "10-driver.conf"), "[storage]\ndriver = \"btrfs\"\n")
+	writeConfigFile(t, filepath.Join(etcDir, "10-driver.conf"), "[storage]\ngraphroot = \"/var/lib/etc\"\n")
+	writeConfigFile(t, filepath.Join(usrDir, "20-runroot.conf"), "[storage]\nrunroot = \"/run/usr\"\n")
+	writeConfigFile(t, filepath.Join(usrDir, "20-runroot.conf.disabled"), "[storage]\nrunroot = \"/run/disabled\"\n")
+	writeConfigFile(t, filepath.Join(userDir, "05-user.conf"), "[storage]\ndriver = \"vfs\"\n[storage.options]\nadditionalimagestores = [\"/user\"]\n")
+
+	files, err := ConfigDropInFiles()
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(etcDir, "10-driver.conf"),
+		filepath.Join(usrDir, "20-runroot.conf"),
+		filepath.Join(userDir, "05-user.conf"),
+	}, files)
+
+	var options StoreOptions
+	require.NoError(t, ReloadConfigurationFile(configFile, &options))
+	assert.Equal(t, "vfs", options.GraphDriverName)
+	assert.Equal(t, "/run/usr", options.RunRoot)
+	assert.Equal(t, "/var/lib/etc", options.GraphRoot)
+	assert.Contains(t, options.GraphDriverOptions, "vfs.imagestore=/user")
+	assert.NotContains(t, options.GraphDriverOptions, "vfs.imagestore=/main")
+
+	explanation, err := ExplainConfigurationFile(configFile)
+	require.NoError(t, err)
+	assert.Equal(t, append([]string{configFile}, files...), explanation.Files)
+	assert.Equal(t, filepath.Join(userDir, "05-user.conf"), explanation.Source("storage.driver"))
+	assert.Equal(t, filepath.Join(usrDir, "20-runroot.conf"), explanation.Source("storage.runroot"))
+	assert.Equal(t, filepath.Join(etcDir, "10-driver.conf"), explanation.Source("storage.graphroot"))
+	assert.Equal(t, "", explanation.Source("storage.imagestore"))
+	t.Setenv("STORAGE_DRIVER", "overlay")
+	explanation, err = ExplainConfigurationFile(configFile)
+	require.NoError(t, err)
+	assert.Equal(t, "$STORAGE_DRIVER", explanation.Source("storage.driver"))
+	t.Setenv("STORAGE_DRIVER", "")
+
+	// Drop-ins aren't used along with CONTAINERS_STORAGE_CONF.
+	t.Setenv(storageConfEnv, configFile)
+	files, err = ConfigDropInFiles()
+	require.NoError(t, err)
+	assert.Empty(t, files)
+	require.NoError(t, ReloadConfigurationFile(configFile, &options))
+	assert.Equal(t, "overlay", options.GraphDriverName)
+	assert.Equal(t, "/run/main", options.RunRoot)
+}
+
+func TestConfigDropInsWithoutConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	useTestConfigDropIns(t, dir)
+
+	configFile := filepath.Join(dir, "missing.conf")
+	dropIn := filepath.Join(dir, "home", "containers", configDropInDirName, "10-test.conf")
+	writeConfigFile(t, dropIn, "[storage]\ndriver = \"vfs\"\n")
+
+	var options StoreOptions
+	err := ReloadConfigurationFileIfNeeded(configFile, &options)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.Equal(t, "vfs", options.GraphDriverName)
+
+	// Changes to the drop-ins are noticed.
+	writeConfigFile(t, dropIn, "[storage]\ndriver = \"overlay\"\n")
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(dropIn, later, later))
+	options = StoreOptions{}
+	err = ReloadConfigurationFileIfNeeded(configFile, &options)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.Equal(t, "overlay", options.GraphDriverName)
+
+	options = StoreOptions{}
+	reloadConfigurationFileIfNeeded(configFile, &options)
+	assert.Equal(t, "overlay", options.GraphDriverName)
+}
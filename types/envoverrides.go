@@ -0,0 +1,200 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// configEnvPrefix is the prefix of the names of the environment variables
+// which override configuration options.
+const configEnvPrefix = "CONTAINERS_STORAGE_"
+
+// configEnvOverride is a configuration option which can be set using an
+// environment variable.
+type configEnvOverride struct {
+	key      string // the option's key in dotted TOML form
+	variable string // the name of the environment variable
+	index    []int  // the option's field in TomlConfig
+}
+
+// configEnvOverrides lists the configuration options which can be set using
+// environment variables, sorted by the names of the variables.
+var configEnvOverrides = sync.OnceValue(func() []configEnvOverride {
+	var overrides []configEnvOverride
+	var walk func(t reflect.Type, key string, index []int)
+	walk = func(t reflect.Type, key string, index []int) {
+		for i := range t.NumField() {
+			field := t.Field(i)
+			fieldIndex := append(slices.Clone(index), i)
+			if field.Anonymous && field.Type.Kind() == reflect.Struct {
+				// The driver sections embed their options.
+				walk(field.Type, key, fieldIndex)
+				continue
+			}
+			name, _, _ := strings.Cut(field.Tag.Get("toml"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			fieldKey := name
+			if key != "" {
+				fieldKey = key + "." + name
+			}
+			if field.Type.Kind() == reflect.Struct {
+				walk(field.Type, fieldKey, fieldIndex)
+				continue
+			}
+			overrides = append(overrides, configEnvOverride{
+				key:      fieldKey,
+				variable: ConfigEnvVariable(fieldKey),
+				index:    fieldIndex,
+			})
+		}
+	}
+	walk(reflect.TypeOf(TomlConfig{}), "", nil)
+	slices.SortFunc(overrides, func(a, b configEnvOverride) int {
+		return strings.Compare(a.variable, b.variable)
+	})
+	return overrides
+})
+
+// ConfigEnvVariable returns the name of the environment variable which
+// overrides the configuration option with the specified key, in dotted TOML
+// form.  The name is CONTAINERS_STORAGE_ followed by the rest of the key, in
+// upper case, with "." and "-" replaced by "_", so that the variable for
+// "storage.options.overlay.mount_program" is
+// CONTAINERS_STORAGE_OPTIONS_OVERLAY_MOUNT_PROGRAM.
+func ConfigEnvVariable(key string) string {
+	key = strings.TrimPrefix(key, "storage.")
+	return configEnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(key))
+}
+
+// parseConfigEnvValue converts the value of an environment variable to a value
+// of type t.  Lists are separated by commas, and maps are lists of key=value
+// pairs.
+func parseConfigEnvValue(t reflect.Type, value string) (reflect.Value, error) {
+	v := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return v, err
+		}
+		v.SetBool(b)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		// Accept 0755 and 0o755 for permissions as well as decimal numbers.
+		u, err := strconv.ParseUint(value, 0, t.Bits())
+		if err != nil {
+			return v, err
+		}
+		v.SetUint(u)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(value, 0, t.Bits())
+		if err != nil {
+			return v, err
+		}
+		v.SetInt(i)
+	case reflect.Slice:
+		if t.Elem().Kind() != reflect.String {
+			return v, fmt.Errorf("unsupported option type %s", t)
+		}
+		v.Set(reflect.MakeSlice(t, 0, 0))
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				v.Set(reflect.Append(v, reflect.ValueOf(item)))
+			}
+		}
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String || t.Elem().Kind() != reflect.String {
+			return v, fmt.Errorf("unsupported option type %s", t)
+		}
+		v.Set(reflect.MakeMap(t))
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			k, val, ok := strings.Cut(item, "=")
+			if !ok {
+				return v, fmt.Errorf("%q is not a key=value pair", item)
+			}
+			v.SetMapIndex(reflect.ValueOf(strings.TrimSpace(k)), reflect.ValueOf(strings.TrimSpace(val)))
+		}
+	default:
+		return v, fmt.Errorf("unsupported option type %s", t)
+	}
+	return v, nil
+}
+
+// configEnvError is an environment variable whose value can't be used for the
+// option which it overrides.
+type configEnvError struct {
+	key      string
+	variable string
+	err      error
+}
+
+func (e *configEnvError) Error() string {
+	return fmt.Sprintf("parsing $%s: %v", e.variable, e.err)
+}
+
+func (e *configEnvError) Unwrap() error {
+	return e.err
+}
+
+// applyConfigEnvOverrides sets the options in config for which environment
+// variables are set, and returns the settings which were made, with the
+// variables as their sources, along with the variables whose values couldn't
+// be parsed.
+func applyConfigEnvOverrides(config *TomlConfig) ([]ConfigSetting, []*configEnvError) {
+	var settings []ConfigSetting
+	var errs []*configEnvError
+	root := reflect.ValueOf(config).Elem()
+	for _, override := range configEnvOverrides() {
+		value, ok := os.LookupEnv(override.variable)
+		if !ok {
+			continue
+		}
+		field := root.FieldByIndex(override.index)
+		parsed, err := parseConfigEnvValue(field.Type(), value)
+		if err != nil {
+			errs = append(errs, &configEnvError{key: override.key, variable: override.variable, err: err})
+			continue
+		}
+		field.Set(parsed)
+		settings = append(settings, ConfigSetting{Key: override.key, Value: parsed.Interface(), Source: "$" + override.variable})
+	}
+	return settings, errs
+}
+
+// decodeConfigEnvOverrides applies the environment variables which override
+// configuration options to config.
+func decodeConfigEnvOverrides(config *TomlConfig) error {
+	_, errs := applyConfigEnvOverrides(config)
+	if len(errs) == 0 {
+		return nil
+	}
+	joined := make([]error, 0, len(errs))
+	for _, err := range errs {
+		joined = append(joined, err)
+	}
+	return errors.Join(joined...)
+}
+
+// configEnvironment returns the values of the environment variables which
+// override configuration options, so that changes to them can be noticed.
+func configEnvironment() string {
+	var env []string
+	for _, override := range configEnvOverrides() {
+		if value, ok := os.LookupEnv(override.variable); ok {
+			env = append(env, override.variable+"="+value)
+		}
+	}
+	return strings.Join(env, "\n")
+}
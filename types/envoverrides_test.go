@@ -0,0 +1,105 @@
+package types
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigEnvVariable(t *testing.T) {
+	assert.Equal(t, "CONTAINERS_STORAGE_DRIVER", ConfigEnvVariable("storage.driver"))
+	assert.Equal(t, "CONTAINERS_STORAGE_OPTIONS_OVERLAY_MOUNT_PROGRAM", ConfigEnvVariable("storage.options.overlay.mount_program"))
+	assert.Equal(t, "CONTAINERS_STORAGE_OPTIONS_AUTO_USERNS_MAX_SIZE", ConfigEnvVariable("storage.options.auto-userns-max-size"))
+
+	variables := make(map[string]string)
+	for _, override := range configEnvOverrides() {
+		variables[override.variable] = override.key
+	}
+	assert.Equal(t, "storage.graphroot", variables["CONTAINERS_STORAGE_GRAPHROOT"])
+	assert.Equal(t, "storage.options.zfs.fsname", variables["CONTAINERS_STORAGE_OPTIONS_ZFS_FSNAME"])
+	assert.Equal(t, "storage.options.btrfs.min_space", variables["CONTAINERS_STORAGE_OPTIONS_BTRFS_MIN_SPACE"])
+	assert.Equal(t, "storage.options.pull_options", variables["CONTAINERS_STORAGE_OPTIONS_PULL_OPTIONS"])
+	assert.NotContains(t, variables, storageConfEnv)
+}
+
+func TestConfigEnvOverrides(t *testing.T) {
+	dir := t.TempDir()
+	useTestConfigDropIns(t, dir)
+
+	configFile := filepath.Join(dir, "storage.conf")
+	writeConfigFile(t, configFile, `[storage]
+driver = "vfs"
+runroot = "/run/main"
+graphroot = "/var/lib/main"
+[storage.options]
+additionalimagestores = ["/main"]
+`)
+	t.Setenv("CONTAINERS_STORAGE_DRIVER", "overlay")
+	t.Setenv("CONTAINERS_STORAGE_GRAPHROOT", "/var/lib/env")
+	t.Setenv("CONTAINERS_STORAGE_TRANSIENT_STORE", "true")
+	t.Setenv("CONTAINERS_STORAGE_OPTIONS_ADDITIONALIMAGESTORES", "/env1, /env2")
+	t.Setenv("CONTAINERS_STORAGE_OPTIONS_FORCE_MASK", "0o700")
+	t.Setenv("CONTAINERS_STORAGE_OPTIONS_AUTO_USERNS_MAX_SIZE", "4096")
+	t.Setenv("CONTAINERS_STORAGE_OPTIONS_PULL_OPTIONS", "enable_partial_images=true,use_hard_links=false")
+	t.Setenv("CONTAINERS_STORAGE_OPTIONS_OVERLAY_MOUNT_PROGRAM", "/usr/bin/fuse-overlayfs")
+
+	var options StoreOptions
+	require.NoError(t, ReloadConfigurationFile(configFile, &options))
+	assert.Equal(t, "overlay", options.GraphDriverName)
+	assert.Equal(t, "/run/main", options.RunRoot)
+	assert.Equal(t, "/var/lib/env", options.GraphRoot)
+	assert.True(t, options.TransientStore)
+	assert.Equal(t, uint32(4096), options.AutoNsMaxSize)
+	assert.Equal(t, map[string]string{"enable_partial_images": "true", "use_hard_links": "false"}, options.PullOptions)
+	assert.Subset(t, options.GraphDriverOptions, []string{
+		"overlay.imagestore=/env1",
+		"overlay.imagestore=/env2",
+		"overlay.force_mask=700",
+		"overlay.mount_program=/usr/bin/fuse-overlayfs",
+	})
+	assert.NotContains(t, options.GraphDriverOptions, "overlay.imagestore=/main")
+
+	// STORAGE_DRIVER still has the last word.
+	t.Setenv("STORAGE_DRIVER", "vfs")
+	require.NoError(t, ReloadConfigurationFile(configFile, &options))
+	assert.Equal(t, "vfs", options.GraphDriverName)
+
+	explanation, err := ExplainConfigurationFile(configFile)
+	require.NoError(t, err)
+	assert.Equal(t, "$STORAGE_DRIVER", explanation.Source("storage.driver"))
+	assert.Equal(t, "$CONTAINERS_STORAGE_GRAPHROOT", explanation.Source("storage.graphroot"))
+	assert.Equal(t, "$CONTAINERS_STORAGE_OPTIONS_ADDITIONALIMAGESTORES", explanation.Source("storage.options.additionalimagestores"))
+	assert.Equal(t, configFile, explanation.Source("storage.runroot"))
+
+	t.Setenv("CONTAINERS_STORAGE_OPTIONS_AUTO_USERNS_MAX_SIZE", "lots")
+	err = ReloadConfigurationFile(configFile, &options)
+	assert.ErrorContains(t, err, "$CONTAINERS_STORAGE_OPTIONS_AUTO_USERNS_MAX_SIZE")
+	diagnostics, err := ValidateConfigurationFile(configFile)
+	require.NoError(t, err)
+	require.NotEmpty(t, diagnostics)
+	assert.Equal(t, ConfigDiagnosticInvalidValue, diagnostics[0].Code)
+	assert.Equal(t, "storage.options.auto-userns-max-size", diagnostics[0].Key)
+	assert.Equal(t, "$CONTAINERS_STORAGE_OPTIONS_AUTO_USERNS_MAX_SIZE", diagnostics[0].File)
+}
+
+func TestConfigEnvOverridesWithoutConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	useTestConfigDropIns(t, dir)
+	t.Setenv("CONTAINERS_STORAGE_DRIVER", "vfs")
+	t.Setenv("CONTAINERS_STORAGE_RUNROOT", "/tmp/envrun")
+
+	var options StoreOptions
+	err := ReloadConfigurationFileIfNeeded(filepath.Join(dir, "missing.conf"), &options)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.Equal(t, "vfs", options.GraphDriverName)
+	assert.Equal(t, "/tmp/envrun", options.RunRoot)
+
+	// Changes to the variables are noticed.
+	t.Setenv("CONTAINERS_STORAGE_RUNROOT", "/tmp/envrun2")
+	err = ReloadConfigurationFileIfNeeded(filepath.Join(dir, "missing.conf"), &options)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.Equal(t, "/tmp/envrun2", options.RunRoot)
+}
@@ -21,12 +21,16 @@ var (
 	ErrImageUnknown = errors.New("image not known")
 	// ErrImageUsedByContainer is returned when the caller attempts to delete an image that is a container's image.
 	ErrImageUsedByContainer = errors.New("image is in use by a container")
+	// ErrImagePinned is returned when the caller attempts to remove an image that has been pinned.
+	ErrImagePinned = errors.New("image is pinned")
 	// ErrIncompleteOptions is returned when the caller attempts to initialize a Store without providing required information.
 	ErrIncompleteOptions = errors.New("missing necessary StoreOptions")
 	// ErrInvalidBigDataName indicates that the name for a big data item is not acceptable; it may be empty.
 	ErrInvalidBigDataName = errors.New("not a valid name for a big data item")
 	// ErrLayerHasChildren is returned when the caller attempts to delete a layer that has children.
 	ErrLayerHasChildren = errors.New("layer has children")
+	// ErrLayerInUse is returned when the caller attempts to move a layer which is mounted, or which a mounted layer is based on.
+	ErrLayerInUse = errors.New("layer is mounted, or is the parent of a mounted layer")
 	// ErrLayerNotMounted is returned when the requested information can only be computed for a mounted layer, and the layer is not mounted.
 	ErrLayerNotMounted = errors.New("layer is not mounted")
 	// ErrLayerUnknown indicates that there was no layer with the specified name or ID.
@@ -57,6 +61,25 @@ var (
 	ErrNotSupported = errors.New("not supported")
 	// ErrInvalidMappings is returned when the specified mappings are invalid.
 	ErrInvalidMappings = errors.New("invalid mappings specified")
+	// ErrSnapshotUnknown indicates that a container has no snapshot with the specified name.
+	ErrSnapshotUnknown = errors.New("snapshot not known")
+	// ErrImagePlatformUnknown indicates that a manifest list has no instance for the specified platform or digest.
+	ErrImagePlatformUnknown = errors.New("platform not listed in manifest list")
+	// ErrInvalidLabels is returned when labels or a label selector can't be used.
+	ErrInvalidLabels = errors.New("invalid labels")
+	// ErrReservationUnknown indicates that there is no reservation of IDs with the specified name.
+	ErrReservationUnknown = errors.New("reservation not known")
+	// ErrInvalidConfiguration is returned when problems are found in the storage configuration.
+	ErrInvalidConfiguration = errors.New("invalid storage configuration")
+	// ErrImageStoreUnknown indicates that the specified directory is not being used as an additional image store.
+	ErrImageStoreUnknown = errors.New("additional image store not known")
+	// ErrStoreQuotaExceeded is returned when creating or populating a layer would exceed the store's limit on the number of layers or on their total size.
+	ErrStoreQuotaExceeded = errors.New("store quota exceeded")
+	// ErrDuplicateImageStore indicates that the specified directory is already being used as an image store.
+	ErrDuplicateImageStore = errors.New("image store is already in use")
+	// ErrImageStoreInUse indicates that an additional image store can't be removed because layers in the
+	// primary store are based on its layers.
+	ErrImageStoreInUse = errors.New("additional image store has layers which are in use")
 	// ErrNoAvailableIDs is returned when there are not enough unused IDS within the user namespace.
 	ErrNoAvailableIDs = errors.New("not enough unused IDs in user namespace")
 
@@ -76,6 +99,9 @@ var (
 	// ErrLayerContentModified describes a layer which contains contents which should not be
 	// there, or for which ownership/permissions/dates have been changed.
 	ErrLayerContentModified = errors.New("layer content modified")
+	// ErrLayerVerityMismatch describes a layer whose files no longer match the fs-verity
+	// digests which were recorded for them when the layer was populated.
+	ErrLayerVerityMismatch = errors.New("layer content does not match its fs-verity digests")
 	// ErrLayerDataMissing describes a layer which is missing a big data item.
 	ErrLayerDataMissing = errors.New("layer data item is missing")
 	// ErrLayerMissing describes a layer which is the missing parent of a layer.
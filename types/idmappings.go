@@ -26,6 +26,26 @@ type AutoUserNsOptions struct {
 	// AdditionalGIDMappings specified additional GID mappings to include in
 	// the generated user namespace.
 	AdditionalGIDMappings []idtools.IDMap
+	// Group, if set, names a group of containers which share a user
+	// namespace.  The first container in the group is given a range of
+	// IDs, and the others reuse it, so that ID-shifted copies of image
+	// layers which are made for one of them can be used by all of them.
+	// The range is released when the last container in the group is
+	// deleted.
+	Group string
+	// PerImage, if set and Group is not, groups containers which are
+	// created from the same image in the same way that Group does.
+	PerImage bool
+	// Sparse, if set, maps only the container IDs which own files in the
+	// image's layers, as recorded when their contents were applied, along
+	// with ID 0 and those in ExtraUIDs and ExtraGIDs, instead of every
+	// container ID below the namespace's size.  Size, InitialSize,
+	// PasswdFile, and GroupFile are ignored if it is set.
+	Sparse bool
+	// ExtraUIDs and ExtraGIDs are container IDs which sparse mappings
+	// include even if no files in the image are owned by them.
+	ExtraUIDs []uint32
+	ExtraGIDs []uint32
 }
 
 // IDMappingOptions are used for specifying how ID mapping should be set up for
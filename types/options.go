@@ -15,6 +15,7 @@ import (
 	"github.com/containers/storage/pkg/homedir"
 	"github.com/containers/storage/pkg/idtools"
 	"github.com/containers/storage/pkg/unshare"
+	"github.com/docker/go-units"
 	"github.com/sirupsen/logrus"
 )
 
@@ -25,6 +26,7 @@ type TomlConfig struct {
 		DriverPriority      []string          `toml:"driver_priority,omitempty"`
 		RunRoot             string            `toml:"runroot,omitempty"`
 		ImageStore          string            `toml:"imagestore,omitempty"`
+		ColdStore           string            `toml:"coldstore,omitempty"`
 		GraphRoot           string            `toml:"graphroot,omitempty"`
 		RootlessStoragePath string            `toml:"rootless_storage_path,omitempty"`
 		TransientStore      bool              `toml:"transient_store,omitempty"`
@@ -236,6 +238,17 @@ type StoreOptions struct {
 	// Image Store is the alternate location of image store if a location
 	// separate from the container store is required.
 	ImageStore string `json:"imagestore,omitempty"`
+	// ColdStore is the location to which layers which haven't been used
+	// recently are moved, typically on slower but larger storage than the
+	// GraphRoot or ImageStore.  Layers are moved back when they are used.
+	ColdStore string `json:"coldstore,omitempty"`
+	// TierDemoteAfter is how long a layer must have gone unused before
+	// Store.DemoteLayers moves it to the ColdStore by default.
+	TierDemoteAfter time.Duration `json:"tier-demote-after,omitempty"`
+	// TierDemoteMinSize is the size, in bytes, which a layer must be at
+	// least as large as for Store.DemoteLayers to move it to the ColdStore
+	// by default.
+	TierDemoteMinSize int64 `json:"tier-demote-min-size,omitempty"`
 	// RootlessStoragePath is the storage path for rootless users
 	// default $HOME/.local/share/containers/storage
 	RootlessStoragePath string `toml:"rootless_storage_path"`
@@ -269,6 +282,24 @@ type StoreOptions struct {
 	DisableVolatile bool `json:"disable-volatile,omitempty"`
 	// If transient, don't persist containers over boot (stores db in runroot)
 	TransientStore bool `json:"transient_store,omitempty"`
+	// LayerVerity enables fs-verity on every regular file in a layer when
+	// the layer is populated as a read-only layer, and records the files'
+	// digests so that they can be verified when the layer is mounted.
+	LayerVerity bool `json:"layer_verity,omitempty"`
+	// MetadataJournal records changes to layers and images by appending
+	// them to journals which are periodically compacted, instead of
+	// rewriting layers.json and images.json for every change.  Versions
+	// of this library which don't support journals refuse to use a store
+	// whose metadata is being journaled.
+	MetadataJournal bool `json:"metadata_journal,omitempty"`
+	// StoreQuotaLayers is the largest number of layers which the store
+	// can hold, if it is not zero.
+	StoreQuotaLayers int `json:"store-quota-layers,omitempty"`
+	// StoreQuotaSize is the largest total size, in bytes, of the diffs
+	// which have been applied to the layers in the store, if it is not
+	// zero.  Data written into containers' read-write layers is not
+	// counted.
+	StoreQuotaSize int64 `json:"store-quota-size,omitempty"`
 }
 
 // isRootlessDriver returns true if the given storage driver is valid for containers running as non root
@@ -304,6 +335,8 @@ func getRootlessStorageOpts(systemOpts StoreOptions) (StoreOptions, error) {
 	}
 
 	opts.PullOptions = systemOpts.PullOptions
+	opts.StoreQuotaLayers = systemOpts.StoreQuotaLayers
+	opts.StoreQuotaSize = systemOpts.StoreQuotaSize
 	if systemOpts.RootlessStoragePath != "" {
 		opts.GraphRoot, err = expandEnvPath(systemOpts.RootlessStoragePath, rootlessUID)
 		if err != nil {
@@ -329,6 +362,7 @@ func getRootlessStorageOpts(systemOpts StoreOptions) (StoreOptions, error) {
 	if defaultConfigFileSet {
 		opts.GraphDriverOptions = systemOpts.GraphDriverOptions
 		opts.ImageStore = systemOpts.ImageStore
+		opts.ColdStore = systemOpts.ColdStore
 	} else if opts.GraphDriverName == overlayDriver {
 		for _, o := range systemOpts.GraphDriverOptions {
 			if strings.Contains(o, "ignore_chown_errors") {
@@ -373,6 +407,7 @@ var prevReloadConfig = struct {
 	mod          time.Time
 	mutex        sync.Mutex
 	configFile   string
+	env          string
 }{}
 
 // SetDefaultConfigFilePath sets the default configuration to the specified path
@@ -382,19 +417,26 @@ func SetDefaultConfigFilePath(path string) error {
 	return ReloadConfigurationFileIfNeeded(defaultConfigFile, &defaultStoreOptions)
 }
 
+// ReloadConfigurationFileIfNeeded calls ReloadConfigurationFile, unless
+// neither the configuration file, the drop-in configuration files, nor the
+// environment variables which override options have changed since the last
+// time it did so.  If configFile doesn't exist, storeOptions is still set
+// using the drop-in configuration files and environment variables, and an
+// error for which errors.Is(err, os.ErrNotExist) is true is returned.
 func ReloadConfigurationFileIfNeeded(configFile string, storeOptions *StoreOptions) error {
 	prevReloadConfig.mutex.Lock()
 	defer prevReloadConfig.mutex.Unlock()
 
-	fi, err := os.Stat(configFile)
-	if err != nil {
-		return err
+	fi, statErr := os.Stat(configFile)
+	if statErr != nil && !errors.Is(statErr, os.ErrNotExist) {
+		return statErr
 	}
 
-	mtime := fi.ModTime()
-	if prevReloadConfig.storeOptions != nil && mtime.Equal(prevReloadConfig.mod) && prevReloadConfig.configFile == configFile {
+	mtime := configModTime(fi)
+	env := configEnvironment()
+	if prevReloadConfig.storeOptions != nil && mtime.Equal(prevReloadConfig.mod) && prevReloadConfig.configFile == configFile && prevReloadConfig.env == env {
 		*storeOptions = *prevReloadConfig.storeOptions
-		return nil
+		return statErr
 	}
 
 	if err := ReloadConfigurationFile(configFile, storeOptions); err != nil {
@@ -405,15 +447,19 @@ func ReloadConfigurationFileIfNeeded(configFile string, storeOptions *StoreOptio
 	prevReloadConfig.storeOptions = &cOptions
 	prevReloadConfig.mod = mtime
 	prevReloadConfig.configFile = configFile
-	return nil
+	prevReloadConfig.env = env
+	return statErr
 }
 
-// ReloadConfigurationFile parses the specified configuration file and overrides
-// the configuration in storeOptions.
+// ReloadConfigurationFile parses the specified configuration file, followed by
+// any drop-in configuration files (see ConfigDropInFiles) and environment
+// variables which override options (see ConfigEnvVariable), and overrides the
+// configuration in storeOptions.
 func ReloadConfigurationFile(configFile string, storeOptions *StoreOptions) error {
 	config := new(TomlConfig)
 
 	meta, err := toml.DecodeFile(configFile, &config)
+	configFileExists := err == nil
 	if err == nil {
 		keys := meta.Undecoded()
 		if len(keys) > 0 {
@@ -425,6 +471,12 @@ func ReloadConfigurationFile(configFile string, storeOptions *StoreOptions) erro
 			return err
 		}
 	}
+	if err := decodeConfigDropIns(config); err != nil {
+		return err
+	}
+	if err := decodeConfigEnvOverrides(config); err != nil {
+		return err
+	}
 
 	// Clear storeOptions of previous settings
 	*storeOptions = StoreOptions{}
@@ -440,7 +492,7 @@ func ReloadConfigurationFile(configFile string, storeOptions *StoreOptions) erro
 		storeOptions.GraphDriverName = overlayDriver
 	}
 	storeOptions.GraphDriverPriority = config.Storage.DriverPriority
-	if storeOptions.GraphDriverName == "" && len(storeOptions.GraphDriverPriority) == 0 {
+	if storeOptions.GraphDriverName == "" && len(storeOptions.GraphDriverPriority) == 0 && configFileExists {
 		logrus.Warnf("The storage 'driver' option should be set in %s. A driver was picked automatically.", configFile)
 	}
 	if config.Storage.RunRoot != "" {
@@ -452,6 +504,9 @@ func ReloadConfigurationFile(configFile string, storeOptions *StoreOptions) erro
 	if config.Storage.ImageStore != "" {
 		storeOptions.ImageStore = config.Storage.ImageStore
 	}
+	if config.Storage.ColdStore != "" {
+		storeOptions.ColdStore = config.Storage.ColdStore
+	}
 	if config.Storage.RootlessStoragePath != "" {
 		storeOptions.RootlessStoragePath = config.Storage.RootlessStoragePath
 	}
@@ -492,6 +547,30 @@ func ReloadConfigurationFile(configFile string, storeOptions *StoreOptions) erro
 
 	storeOptions.DisableVolatile = config.Storage.Options.DisableVolatile
 	storeOptions.TransientStore = config.Storage.TransientStore
+	storeOptions.LayerVerity = config.Storage.Options.LayerVerity
+	storeOptions.MetadataJournal = config.Storage.Options.MetadataJournal
+	if config.Storage.Options.TierDemoteAfter != "" {
+		demoteAfter, err := time.ParseDuration(config.Storage.Options.TierDemoteAfter)
+		if err != nil {
+			return fmt.Errorf("parsing tier_demote_after: %w", err)
+		}
+		storeOptions.TierDemoteAfter = demoteAfter
+	}
+	if config.Storage.Options.TierDemoteMinSize != "" {
+		minSize, err := units.RAMInBytes(config.Storage.Options.TierDemoteMinSize)
+		if err != nil {
+			return fmt.Errorf("parsing tier_demote_min_size: %w", err)
+		}
+		storeOptions.TierDemoteMinSize = minSize
+	}
+	storeOptions.StoreQuotaLayers = int(config.Storage.Options.StoreQuotaLayers)
+	if config.Storage.Options.StoreQuotaSize != "" {
+		quotaSize, err := units.RAMInBytes(config.Storage.Options.StoreQuotaSize)
+		if err != nil {
+			return fmt.Errorf("parsing store_quota_size: %w", err)
+		}
+		storeOptions.StoreQuotaSize = quotaSize
+	}
 
 	storeOptions.GraphDriverOptions = append(storeOptions.GraphDriverOptions, cfg.GetGraphDriverOptions(storeOptions.GraphDriverName, config.Storage.Options)...)
 
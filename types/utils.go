@@ -56,12 +56,16 @@ func reloadConfigurationFileIfNeeded(configFile string, storeOptions *StoreOptio
 	if err != nil {
 		if !os.IsNotExist(err) {
 			logrus.Warningf("Failed to read %s %v\n", configFile, err.Error())
+			return
 		}
-		return
+		// Drop-in configuration files and environment variables are
+		// used even if there is no configuration file.
+		fi = nil
 	}
 
-	mtime := fi.ModTime()
-	if prevReloadConfig.storeOptions != nil && mtime.Equal(prevReloadConfig.mod) && prevReloadConfig.configFile == configFile {
+	mtime := configModTime(fi)
+	env := configEnvironment()
+	if prevReloadConfig.storeOptions != nil && mtime.Equal(prevReloadConfig.mod) && prevReloadConfig.configFile == configFile && prevReloadConfig.env == env {
 		*storeOptions = *prevReloadConfig.storeOptions
 		return
 	}
@@ -74,4 +78,5 @@ func reloadConfigurationFileIfNeeded(configFile string, storeOptions *StoreOptio
 	prevReloadConfig.storeOptions = storeOptions
 	prevReloadConfig.mod = mtime
 	prevReloadConfig.configFile = configFile
+	prevReloadConfig.env = env
 }
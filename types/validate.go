@@ -0,0 +1,320 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/docker/go-units"
+)
+
+// Codes which identify the kinds of problems which ValidateConfigurationFile
+// reports.
+const (
+	// ConfigDiagnosticSyntax is a file which can't be parsed.
+	ConfigDiagnosticSyntax = "syntax"
+	// ConfigDiagnosticUnknownKey is an option which isn't recognized.
+	ConfigDiagnosticUnknownKey = "unknown-key"
+	// ConfigDiagnosticInvalidValue is an option whose value can't be used.
+	ConfigDiagnosticInvalidValue = "invalid-value"
+	// ConfigDiagnosticConflict is an option whose value can't be used
+	// along with the value of another option.
+	ConfigDiagnosticConflict = "conflict"
+	// ConfigDiagnosticMissingStore is an additional image or layer store
+	// which doesn't exist.
+	ConfigDiagnosticMissingStore = "missing-store"
+)
+
+// ConfigDiagnostic describes a problem which was found in the configuration.
+type ConfigDiagnostic struct {
+	// Code identifies the kind of problem.
+	Code string `json:"code"`
+	// Key is the option which has the problem, in dotted TOML form, if
+	// the problem is with a particular option.
+	Key string `json:"key,omitempty"`
+	// File is the configuration file, or the environment variable with
+	// a "$" prefix, which set the option, or which has the problem.
+	File    string `json:"file,omitempty"`
+	Message string `json:"message"`
+}
+
+func (d ConfigDiagnostic) String() string {
+	var parts []string
+	if d.File != "" {
+		parts = append(parts, d.File)
+	}
+	if d.Key != "" {
+		parts = append(parts, d.Key)
+	}
+	return strings.Join(append(parts, d.Message), ": ")
+}
+
+// ConfigValidationError is returned by LoadStoreOptions, in strict mode, when
+// problems are found in the configuration.
+type ConfigValidationError struct {
+	Diagnostics []ConfigDiagnostic
+}
+
+func (e *ConfigValidationError) Error() string {
+	problems := make([]string, 0, len(e.Diagnostics))
+	for _, d := range e.Diagnostics {
+		problems = append(problems, d.String())
+	}
+	return fmt.Sprintf("%v: %s", ErrInvalidConfiguration, strings.Join(problems, "; "))
+}
+
+func (e *ConfigValidationError) Unwrap() error {
+	return ErrInvalidConfiguration
+}
+
+// configValidator collects diagnostics about a configuration.
+type configValidator struct {
+	sources     map[string]string
+	diagnostics []ConfigDiagnostic
+}
+
+// report records a problem with the option with the specified key.
+func (v *configValidator) report(code, key, format string, args ...any) {
+	v.diagnostics = append(v.diagnostics, ConfigDiagnostic{
+		Code:    code,
+		Key:     key,
+		File:    v.sources[key],
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// checkValue calls check with the value of the option with the specified key,
+// if it is set, and reports an invalid value if check returns an error.
+func (v *configValidator) checkValue(key, value string, check func(string) error) {
+	if value == "" {
+		return
+	}
+	if err := check(value); err != nil {
+		v.report(ConfigDiagnosticInvalidValue, key, "%q is not a valid value: %v", value, err)
+	}
+}
+
+// checkStores reports problems with a list of additional stores.
+func (v *configValidator) checkStores(key string, stores []string, trimOptions bool) {
+	for _, store := range stores {
+		if trimOptions {
+			store, _, _ = strings.Cut(store, ":")
+		}
+		if !filepath.IsAbs(store) {
+			v.report(ConfigDiagnosticInvalidValue, key, "store path %q is not absolute", store)
+			continue
+		}
+		st, err := os.Stat(store)
+		if err != nil {
+			v.report(ConfigDiagnosticMissingStore, key, "store %q can not be used: %v", store, err)
+			continue
+		}
+		if !st.IsDir() {
+			v.report(ConfigDiagnosticMissingStore, key, "store %q is not a directory", store)
+		}
+	}
+}
+
+func parseSize(value string) error {
+	size, err := units.RAMInBytes(value)
+	if err == nil && size < 0 {
+		err = errors.New("sizes can not be negative")
+	}
+	return err
+}
+
+func parseDuration(value string) error {
+	duration, err := time.ParseDuration(value)
+	if err == nil && duration < 0 {
+		err = errors.New("durations can not be negative")
+	}
+	return err
+}
+
+func parseBool(value string) error {
+	_, err := strconv.ParseBool(value)
+	return err
+}
+
+func parseInodes(value string) error {
+	_, err := strconv.ParseUint(value, 10, 64)
+	return err
+}
+
+func parseForceMask(value string) error {
+	switch value {
+	case "shared", "private":
+		return nil
+	}
+	mask, err := strconv.ParseUint(value, 8, 32)
+	if err == nil && mask > 0o7777 {
+		err = errors.New("permissions masks can not be larger than 07777")
+	}
+	return err
+}
+
+func oneOf(values ...string) func(string) error {
+	return func(value string) error {
+		for _, v := range values {
+			if value == v {
+				return nil
+			}
+		}
+		return fmt.Errorf("expected one of %q", values)
+	}
+}
+
+// firstSet returns the key and value of the first of the options which is set.
+func firstSet(keysAndValues ...string) (string, string) {
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		if keysAndValues[i+1] != "" {
+			return keysAndValues[i], keysAndValues[i+1]
+		}
+	}
+	return "", ""
+}
+
+// ValidateConfigurationFile reads the specified configuration file, the drop-in
+// configuration files, and the environment variables which override options in
+// the same way that ReloadConfigurationFile does, and reports problems which
+// would otherwise be ignored, or only be noticed when the storage driver is
+// initialized: options which aren't recognized, values which can't be used,
+// options which conflict with one another, and additional stores which don't
+// exist.  An error is returned only if the files can't be read at all.
+func ValidateConfigurationFile(configFile string) ([]ConfigDiagnostic, error) {
+	dropIns, err := ConfigDropInFiles()
+	if err != nil {
+		return nil, err
+	}
+	v := &configValidator{sources: make(map[string]string)}
+	config := new(TomlConfig)
+	for _, file := range append([]string{configFile}, dropIns...) {
+		meta, err := toml.DecodeFile(file, config)
+		if err != nil {
+			var pathErr *os.PathError
+			switch {
+			case file == configFile && errors.Is(err, os.ErrNotExist):
+			case errors.As(err, &pathErr):
+				return nil, err
+			default:
+				v.diagnostics = append(v.diagnostics, ConfigDiagnostic{Code: ConfigDiagnosticSyntax, File: file, Message: err.Error()})
+			}
+			continue
+		}
+		for _, key := range meta.Keys() {
+			v.sources[key.String()] = file
+		}
+		for _, key := range meta.Undecoded() {
+			v.diagnostics = append(v.diagnostics, ConfigDiagnostic{
+				Code:    ConfigDiagnosticUnknownKey,
+				Key:     key.String(),
+				File:    file,
+				Message: "unknown option",
+			})
+		}
+	}
+	envSettings, envErrs := applyConfigEnvOverrides(config)
+	for _, setting := range envSettings {
+		v.sources[setting.Key] = setting.Source
+	}
+	for _, err := range envErrs {
+		v.diagnostics = append(v.diagnostics, ConfigDiagnostic{
+			Code:    ConfigDiagnosticInvalidValue,
+			Key:     err.key,
+			File:    "$" + err.variable,
+			Message: err.err.Error(),
+		})
+	}
+
+	storage := &config.Storage
+	options := &storage.Options
+	v.checkValue("storage.options.size", options.Size, parseSize)
+	v.checkValue("storage.options.overlay.size", options.Overlay.Size, parseSize)
+	v.checkValue("storage.options.btrfs.size", options.Btrfs.Size, parseSize)
+	v.checkValue("storage.options.btrfs.min_space", options.Btrfs.MinSpace, parseSize)
+	v.checkValue("storage.options.zfs.size", options.Zfs.Size, parseSize)
+	v.checkValue("storage.options.overlay.inodes", options.Overlay.Inodes, parseInodes)
+	v.checkValue("storage.options.overlay.force_mask", options.Overlay.ForceMask, parseForceMask)
+	if options.ForceMask > 0o7777 {
+		v.report(ConfigDiagnosticInvalidValue, "storage.options.force_mask", "%o is not a valid value: permissions masks can not be larger than 07777", options.ForceMask)
+	}
+	v.checkValue("storage.options.ignore_chown_errors", options.IgnoreChownErrors, parseBool)
+	v.checkValue("storage.options.overlay.ignore_chown_errors", options.Overlay.IgnoreChownErrors, parseBool)
+	v.checkValue("storage.options.vfs.ignore_chown_errors", options.Vfs.IgnoreChownErrors, parseBool)
+	v.checkValue("storage.options.skip_mount_home", options.SkipMountHome, parseBool)
+	v.checkValue("storage.options.overlay.skip_mount_home", options.Overlay.SkipMountHome, parseBool)
+	v.checkValue("storage.options.use_composefs", options.UseComposefs, parseBool)
+	v.checkValue("storage.options.overlay.use_composefs", options.Overlay.UseComposefs, parseBool)
+	v.checkValue("storage.options.overlay.quota_backend", options.Overlay.QuotaBackend, oneOf("project", "loopback"))
+	v.checkValue("storage.options.overlay.loopback_fs", options.Overlay.LoopbackFs, oneOf("ext4", "xfs"))
+	v.checkValue("storage.options.tier_demote_after", options.TierDemoteAfter, parseDuration)
+	v.checkValue("storage.options.tier_demote_min_size", options.TierDemoteMinSize, parseSize)
+	v.checkValue("storage.options.store_quota_size", options.StoreQuotaSize, parseSize)
+
+	mountProgramKey, mountProgram := firstSet(
+		"storage.options.overlay.mount_program", options.Overlay.MountProgram,
+		"storage.options.mount_program", options.MountProgram,
+	)
+	v.checkValue(mountProgramKey, mountProgram, func(program string) error {
+		_, err := os.Stat(program)
+		return err
+	})
+	composefsKey, composefs := firstSet(
+		"storage.options.overlay.use_composefs", options.Overlay.UseComposefs,
+		"storage.options.use_composefs", options.UseComposefs,
+	)
+	if useComposefs, err := strconv.ParseBool(composefs); err == nil && useComposefs && mountProgram != "" {
+		v.report(ConfigDiagnosticConflict, composefsKey, "composefs can not be used along with %s", mountProgramKey)
+	}
+	if storage.ImageStore != "" && storage.ImageStore == storage.GraphRoot {
+		v.report(ConfigDiagnosticConflict, "storage.imagestore", "the image store must be different from storage.graphroot")
+	}
+	if storage.ColdStore != "" && (storage.ColdStore == storage.GraphRoot || storage.ColdStore == storage.ImageStore) {
+		v.report(ConfigDiagnosticConflict, "storage.coldstore", "the cold store must be different from storage.graphroot and storage.imagestore")
+	}
+	if options.AutoUsernsMinSize > 0 && options.AutoUsernsMaxSize > 0 && options.AutoUsernsMinSize > options.AutoUsernsMaxSize {
+		v.report(ConfigDiagnosticConflict, "storage.options.auto-userns-min-size", "%d is larger than storage.options.auto-userns-max-size, %d", options.AutoUsernsMinSize, options.AutoUsernsMaxSize)
+	}
+	v.checkStores("storage.options.additionalimagestores", options.AdditionalImageStores, false)
+	v.checkStores("storage.options.additionallayerstores", options.AdditionalLayerStores, true)
+	return v.diagnostics, nil
+}
+
+// LoadOptions controls how LoadStoreOptions reads the configuration.
+type LoadOptions struct {
+	// ConfigFile is the configuration file to read.  If it is "", the
+	// default configuration file is read.
+	ConfigFile string
+	// Strict causes LoadStoreOptions to fail, returning a
+	// *ConfigValidationError, if ValidateConfigurationFile finds any
+	// problems with the configuration.
+	Strict bool
+}
+
+// LoadStoreOptions reads the storage configuration from a configuration file
+// and the drop-in configuration files, filling in defaults in the same way
+// that DefaultStoreOptions does.
+func LoadStoreOptions(options LoadOptions) (StoreOptions, error) {
+	configFile := options.ConfigFile
+	if configFile == "" {
+		var err error
+		if configFile, err = DefaultConfigFile(); err != nil {
+			return StoreOptions{}, err
+		}
+	}
+	if options.Strict {
+		diagnostics, err := ValidateConfigurationFile(configFile)
+		if err != nil {
+			return StoreOptions{}, err
+		}
+		if len(diagnostics) > 0 {
+			return StoreOptions{}, &ConfigValidationError{Diagnostics: diagnostics}
+		}
+	}
+	return loadStoreOptionsFromConfFile(configFile)
+}
@@ -0,0 +1,106 @@
+package types
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// useTestConfigDropIns points the drop-in configuration directories at dir
+// until the test is over.
+func useTestConfigDropIns(t *testing.T, dir string) {
+	t.Helper()
+	saved := systemConfigDropInDirs
+	systemConfigDropInDirs = []string{filepath.Join(dir, "etc", configDropInDirName)}
+	t.Cleanup(func() { systemConfigDropInDirs = saved })
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "home"))
+	t.Setenv("STORAGE_DRIVER", "")
+	unsetenv(t, "STORAGE_OPTS")
+	unsetenv(t, storageConfEnv)
+}
+
+func TestValidateConfigurationFile(t *testing.T) {
+	dir := t.TempDir()
+	useTestConfigDropIns(t, dir)
+
+	configFile := filepath.Join(dir, "storage.conf")
+	missing := filepath.Join(dir, "missing")
+	writeConfigFile(t, configFile, `[storage]
+driver = "overlay"
+runroot = "/run/main"
+graphroot = "/var/lib/main"
+no_such_option = true
+[storage.options]
+size = "lots"
+additionalimagestores = ["`+missing+`", "relative"]
+additionallayerstores = ["`+dir+`:ref"]
+[storage.options.overlay]
+force_mask = "8888"
+mount_program = "/usr/bin/true"
+`)
+	dropIn := filepath.Join(dir, "etc", configDropInDirName, "10-composefs.conf")
+	writeConfigFile(t, dropIn, "[storage.options.overlay]\nuse_composefs = \"true\"\n")
+
+	diagnostics, err := ValidateConfigurationFile(configFile)
+	require.NoError(t, err)
+	type found struct{ code, key, file string }
+	var got []found
+	for _, d := range diagnostics {
+		got = append(got, found{d.Code, d.Key, d.File})
+		assert.NotEmpty(t, d.Message)
+	}
+	assert.ElementsMatch(t, []found{
+		{ConfigDiagnosticUnknownKey, "storage.no_such_option", configFile},
+		{ConfigDiagnosticInvalidValue, "storage.options.size", configFile},
+		{ConfigDiagnosticInvalidValue, "storage.options.overlay.force_mask", configFile},
+		{ConfigDiagnosticConflict, "storage.options.overlay.use_composefs", dropIn},
+		{ConfigDiagnosticMissingStore, "storage.options.additionalimagestores", configFile},
+		{ConfigDiagnosticInvalidValue, "storage.options.additionalimagestores", configFile},
+	}, got)
+
+	_, err = LoadStoreOptions(LoadOptions{ConfigFile: configFile, Strict: true})
+	assert.ErrorIs(t, err, ErrInvalidConfiguration)
+	var validationErr *ConfigValidationError
+	require.True(t, errors.As(err, &validationErr))
+	assert.Equal(t, diagnostics, validationErr.Diagnostics)
+
+	// Without strict mode, the problems are ignored.
+	options, err := LoadStoreOptions(LoadOptions{ConfigFile: configFile})
+	require.NoError(t, err)
+	assert.Equal(t, "overlay", options.GraphDriverName)
+}
+
+func TestValidateConfigurationFileClean(t *testing.T) {
+	dir := t.TempDir()
+	useTestConfigDropIns(t, dir)
+
+	configFile := filepath.Join(dir, "storage.conf")
+	writeConfigFile(t, configFile, `[storage]
+driver = "vfs"
+runroot = "/run/main"
+graphroot = "/var/lib/main"
+[storage.options]
+size = "10G"
+additionalimagestores = ["`+dir+`"]
+[storage.options.overlay]
+force_mask = "shared"
+`)
+	diagnostics, err := ValidateConfigurationFile(configFile)
+	require.NoError(t, err)
+	assert.Empty(t, diagnostics)
+
+	options, err := LoadStoreOptions(LoadOptions{ConfigFile: configFile, Strict: true})
+	require.NoError(t, err)
+	assert.Equal(t, "vfs", options.GraphDriverName)
+	assert.Equal(t, "/var/lib/main", options.GraphRoot)
+
+	writeConfigFile(t, configFile, "[storage\n")
+	diagnostics, err = ValidateConfigurationFile(configFile)
+	require.NoError(t, err)
+	require.Len(t, diagnostics, 1)
+	assert.Equal(t, ConfigDiagnosticSyntax, diagnostics[0].Code)
+	assert.Equal(t, configFile, diagnostics[0].File)
+}
@@ -3,10 +3,13 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/user"
+	"slices"
 	"strconv"
+	"time"
 
 	drivers "github.com/containers/storage/drivers"
 	"github.com/containers/storage/pkg/idtools"
@@ -148,42 +151,88 @@ func parseMountedFiles(containerMount, passwdFile, groupFile string) uint32 {
 	return uint32(size)
 }
 
-// getMaxSizeFromImage returns the maximum ID used by the specified image.
-// On entry, rlstore must be locked for writing, and lstores must be locked for reading.
-func (s *store) getMaxSizeFromImage(image *Image, rlstore rwLayerStore, lstores []roLayerStore, passwdFile, groupFile string) (_ uint32, retErr error) {
+// imageLayerChain returns the specified image's top layer and the layers below
+// it.
+// On entry, rlstore and lstores must be locked for reading or writing.
+func imageLayerChain(image *Image, rlstore rwLayerStore, lstores []roLayerStore) ([]*Layer, error) {
 	layerStores := append([]roLayerStore{rlstore}, lstores...)
 
-	size := uint32(0)
-
-	var topLayer *Layer
+	var layers []*Layer
 	layerName := image.TopLayer
 outer:
-	for {
+	for layerName != "" {
 		for _, ls := range layerStores {
 			layer, err := ls.Get(layerName)
 			if err != nil {
 				continue
 			}
-			if image.TopLayer == layerName {
-				topLayer = layer
-			}
-			for _, uid := range layer.UIDs {
-				if uid >= size {
-					size = uid + 1
-				}
-			}
-			for _, gid := range layer.GIDs {
-				if gid >= size {
-					size = gid + 1
-				}
-			}
+			layers = append(layers, layer)
 			layerName = layer.Parent
-			if layerName == "" {
-				break outer
-			}
 			continue outer
 		}
-		return 0, fmt.Errorf("cannot find layer %q", layerName)
+		return nil, fmt.Errorf("cannot find layer %q", layerName)
+	}
+	return layers, nil
+}
+
+// getIDsFromImage returns the sets of IDs which were recorded for the
+// specified image's layers when their contents were applied.
+// On entry, rlstore and lstores must be locked for reading or writing.
+func getIDsFromImage(image *Image, rlstore rwLayerStore, lstores []roLayerStore) (*idSet, *idSet, error) {
+	layers, err := imageLayerChain(image, rlstore, lstores)
+	if err != nil {
+		return nil, nil, err
+	}
+	var uids, gids []interval
+	for _, layer := range layers {
+		for _, uid := range layer.UIDs {
+			uids = append(uids, interval{start: int(uid), end: int(uid) + 1})
+		}
+		for _, gid := range layer.GIDs {
+			gids = append(gids, interval{start: int(gid), end: int(gid) + 1})
+		}
+	}
+	return newIDSet(uids), newIDSet(gids), nil
+}
+
+// getMaxSizeFromImage returns the maximum ID used by the specified image, and
+// an explanation of how it was found.  The sets of IDs which were recorded for
+// the image's layers when their contents were applied are used if there are
+// any, and the image is only mounted to look for users and groups in its
+// passwd and group files if there aren't, or if passwdFile or groupFile are
+// specified.
+// On entry, rlstore must be locked for writing, and lstores must be locked for reading.
+func (s *store) getMaxSizeFromImage(image *Image, rlstore rwLayerStore, lstores []roLayerStore, passwdFile, groupFile string) (_ uint32, _ string, retErr error) {
+	layers, err := imageLayerChain(image, rlstore, lstores)
+	if err != nil {
+		return 0, "", err
+	}
+
+	size := uint32(0)
+	recorded := false
+
+	var topLayer *Layer
+	for _, layer := range layers {
+		if image.TopLayer == layer.ID {
+			topLayer = layer
+		}
+		if len(layer.UIDs) > 0 || len(layer.GIDs) > 0 {
+			recorded = true
+		}
+		for _, uid := range layer.UIDs {
+			if uid >= size {
+				size = uid + 1
+			}
+		}
+		for _, gid := range layer.GIDs {
+			if gid >= size {
+				size = gid + 1
+			}
+		}
+	}
+
+	if recorded && passwdFile == "" && groupFile == "" {
+		return size, fmt.Sprintf("the IDs recorded for the layers of image %s need a size of %d", image.ID, size), nil
 	}
 
 	layerOptions := &LayerOptions{
@@ -199,7 +248,7 @@ outer:
 	// maximum IDs used.
 	clayer, _, err := rlstore.create("", topLayer, nil, "", nil, layerOptions, false, nil, nil)
 	if err != nil {
-		return 0, err
+		return 0, "", err
 	}
 	defer func() {
 		if err2 := rlstore.deleteWhileHoldingLock(clayer.ID); err2 != nil {
@@ -220,7 +269,7 @@ outer:
 
 	mountpoint, err := rlstore.Mount(clayer.ID, mountOptions)
 	if err != nil {
-		return 0, err
+		return 0, "", err
 	}
 	defer func() {
 		if _, err2 := rlstore.unmount(clayer.ID, true, false); err2 != nil {
@@ -237,12 +286,13 @@ outer:
 		size = userFilesSize
 	}
 
-	return size, nil
+	return size, fmt.Sprintf("the users and groups in the passwd and group files of image %s need a size of %d", image.ID, size), nil
 }
 
-// getAutoUserNS creates an automatic user namespace
+// getAutoUserNS creates an automatic user namespace, and returns an explanation
+// of how its size was chosen along with its mappings.
 // If image != nil, On entry, rlstore must be locked for writing, and lstores must be locked for reading.
-func (s *store) getAutoUserNS(options *types.AutoUserNsOptions, image *Image, rlstore rwLayerStore, lstores []roLayerStore) ([]idtools.IDMap, []idtools.IDMap, error) {
+func (s *store) getAutoUserNS(options *types.AutoUserNsOptions, image *Image, rlstore rwLayerStore, lstores []roLayerStore) ([]idtools.IDMap, []idtools.IDMap, string, error) {
 	requestedSize := uint32(0)
 	initialSize := uint32(1)
 	if options.Size > 0 {
@@ -252,24 +302,78 @@ func (s *store) getAutoUserNS(options *types.AutoUserNsOptions, image *Image, rl
 		initialSize = options.InitialSize
 	}
 
+	// If the container is going to share a user namespace with others
+	// which already exist, there's nothing to allocate.
+	imageID := ""
+	if image != nil {
+		imageID = image.ID
+	}
+	if group, image := autoUserNSGroup(options, imageID); group != "" || image != "" {
+		type mappings struct{ uids, gids []idtools.IDMap }
+		m, _, err := readContainerStore(s, func() (mappings, bool, error) {
+			uidMap, gidMap, err := s.groupAutoUserNS(group, image)
+			return mappings{uidMap, gidMap}, true, err
+		})
+		if err != nil {
+			return nil, nil, "", err
+		}
+		if m.uids != nil || m.gids != nil {
+			if !options.Sparse && requestedSize > 0 && requestedSize != idMapSize(m.uids) {
+				return nil, nil, "", fmt.Errorf("the container needs a user namespace with size %v, but its group's user namespace has size %v", requestedSize, idMapSize(m.uids))
+			}
+			reason := fmt.Sprintf("the user namespace of group %q has a size of %d", group, idMapSize(m.uids))
+			if group == "" {
+				reason = fmt.Sprintf("the user namespace shared by containers of image %s has a size of %d", image, idMapSize(m.uids))
+			}
+			return copySlicePreferringNil(m.uids), copySlicePreferringNil(m.gids), reason, nil
+		}
+	}
+
 	availableUIDs, availableGIDs, err := s.getAvailableIDs()
 	if err != nil {
-		return nil, nil, fmt.Errorf("cannot read mappings: %w", err)
+		return nil, nil, "", fmt.Errorf("cannot read mappings: %w", err)
 	}
 
-	// Look at every container that is using a user namespace and store
-	// the intervals that are already used.
-	containers, err := s.Containers()
+	// Look at every container that is using a user namespace, and at the
+	// ledger, and store the intervals that are already used.
+	type used struct{ uids, gids []idtools.IDMap }
+	u, _, err := readContainerStore(s, func() (used, bool, error) {
+		_, usedUIDs, usedGIDs, err := s.autoUserNSUsed()
+		return used{usedUIDs, usedGIDs}, true, err
+	})
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, "", err
 	}
-	var usedUIDs, usedGIDs []idtools.IDMap
-	for _, c := range containers {
-		usedUIDs = append(usedUIDs, c.UIDMap...)
-		usedGIDs = append(usedGIDs, c.GIDMap...)
+	usedUIDs, usedGIDs := u.uids, u.gids
+
+	if options.Sparse {
+		containerUIDs, containerGIDs := newIDSet(nil), newIDSet(nil)
+		if image != nil {
+			if containerUIDs, containerGIDs, err = getIDsFromImage(image, rlstore, lstores); err != nil {
+				return nil, nil, "", err
+			}
+		}
+		for _, uid := range options.ExtraUIDs {
+			containerUIDs = containerUIDs.union(newIDSet([]interval{{start: int(uid), end: int(uid) + 1}}))
+		}
+		for _, gid := range options.ExtraGIDs {
+			containerGIDs = containerGIDs.union(newIDSet([]interval{{start: int(gid), end: int(gid) + 1}}))
+		}
+		uidMap, gidMap, err := getSparseAutoUserNSIDMappings(
+			containerUIDs, containerGIDs,
+			availableUIDs, availableGIDs,
+			usedUIDs, usedGIDs,
+			options.AdditionalUIDMappings, options.AdditionalGIDMappings,
+		)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		reason := fmt.Sprintf("a sparse mapping of %d UIDs and %d GIDs was requested", getContainerIDs(uidMap).size(), getContainerIDs(gidMap).size())
+		return uidMap, gidMap, reason, nil
 	}
 
 	size := requestedSize
+	reason := fmt.Sprintf("a size of %d was requested", size)
 
 	// If there is no requestedSize, lookup the maximum used IDs in the layers
 	// metadata.  Make sure the size is at least s.autoNsMinSize and it is not
@@ -277,41 +381,271 @@ func (s *store) getAutoUserNS(options *types.AutoUserNsOptions, image *Image, rl
 	// This is a best effort heuristic.
 	if requestedSize == 0 {
 		size = max(s.autoNsMinSize, initialSize)
+		reason = fmt.Sprintf("the minimum size is %d", size)
 		if image != nil {
-			sizeFromImage, err := s.getMaxSizeFromImage(image, rlstore, lstores, options.PasswdFile, options.GroupFile)
+			sizeFromImage, imageReason, err := s.getMaxSizeFromImage(image, rlstore, lstores, options.PasswdFile, options.GroupFile)
 			if err != nil {
-				return nil, nil, err
+				return nil, nil, "", err
 			}
 			if sizeFromImage > size {
 				size = sizeFromImage
+				reason = imageReason
 			}
 		}
 		if s.autoNsMaxSize > 0 && size > s.autoNsMaxSize {
-			return nil, nil, fmt.Errorf("the container needs a user namespace with size %v that is bigger than the maximum value allowed with userns=auto %v", size, s.autoNsMaxSize)
+			return nil, nil, "", fmt.Errorf("the container needs a user namespace with size %v that is bigger than the maximum value allowed with userns=auto %v", size, s.autoNsMaxSize)
 		}
 	}
 
-	return getAutoUserNSIDMappings(
+	uidMap, gidMap, err := getAutoUserNSIDMappings(
 		int(size),
 		availableUIDs, availableGIDs,
 		usedUIDs, usedGIDs,
 		options.AdditionalUIDMappings, options.AdditionalGIDMappings,
 	)
+	return uidMap, gidMap, reason, err
+}
+
+// autoUserNSUsed returns the allocations recorded in the ledger, leaving out
+// those for containers which no longer exist, and the host IDs which are
+// either used by containers or set aside by those allocations.
+// Requires startReading or startWriting on s.containerStore.
+func (s *store) autoUserNSUsed() ([]AutoUserNSAllocation, []idtools.IDMap, []idtools.IDMap, error) {
+	containers, err := s.containerStore.Containers()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	allocations, err := s.containerStore.autoUserNSAllocations()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var usedUIDs, usedGIDs []idtools.IDMap
+	for _, c := range containers {
+		usedUIDs = append(usedUIDs, c.UIDMap...)
+		usedGIDs = append(usedGIDs, c.GIDMap...)
+	}
+	live := make([]AutoUserNSAllocation, 0, len(allocations))
+	for _, a := range allocations {
+		if a.grouped() {
+			a.Containers = slices.DeleteFunc(slices.Clone(a.Containers), func(c string) bool {
+				return !s.containerStore.Exists(c)
+			})
+			if len(a.Containers) == 0 {
+				continue
+			}
+		} else if a.Container != "" && !s.containerStore.Exists(a.Container) {
+			continue
+		}
+		live = append(live, a)
+		usedUIDs = append(usedUIDs, rangesIDMap(a.UIDs)...)
+		usedGIDs = append(usedGIDs, rangesIDMap(a.GIDs)...)
+	}
+	return live, usedUIDs, usedGIDs, nil
 }
 
+// recordAutoUserNS adds the host IDs in uidMap and gidMap to the ledger as an
+// allocation for the container with the specified ID, or adds the container to
+// the group which already shares an allocation, if group or image is set and
+// there is one.
+// Requires startWriting on s.containerStore, and s.usernsLock to be held.
+func (s *store) recordAutoUserNS(id, group, image string, uidMap, gidMap []idtools.IDMap) error {
+	allocations, _, _, err := s.autoUserNSUsed()
+	if err != nil {
+		return err
+	}
+	if group != "" || image != "" {
+		if i := slices.IndexFunc(allocations, func(a AutoUserNSAllocation) bool {
+			return a.grouped() && a.Group == group && a.Image == image
+		}); i != -1 {
+			allocations[i].Containers = append(allocations[i].Containers, id)
+			return s.containerStore.setAutoUserNSAllocations(allocations)
+		}
+	}
+	allocation := AutoUserNSAllocation{
+		Group:   group,
+		Image:   image,
+		UIDs:    idSetRanges(getHostIDs(uidMap)),
+		GIDs:    idSetRanges(getHostIDs(gidMap)),
+		Created: time.Now().UTC(),
+	}
+	if allocation.grouped() {
+		allocation.Containers = []string{id}
+	} else {
+		allocation.Container = id
+	}
+	return s.containerStore.setAutoUserNSAllocations(append(allocations, allocation))
+}
+
+// groupAutoUserNS returns the ID mappings of the containers in the group which
+// shares an allocation, or nil if there is no such group.
+// Requires startReading or startWriting on s.containerStore.
+func (s *store) groupAutoUserNS(group, image string) ([]idtools.IDMap, []idtools.IDMap, error) {
+	allocations, _, _, err := s.autoUserNSUsed()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, a := range allocations {
+		if !a.grouped() || a.Group != group || a.Image != image {
+			continue
+		}
+		c, err := s.containerStore.Get(a.Containers[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		return c.UIDMap, c.GIDMap, nil
+	}
+	return nil, nil, nil
+}
+
+// idMapSize returns the number of IDs, starting at 0, which idMap covers.
+func idMapSize(idMap []idtools.IDMap) uint32 {
+	size := 0
+	for _, m := range idMap {
+		size = max(size, m.ContainerID+m.Size)
+	}
+	return uint32(size)
+}
+
+func (s *store) AutoUserNSUsage() (*AutoUserNSUsage, error) {
+	availableUIDs, availableGIDs, err := s.getAvailableIDs()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read mappings: %w", err)
+	}
+	usage, _, err := readContainerStore(s, func() (*AutoUserNSUsage, bool, error) {
+		allocations, usedUIDs, usedGIDs, err := s.autoUserNSUsed()
+		if err != nil {
+			return nil, true, err
+		}
+		usedUIDSet, usedGIDSet := getHostIDs(usedUIDs), getHostIDs(usedGIDs)
+		return &AutoUserNSUsage{
+			AvailableUIDs: idSetRanges(availableUIDs),
+			AvailableGIDs: idSetRanges(availableGIDs),
+			FreeUIDs:      idSetRanges(availableUIDs.subtract(usedUIDSet)),
+			FreeGIDs:      idSetRanges(availableGIDs.subtract(usedGIDSet)),
+			UsedUIDs:      idSetRanges(usedUIDSet),
+			UsedGIDs:      idSetRanges(usedGIDSet),
+			Allocations:   allocations,
+		}, true, nil
+	})
+	return usage, err
+}
+
+func (s *store) ReserveAutoUserNS(name string, size uint32) (*AutoUserNSAllocation, error) {
+	if name == "" {
+		return nil, errors.New("a reservation needs a name")
+	}
+	if size == 0 {
+		return nil, errors.New("a reservation needs a size greater than 0")
+	}
+	availableUIDs, availableGIDs, err := s.getAvailableIDs()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read mappings: %w", err)
+	}
+
+	s.usernsLock.Lock()
+	defer s.usernsLock.Unlock()
+
+	return writeToContainerStore(s, func() (*AutoUserNSAllocation, error) {
+		allocations, usedUIDs, usedGIDs, err := s.autoUserNSUsed()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range allocations {
+			if a.Reservation == name {
+				return nil, fmt.Errorf("reservation %q already exists: %w", name, ErrDuplicateName)
+			}
+		}
+		uids, err := availableUIDs.subtract(getHostIDs(usedUIDs)).findAvailable(int(size))
+		if err != nil {
+			return nil, err
+		}
+		gids, err := availableGIDs.subtract(getHostIDs(usedGIDs)).findAvailable(int(size))
+		if err != nil {
+			return nil, err
+		}
+		allocation := AutoUserNSAllocation{
+			Reservation: name,
+			UIDs:        idSetRanges(uids),
+			GIDs:        idSetRanges(gids),
+			Created:     time.Now().UTC(),
+		}
+		if err := s.containerStore.setAutoUserNSAllocations(append(allocations, allocation)); err != nil {
+			return nil, err
+		}
+		return &allocation, nil
+	})
+}
+
+func (s *store) ReleaseAutoUserNS(name string) error {
+	s.usernsLock.Lock()
+	defer s.usernsLock.Unlock()
+
+	_, err := writeToContainerStore(s, func() (struct{}, error) {
+		allocations, _, _, err := s.autoUserNSUsed()
+		if err != nil {
+			return struct{}{}, err
+		}
+		remaining := slices.DeleteFunc(slices.Clone(allocations), func(a AutoUserNSAllocation) bool {
+			return a.Reservation == name
+		})
+		if len(remaining) == len(allocations) {
+			return struct{}{}, fmt.Errorf("releasing %q: %w", name, ErrReservationUnknown)
+		}
+		return struct{}{}, s.containerStore.setAutoUserNSAllocations(remaining)
+	})
+	return err
+}
+
+// maxIDMapExtents is the largest number of lines which the kernel accepts in
+// a user namespace's uid_map or gid_map.
+const maxIDMapExtents = 340
+
 // getAutoUserNSIDMappings computes the user/group id mappings for the automatic user namespace.
 func getAutoUserNSIDMappings(
 	size int,
 	availableUIDs, availableGIDs *idSet,
 	usedUIDMappings, usedGIDMappings, additionalUIDMappings, additionalGIDMappings []idtools.IDMap,
+) ([]idtools.IDMap, []idtools.IDMap, error) {
+	targetIDs := newIDSet([]interval{{start: 0, end: size}})
+	return getAutoUserNSIDMappingsFor(
+		targetIDs, targetIDs,
+		availableUIDs, availableGIDs,
+		usedUIDMappings, usedGIDMappings, additionalUIDMappings, additionalGIDMappings,
+	)
+}
+
+// getSparseAutoUserNSIDMappings computes user/group id mappings for an
+// automatic user namespace which map only the specified container IDs, and ID
+// 0, filling in gaps between them where the kernel's limit on the number of
+// extents in a mapping requires it.
+func getSparseAutoUserNSIDMappings(
+	containerUIDs, containerGIDs *idSet,
+	availableUIDs, availableGIDs *idSet,
+	usedUIDMappings, usedGIDMappings, additionalUIDMappings, additionalGIDMappings []idtools.IDMap,
+) ([]idtools.IDMap, []idtools.IDMap, error) {
+	root := newIDSet([]interval{{start: 0, end: 1}})
+	targetUIDs := containerUIDs.union(root).subtract(getContainerIDs(additionalUIDMappings)).coalesce(maxIDMapExtents - len(additionalUIDMappings))
+	targetGIDs := containerGIDs.union(root).subtract(getContainerIDs(additionalGIDMappings)).coalesce(maxIDMapExtents - len(additionalGIDMappings))
+	return getAutoUserNSIDMappingsFor(
+		targetUIDs, targetGIDs,
+		availableUIDs, availableGIDs,
+		usedUIDMappings, usedGIDMappings, additionalUIDMappings, additionalGIDMappings,
+	)
+}
+
+// getAutoUserNSIDMappingsFor computes user/group id mappings for the
+// automatic user namespace which map the specified container IDs.
+func getAutoUserNSIDMappingsFor(
+	targetUIDs, targetGIDs *idSet,
+	availableUIDs, availableGIDs *idSet,
+	usedUIDMappings, usedGIDMappings, additionalUIDMappings, additionalGIDMappings []idtools.IDMap,
 ) ([]idtools.IDMap, []idtools.IDMap, error) {
 	usedUIDs := getHostIDs(append(usedUIDMappings, additionalUIDMappings...))
 	usedGIDs := getHostIDs(append(usedGIDMappings, additionalGIDMappings...))
 
 	// Exclude additional uids and gids from requested range.
-	targetIDs := newIDSet([]interval{{start: 0, end: size}})
-	requestedContainerUIDs := targetIDs.subtract(getContainerIDs(additionalUIDMappings))
-	requestedContainerGIDs := targetIDs.subtract(getContainerIDs(additionalGIDMappings))
+	requestedContainerUIDs := targetUIDs.subtract(getContainerIDs(additionalUIDMappings))
+	requestedContainerGIDs := targetGIDs.subtract(getContainerIDs(additionalGIDMappings))
 
 	// Make sure the specified additional IDs are not used as part of the automatic
 	// mapping
@@ -326,6 +660,9 @@ func getAutoUserNSIDMappings(
 
 	uidMap := append(availableUIDs.zip(requestedContainerUIDs), additionalUIDMappings...)
 	gidMap := append(availableGIDs.zip(requestedContainerGIDs), additionalGIDMappings...)
+	if len(uidMap) > maxIDMapExtents || len(gidMap) > maxIDMapExtents {
+		return nil, nil, fmt.Errorf("the available IDs are too fragmented to map with at most %d extents: %w", maxIDMapExtents, types.ErrNoAvailableIDs)
+	}
 	return uidMap, gidMap, nil
 }
 
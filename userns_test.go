@@ -3,12 +3,18 @@
 package storage
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"reflect"
 	"testing"
 
+	"github.com/containers/storage/pkg/archive"
 	"github.com/containers/storage/pkg/idtools"
+	"github.com/containers/storage/pkg/reexec"
+	"github.com/containers/storage/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestGetAutoUserNSMapping(t *testing.T) {
@@ -267,3 +273,286 @@ nogroup:x:65533:`,
 		})
 	}
 }
+
+func TestAutoUserNSLedger(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("automatic user namespaces are only allocated from /etc/subuid when running as root")
+	}
+	s := newTestStore(t, StoreOptions{})
+	defer s.Shutdown(true)
+	st, ok := s.(*store)
+	require.True(t, ok)
+	st.additionalUIDs = newIDSet([]interval{{start: 100000, end: 100000 + 3000}})
+	st.additionalGIDs = newIDSet([]interval{{start: 200000, end: 200000 + 3000}})
+
+	reservation, err := s.ReserveAutoUserNS("external", 1000)
+	require.NoError(t, err)
+	assert.Equal(t, []AutoUserNSRange{{Start: 100000, Size: 1000}}, reservation.UIDs)
+	assert.Equal(t, []AutoUserNSRange{{Start: 200000, Size: 1000}}, reservation.GIDs)
+	_, err = s.ReserveAutoUserNS("external", 1000)
+	assert.ErrorIs(t, err, ErrDuplicateName)
+
+	options := &ContainerOptions{IDMappingOptions: types.IDMappingOptions{AutoUserNs: true, AutoUserNsOpts: types.AutoUserNsOptions{Size: 1000}}}
+	container, err := s.CreateContainer("", nil, "", "", "", options)
+	require.NoError(t, err)
+	assert.Equal(t, []idtools.IDMap{{ContainerID: 0, HostID: 101000, Size: 1000}}, container.UIDMap)
+	assert.Equal(t, []idtools.IDMap{{ContainerID: 0, HostID: 201000, Size: 1000}}, container.GIDMap)
+
+	usage, err := s.AutoUserNSUsage()
+	require.NoError(t, err)
+	assert.Equal(t, []AutoUserNSRange{{Start: 102000, Size: 1000}}, usage.FreeUIDs)
+	assert.Equal(t, []AutoUserNSRange{{Start: 202000, Size: 1000}}, usage.FreeGIDs)
+	assert.Equal(t, []AutoUserNSRange{{Start: 100000, Size: 2000}}, usage.UsedUIDs)
+	require.Len(t, usage.Allocations, 2)
+	assert.Equal(t, "external", usage.Allocations[0].Reservation)
+	assert.Equal(t, container.ID, usage.Allocations[1].Container)
+	assert.Equal(t, []AutoUserNSRange{{Start: 101000, Size: 1000}}, usage.Allocations[1].UIDs)
+
+	// Neither the container nor the reservation leaves room for another
+	// container of the same size, until one of them is gone.
+	_, err = s.CreateContainer("", nil, "", "", "", &ContainerOptions{IDMappingOptions: types.IDMappingOptions{AutoUserNs: true, AutoUserNsOpts: types.AutoUserNsOptions{Size: 2000}}})
+	assert.Error(t, err)
+
+	require.NoError(t, s.DeleteContainer(container.ID))
+	usage, err = s.AutoUserNSUsage()
+	require.NoError(t, err)
+	require.Len(t, usage.Allocations, 1)
+	assert.Equal(t, "external", usage.Allocations[0].Reservation)
+
+	assert.ErrorIs(t, s.ReleaseAutoUserNS("unknown"), ErrReservationUnknown)
+	require.NoError(t, s.ReleaseAutoUserNS("external"))
+	usage, err = s.AutoUserNSUsage()
+	require.NoError(t, err)
+	assert.Empty(t, usage.Allocations)
+	assert.Empty(t, usage.UsedUIDs)
+	assert.Equal(t, usage.AvailableUIDs, usage.FreeUIDs)
+}
+
+func TestAutoUserNSGroups(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("automatic user namespaces are only allocated from /etc/subuid when running as root")
+	}
+	reexec.Init()
+	s := newTestStore(t, StoreOptions{})
+	defer s.Shutdown(true)
+	st, ok := s.(*store)
+	require.True(t, ok)
+	st.additionalUIDs = newIDSet([]interval{{start: 100000, end: 100000 + 4000}})
+	st.additionalGIDs = newIDSet([]interval{{start: 100000, end: 100000 + 4000}})
+
+	layer, err := s.CreateLayer("", "", nil, "", true, nil)
+	require.NoError(t, err)
+	image, err := s.CreateImage("", nil, layer.ID, "", nil)
+	require.NoError(t, err)
+
+	autoUserNs := func(opts types.AutoUserNsOptions) *ContainerOptions {
+		opts.Size = 1000
+		return &ContainerOptions{IDMappingOptions: types.IDMappingOptions{AutoUserNs: true, AutoUserNsOpts: opts}}
+	}
+
+	// Containers in a named group share a range.
+	first, err := s.CreateContainer("", nil, "", "", "", autoUserNs(types.AutoUserNsOptions{Group: "g"}))
+	require.NoError(t, err)
+	second, err := s.CreateContainer("", nil, image.ID, "", "", autoUserNs(types.AutoUserNsOptions{Group: "g"}))
+	require.NoError(t, err)
+	assert.Equal(t, first.UIDMap, second.UIDMap)
+	assert.Equal(t, first.GIDMap, second.GIDMap)
+
+	// Containers from the same image share a different range.
+	third, err := s.CreateContainer("", nil, image.ID, "", "", autoUserNs(types.AutoUserNsOptions{PerImage: true}))
+	require.NoError(t, err)
+	fourth, err := s.CreateContainer("", nil, image.ID, "", "", autoUserNs(types.AutoUserNsOptions{PerImage: true}))
+	require.NoError(t, err)
+	assert.Equal(t, third.UIDMap, fourth.UIDMap)
+	assert.NotEqual(t, first.UIDMap, third.UIDMap)
+	// Only one ID-shifted copy of the image's layer was needed for each of
+	// the namespaces.
+	image, err = s.Image(image.ID)
+	require.NoError(t, err)
+	assert.Len(t, image.MappedTopLayers, 2)
+
+	// Containers which aren't in a group don't share.
+	fifth, err := s.CreateContainer("", nil, image.ID, "", "", autoUserNs(types.AutoUserNsOptions{}))
+	require.NoError(t, err)
+	assert.NotEqual(t, first.UIDMap, fifth.UIDMap)
+	assert.NotEqual(t, third.UIDMap, fifth.UIDMap)
+
+	// A container can't join a group with a namespace of a different size.
+	_, err = s.CreateContainer("", nil, "", "", "", &ContainerOptions{IDMappingOptions: types.IDMappingOptions{AutoUserNs: true, AutoUserNsOpts: types.AutoUserNsOptions{Group: "g", Size: 500}}})
+	assert.Error(t, err)
+
+	usage, err := s.AutoUserNSUsage()
+	require.NoError(t, err)
+	require.Len(t, usage.Allocations, 3)
+	assert.Equal(t, "g", usage.Allocations[0].Group)
+	assert.Equal(t, []string{first.ID, second.ID}, usage.Allocations[0].Containers)
+	assert.Equal(t, image.ID, usage.Allocations[1].Image)
+	assert.Equal(t, []string{third.ID, fourth.ID}, usage.Allocations[1].Containers)
+	assert.Equal(t, fifth.ID, usage.Allocations[2].Container)
+
+	// The group's range is kept until its last container is deleted.
+	require.NoError(t, s.DeleteContainer(first.ID))
+	usage, err = s.AutoUserNSUsage()
+	require.NoError(t, err)
+	require.Len(t, usage.Allocations, 3)
+	assert.Equal(t, []string{second.ID}, usage.Allocations[0].Containers)
+	require.NoError(t, s.DeleteContainer(second.ID))
+	usage, err = s.AutoUserNSUsage()
+	require.NoError(t, err)
+	require.Len(t, usage.Allocations, 2)
+	assert.Equal(t, image.ID, usage.Allocations[0].Image)
+
+	// A new container in the group gets the first free range.
+	sixth, err := s.CreateContainer("", nil, "", "", "", autoUserNs(types.AutoUserNsOptions{Group: "g"}))
+	require.NoError(t, err)
+	assert.Equal(t, first.UIDMap, sixth.UIDMap)
+}
+
+func TestAutoUserNSSizeFromLayerIDs(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("automatic user namespaces are only allocated from /etc/subuid when running as root")
+	}
+	reexec.Init()
+	s := newTestStore(t, StoreOptions{
+		UIDMap: []idtools.IDMap{{ContainerID: 0, HostID: 0, Size: 65536}},
+		GIDMap: []idtools.IDMap{{ContainerID: 0, HostID: 0, Size: 65536}},
+	})
+	defer s.Shutdown(true)
+	st, ok := s.(*store)
+	require.True(t, ok)
+	st.additionalUIDs = newIDSet([]interval{{start: 100000, end: 100000 + 10000}})
+	st.additionalGIDs = newIDSet([]interval{{start: 100000, end: 100000 + 10000}})
+
+	// The passwd file mentions a user with a larger ID than any which
+	// owns files, but it isn't consulted when the layer's IDs are known.
+	contents := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(contents, "etc"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(contents, "etc", "passwd"), []byte("root:x:0:0::/root:/bin/sh\nuser:x:3000:3000::/home/user:/bin/sh\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(contents, "file"), nil, 0o644))
+	require.NoError(t, os.Lchown(filepath.Join(contents, "file"), 1500, 1600))
+	diff, err := archive.Tar(contents, archive.Uncompressed)
+	require.NoError(t, err)
+	defer diff.Close()
+	layer, _, err := s.PutLayer("", "", nil, "", false, nil, diff)
+	require.NoError(t, err)
+	require.Contains(t, layer.UIDs, uint32(1500))
+	image, err := s.CreateImage("", nil, layer.ID, "", nil)
+	require.NoError(t, err)
+
+	options := &ContainerOptions{IDMappingOptions: types.IDMappingOptions{AutoUserNs: true}}
+	container, err := s.CreateContainer("", nil, image.ID, "", "", options)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1601), idMapSize(container.UIDMap))
+	assert.Contains(t, container.AutoUserNsSizeReason(), "IDs recorded for the layers")
+
+	// Without any recorded IDs, the minimum size is used.
+	emptyLayer, err := s.CreateLayer("", "", nil, "", false, nil)
+	require.NoError(t, err)
+	emptyImage, err := s.CreateImage("", nil, emptyLayer.ID, "", nil)
+	require.NoError(t, err)
+	options = &ContainerOptions{IDMappingOptions: types.IDMappingOptions{AutoUserNs: true}}
+	container, err = s.CreateContainer("", nil, emptyImage.ID, "", "", options)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(AutoUserNsMinSize), idMapSize(container.UIDMap))
+	assert.Equal(t, fmt.Sprintf("the minimum size is %d", AutoUserNsMinSize), container.AutoUserNsSizeReason())
+
+	// An explicit size is explained, too.
+	options = &ContainerOptions{IDMappingOptions: types.IDMappingOptions{AutoUserNs: true, AutoUserNsOpts: types.AutoUserNsOptions{Size: 2000}}}
+	container, err = s.CreateContainer("", nil, image.ID, "", "", options)
+	require.NoError(t, err)
+	assert.Equal(t, "a size of 2000 was requested", container.AutoUserNsSizeReason())
+}
+
+func TestGetSparseAutoUserNSIDMappings(t *testing.T) {
+	available := newIDSet([]interval{{start: 100000, end: 200000}})
+	used := []idtools.IDMap{{ContainerID: 0, HostID: 100000, Size: 10}}
+
+	ids := newIDSet([]interval{{start: 33, end: 34}, {start: 65534, end: 65535}})
+	uidMap, gidMap, err := getSparseAutoUserNSIDMappings(ids, ids, available, available, used, used, nil, nil)
+	require.NoError(t, err)
+	want := []idtools.IDMap{
+		{ContainerID: 0, HostID: 100010, Size: 1},
+		{ContainerID: 33, HostID: 100011, Size: 1},
+		{ContainerID: 65534, HostID: 100012, Size: 1},
+	}
+	assert.Equal(t, want, uidMap)
+	assert.Equal(t, want, gidMap)
+
+	// Additional mappings take the place of the IDs which they map.
+	additional := []idtools.IDMap{{ContainerID: 33, HostID: 150000, Size: 1}}
+	uidMap, _, err = getSparseAutoUserNSIDMappings(ids, ids, available, available, used, used, additional, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []idtools.IDMap{
+		{ContainerID: 0, HostID: 100010, Size: 1},
+		{ContainerID: 65534, HostID: 100011, Size: 1},
+		{ContainerID: 33, HostID: 150000, Size: 1},
+	}, uidMap)
+
+	// Too many scattered IDs are coalesced to fit the kernel's limit.
+	var scattered []interval
+	for i := range 500 {
+		scattered = append(scattered, interval{start: 10 * i, end: 10*i + 1})
+	}
+	uidMap, _, err = getSparseAutoUserNSIDMappings(newIDSet(scattered), ids, available, available, used, used, nil, nil)
+	require.NoError(t, err)
+	assert.Len(t, uidMap, maxIDMapExtents)
+	assert.True(t, idSetsEqual(getContainerIDs(uidMap).union(newIDSet(scattered)), getContainerIDs(uidMap)))
+
+	// Host IDs which are too fragmented can't be used.
+	var fragmented []interval
+	for i := range 500 {
+		fragmented = append(fragmented, interval{start: 100000 + 2*i, end: 100000 + 2*i + 1})
+	}
+	_, _, err = getSparseAutoUserNSIDMappings(newIDSet([]interval{{start: 0, end: 400}}), ids, newIDSet(fragmented), available, nil, nil, nil, nil)
+	assert.ErrorIs(t, err, types.ErrNoAvailableIDs)
+}
+
+func TestAutoUserNSSparse(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("automatic user namespaces are only allocated from /etc/subuid when running as root")
+	}
+	reexec.Init()
+	s := newTestStore(t, StoreOptions{
+		UIDMap: []idtools.IDMap{{ContainerID: 0, HostID: 0, Size: 65536}},
+		GIDMap: []idtools.IDMap{{ContainerID: 0, HostID: 0, Size: 65536}},
+	})
+	defer s.Shutdown(true)
+	st, ok := s.(*store)
+	require.True(t, ok)
+	st.additionalUIDs = newIDSet([]interval{{start: 100000, end: 100000 + 10000}})
+	st.additionalGIDs = newIDSet([]interval{{start: 100000, end: 100000 + 10000}})
+
+	contents := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(contents, "www"), nil, 0o644))
+	require.NoError(t, os.Lchown(filepath.Join(contents, "www"), 33, 33))
+	require.NoError(t, os.WriteFile(filepath.Join(contents, "nobody"), nil, 0o644))
+	require.NoError(t, os.Lchown(filepath.Join(contents, "nobody"), 65534, 65534))
+	diff, err := archive.Tar(contents, archive.Uncompressed)
+	require.NoError(t, err)
+	defer diff.Close()
+	layer, _, err := s.PutLayer("", "", nil, "", false, nil, diff)
+	require.NoError(t, err)
+	image, err := s.CreateImage("", nil, layer.ID, "", nil)
+	require.NoError(t, err)
+
+	options := &ContainerOptions{IDMappingOptions: types.IDMappingOptions{AutoUserNs: true, AutoUserNsOpts: types.AutoUserNsOptions{
+		Sparse:    true,
+		ExtraUIDs: []uint32{1000},
+		ExtraGIDs: []uint32{1000},
+	}}}
+	container, err := s.CreateContainer("", nil, image.ID, "", "", options)
+	require.NoError(t, err)
+	want := []idtools.IDMap{
+		{ContainerID: 0, HostID: 100000, Size: 1},
+		{ContainerID: 33, HostID: 100001, Size: 1},
+		{ContainerID: 1000, HostID: 100002, Size: 1},
+		{ContainerID: 65534, HostID: 100003, Size: 1},
+	}
+	assert.Equal(t, want, container.UIDMap)
+	assert.Equal(t, want, container.GIDMap)
+	assert.Equal(t, "a sparse mapping of 4 UIDs and 4 GIDs was requested", container.AutoUserNsSizeReason())
+
+	usage, err := s.AutoUserNSUsage()
+	require.NoError(t, err)
+	assert.Equal(t, []AutoUserNSRange{{Start: 100000, Size: 4}}, usage.UsedUIDs)
+}
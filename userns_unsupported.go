@@ -9,6 +9,22 @@ import (
 	"github.com/containers/storage/types"
 )
 
-func (s *store) getAutoUserNS(_ *types.AutoUserNsOptions, _ *Image, _ rwLayerStore, _ []roLayerStore) ([]idtools.IDMap, []idtools.IDMap, error) {
-	return nil, nil, errors.New("user namespaces are not supported on this platform")
+func (s *store) getAutoUserNS(_ *types.AutoUserNsOptions, _ *Image, _ rwLayerStore, _ []roLayerStore) ([]idtools.IDMap, []idtools.IDMap, string, error) {
+	return nil, nil, "", errors.New("user namespaces are not supported on this platform")
+}
+
+func (s *store) AutoUserNSUsage() (*AutoUserNSUsage, error) {
+	return nil, errors.New("user namespaces are not supported on this platform")
+}
+
+func (s *store) ReserveAutoUserNS(_ string, _ uint32) (*AutoUserNSAllocation, error) {
+	return nil, errors.New("user namespaces are not supported on this platform")
+}
+
+func (s *store) ReleaseAutoUserNS(_ string) error {
+	return errors.New("user namespaces are not supported on this platform")
+}
+
+func (s *store) recordAutoUserNS(_, _, _ string, _, _ []idtools.IDMap) error {
+	return errors.New("user namespaces are not supported on this platform")
 }
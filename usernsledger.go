@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/containers/storage/pkg/idtools"
+	"github.com/containers/storage/pkg/ioutils"
+	"github.com/containers/storage/types"
+)
+
+// AutoUserNSRange is a range of host IDs.
+type AutoUserNSRange struct {
+	Start int `json:"start"`
+	Size  int `json:"size"`
+}
+
+// AutoUserNSAllocation records host IDs which were set aside, either for an
+// automatically created user namespace, or by ReserveAutoUserNS.
+type AutoUserNSAllocation struct {
+	// Container is the ID of the container whose user namespace the IDs
+	// were allocated for, if they were.
+	Container string `json:"container,omitempty"`
+	// Group is the group of containers whose shared user namespace the
+	// IDs were allocated for, if they were, and Image is the ID of the
+	// image if the containers were grouped by image.
+	Group string `json:"group,omitempty"`
+	Image string `json:"image,omitempty"`
+	// Containers are the IDs of the containers in the group.
+	Containers []string `json:"containers,omitempty"`
+	// Reservation is the name passed to ReserveAutoUserNS, if the IDs
+	// were reserved.
+	Reservation string            `json:"reservation,omitempty"`
+	UIDs        []AutoUserNSRange `json:"uids,omitempty"`
+	GIDs        []AutoUserNSRange `json:"gids,omitempty"`
+	Created     time.Time         `json:"created"`
+}
+
+// AutoUserNSUsage describes which of the host IDs which automatically created
+// user namespaces can use are in use.
+type AutoUserNSUsage struct {
+	// AvailableUIDs and AvailableGIDs are the IDs which automatically
+	// created user namespaces can use.
+	AvailableUIDs []AutoUserNSRange `json:"available-uids,omitempty"`
+	AvailableGIDs []AutoUserNSRange `json:"available-gids,omitempty"`
+	// FreeUIDs and FreeGIDs are the available IDs which aren't used by
+	// any container or set aside by any reservation.
+	FreeUIDs []AutoUserNSRange `json:"free-uids,omitempty"`
+	FreeGIDs []AutoUserNSRange `json:"free-gids,omitempty"`
+	// UsedUIDs and UsedGIDs are the IDs which are used by containers or
+	// set aside by reservations, whether they're available or not.
+	UsedUIDs []AutoUserNSRange `json:"used-uids,omitempty"`
+	UsedGIDs []AutoUserNSRange `json:"used-gids,omitempty"`
+	// Allocations lists the allocations and reservations which are
+	// recorded in the store.
+	Allocations []AutoUserNSAllocation `json:"allocations,omitempty"`
+}
+
+// autoUserNSLedger is the format of the file which records allocations.
+type autoUserNSLedger struct {
+	Allocations []AutoUserNSAllocation `json:"allocations"`
+}
+
+// idSetRanges returns the intervals in s as ranges.
+func idSetRanges(s *idSet) []AutoUserNSRange {
+	var ranges []AutoUserNSRange
+	iterator, cancel := s.iterator()
+	defer cancel()
+	for i := iterator(); i != nil; i = iterator() {
+		ranges = append(ranges, AutoUserNSRange{Start: i.start, Size: i.length()})
+	}
+	return ranges
+}
+
+// rangesIDMap returns ranges in the form of an ID map whose container IDs are
+// the same as its host IDs, for use with getHostIDs.
+func rangesIDMap(ranges []AutoUserNSRange) []idtools.IDMap {
+	idMap := make([]idtools.IDMap, 0, len(ranges))
+	for _, r := range ranges {
+		idMap = append(idMap, idtools.IDMap{ContainerID: r.Start, HostID: r.Start, Size: r.Size})
+	}
+	return idMap
+}
+
+func (r *containerStore) autoUserNSLedgerPath() string {
+	return filepath.Join(r.dir, "auto-userns.json")
+}
+
+// autoUserNSAllocations returns the allocations recorded in the store.
+// Requires startReading or startWriting.
+func (r *containerStore) autoUserNSAllocations() ([]AutoUserNSAllocation, error) {
+	data, err := os.ReadFile(r.autoUserNSLedgerPath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ledger autoUserNSLedger
+	if err := json.Unmarshal(data, &ledger); err != nil {
+		return nil, fmt.Errorf("decoding %q: %w", r.autoUserNSLedgerPath(), err)
+	}
+	return ledger.Allocations, nil
+}
+
+// setAutoUserNSAllocations replaces the allocations recorded in the store.
+// Requires startWriting.
+func (r *containerStore) setAutoUserNSAllocations(allocations []AutoUserNSAllocation) error {
+	if len(allocations) == 0 {
+		if err := os.Remove(r.autoUserNSLedgerPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(&autoUserNSLedger{Allocations: allocations})
+	if err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(r.autoUserNSLedgerPath(), data, 0o600)
+}
+
+// autoUserNSGroup returns the values of the Group and Image fields of the
+// allocation which a container created from the image with the specified ID,
+// if there is one, using options, would share, if it would share one.
+func autoUserNSGroup(options *types.AutoUserNsOptions, imageID string) (string, string) {
+	if options.Group != "" {
+		return options.Group, ""
+	}
+	if options.PerImage {
+		return "", imageID
+	}
+	return "", ""
+}
+
+// grouped returns true if the allocation is shared by a group of containers.
+func (a *AutoUserNSAllocation) grouped() bool {
+	return a.Group != "" || a.Image != ""
+}
+
+// releaseAutoUserNS forgets the allocation for the container with the
+// specified ID, if there is one, or removes the container from the group which
+// it shares an allocation with, forgetting the allocation if it was the last
+// one in the group.
+// Requires startWriting.
+func (r *containerStore) releaseAutoUserNS(id string) error {
+	allocations, err := r.autoUserNSAllocations()
+	if err != nil {
+		return err
+	}
+	changed := false
+	remaining := make([]AutoUserNSAllocation, 0, len(allocations))
+	for _, a := range allocations {
+		if a.grouped() && slices.Contains(a.Containers, id) {
+			a.Containers = slices.DeleteFunc(slices.Clone(a.Containers), func(c string) bool { return c == id })
+			changed = true
+			if len(a.Containers) == 0 {
+				continue
+			}
+		} else if a.Container == id {
+			changed = true
+			continue
+		}
+		remaining = append(remaining, a)
+	}
+	if !changed {
+		return nil
+	}
+	return r.setAutoUserNSAllocations(remaining)
+}
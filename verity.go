@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+
+	drivers "github.com/containers/storage/drivers"
+	"github.com/containers/storage/pkg/fsverity"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// layerVerityBigDataKey is the name of the big data item in which the
+// fs-verity digests of the files in a sealed layer are recorded, as a map
+// from the files' paths, relative to the directory in which the storage driver
+// keeps the layer's contents, to their digests.
+const layerVerityBigDataKey = "fs-verity-digests"
+
+// verityPendingFlag is set on read-only layers which were created empty while
+// sealing was enabled, so that they are sealed once a diff is applied to them.
+const verityPendingFlag = "fs-verity-pending"
+
+// layerContentsDir returns the directory in which the storage driver keeps
+// the contents of the layer, along with a function to call when the caller is
+// done with it.  Drivers which report an upper directory keep only the
+// layer's own contents there, so that's used in preference to mounting the
+// layer.
+func (r *layerStore) layerContentsDir(layer *Layer) (string, func() error, error) {
+	if metadata, err := r.driver.Metadata(layer.ID); err == nil && metadata["UpperDir"] != "" {
+		return metadata["UpperDir"], func() error { return nil }, nil
+	}
+	dir, err := r.driver.Get(layer.ID, drivers.MountOpts{MountLabel: layer.MountLabel, Options: []string{"ro"}})
+	if err != nil {
+		return "", nil, err
+	}
+	return dir, func() error { return r.driver.Put(layer.ID) }, nil
+}
+
+// sealLayer enables fs-verity on every regular file in a newly-populated
+// read-only layer, and records the files' digests as a big data item.  If
+// the filesystem doesn't support fs-verity, the layer is left unsealed.
+// Requires startWriting.
+func (r *layerStore) sealLayer(layer *Layer) (err error) {
+	dir, done, err := r.layerContentsDir(layer)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := done(); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+
+	digests := make(map[string]string)
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		// EnableVerity succeeds if a hard link to the file was already sealed.
+		if err := fsverity.EnableVerity(rel, int(f.Fd())); err != nil {
+			return err
+		}
+		digest, err := fsverity.MeasureVerity(rel, int(f.Fd()))
+		if err != nil {
+			return err
+		}
+		digests[rel] = digest
+		return nil
+	})
+	if err != nil {
+		if fsverity.IsNotSupported(err) {
+			logrus.Warnf("Not sealing layer %s: %v", layer.ID, err)
+			return nil
+		}
+		return fmt.Errorf("enabling fs-verity for layer %s: %w", layer.ID, err)
+	}
+
+	data, err := json.Marshal(digests)
+	if err != nil {
+		return err
+	}
+	return r.setBigData(layer, layerVerityBigDataKey, bytes.NewReader(data))
+}
+
+// resealLayer seals a layer after a diff has been applied to an existing
+// layer, if the layer was already sealed or was created to be sealed once it
+// was populated.  The caller is expected to save the layer's metadata.
+// Requires startWriting.
+func (r *layerStore) resealLayer(layer *Layer) error {
+	if !r.verity {
+		return nil
+	}
+	if _, pending := layer.Flags[verityPendingFlag]; !pending && !slices.Contains(layer.BigDataNames, layerVerityBigDataKey) {
+		return nil
+	}
+	if err := r.sealLayer(layer); err != nil {
+		return err
+	}
+	delete(layer.Flags, verityPendingFlag)
+	return nil
+}
+
+// readVerityRecord reads the fs-verity digests which sealLayer recorded for
+// a layer, and returns them along with the digest of the record itself.
+// Requires startReading or startWriting.
+func (r *layerStore) readVerityRecord(layer *Layer) (map[string]string, digest.Digest, error) {
+	data, err := os.ReadFile(r.datapath(layer.ID, layerVerityBigDataKey))
+	if err != nil {
+		return nil, "", fmt.Errorf("reading fs-verity digests: %w", err)
+	}
+	expected := make(map[string]string)
+	if err := json.Unmarshal(data, &expected); err != nil {
+		return nil, "", fmt.Errorf("decoding fs-verity digests: %w", err)
+	}
+	return expected, digest.FromBytes(data), nil
+}
+
+// verifyLayer checks that the regular files in a layer which was sealed by
+// sealLayer still have the fs-verity digests which were recorded for them,
+// and that none have been added or removed.  Layers which weren't sealed
+// pass without being examined.
+// Requires startReading or startWriting.
+func (r *layerStore) verifyLayer(layer *Layer) error {
+	if !slices.Contains(layer.BigDataNames, layerVerityBigDataKey) {
+		return nil
+	}
+	expected, _, err := r.readVerityRecord(layer)
+	if err != nil {
+		return err
+	}
+	return r.verifyLayerContents(layer, expected)
+}
+
+// verifyLayerContents compares the regular files in a layer to the fs-verity
+// digests in expected, which it consumes.
+// Requires startReading or startWriting.
+func (r *layerStore) verifyLayerContents(layer *Layer, expected map[string]string) (err error) {
+
+	dir, done, err := r.layerContentsDir(layer)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := done(); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		expectedDigest, ok := expected[rel]
+		if !ok {
+			return fmt.Errorf("%q was added: %w", rel, ErrLayerVerityMismatch)
+		}
+		delete(expected, rel)
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		// A file which was replaced won't have fs-verity enabled, so
+		// failing to measure it is a mismatch, too.
+		digest, err := fsverity.MeasureVerity(rel, int(f.Fd()))
+		if err != nil {
+			return fmt.Errorf("%v: %w", err, ErrLayerVerityMismatch)
+		}
+		if digest != expectedDigest {
+			return fmt.Errorf("%q was modified: %w", rel, ErrLayerVerityMismatch)
+		}
+		return nil
+	})
+	if err == nil && len(expected) > 0 {
+		missing := make([]string, 0, len(expected))
+		for rel := range expected {
+			missing = append(missing, rel)
+		}
+		sort.Strings(missing)
+		err = fmt.Errorf("%q was removed: %w", missing[0], ErrLayerVerityMismatch)
+	}
+	return err
+}
+
+// verifyLayerOnce runs verifyLayer on a layer unless it has already passed
+// against the same record of digests.  Files with fs-verity enabled can't be
+// modified, so this only misses files being replaced, added, or removed
+// afterward, which Store.Check still catches.
+// Requires startReading or startWriting.
+func (r *layerStore) verifyLayerOnce(layer *Layer) error {
+	if !slices.Contains(layer.BigDataNames, layerVerityBigDataKey) {
+		return nil
+	}
+	expected, recordDigest, err := r.readVerityRecord(layer)
+	if err != nil {
+		return err
+	}
+	r.verifiedLayersLock.Lock()
+	verified := r.verifiedLayers[layer.ID] == recordDigest
+	r.verifiedLayersLock.Unlock()
+	if verified {
+		return nil
+	}
+	if err := r.verifyLayerContents(layer, expected); err != nil {
+		return err
+	}
+	r.verifiedLayersLock.Lock()
+	defer r.verifiedLayersLock.Unlock()
+	if r.verifiedLayers == nil {
+		r.verifiedLayers = make(map[string]digest.Digest)
+	}
+	r.verifiedLayers[layer.ID] = recordDigest
+	return nil
+}
+
+// verifyLayerChain runs verifyLayerOnce on the layer and on each of its
+// ancestors which are in this store.
+// Requires startReading or startWriting.
+func (r *layerStore) verifyLayerChain(layer *Layer) error {
+	for layer != nil {
+		if err := r.verifyLayerOnce(layer); err != nil {
+			return fmt.Errorf("verifying layer %s: %w", layer.ID, err)
+		}
+		if layer.Parent == "" {
+			break
+		}
+		layer, _ = r.lookup(layer.Parent)
+	}
+	return nil
+}
+
+// Requires startReading or startWriting.
+func (r *layerStore) verifyVerity(id string) error {
+	layer, ok := r.lookup(id)
+	if !ok {
+		return ErrLayerUnknown
+	}
+	return r.verifyLayer(layer)
+}